@@ -0,0 +1,36 @@
+//go:build js && wasm
+
+// This example runs Lua scripts in a web browser.
+//
+//	GOOS=js GOARCH=wasm go build -o main.wasm .
+//	cp "$(go env GOROOT)/lib/wasm/wasm_exec.js" .
+//
+// Then serve this directory with any static file server and open index.html.
+package main
+
+import (
+	"bytes"
+	"syscall/js"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// runLua executes a script and returns everything it printed, followed by
+// the error message if the script failed.
+func runLua(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 {
+		return "runLua: script expected"
+	}
+	var out bytes.Buffer
+	L := lua.NewState(lua.Options{Stdout: &out, Stderr: &out})
+	defer L.Close()
+	if err := L.DoString(args[0].String()); err != nil {
+		out.WriteString(err.Error())
+	}
+	return out.String()
+}
+
+func main() {
+	js.Global().Set("runLua", js.FuncOf(runLua))
+	select {}
+}
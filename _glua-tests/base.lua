@@ -46,3 +46,41 @@ local ok, a, b = xpcall(function()
      return err .. "!", "b"
   end)
 assert(not ok and string.find(a, "error!!") and b == nil)
+
+local ok, sum = xpcall(function(a, b, c) return a + b + c end, print, 1, 2, 3)
+assert(ok and sum == 6)
+
+local ok, e = xpcall(function(t) error(t) end, function(err) return err end, {code = 42})
+assert(not ok and type(e) == "table" and e.code == 42)
+
+local function failing() error("deep") end
+local ok, tb = xpcall(function() pcall(error, "caught") failing() end, function(err) return debug.traceback(err) end)
+assert(not ok and string.find(tb, "in function 'failing'", 1, true))
+
+local proxy = setmetatable({1, 2, 3}, {__len = function() return 10 end})
+assert(#proxy == 10 and rawlen(proxy) == 3 and rawlen("abcd") == 4 and rawlen({}) == 0)
+local ok, msg = pcall(rawlen, 5)
+assert(not ok and string.find(msg, "table or string expected"))
+
+assert(select(-1, "a", "b", "c") == "c" and select("#", select(-2, "a", "b", "c")) == 2)
+assert(select("-3", "a", "b", "c") == "a" and select("2", "a", "b") == "b")
+assert(not pcall(select, -4, "a", "b", "c") and not pcall(select, 0, "a"))
+local ok, msg = pcall(select, "x", "a")
+assert(not ok and string.find(msg, "invalid string 'x'"))
+
+assert(0x1p-3 == 0.125 and 0xA.8p0 == 10.5 and 0x.8 == 0.5 and 0X1P+4 == 16)
+assert(0xffffffffffffffff == -1 and "0x1p4" + 0 == 16)
+assert(tonumber(" 0x10 ") == 16 and tonumber("\t-0x1p4\v") == -16 and tonumber("1e5") == 1e5)
+assert(tonumber("1e400") == 1/0 and tonumber("010") == 10 and tonumber("+.5") == 0.5)
+for _, s in ipairs({"", " ", "1e", "0x", ".", "0b1", "1_0", "inf", "nan", "1 2", "- 1"}) do
+  assert(tonumber(s) == nil, s)
+end
+assert(tonumber("z", 36) == 35 and tonumber(" -ff ", 16) == -255 and tonumber("101", 2) == 5)
+assert(tonumber("8", 8) == nil and tonumber("1.0", 10) == nil and tonumber("", 10) == nil)
+local ok, msg = pcall(tonumber, "1", 37)
+assert(not ok and string.find(msg, "base out of range"))
+assert(not pcall(tonumber, 10, 16))
+for _, s in ipairs({"return 1e", "return 1e+", "return 2.5E-", "return 0x1p"}) do
+  local f, msg = load(s)
+  assert(f == nil and string.find(msg, "malformed number"), s)
+end
@@ -10,3 +10,10 @@ local ok, msg = pcall(function()
   math.min()
 end)
 assert(not ok and string.find(msg, "wrong number of arguments"))
+
+assert(math.maxinteger > 2^62 and math.mininteger == -2^63)
+assert(math.tointeger(3) == 3 and math.tointeger(3.5) == nil and math.tointeger("3") == nil and math.tointeger(2^63) == nil)
+assert(math.type(1) == "integer" and math.type(1.5) == "float" and math.type(1/0) == "float" and math.type("1") == nil)
+assert(math.type(math.maxinteger) == "integer" and math.type(math.mininteger) == "integer")
+assert(math.ult(1, 2) and not math.ult(2, 1) and math.ult(1, -1) and not math.ult(-1, 1))
+assert(not pcall(math.ult, 1.5, 2) and not pcall(math.type))
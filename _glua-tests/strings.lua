@@ -11,3 +11,55 @@ assert(ret1 == 1)
 assert(ret2 == 3)
 assert(ret3 == "aaa")
 assert(ret4 == 4)
+
+local packed = string.pack("<i4>I2bz s1 d", -2, 513, -1, "hi", "abc", 1.5)
+assert(#packed == 22)
+local a, b, c, d, e, f, nextpos = string.unpack("<i4>I2bz s1 d", packed)
+assert(a == -2 and b == 513 and c == -1 and d == "hi" and e == "abc" and f == 1.5 and nextpos == 23)
+assert(string.packsize("!8 b i8") == 16 and string.packsize("b Xi4 h") == 3 and string.packsize("!4 b Xi4 h") == 6)
+assert(string.pack("!4 b i4", 1, 2) == "\1\0\0\0\2\0\0\0")
+assert(string.pack(">I3", 66051) == "\1\2\3" and string.unpack("B", "abc", -1) == 99)
+assert(string.unpack("<i16", string.pack("<i16", -3)) == -3)
+assert(string.unpack("<J", string.pack("<j", -1)) == -1)
+assert(string.pack("c5", "ab") == "ab\0\0\0" and string.unpack("<f", string.pack("<f", 0.25)) == 0.25)
+for _, case in ipairs({
+  {"integer overflow", string.pack, "i1", 200},
+  {"unsigned overflow", string.pack, "I1", -1},
+  {"variable%-length format", string.packsize, "s"},
+  {"data string too short", string.unpack, "i4", "ab"},
+  {"invalid format option 'q'", string.pack, "q", 1},
+  {"out of limits", string.pack, "i17", 1},
+  {"string contains zeros", string.pack, "z", "a\0b"},
+  {"unfinished string", string.unpack, "z", "abc"},
+  {"does not fit into Lua Integer", string.unpack, "<i9", "\0\0\0\0\0\0\0\0\1"},
+}) do
+  local ok, msg = pcall(case[2], case[3], case[4])
+  assert(not ok and string.find(msg, case[1]), msg)
+end
+
+-- string.format %q, %g and %a
+local s = "a\nb\0c\0001d\"e\\f\r\t\255\127z"
+assert(string.format("%q", s) == '"a\\\nb\\0c\\0001d\\"e\\\\f\\13\\9\255\\127z"')
+assert(loadstring("return " .. string.format("%q", s))() == s)
+for _, n in ipairs({1/3, 10, -0.1, 1e100, 2^53, 1/0, -1/0}) do
+  assert(loadstring("return " .. string.format("%q", n))() == n)
+end
+assert(string.format("%q %q %q", 0/0, true, nil) == "(0/0) true nil")
+assert(not pcall(string.format, "%q", {}))
+assert(string.format("%g %g %g %g", 1/3, 123456789, 1e-5, 100000) == "0.333333 1.23457e+08 1e-05 100000")
+assert(string.format("[%8.2g][%#g][%-5g][%G][%g]", 3.14159, 1, 1/0, -1/0, 0/0) == "[     3.1][1.00000][inf  ][-INF][nan]")
+assert(string.format("%a %A %.3a %a %a", 1, 255.5, 1/3, 0, -0.1) == "0x1p+0 0X1.FFP+7 0x1.555p-2 0x0p+0 -0x1.999999999999ap-4")
+assert(string.format("[%8a][%-8a][%08a][%+a]", 1, 1, 1, 2) == "[  0x1p+0][0x1p+0  ][0x001p+0][+0x1p+1]")
+
+-- string.gmatch init and empty matches
+local function gmatchAll(...)
+  local t = {}
+  for a in string.gmatch(...) do t[#t+1] = a end
+  return table.concat(t, "|")
+end
+assert(gmatchAll("abc", "%a*") == "abc")
+assert(gmatchAll("a,b,,c", "[^,]*") == "a|b||c")
+assert(gmatchAll("abc", ".-") == "|||")
+assert(gmatchAll("hello", "()") == "1|2|3|4|5|6")
+assert(gmatchAll("^a^a", "^a") == "^a|^a")
+assert(gmatchAll("abcabc", "%a+", 3) == "cabc" and gmatchAll("abcabc", "a", -3) == "a" and gmatchAll("abc", "", 10) == "")
@@ -35,3 +35,23 @@ for k, v in pairs(a) do
     error("unexpected key:" .. tostring(k))
   end
 end
+
+local moved = {1, 2, 3, 4, 5}
+assert(table.move(moved, 1, 3, 3) == moved)
+assert(table.concat(moved, ",") == "1,2,1,2,3")
+moved = {1, 2, 3, 4, 5}
+table.move(moved, 3, 5, 1)
+assert(table.concat(moved, ",") == "3,4,5,4,5")
+local dest = table.move({1, 2, 3}, 1, 3, 2, {})
+assert(dest[1] == nil and dest[2] == 1 and dest[4] == 3)
+local log = {}
+local proxy = setmetatable({}, {__index = function(_, k) return k * 10 end, __newindex = function(_, k, v) log[#log + 1] = k .. "=" .. v end})
+table.move(proxy, 1, 2, 5, proxy)
+assert(table.concat(log, ",") == "5=10,6=20")
+assert(table.move({}, 1, 0, 1) ~= nil)
+
+local packed = table.pack(1, nil, 3, nil)
+assert(packed.n == 4 and packed[1] == 1 and packed[2] == nil and packed[3] == 3)
+assert(select("#", unpack(packed, 1, packed.n)) == 4)
+local empty = table.pack()
+assert(empty.n == 0 and next(empty) == "n")
@@ -0,0 +1,32 @@
+//go:build tinygo
+
+package lua
+
+const preloadLimit LNumber = 128
+
+var preloads [int(preloadLimit)]LValue
+
+func init() {
+	for i := 0; i < int(preloadLimit); i++ {
+		preloads[i] = LNumber(i)
+	}
+}
+
+// allocator boxes numbers one at a time. The interface layout trick used by
+// the default allocator depends on the gc compiler and does not work with
+// TinyGo.
+type allocator struct {
+	size int
+}
+
+func newAllocator(size int) *allocator {
+	return &allocator{size: size}
+}
+
+// LNumber2I takes a number value and returns an interface LValue representing the same number.
+func (al *allocator) LNumber2I(v LNumber) LValue {
+	if v >= 0 && v < preloadLimit && float64(v) == float64(int64(v)) {
+		return preloads[int(v)]
+	}
+	return v
+}
@@ -0,0 +1,63 @@
+package lua
+
+/* allocation hook {{{ */
+
+// AllocKind tells what a tracked allocation is for.
+type AllocKind int
+
+const (
+	// AllocOther is an allocation reported by the host with TrackAlloc or
+	// ReserveMemory.
+	AllocOther AllocKind = iota
+	// AllocTable is a new table or the growth of a table.
+	AllocTable
+	// AllocString is a string built by a script, the string library or
+	// pushed by the host.
+	AllocString
+	// AllocFunction is a new closure or Go function.
+	AllocFunction
+	// AllocUserData is a new userdata and the payload charged for it.
+	AllocUserData
+	// AllocStack is the growth of the registry or of the call stack.
+	AllocStack
+	// AllocThread is a new coroutine with its registry and call stack.
+	AllocThread
+	// AllocProto is a compiled chunk, with its constants and debug
+	// information.
+	AllocProto
+	// AllocChannel is a new channel, or a value buffered in a channel until
+	// it is received.
+	AllocChannel
+)
+
+var allocKindNames = [...]string{"other", "table", "string", "function", "userdata", "stack", "coroutine", "prototype", "channel"}
+
+func (k AllocKind) String() string {
+	return allocKindNames[k]
+}
+
+// AllocHook is called by SetAllocHook for every tracked allocation. source
+// and line locate the Lua code that made it; source is empty for
+// allocations made outside of Lua code, e.g. while the state is set up.
+type AllocHook func(kind AllocKind, bytes uint64, source string, line int)
+
+// SetAllocHook sets a function called for every allocation charged to the
+// memory accounting of this state and of the coroutines it creates, before
+// the limit is checked. It can be used to build an allocation profile of a
+// script. The hook runs in the middle of the allocation and must not call
+// into the state. A nil hook removes it.
+func (ls *LState) SetAllocHook(hook AllocHook) {
+	ls.allocHook = hook
+}
+
+// allocSite returns the position of the innermost running Lua function.
+func (ls *LState) allocSite() (string, int) {
+	for cf := ls.currentFrame; cf != nil; cf = cf.Parent {
+		if cf.Fn != nil && cf.Fn.Proto != nil && cf.Pc > 0 {
+			return cf.Fn.Proto.SourceName, cf.Fn.Proto.DbgSourcePositions[cf.Pc-1]
+		}
+	}
+	return "", 0
+}
+
+/* }}} */
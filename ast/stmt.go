@@ -22,7 +22,10 @@ type LocalAssignStmt struct {
 	StmtBase
 
 	Names []string
-	Exprs []Expr
+	// Attribs holds the attribute of each name, "const" or "close", or ""
+	// for a name without one. It is nil if no name has an attribute.
+	Attribs []string
+	Exprs   []Expr
 }
 
 type FuncCallStmt struct {
@@ -0,0 +1,76 @@
+package lua
+
+/* audit hook {{{ */
+
+// AuditHook receives the events of sensitive library functions, see
+// SetAuditHook.
+type AuditHook func(L *LState, event string, args []LValue) error
+
+type auditHook struct {
+	fn      AuditHook
+	running bool
+}
+
+// SetAuditHook calls fn before the library functions that reach the host
+// run, in the spirit of CPython's sys.audit. event is the name of the
+// function and args a copy of its arguments:
+//
+//	os.execute, os.exit, os.getenv, os.setenv, os.remove, os.rename, os.tmpname
+//	io.open, io.lines, io.input, io.output, io.popen, io.tmpfile
+//	load, loadstring, loadfile, dofile, require, package.loadlib
+//
+// If fn returns an error, the function does not run and the script fails
+// with it, so that errors.Is and errors.As see it through the returned
+// *ApiError. The hook thus logs and enforces a policy in one place:
+//
+//	L.SetAuditHook(func(L *lua.LState, event string, args []lua.LValue) error {
+//		log.Printf("audit: %s %v", event, args)
+//		if event == "os.execute" {
+//			return errors.New("os.execute is not allowed")
+//		}
+//		return nil
+//	})
+//
+// Host functions can raise their own events with Audit. fn is not called
+// for the events raised while it runs. A nil fn removes the hook.
+func (ls *LState) SetAuditHook(fn AuditHook) {
+	if fn == nil {
+		ls.G.auditHook = nil
+	} else {
+		ls.G.auditHook = &auditHook{fn: fn}
+	}
+}
+
+// Audit passes event and args to the hook set by SetAuditHook, if any, and
+// raises the error it returns.
+func (ls *LState) Audit(event string, args ...LValue) {
+	h := ls.G.auditHook
+	if h == nil || h.running {
+		return
+	}
+	h.running = true
+	defer func() { h.running = false }()
+	if clock := ls.G.execClock; clock != nil && clock.pause() {
+		defer clock.resume()
+	}
+	if err := h.fn(ls, event, args); err != nil {
+		ls.raiseTypedError(err, "%s", err.Error())
+	}
+}
+
+// audited wraps a library function so that it raises event with its
+// arguments before it runs.
+func audited(event string, fn LGFunction) LGFunction {
+	return func(L *LState) int {
+		if L.G.auditHook != nil {
+			args := make([]LValue, L.GetTop())
+			for i := range args {
+				args[i] = L.Get(i + 1)
+			}
+			L.Audit(event, args...)
+		}
+		return fn(L)
+	}
+}
+
+/* }}} */
@@ -2,9 +2,9 @@ package lua
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 )
 
@@ -123,7 +123,9 @@ func (ls *LState) CheckTypes(n int, typs ...LValueType) {
 	for _, typ := range typs {
 		buf = append(buf, typ.String())
 	}
-	ls.ArgError(n, strings.Join(buf, " or ")+" expected, got "+ls.Get(n).Type().String())
+	expected := strings.Join(buf, " or ")
+	ls.raiseTypedError(&TypeError{Function: ls.rawFrameFuncName(ls.currentFrame), Arg: n, Expected: expected, Value: ls.Get(n)},
+		"bad argument #%v to %v (%v)", n, ls.rawFrameFuncName(ls.currentFrame), expected+" expected, got "+ls.Get(n).Type().String())
 }
 
 func (ls *LState) CheckOption(n int, options []string) int {
@@ -246,7 +248,8 @@ func (ls *LState) ArgError(n int, message string) {
 }
 
 func (ls *LState) TypeError(n int, typ LValueType) {
-	ls.RaiseError("bad argument #%v to %v (%v expected, got %v)", n, ls.rawFrameFuncName(ls.currentFrame), typ.String(), ls.Get(n).Type().String())
+	ls.raiseTypedError(&TypeError{Function: ls.rawFrameFuncName(ls.currentFrame), Arg: n, Expected: typ.String(), Value: ls.Get(n)},
+		"bad argument #%v to %v (%v expected, got %v)", n, ls.rawFrameFuncName(ls.currentFrame), typ.String(), ls.Get(n).Type().String())
 }
 
 /* }}} */
@@ -350,16 +353,17 @@ func (ls *LState) CallMeta(obj LValue, event string) LValue {
 /* load and function call operations {{{ */
 
 func (ls *LState) LoadFile(path string) (*LFunction, error) {
-	var file *os.File
-	var err error
+	var file io.Reader
 	if len(path) == 0 {
-		file = os.Stdin
+		file = ls.Options.Stdin
 	} else {
-		file, err = os.Open(path)
-		defer file.Close()
+		fp, name, err := ls.openScript(path)
 		if err != nil {
 			return nil, newApiErrorE(ApiErrorFile, err)
 		}
+		defer fp.Close()
+		file = fp
+		path = name
 	}
 
 	reader := bufio.NewReader(file)
@@ -371,7 +375,7 @@ func (ls *LState) LoadFile(path string) (*LFunction, error) {
 	if c == byte('#') {
 		// Unix exec. file?
 		// skip first line
-		_, err, _ = readBufioLine(reader)
+		_, err, _ = readBufioLine(reader, nil)
 		if err != nil {
 			return nil, newApiErrorE(ApiErrorFile, err)
 		}
@@ -411,6 +415,59 @@ func (ls *LState) DoString(source string) error {
 	}
 }
 
+// DoFileContext is like DoFile but runs the file under ctx, see
+// DoStringContext.
+func (ls *LState) DoFileContext(ctx context.Context, path string) error {
+	defer ls.scopeContext(ctx)()
+	return ls.DoFile(path)
+}
+
+// DoStringContext is like DoString but runs source under ctx: the script is
+// stopped when ctx is done, as with SetContext, but ctx is only attached to
+// the state for this call. The context of the state, if any, is restored
+// afterwards and still applies during the call, so that a deadline of ctx
+// that expires does not leave the state unusable for the calls that follow.
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//	defer cancel()
+//	err := L.DoStringContext(ctx, src)
+func (ls *LState) DoStringContext(ctx context.Context, source string) error {
+	defer ls.scopeContext(ctx)()
+	return ls.DoString(source)
+}
+
+// CallContext is like CallByParam but makes the call under ctx, see
+// DoStringContext.
+func (ls *LState) CallContext(ctx context.Context, cp P, args ...LValue) error {
+	defer ls.scopeContext(ctx)()
+	return ls.CallByParam(cp, args...)
+}
+
+// scopeContext attaches ctx to ls, combined with the context of ls if it has
+// one, and returns the function that restores the previous context.
+func (ls *LState) scopeContext(ctx context.Context) func() {
+	prev := ls.ctx
+	release := func() {}
+	if prev != nil {
+		inner, cancel := context.WithCancelCause(ctx)
+		stop := context.AfterFunc(prev, func() { cancel(context.Cause(prev)) })
+		ctx = inner
+		release = func() {
+			stop()
+			cancel(nil)
+		}
+	}
+	ls.SetContext(ctx)
+	return func() {
+		release()
+		if prev != nil {
+			ls.SetContext(prev)
+		} else {
+			ls.RemoveContext()
+		}
+	}
+}
+
 /* }}} */
 
 /* GopherLua original APIs {{{ */
@@ -424,7 +481,7 @@ func (ls *LState) ToStringMeta(lv LValue) LValue {
 		ls.Call(1, 1)
 		return ls.reg.Pop()
 	} else {
-		return LString(lv.String())
+		return LString(ls.objectString(lv))
 	}
 }
 
@@ -1,11 +1,11 @@
 package lua
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
-	"strconv"
 	"strings"
 )
 
@@ -19,6 +19,13 @@ func OpenBase(L *LState) int {
 	basemod := L.RegisterModule("_G", baseFuncs)
 	global.RawSetString("ipairs", L.NewClosure(baseIpairs, L.NewFunction(ipairsaux)))
 	global.RawSetString("pairs", L.NewClosure(basePairs, L.NewFunction(pairsaux)))
+	if L.Options.CompatFlags&CompatNoGlobalUnpack != 0 {
+		global.RawSetString("unpack", LNil)
+	}
+	if L.Options.CompatFlags&CompatNoFEnv != 0 {
+		global.RawSetString("getfenv", LNil)
+		global.RawSetString("setfenv", LNil)
+	}
 	L.Push(basemod)
 	return 1
 }
@@ -26,18 +33,19 @@ func OpenBase(L *LState) int {
 var baseFuncs = map[string]LGFunction{
 	"assert":         baseAssert,
 	"collectgarbage": baseCollectGarbage,
-	"dofile":         baseDoFile,
+	"dofile":         audited("dofile", baseDoFile),
 	"error":          baseError,
 	"getfenv":        baseGetFEnv,
 	"getmetatable":   baseGetMetatable,
-	"load":           baseLoad,
-	"loadfile":       baseLoadFile,
-	"loadstring":     baseLoadString,
+	"load":           audited("load", baseLoad),
+	"loadfile":       audited("loadfile", baseLoadFile),
+	"loadstring":     audited("loadstring", baseLoadString),
 	"next":           baseNext,
 	"pcall":          basePCall,
 	"print":          basePrint,
 	"rawequal":       baseRawEqual,
 	"rawget":         baseRawGet,
+	"rawlen":         baseRawLen,
 	"rawset":         baseRawSet,
 	"select":         baseSelect,
 	"_printregs":     base_PrintRegs,
@@ -47,10 +55,11 @@ var baseFuncs = map[string]LGFunction{
 	"tostring":       baseToString,
 	"type":           baseType,
 	"unpack":         baseUnpack,
+	"warn":           baseWarn,
 	"xpcall":         baseXPCall,
 	// loadlib
 	"module":  loModule,
-	"require": loRequire,
+	"require": audited("require", loRequire),
 	// hidden features
 	"newproxy": baseNewProxy,
 }
@@ -64,8 +73,32 @@ func baseAssert(L *LState) int {
 }
 
 func baseCollectGarbage(L *LState) int {
-	runtime.GC()
-	return 0
+	root := L.memRoot()
+	switch opt := L.OptString(1, "collect"); opt {
+	case "collect":
+		root.CollectGarbage()
+		runtime.GC()
+		return 0
+	case "count":
+		// the tracked memory, in kilobytes
+		L.Push(LNumber(float64(L.GetAllocatedBytes()) / 1024))
+	case "step":
+		L.Push(LBool(root.gcStep(L.OptInt(2, 0))))
+	case "setpause":
+		L.Push(LNumber(root.gcPause))
+		root.gcPause = L.OptInt(2, 0)
+	case "setstepmul":
+		L.Push(LNumber(root.gcStepMul))
+		root.gcStepMul = L.OptInt(2, 0)
+	case "stop", "restart":
+		root.gcStopped = opt == "stop"
+		return 0
+	case "isrunning":
+		L.Push(LBool(!root.gcStopped))
+	default:
+		L.ArgError(1, fmt.Sprintf("invalid option '%s'", opt))
+	}
+	return 1
 }
 
 func baseDoFile(L *LState) int {
@@ -156,8 +189,29 @@ func baseIpairs(L *LState) int {
 	return 3
 }
 
-func loadaux(L *LState, reader io.Reader, chunkname string) int {
-	if fn, err := L.Load(reader, chunkname); err != nil {
+// loadaux loads a chunk from reader. mode tells which chunks are accepted,
+// as in Lua 5.2: "t" for text, "b" for binary, "bt" for both.
+func loadaux(L *LState, reader io.Reader, chunkname string, mode string) int {
+	br := bufio.NewReader(reader)
+	if !L.checkTextChunk(br) {
+		L.Push(LNil)
+		L.Push(LString("attempt to load a binary chunk"))
+		return 2
+	}
+	binary := false
+	if c, err := br.Peek(1); err == nil {
+		binary = c[0] == BinaryChunkSignature[0]
+	}
+	if binary && !strings.Contains(mode, "b") {
+		L.Push(LNil)
+		L.Push(LString(fmt.Sprintf("attempt to load a binary chunk (mode is '%s')", mode)))
+		return 2
+	} else if !binary && !strings.Contains(mode, "t") {
+		L.Push(LNil)
+		L.Push(LString(fmt.Sprintf("attempt to load a text chunk (mode is '%s')", mode)))
+		return 2
+	}
+	if fn, err := L.Load(br, chunkname); err != nil {
 		L.Push(LNil)
 		L.Push(LString(err.Error()))
 		return 2
@@ -167,40 +221,69 @@ func loadaux(L *LState, reader io.Reader, chunkname string) int {
 	}
 }
 
+// baseLoad implements load(chunk [, chunkname [, mode [, env]]]) of Lua 5.2,
+// where chunk is a string or a function returning the pieces of one.
 func baseLoad(L *LState) int {
-	fn := L.CheckFunction(1)
-	chunkname := L.OptString(2, "?")
-	top := L.GetTop()
-	buf := []string{}
-	for {
-		L.SetTop(top)
-		L.Push(fn)
-		L.Call(0, 1)
-		ret := L.reg.Pop()
-		if ret == LNil {
-			break
-		} else if LVCanConvToString(ret) {
-			str := ret.String()
-			if len(str) > 0 {
-				buf = append(buf, string(str))
-			} else {
+	var reader io.Reader
+	var chunkname string
+	switch chunk := L.Get(1).(type) {
+	case LString:
+		reader = strings.NewReader(string(chunk))
+		chunkname = L.OptString(2, "<string>")
+	case *LFunction:
+		chunkname = L.OptString(2, "?")
+		top := L.GetTop()
+		buf := []string{}
+		for {
+			L.SetTop(top)
+			L.Push(chunk)
+			L.Call(0, 1)
+			ret := L.reg.Pop()
+			if ret == LNil {
 				break
+			} else if LVCanConvToString(ret) {
+				str := ret.String()
+				if len(str) > 0 {
+					buf = append(buf, string(str))
+				} else {
+					break
+				}
+			} else {
+				L.Push(LNil)
+				L.Push(LString("reader function must return a string"))
+				return 2
 			}
-		} else {
-			L.Push(LNil)
-			L.Push(LString("reader function must return a string"))
-			return 2
 		}
+		L.SetTop(top)
+		reader = strings.NewReader(strings.Join(buf, ""))
+	default:
+		L.TypeError(1, LTFunction)
 	}
-	return loadaux(L, strings.NewReader(strings.Join(buf, "")), chunkname)
+	return loadWithEnv(L, reader, chunkname, 3)
 }
 
+// loadWithEnv is loadaux for the mode and env arguments of load and
+// loadfile, at n and n+1: the loaded function gets env as its environment.
+func loadWithEnv(L *LState, reader io.Reader, chunkname string, n int) int {
+	mode := L.OptString(n, "bt")
+	var env *LTable
+	if L.GetTop() > n && L.Get(n+1) != LNil {
+		env = L.CheckTable(n + 1)
+	}
+	if ret := loadaux(L, reader, chunkname, mode); ret != 1 || env == nil {
+		return ret
+	}
+	L.Get(-1).(*LFunction).Env = env
+	return 1
+}
+
+// baseLoadFile implements loadfile([filename [, mode [, env]]]) of Lua 5.2.
 func baseLoadFile(L *LState) int {
 	var reader io.Reader
 	var chunkname string
 	var err error
-	if L.GetTop() < 1 {
-		reader = os.Stdin
+	if L.Get(1) == LNil {
+		reader = L.Options.Stdin
 		chunkname = "<stdin>"
 	} else {
 		chunkname = L.CheckString(1)
@@ -212,11 +295,12 @@ func baseLoadFile(L *LState) int {
 		}
 		defer reader.(*os.File).Close()
 	}
-	return loadaux(L, reader, chunkname)
+	return loadWithEnv(L, reader, chunkname, 2)
 }
 
 func baseLoadString(L *LState) int {
-	return loadaux(L, strings.NewReader(L.CheckString(1)), L.OptString(2, "<string>"))
+	L.warnDeprecated("loadstring", "load")
+	return loadaux(L, strings.NewReader(L.CheckString(1)), L.OptString(2, "<string>"), "bt")
 }
 
 func baseNext(L *LState) int {
@@ -249,7 +333,15 @@ func pairsaux(L *LState) int {
 	}
 }
 
+// basePairs calls the __pairs metamethod of its argument, if it has one,
+// and returns its first three results, as in Lua 5.2.
 func basePairs(L *LState) int {
+	if mm := L.GetMetaField(L.Get(1), "__pairs"); mm != LNil {
+		L.SetTop(1)
+		L.Insert(mm, 1)
+		L.Call(1, 3)
+		return 3
+	}
 	tb := L.CheckTable(1)
 	L.Push(L.Get(UpvalueIndex(1)))
 	L.Push(tb)
@@ -281,14 +373,15 @@ func basePCall(L *LState) int {
 }
 
 func basePrint(L *LState) int {
+	out := L.Options.Stdout
 	top := L.GetTop()
 	for i := 1; i <= top; i++ {
-		fmt.Print(L.ToStringMeta(L.Get(i)).String())
+		fmt.Fprint(out, L.ToStringMeta(L.Get(i)).String())
 		if i != top {
-			fmt.Print("\t")
+			fmt.Fprint(out, "\t")
 		}
 	}
-	fmt.Println("")
+	fmt.Fprintln(out, "")
 	return 0
 }
 
@@ -311,34 +404,52 @@ func baseRawGet(L *LState) int {
 	return 1
 }
 
+func baseRawLen(L *LState) int {
+	switch lv := L.Get(1).(type) {
+	case *LTable:
+		L.Push(LNumber(lv.Len()))
+	case LString:
+		L.Push(LNumber(len(lv)))
+	default:
+		L.ArgError(1, "table or string expected")
+	}
+	return 1
+}
+
 func baseRawSet(L *LState) int {
 	L.RawSet(L.CheckTable(1), L.CheckAny(2), L.CheckAny(3))
 	return 0
 }
 
+// baseSelect implements select(n, ...), where a negative n counts from the
+// end of the arguments, as in Lua 5.2.
 func baseSelect(L *LState) int {
 	L.CheckTypes(1, LTNumber, LTString)
+	var idx int
 	switch lv := L.Get(1).(type) {
 	case LNumber:
-		idx := int(lv)
-		num := L.GetTop()
-		if idx < 0 {
-			idx = num + idx
-		} else if idx > num {
-			idx = num
-		}
-		if 1 > idx {
-			L.ArgError(1, "index out of range")
-		}
-		return num - idx
+		idx = int(lv)
 	case LString:
-		if string(lv) != "#" {
+		if string(lv) == "#" {
+			L.Push(LNumber(L.GetTop() - 1))
+			return 1
+		}
+		n, err := parseNumber(string(lv))
+		if err != nil {
 			L.ArgError(1, "invalid string '"+string(lv)+"'")
 		}
-		L.Push(LNumber(L.GetTop() - 1))
-		return 1
+		idx = int(n)
 	}
-	return 0
+	num := L.GetTop()
+	if idx < 0 {
+		idx = num + idx
+	} else if idx > num {
+		idx = num
+	}
+	if 1 > idx {
+		L.ArgError(1, "index out of range")
+	}
+	return num - idx
 }
 
 func baseSetFEnv(L *LState) int {
@@ -392,7 +503,7 @@ func baseSetMetatable(L *LState) int {
 	}
 	mt := L.Get(2)
 	if m := L.metatable(obj, true); m != LNil {
-		if tb, ok := m.(*LTable); ok && tb.RawGetString("__metatable") != LNil {
+		if tb, ok := m.(*LTable); ok && (tb.protected || tb.RawGetString("__metatable") != LNil) {
 			L.RaiseError("cannot change a protected metatable")
 		}
 	}
@@ -402,31 +513,29 @@ func baseSetMetatable(L *LState) int {
 }
 
 func baseToNumber(L *LState) int {
-	base := L.OptInt(2, 10)
-	noBase := L.Get(2) == LNil
-
-	switch lv := L.CheckAny(1).(type) {
-	case LNumber:
-		L.Push(lv)
-	case LString:
-		str := strings.Trim(string(lv), " \n\t")
-		if strings.Index(str, ".") > -1 {
-			if v, err := strconv.ParseFloat(str, LNumberBit); err != nil {
-				L.Push(LNil)
+	if L.Get(2) == LNil {
+		switch lv := L.CheckAny(1).(type) {
+		case LNumber:
+			L.Push(lv)
+		case LString:
+			if v, err := parseNumber(string(lv)); err == nil {
+				L.Push(v)
 			} else {
-				L.Push(LNumber(v))
-			}
-		} else {
-			if noBase && strings.HasPrefix(strings.ToLower(str), "0x") {
-				base, str = 16, str[2:] // Hex number
-			}
-			if v, err := strconv.ParseInt(str, base, LNumberBit); err != nil {
 				L.Push(LNil)
-			} else {
-				L.Push(LNumber(v))
 			}
+		default:
+			L.Push(LNil)
 		}
-	default:
+		return 1
+	}
+	base := L.CheckInt(2)
+	L.CheckType(1, LTString)
+	if base < 2 || base > 36 {
+		L.ArgError(2, "base out of range")
+	}
+	if v, ok := parseIntegerBase(L.ToString(1), base); ok {
+		L.Push(v)
+	} else {
 		L.Push(LNil)
 	}
 	return 1
@@ -445,10 +554,11 @@ func baseType(L *LState) int {
 
 func baseUnpack(L *LState) int {
 	tb := L.CheckTable(1)
+	n, meta := tableLen(L, tb)
 	start := L.OptInt(2, 1)
-	end := L.OptInt(3, tb.Len())
+	end := L.OptInt(3, n)
 	for i := start; i <= end; i++ {
-		L.Push(tb.RawGetInt(i))
+		L.Push(tableGetInt(L, tb, i, meta))
 	}
 	ret := end - start + 1
 	if ret < 0 {
@@ -457,13 +567,45 @@ func baseUnpack(L *LState) int {
 	return ret
 }
 
+func baseWarn(L *LState) int {
+	top := L.GetTop()
+	L.CheckString(1)
+	buf := make([]string, 0, top)
+	for i := 1; i <= top; i++ {
+		buf = append(buf, L.CheckString(i))
+	}
+	if top == 1 && strings.HasPrefix(buf[0], "@") {
+		// control message, unknown ones are ignored
+		switch buf[0] {
+		case "@on":
+			L.G.warnOff = false
+		case "@off":
+			L.G.warnOff = true
+		}
+		return 0
+	}
+	if L.G.warnOff {
+		return 0
+	}
+	if fn := L.G.warnFunc; fn != nil {
+		for i, msg := range buf {
+			fn(msg, i < top-1)
+		}
+	}
+	L.handleWarning(WarningUser, strings.Join(buf, ""))
+	return 0
+}
+
 func baseXPCall(L *LState) int {
 	fn := L.CheckFunction(1)
 	errfunc := L.CheckFunction(2)
 
 	top := L.GetTop()
 	L.Push(fn)
-	if err := L.PCall(0, MultRet, errfunc); err != nil {
+	for i := 3; i <= top; i++ {
+		L.Push(L.Get(i))
+	}
+	if err := L.PCall(top-2, MultRet, errfunc); err != nil {
 		L.Push(LFalse)
 		if aerr, ok := err.(*ApiError); ok {
 			L.Push(aerr.Object)
@@ -534,6 +676,7 @@ func loRequire(L *LState) int {
 		L.Push(lv)
 		return 1
 	}
+	L.checkRequireWhitelist(name)
 	loaders, ok := L.GetField(L.Get(RegistryIndex), "_LOADERS").(*LTable)
 	if !ok {
 		L.RaiseError("package.loaders must be a table")
@@ -586,7 +729,7 @@ func baseNewProxy(L *LState) int {
 	if L.Get(1) == LTrue {
 		L.SetMetatable(ud, L.NewTable())
 	} else if d, ok := L.Get(1).(*LUserData); ok {
-		L.SetMetatable(ud, L.GetMetatable(d))
+		L.SetMetatable(ud, L.metatable(d, true))
 	}
 	L.Push(ud)
 	return 1
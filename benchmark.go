@@ -0,0 +1,127 @@
+package lua
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/* script benchmarks {{{ */
+
+// BenchmarkOptions configures Benchmark.
+type BenchmarkOptions struct {
+	// N is the number of times the chunk is run. It defaults to 1.
+	N int
+	// Name is the chunk name used in error messages. It defaults to "<benchmark>".
+	Name string
+	// Options are used to create the state the chunk runs in.
+	Options Options
+	// Setup, if set, is called once before the runs, e.g. to register host functions.
+	Setup func(L *LState) error
+}
+
+// BenchmarkResult holds the cost of running a chunk N times.
+type BenchmarkResult struct {
+	// N is the number of runs.
+	N int
+	// Duration is the total wall time of all runs.
+	Duration time.Duration
+	// Instructions is the total number of VM instructions executed.
+	Instructions int64
+	// AllocatedBytes is the total number of bytes tracked by the memory accounting
+	// (see LState.GetAllocatedBytes), i.e. the cost checked against SetMemoryLimit.
+	AllocatedBytes int64
+	// PeakMemory is the largest number of tracked bytes in use at any point of
+	// a single run (see LState.GetPeakAllocatedBytes).
+	PeakMemory int64
+	// GoAllocs and GoBytes are the number of heap allocations and bytes
+	// allocated by the Go runtime during all runs.
+	GoAllocs uint64
+	GoBytes  uint64
+}
+
+// NsPerRun returns the average wall time per run in nanoseconds.
+func (r *BenchmarkResult) NsPerRun() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return r.Duration.Nanoseconds() / int64(r.N)
+}
+
+// InstructionsPerRun returns the average number of VM instructions per run.
+func (r *BenchmarkResult) InstructionsPerRun() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return r.Instructions / int64(r.N)
+}
+
+// AllocatedBytesPerRun returns the average number of tracked bytes per run.
+func (r *BenchmarkResult) AllocatedBytesPerRun() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return r.AllocatedBytes / int64(r.N)
+}
+
+func (r *BenchmarkResult) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%8d runs\t%10d ns/run\t%10d insts/run\t%10d B/run\t%10d peak B", r.N,
+		r.NsPerRun(), r.InstructionsPerRun(), r.AllocatedBytesPerRun(), r.PeakMemory)
+	if r.N > 0 {
+		fmt.Fprintf(&buf, "\t%8d go allocs/run\t%10d go B/run", r.GoAllocs/uint64(r.N), r.GoBytes/uint64(r.N))
+	}
+	return buf.String()
+}
+
+// Benchmark compiles src once and runs it opts.N times in a new state,
+// measuring the cost of each run. The global environment is shared between
+// runs. It returns the first error raised by the chunk.
+func Benchmark(src string, opts BenchmarkOptions) (*BenchmarkResult, error) {
+	if opts.N <= 0 {
+		opts.N = 1
+	}
+	if len(opts.Name) == 0 {
+		opts.Name = "<benchmark>"
+	}
+	L := NewState(opts.Options)
+	defer L.Close()
+	if opts.Setup != nil {
+		if err := opts.Setup(L); err != nil {
+			return nil, err
+		}
+	}
+	fn, err := L.Load(strings.NewReader(src), opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	L.SetCountInstructions(true)
+
+	result := &BenchmarkResult{N: opts.N}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < opts.N; i++ {
+		L.ResetInstructionCount()
+		L.ResetMemoryUsage()
+		L.ResetPeak()
+		start := time.Now()
+		L.Push(fn)
+		err := L.PCall(0, 0, nil)
+		result.Duration += time.Since(start)
+		result.Instructions += L.GetInstructionCount()
+		result.AllocatedBytes += L.GetAllocatedBytes()
+		if peak := L.GetPeakAllocatedBytes(); peak > result.PeakMemory {
+			result.PeakMemory = peak
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	runtime.ReadMemStats(&after)
+	result.GoAllocs = after.Mallocs - before.Mallocs
+	result.GoBytes = after.TotalAlloc - before.TotalAlloc
+	return result, nil
+}
+
+/* }}} */
@@ -0,0 +1,476 @@
+// Package bind exposes Go values to Lua through reflection:
+//
+//	L.SetGlobal("svc", bind.New(L, myService))
+//
+// Booleans, numbers and strings are converted to Lua values. Pointers,
+// structs, maps, slices, arrays, functions and channels are wrapped in a
+// userdata whose metatable gives Lua access to them:
+//
+//   - Exported methods are called with a colon: svc:Start("x"). A non-nil
+//     error returned last by a method or a function is raised as a Lua
+//     error, and is not returned otherwise.
+//   - Exported fields of structs, including promoted ones, are read and,
+//     through a pointer, written by name: svc.Timeout = 10. A field tagged
+//     `lua:"name"` is reached by that name, and a field tagged `lua:"-"` is
+//     hidden. Structs and arrays read from a field of a pointer are
+//     returned as pointers, so that a.B.C = 1 changes a.
+//   - Maps are indexed by key, slices and arrays by index from 1. Assigning
+//     nil to a key of a map deletes it. # gives their length and pairs
+//     iterates over them, and over the fields of structs.
+//   - Functions are called like Lua functions.
+//
+// Arguments and assigned values are converted to the Go types expected:
+// tables become slices, arrays, maps or structs, Lua functions become Go
+// functions that call them in L, and userdata give back the values they
+// wrap. A value that does not fit raises a Lua error. A table reached
+// several times, e.g. one that contains itself, is converted once through
+// pointers, slices and maps, and is rejected where it would have to contain
+// itself by value.
+//
+// Booleans, numbers and strings are converted by lua.LState.ToLValue and
+// userdata are created by lua.LState.NewTypedUserData, so they are charged to
+// the memory usage of the state like other values created from Go. The
+// metatables are those of the type registry of the state: the methods and
+// metamethods registered with lua.RegisterType for a type take precedence
+// over its Go methods and the ones added by the package. The reflection done
+// for a type is cached, and each state extends the metatable of a type once.
+package bind
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"unsafe"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// New returns v as a Lua value. Lua values are returned as is, and
+// func(*lua.LState) int becomes a Go function of L.
+func New(L *lua.LState, v interface{}) lua.LValue {
+	switch fn := v.(type) {
+	case func(*lua.LState) int:
+		return L.NewFunction(fn)
+	case lua.LGFunction:
+		return L.NewFunction(fn)
+	}
+	return toLua(L, reflect.ValueOf(v))
+}
+
+func toLua(L *lua.LState, rv reflect.Value) lua.LValue {
+	switch rv.Kind() {
+	case reflect.Invalid, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return lua.LNil
+	case reflect.Interface:
+		return toLua(L, rv.Elem())
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		if rv.IsNil() {
+			return lua.LNil
+		}
+	}
+	if !rv.CanInterface() {
+		return lua.LNil
+	}
+	v := rv.Interface()
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Struct, reflect.Array:
+		if lv, ok := v.(lua.LValue); ok {
+			return lv
+		}
+		ud := L.NewTypedUserData(v)
+		ud.Metatable = metatable(L, rv.Type())
+		return ud
+	}
+	return L.ToLValue(v)
+}
+
+// fieldValue returns the field or element fv as a Lua value: structs and
+// arrays that can be changed are returned as pointers to them.
+func fieldValue(L *lua.LState, fv reflect.Value) lua.LValue {
+	if k := fv.Kind(); (k == reflect.Struct || k == reflect.Array) && fv.CanAddr() {
+		fv = fv.Addr()
+	}
+	return toLua(L, fv)
+}
+
+/* type information {{{ */
+
+// typeInfo is the reflection done for a type, shared by all the states.
+type typeInfo struct {
+	fields map[string][]int
+	// names lists the fields in declaration order, for pairs.
+	names []string
+}
+
+var typeInfos sync.Map // reflect.Type -> *typeInfo
+
+func structInfo(t reflect.Type) *typeInfo {
+	if info, ok := typeInfos.Load(t); ok {
+		return info.(*typeInfo)
+	}
+	info := &typeInfo{fields: map[string][]int{}}
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("lua"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		if _, dup := info.fields[name]; dup {
+			continue
+		}
+		info.fields[name] = f.Index
+		info.names = append(info.names, name)
+	}
+	actual, _ := typeInfos.LoadOrStore(t, info)
+	return actual.(*typeInfo)
+}
+
+// field returns the field at index of the struct rv. Unlike FieldByIndex, it
+// gives access to the exported fields promoted through unexported embedded
+// structs, which can be set if rv can.
+func field(rv reflect.Value, index []int) (reflect.Value, error) {
+	fv, err := rv.FieldByIndexErr(index)
+	if err != nil || fv.CanInterface() {
+		return fv, err
+	}
+	if fv.CanAddr() {
+		return reflect.NewAt(fv.Type(), unsafe.Pointer(fv.UnsafeAddr())).Elem(), nil
+	}
+	// a struct held by value: the field is read from a copy
+	cp := reflect.New(rv.Type()).Elem()
+	cp.Set(rv)
+	fv, _ = cp.FieldByIndexErr(index)
+	return reflect.ValueOf(reflect.NewAt(fv.Type(), unsafe.Pointer(fv.UnsafeAddr())).Elem().Interface()), nil
+}
+
+/* }}} */
+
+/* metatables {{{ */
+
+// metatable returns the metatable of the values of type t from the type
+// registry of the state, registering t if needed, once it gives access to
+// them.
+func metatable(L *lua.LState, t reflect.Type) *lua.LTable {
+	base := t
+	if base.Kind() == reflect.Ptr {
+		base = base.Elem()
+	}
+	mt := L.TypeMetatable(base)
+	if mt == nil {
+		mt = L.RegisterTypeOf(base, nil)
+	}
+	// the registry sets __index to the table of the registered methods
+	if registered, ok := mt.RawGetString("__index").(*lua.LTable); ok {
+		extend(L, mt, base, registered)
+	}
+	return mt
+}
+
+// extend adds to mt, the metatable of the values of base and of pointers to
+// them, the metamethods that give access to their Go methods, fields and
+// elements. The methods registered in the table registered and the
+// metamethods already set are kept.
+func extend(L *lua.LState, mt *lua.LTable, base reflect.Type, registered *lua.LTable) {
+	values, pointers := methods(L, base), methods(L, reflect.PointerTo(base))
+	set := func(name string, fn lua.LGFunction) {
+		if mt.RawGetString(name) == lua.LNil {
+			mt.RawSetString(name, L.NewFunction(fn))
+		}
+	}
+	if mt.RawGetString("__name") == lua.LNil {
+		mt.RawSetString("__name", lua.LString(base.String()))
+	}
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		rv, key := check(L), L.Get(2)
+		if name, ok := key.(lua.LString); ok {
+			goMethods := values
+			if rv.Kind() == reflect.Ptr {
+				goMethods = pointers
+			}
+			for _, tb := range []*lua.LTable{registered, goMethods} {
+				if fn := tb.RawGetString(string(name)); fn != lua.LNil {
+					L.Push(fn)
+					return 1
+				}
+			}
+		}
+		L.Push(index(L, rv, key))
+		return 1
+	}))
+	set("__newindex", func(L *lua.LState) int {
+		setIndex(L, check(L), L.Get(2), L.Get(3))
+		return 0
+	})
+	set("__tostring", func(L *lua.LState) int {
+		L.Push(L.NewString(fmt.Sprint(check(L).Interface())))
+		return 1
+	})
+	set("__eq", func(L *lua.LState) int {
+		a, aok := L.Get(1).(*lua.LUserData)
+		b, bok := L.Get(2).(*lua.LUserData)
+		L.Push(lua.LBool(aok && bok && comparable(a.Value, b.Value) && a.Value == b.Value))
+		return 1
+	})
+	switch base.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		set("__len", func(L *lua.LState) int {
+			L.Push(lua.LNumber(deref(check(L)).Len()))
+			return 1
+		})
+	}
+	switch base.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		set("__pairs", func(L *lua.LState) int {
+			L.Push(L.NewFunction(iterator(deref(check(L)))))
+			L.Push(L.Get(1))
+			L.Push(lua.LNil)
+			return 3
+		})
+	}
+	if base.Kind() == reflect.Func {
+		set("__call", func(L *lua.LState) int {
+			return call(L, check(L), nil, 2)
+		})
+	}
+}
+
+// methods returns the table of the exported Go methods of t.
+func methods(L *lua.LState, t reflect.Type) *lua.LTable {
+	tb := L.NewTable()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		tb.RawSetString(m.Name, L.NewFunction(methodFunction(t, m)))
+	}
+	return tb
+}
+
+// comparable reports whether a and b have the same type, whose values can
+// be compared with ==.
+func comparable(a, b interface{}) bool {
+	t := reflect.TypeOf(a)
+	return t != nil && t == reflect.TypeOf(b) && t.Comparable()
+}
+
+// check returns the value wrapped by the first argument.
+func check(L *lua.LState) reflect.Value {
+	ud := L.CheckUserData(1)
+	rv := reflect.ValueOf(ud.Value)
+	if !rv.IsValid() {
+		L.ArgError(1, "Go value expected")
+	}
+	return rv
+}
+
+// checkType returns the value wrapped by the first argument, which must be
+// a t.
+func checkType(L *lua.LState, t reflect.Type) reflect.Value {
+	rv := check(L)
+	if rv.Type() != t {
+		L.ArgError(1, t.String()+" expected")
+	}
+	return rv
+}
+
+func deref(rv reflect.Value) reflect.Value {
+	if rv.Kind() == reflect.Ptr {
+		return rv.Elem()
+	}
+	return rv
+}
+
+func methodFunction(t reflect.Type, m reflect.Method) lua.LGFunction {
+	return func(L *lua.LState) int {
+		recv := checkType(L, t)
+		return call(L, m.Func, []reflect.Value{recv}, 2)
+	}
+}
+
+// call calls fn with in followed by the arguments from first, and pushes its
+// results.
+func call(L *lua.LState, fn reflect.Value, in []reflect.Value, first int) int {
+	ft := fn.Type()
+	nin := ft.NumIn()
+	for n := first; ; n++ {
+		var typ reflect.Type
+		if i := len(in); ft.IsVariadic() && i >= nin-1 {
+			if n > L.GetTop() {
+				break
+			}
+			typ = ft.In(nin - 1).Elem()
+		} else if i < nin {
+			typ = ft.In(i)
+		} else {
+			break
+		}
+		v, err := toGo(L, L.Get(n), typ)
+		if err != nil {
+			L.ArgError(n, err.Error())
+		}
+		in = append(in, v)
+	}
+	out := fn.Call(in)
+	if n := len(out); n > 0 && ft.Out(n-1) == errorType {
+		if err, _ := out[n-1].Interface().(error); err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		out = out[:n-1]
+	}
+	for _, v := range out {
+		L.Push(toLua(L, v))
+	}
+	return len(out)
+}
+
+func index(L *lua.LState, rv reflect.Value, key lua.LValue) lua.LValue {
+	rv = deref(rv)
+	switch rv.Kind() {
+	case reflect.Struct:
+		name, ok := key.(lua.LString)
+		if !ok {
+			return lua.LNil
+		}
+		idx, ok := structInfo(rv.Type()).fields[string(name)]
+		if !ok {
+			return lua.LNil
+		}
+		fv, err := field(rv, idx)
+		if err != nil {
+			return lua.LNil
+		}
+		return fieldValue(L, fv)
+	case reflect.Map:
+		k, err := toGo(L, key, rv.Type().Key())
+		if err != nil {
+			return lua.LNil
+		}
+		return toLua(L, rv.MapIndex(k))
+	case reflect.Slice, reflect.Array:
+		if i, ok := sliceIndex(rv, key); ok {
+			return fieldValue(L, rv.Index(i))
+		}
+	}
+	return lua.LNil
+}
+
+func setIndex(L *lua.LState, rv reflect.Value, key, value lua.LValue) {
+	rv = deref(rv)
+	var dst reflect.Value
+	switch rv.Kind() {
+	case reflect.Struct:
+		name, _ := key.(lua.LString)
+		idx, ok := structInfo(rv.Type()).fields[string(name)]
+		if !ok {
+			L.RaiseError("%s has no field '%s'", rv.Type(), key.String())
+		}
+		fv, err := field(rv, idx)
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		dst = fv
+	case reflect.Map:
+		k, err := toGo(L, key, rv.Type().Key())
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		if value == lua.LNil {
+			rv.SetMapIndex(k, reflect.Value{})
+			return
+		}
+		v, err := toGo(L, value, rv.Type().Elem())
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		rv.SetMapIndex(k, v)
+		return
+	case reflect.Slice, reflect.Array:
+		i, ok := sliceIndex(rv, key)
+		if !ok {
+			L.RaiseError("index %s out of range", key.String())
+		}
+		dst = rv.Index(i)
+	default:
+		L.RaiseError("attempt to index a %s value", rv.Type())
+	}
+	if !dst.CanSet() {
+		L.RaiseError("cannot assign to %s %s, use a pointer", key.String(), rv.Type())
+	}
+	v, err := toGo(L, value, dst.Type())
+	if err != nil {
+		L.ArgError(3, err.Error())
+	}
+	dst.Set(v)
+}
+
+// sliceIndex returns the Go index of the Lua index key, if it is in range.
+func sliceIndex(rv reflect.Value, key lua.LValue) (int, bool) {
+	n, ok := key.(lua.LNumber)
+	if !ok || float64(n) != float64(int(n)) || int(n) < 1 || int(n) > rv.Len() {
+		return 0, false
+	}
+	return int(n) - 1, true
+}
+
+// iterator returns the function called by the generic for to iterate over
+// rv: it goes through the indexes of slices and arrays, the fields of
+// structs and a snapshot of the keys of maps, sorted if they are ordered.
+func iterator(rv reflect.Value) lua.LGFunction {
+	var keys []lua.LValue
+	switch rv.Kind() {
+	case reflect.Struct:
+		for _, name := range structInfo(rv.Type()).names {
+			keys = append(keys, lua.LString(name))
+		}
+	case reflect.Map:
+		mkeys := rv.MapKeys()
+		switch rv.Type().Key().Kind() {
+		case reflect.String:
+			sort.Slice(mkeys, func(i, j int) bool { return mkeys[i].String() < mkeys[j].String() })
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			sort.Slice(mkeys, func(i, j int) bool { return mkeys[i].Int() < mkeys[j].Int() })
+		}
+		i := 0
+		return func(L *lua.LState) int {
+			for ; i < len(mkeys); i++ {
+				if v := rv.MapIndex(mkeys[i]); v.IsValid() {
+					L.Push(toLua(L, mkeys[i]))
+					L.Push(toLua(L, v))
+					i++
+					return 2
+				}
+			}
+			return 0
+		}
+	}
+	i := 0
+	return func(L *lua.LState) int {
+		var key lua.LValue
+		switch rv.Kind() {
+		case reflect.Struct:
+			if i >= len(keys) {
+				return 0
+			}
+			key = keys[i]
+		default:
+			if i >= rv.Len() {
+				return 0
+			}
+			key = lua.LNumber(i + 1)
+		}
+		i++
+		L.Push(key)
+		L.Push(index(L, rv, key))
+		return 2
+	}
+}
+
+/* }}} */
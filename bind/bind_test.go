@@ -0,0 +1,247 @@
+package bind
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type address struct {
+	City string
+	Zip  int `lua:"zip"`
+}
+
+type Base struct {
+	ID int
+}
+
+type person struct {
+	Base
+	Name    string
+	Age     int
+	Tags    []string
+	Address address
+	Scores  map[string]float64
+	secret  string
+	Hidden  string `lua:"-"`
+}
+
+func (p person) Greeting(greeting string) string { return greeting + ", " + p.Name }
+
+func (p *person) Birthday() int {
+	p.Age++
+	return p.Age
+}
+
+func (p *person) Rename(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	p.Name = name
+	return nil
+}
+
+func newTestState(t *testing.T) *lua.LState {
+	L := lua.NewState()
+	t.Cleanup(L.Close)
+	return L
+}
+
+func TestStruct(t *testing.T) {
+	L := newTestState(t)
+	p := &person{Base: Base{ID: 7}, Name: "Ann", Age: 30, Tags: []string{"a", "b"},
+		Address: address{City: "Oslo", Zip: 150}, Scores: map[string]float64{"go": 9}, secret: "s"}
+	L.SetGlobal("p", New(L, p))
+	err := L.DoString(`
+		assert(p.Name == "Ann" and p.Age == 30 and p.ID == 7)
+		assert(p.secret == nil and p.Hidden == nil and p.Nope == nil)
+		assert(p:Greeting("Hi") == "Hi, Ann")
+		assert(p:Birthday() == 31)
+		p.Name = "Bob"
+		p.Address.City = "Rome"
+		p.Address.zip = 100
+		assert(#p.Tags == 2 and p.Tags[2] == "b" and p.Tags[3] == nil)
+		p.Tags[1] = "x"
+		p.Scores.lua = 8
+		p.Scores.go = nil
+		p.Tags = {"c", "d", "e"}
+		local ok, msg = pcall(function() p:Rename("") end)
+		assert(not ok and string.find(msg, "empty name"))
+		local ok, msg = pcall(function() p.Age = "old" end)
+		assert(not ok and string.find(msg, "int expected, got string"))
+		local ok, msg = pcall(function() p.Age = 1.5 end)
+		assert(not ok and string.find(msg, "no integer representation"))
+		local ok, msg = pcall(function() p.Nope = 1 end)
+		assert(not ok and string.find(msg, "has no field 'Nope'"))
+		local names = {}
+		for k, v in pairs(p) do names[#names + 1] = k end
+		assert(table.concat(names, ",") == "Base,ID,Name,Age,Tags,Address,Scores")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "Bob" || p.Age != 31 || p.Address.City != "Rome" || p.Address.Zip != 100 {
+		t.Errorf("unexpected person %+v", p)
+	}
+	if strings.Join(p.Tags, ",") != "c,d,e" || len(p.Scores) != 1 || p.Scores["lua"] != 8 {
+		t.Errorf("unexpected person %+v", p)
+	}
+
+	L.SetGlobal("v", New(L, person{Name: "Val"}))
+	if err := L.DoString(`v.Name = "x"`); err == nil || !strings.Contains(err.Error(), "use a pointer") {
+		t.Errorf("expected an error for a field of a struct value, got %v", err)
+	}
+	if err := L.DoString(`assert(v:Greeting("Yo") == "Yo, Val" and v.Birthday == nil)`); err != nil {
+		t.Error(err)
+	}
+}
+
+type inner struct {
+	Level int
+	note  string
+}
+
+type outer struct {
+	inner
+	Name string
+}
+
+func TestPromotedFields(t *testing.T) {
+	L := newTestState(t)
+	o := &outer{inner: inner{Level: 1, note: "n"}, Name: "o"}
+	L.SetGlobal("o", New(L, o))
+	L.SetGlobal("v", New(L, outer{inner: inner{Level: 2}}))
+	L.SetGlobal("level", New(L, func(o outer) int { return o.Level }))
+	err := L.DoString(`
+		assert(o.Level == 1 and o.note == nil and o.inner == nil)
+		o.Level = 5
+		assert(v.Level == 2)
+		local ok, msg = pcall(function() v.Level = 3 end)
+		assert(not ok and string.find(msg, "use a pointer"))
+		local names = {}
+		for k in pairs(o) do names[#names + 1] = k end
+		assert(table.concat(names, ",") == "Level,Name")
+		assert(level({Level = 7, Name = "x"}) == 7)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Level != 5 {
+		t.Errorf("promoted field not set, got %+v", o)
+	}
+}
+
+func TestRegisteredMethods(t *testing.T) {
+	L := newTestState(t)
+	lua.RegisterType[person](L, map[string]lua.LGFunction{
+		"shout": func(L *lua.LState) int {
+			L.Push(lua.LString(strings.ToUpper(lua.CheckType[person](L, 1).Name)))
+			return 1
+		},
+		"__tostring": func(L *lua.LState) int {
+			L.Push(lua.LString("person " + lua.CheckType[person](L, 1).Name))
+			return 1
+		},
+	})
+	L.SetGlobal("p", New(L, &person{Name: "ann"}))
+	L.SetGlobal("q", L.ToLValue(&person{Name: "bob"}))
+	err := L.DoString(`
+		assert(p:shout() == "ANN" and q:shout() == "BOB")
+		assert(tostring(p) == "person ann")
+		assert(p.Name == "ann" and p:Greeting("Hi") == "Hi, ann")
+		p.Name = "cy"
+		assert(p:shout() == "CY")
+		assert(getmetatable(p) == getmetatable(q))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	L := newTestState(t)
+	L.SetGlobal("sum", New(L, func(prefix string, nums ...int) string {
+		total := 0
+		for _, n := range nums {
+			total += n
+		}
+		return prefix + strings.Repeat("+", total)
+	}))
+	L.SetGlobal("apply", New(L, func(fn func(int) (int, error), n int) (int, error) {
+		return fn(n)
+	}))
+	L.SetGlobal("fill", New(L, func(p *person) string { return p.Name + p.Address.City }))
+	err := L.DoString(`
+		assert(sum("s", 1, 2) == "s+++" and sum("s") == "s")
+		assert(apply(function(n) return n * 2 end, 21) == 42)
+		local ok, msg = pcall(apply, function(n) error("boom") end, 1)
+		assert(not ok and string.find(msg, "boom"))
+		assert(fill({Name = "Ann", Address = {City = "Oslo"}}) == "AnnOslo")
+		local ok, msg = pcall(fill, {Nope = 1})
+		assert(not ok and string.find(msg, "has no field 'Nope'"))
+		local ok, msg = pcall(sum, "s", "x")
+		assert(not ok and string.find(msg, "bad argument #3"))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type node struct {
+	Name string
+	Next *node
+	Kids []node
+}
+
+func TestCyclicTables(t *testing.T) {
+	L := newTestState(t)
+	var got *node
+	L.SetGlobal("take", New(L, func(n *node) { got = n }))
+	L.SetGlobal("list", New(L, func(l []interface{}) int { return len(l) }))
+	err := L.DoString(`
+		local t = {Name = "a"}
+		t.Next = t
+		take(t)
+		local l = {1}
+		l[2] = l
+		assert(list(l) == 2)
+		local k = {Name = "k"}
+		k.Kids = {k}
+		local ok, msg = pcall(take, k)
+		assert(not ok and string.find(msg, "cyclic table"), msg)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Name != "a" || got.Next != got {
+		t.Errorf("expected a node pointing to itself, got %+v", got)
+	}
+}
+
+func TestEquality(t *testing.T) {
+	L := newTestState(t)
+	p := &person{}
+	L.SetGlobal("a", New(L, p))
+	L.SetGlobal("b", New(L, p))
+	L.SetGlobal("c", New(L, &person{}))
+	if err := L.DoString(`assert(a == b and a ~= c and tostring(a) ~= nil)`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	L := newTestState(t)
+	before := L.GetAllocatedBytes()
+	L.SetGlobal("s", New(L, strings.Repeat("x", 4096)))
+	if L.GetAllocatedBytes()-before < 4096 {
+		t.Errorf("string not charged, %d bytes", L.GetAllocatedBytes()-before)
+	}
+
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 32*1024)
+	L.SetGlobal("big", New(L, func() string { return strings.Repeat("x", 64*1024) }))
+	if err := L.DoString(`local s = big()`); err == nil {
+		t.Error("expected a memory limit error")
+	}
+}
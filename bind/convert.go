@@ -0,0 +1,291 @@
+package bind
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/* Lua to Go conversion {{{ */
+
+// toGo converts lv to a value of type typ.
+func toGo(L *lua.LState, lv lua.LValue, typ reflect.Type) (reflect.Value, error) {
+	return convert(L, lv, typ, map[seenTable]reflect.Value{})
+}
+
+// seenTable identifies a table converted to a type by convert.
+type seenTable struct {
+	tb  *lua.LTable
+	typ reflect.Type
+}
+
+// convert is toGo for a value reached from the tables of seen. Like ToLValue
+// and ToGoValue, it converts a table reached again to a pointer, slice or map
+// once and shares the result, so that a cyclic table gives a cyclic value.
+// A table reached again while it is converted to a struct or an array is
+// rejected, since such a value can not contain itself.
+func convert(L *lua.LState, lv lua.LValue, typ reflect.Type, seen map[seenTable]reflect.Value) (reflect.Value, error) {
+	if tb, ok := lv.(*lua.LTable); ok {
+		if v, ok := seen[seenTable{tb, typ}]; ok {
+			if !v.IsValid() {
+				return v, fmt.Errorf("cyclic table for %v", typ)
+			}
+			return v, nil
+		}
+	}
+	if typ.Kind() == reflect.Interface && typ.NumMethod() == 0 {
+		if lv == lua.LNil {
+			return reflect.Zero(typ), nil
+		}
+		return reflect.ValueOf(L.ToGoValue(lv)).Convert(typ), nil
+	}
+	if lt := reflect.TypeOf(lv); lt.AssignableTo(typ) {
+		return reflect.ValueOf(lv).Convert(typ), nil
+	}
+	if ud, ok := lv.(*lua.LUserData); ok {
+		rv := reflect.ValueOf(ud.Value)
+		switch {
+		case !rv.IsValid():
+		case rv.Type().AssignableTo(typ):
+			return rv.Convert(typ), nil
+		case rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Type().Elem().AssignableTo(typ):
+			return rv.Elem(), nil
+		}
+		return reflect.Value{}, mismatch(lv, typ)
+	}
+
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan:
+		if lv == lua.LNil {
+			return reflect.Zero(typ), nil
+		}
+	}
+	rv := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Bool:
+		b, ok := lv.(lua.LBool)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		rv.SetBool(bool(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := lv.(lua.LNumber)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		f := float64(n)
+		if f != math.Trunc(f) || f < -(1<<63) || f >= 1<<63 {
+			return rv, fmt.Errorf("number has no integer representation")
+		}
+		if rv.OverflowInt(int64(f)) {
+			return rv, fmt.Errorf("number out of range of %v", typ)
+		}
+		rv.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := lv.(lua.LNumber)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		f := float64(n)
+		if f != math.Trunc(f) {
+			return rv, fmt.Errorf("number has no integer representation")
+		}
+		if f < 0 || f >= 1<<64 || rv.OverflowUint(uint64(f)) {
+			return rv, fmt.Errorf("number out of range of %v", typ)
+		}
+		rv.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		n, ok := lv.(lua.LNumber)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		rv.SetFloat(float64(n))
+	case reflect.String:
+		switch v := lv.(type) {
+		case lua.LString, lua.LNumber:
+			rv.SetString(v.String())
+		default:
+			return rv, mismatch(lv, typ)
+		}
+	case reflect.Slice:
+		if s, ok := lv.(lua.LString); ok && typ.Elem().Kind() == reflect.Uint8 {
+			rv.SetBytes([]byte(s))
+			break
+		}
+		tb, ok := lv.(*lua.LTable)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		n := tb.Len()
+		rv.Set(reflect.MakeSlice(typ, n, n))
+		seen[seenTable{tb, typ}] = rv
+		if err := fillSequence(L, tb, rv, seen); err != nil {
+			return rv, err
+		}
+	case reflect.Array:
+		tb, ok := lv.(*lua.LTable)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		if tb.Len() > typ.Len() {
+			return rv, fmt.Errorf("table too long for %v", typ)
+		}
+		seen[seenTable{tb, typ}] = reflect.Value{}
+		defer delete(seen, seenTable{tb, typ})
+		if err := fillSequence(L, tb, rv, seen); err != nil {
+			return rv, err
+		}
+	case reflect.Map:
+		tb, ok := lv.(*lua.LTable)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		rv.Set(reflect.MakeMap(typ))
+		seen[seenTable{tb, typ}] = rv
+		var err error
+		tb.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			var k, v reflect.Value
+			if k, err = convert(L, key, typ.Key(), seen); err != nil {
+				return
+			}
+			if v, err = convert(L, value, typ.Elem(), seen); err != nil {
+				err = fmt.Errorf("field '%s': %w", key.String(), err)
+				return
+			}
+			rv.SetMapIndex(k, v)
+		})
+		if err != nil {
+			return rv, err
+		}
+	case reflect.Struct:
+		tb, ok := lv.(*lua.LTable)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		fields := structInfo(typ).fields
+		seen[seenTable{tb, typ}] = reflect.Value{}
+		defer delete(seen, seenTable{tb, typ})
+		var err error
+		tb.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			idx, ok := fields[key.String()]
+			if _, isString := key.(lua.LString); !ok || !isString {
+				err = fmt.Errorf("%v has no field '%s'", typ, key.String())
+				return
+			}
+			var fv reflect.Value
+			if fv, err = field(rv, idx); err != nil {
+				return
+			}
+			var v reflect.Value
+			if v, err = convert(L, value, fv.Type(), seen); err != nil {
+				err = fmt.Errorf("field '%s': %w", key.String(), err)
+				return
+			}
+			fv.Set(v)
+		})
+		if err != nil {
+			return rv, err
+		}
+	case reflect.Ptr:
+		rv.Set(reflect.New(typ.Elem()))
+		if tb, ok := lv.(*lua.LTable); ok {
+			seen[seenTable{tb, typ}] = rv
+		}
+		v, err := convert(L, lv, typ.Elem(), seen)
+		if err != nil {
+			return rv, err
+		}
+		rv.Elem().Set(v)
+	case reflect.Func:
+		fn, ok := lv.(*lua.LFunction)
+		if !ok {
+			return rv, mismatch(lv, typ)
+		}
+		rv.Set(luaFunction(L, fn, typ))
+	default:
+		return rv, mismatch(lv, typ)
+	}
+	return rv, nil
+}
+
+func mismatch(lv lua.LValue, typ reflect.Type) error {
+	got := lv.Type().String()
+	if ud, ok := lv.(*lua.LUserData); ok && ud.Value != nil {
+		got = reflect.TypeOf(ud.Value).String()
+	}
+	return fmt.Errorf("%v expected, got %s", typ, got)
+}
+
+// fillSequence sets the elements of rv to the values of tb from 1 up.
+func fillSequence(L *lua.LState, tb *lua.LTable, rv reflect.Value, seen map[seenTable]reflect.Value) error {
+	for i := 1; i <= tb.Len(); i++ {
+		v, err := convert(L, tb.RawGetInt(i), rv.Type().Elem(), seen)
+		if err != nil {
+			return fmt.Errorf("index %d: %w", i, err)
+		}
+		rv.Index(i - 1).Set(v)
+	}
+	return nil
+}
+
+// luaFunction returns a Go function of type typ that calls fn in L, and so
+// must be called by the goroutine running L. If the last result of typ is
+// an error, it returns the errors raised by fn and by the conversion of its
+// results; otherwise they are raised in L.
+func luaFunction(L *lua.LState, fn *lua.LFunction, typ reflect.Type) reflect.Value {
+	nout := typ.NumOut()
+	withErr := nout > 0 && typ.Out(nout-1) == errorType
+	if withErr {
+		nout--
+	}
+	return reflect.MakeFunc(typ, func(args []reflect.Value) []reflect.Value {
+		out := make([]reflect.Value, typ.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(typ.Out(i))
+		}
+		fail := func(err error) []reflect.Value {
+			if !withErr {
+				if apiErr, ok := err.(*lua.ApiError); ok {
+					L.Error(apiErr.Object, 0)
+				}
+				L.RaiseError("%s", err.Error())
+			}
+			out[nout] = reflect.ValueOf(&err).Elem()
+			return out
+		}
+
+		top := L.GetTop()
+		defer L.SetTop(top)
+		L.Push(fn)
+		for i, arg := range args {
+			if typ.IsVariadic() && i == len(args)-1 {
+				for j := 0; j < arg.Len(); j++ {
+					L.Push(toLua(L, arg.Index(j)))
+				}
+				continue
+			}
+			L.Push(toLua(L, arg))
+		}
+		if err := L.PCall(L.GetTop()-top-1, nout, nil); err != nil {
+			return fail(err)
+		}
+		for i := 0; i < nout; i++ {
+			v, err := toGo(L, L.Get(top+1+i), typ.Out(i))
+			if err != nil {
+				return fail(fmt.Errorf("result %d: %w", i+1, err))
+			}
+			out[i] = v
+		}
+		return out
+	})
+}
+
+/* }}} */
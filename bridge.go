@@ -0,0 +1,400 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+/* Go value bridge {{{ */
+
+// ToGoValue converts a Lua value to a plain Go value:
+//
+//   - nil becomes nil, booleans become bool, numbers become float64 and
+//     strings become string.
+//   - Tables whose keys are exactly 1..n become []interface{}, other tables
+//     become map[interface{}]interface{}. A table that references itself is
+//     converted once and shared.
+//   - Userdata become their Value.
+//   - Functions, threads and channels are returned as is.
+func (ls *LState) ToGoValue(lv LValue) interface{} {
+	return toGoValue(lv, map[*LTable]interface{}{})
+}
+
+func toGoValue(lv LValue, seen map[*LTable]interface{}) interface{} {
+	switch v := lv.(type) {
+	case *LNilType:
+		return nil
+	case LBool:
+		return bool(v)
+	case LNumber:
+		return float64(v)
+	case LString:
+		return string(v)
+	case *LUserData:
+		return v.Value
+	case *LTable:
+		if converted, ok := seen[v]; ok {
+			return converted
+		}
+		if n := v.Len(); n > 0 && v.countKeys() == n {
+			slice := make([]interface{}, n)
+			seen[v] = slice
+			for i := 1; i <= n; i++ {
+				slice[i-1] = toGoValue(v.RawGetInt(i), seen)
+			}
+			return slice
+		}
+		m := map[interface{}]interface{}{}
+		seen[v] = m
+		v.ForEach(func(key, value LValue) {
+			m[toGoValue(key, seen)] = toGoValue(value, seen)
+		})
+		return m
+	}
+	return lv
+}
+
+// countKeys returns the number of non-nil entries of the table.
+func (tb *LTable) countKeys() int {
+	n := 0
+	tb.ForEach(func(LValue, LValue) { n++ })
+	return n
+}
+
+// ToLValue converts a Go value to a Lua value. It is the inverse of
+// ToGoValue:
+//
+//   - nil becomes nil, LValues are returned as is.
+//   - Booleans, all integer and floating point types, strings and []byte
+//     become the corresponding Lua values. error becomes its message.
+//     Strings are charged like NewString.
+//   - func(*LState) int becomes a Go function.
+//   - Slices and arrays become sequences and maps become tables. A slice or
+//     map reached several times, e.g. one that contains itself, is
+//     converted once and shared.
+//   - Everything else (structs, pointers, channels...) is wrapped in a new
+//     userdata, with the metatable registered for its type (see
+//     RegisterType).
+func (ls *LState) ToLValue(v interface{}) LValue {
+	return ls.toLValue(v, map[seenRef]*LTable{})
+}
+
+// seenRef identifies a slice or a map converted by ToLValue.
+type seenRef struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+func (ls *LState) toLValue(v interface{}, seen map[seenRef]*LTable) LValue {
+	switch value := v.(type) {
+	case nil:
+		return LNil
+	case LValue:
+		return value
+	case bool:
+		return LBool(value)
+	case string:
+		return ls.NewString(value)
+	case []byte:
+		return ls.NewString(string(value))
+	case int:
+		return LNumber(value)
+	case int64:
+		return LNumber(value)
+	case float64:
+		return LNumber(value)
+	case error:
+		return ls.NewString(value.Error())
+	case func(*LState) int:
+		return ls.NewFunction(value)
+	case LGFunction:
+		return ls.NewFunction(value)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return LNumber(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return LNumber(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return LNumber(rv.Float())
+	case reflect.Bool:
+		return LBool(rv.Bool())
+	case reflect.String:
+		return ls.NewString(rv.String())
+	case reflect.Slice, reflect.Array:
+		var ref seenRef
+		if rv.Kind() == reflect.Slice {
+			if rv.IsNil() {
+				return LNil
+			}
+			// empty slices may all point to the same address
+			if rv.Len() > 0 {
+				ref = seenRef{rv.Type(), rv.Pointer(), rv.Len()}
+				if tb, ok := seen[ref]; ok {
+					return tb
+				}
+			}
+		}
+		tb := ls.CreateTable(rv.Len(), 0)
+		if ref.typ != nil {
+			seen[ref] = tb
+		}
+		for i := 0; i < rv.Len(); i++ {
+			tb.RawSetInt(i+1, ls.toLValue(rv.Index(i).Interface(), seen))
+		}
+		return tb
+	case reflect.Map:
+		if rv.IsNil() {
+			return LNil
+		}
+		ref := seenRef{rv.Type(), rv.Pointer(), 0}
+		if tb, ok := seen[ref]; ok {
+			return tb
+		}
+		tb := ls.CreateTable(0, rv.Len())
+		seen[ref] = tb
+		iter := rv.MapRange()
+		for iter.Next() {
+			tb.RawSet(ls.toLValue(iter.Key().Interface(), seen), ls.toLValue(iter.Value().Interface(), seen))
+		}
+		return tb
+	}
+	return ls.NewTypedUserData(v)
+}
+
+/* }}} */
+
+/* CallGlobal {{{ */
+
+// CallGlobal calls the global function name, which may be a dotted path such
+// as "handlers.on_event". Arguments are converted with ToLValue and the
+// results with ToGoValue. Lua errors are returned as *ApiError values that
+// include a stack traceback.
+//
+//	results, err := L.CallGlobal("handlers.on_event", "click", 10, 20)
+func (ls *LState) CallGlobal(name string, args ...interface{}) ([]interface{}, error) {
+	fn, err := ls.resolveGlobal(name)
+	if err != nil {
+		return nil, err
+	}
+	top := ls.GetTop()
+	ls.Push(fn)
+	for _, arg := range args {
+		ls.Push(ls.ToLValue(arg))
+	}
+	if err := ls.PCall(len(args), MultRet, nil); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, 0, ls.GetTop()-top)
+	for i := top + 1; i <= ls.GetTop(); i++ {
+		results = append(results, ls.ToGoValue(ls.Get(i)))
+	}
+	ls.SetTop(top)
+	return results, nil
+}
+
+// resolveGlobal looks up a dotted name starting at the globals table.
+func (ls *LState) resolveGlobal(name string) (LValue, error) {
+	lookup := ls.NewFunction(func(L *LState) int {
+		lv := L.Get(GlobalsIndex)
+		for _, part := range strings.Split(name, ".") {
+			lv = L.GetField(lv, part)
+		}
+		L.Push(lv)
+		return 1
+	})
+	if err := ls.CallByParam(P{Fn: lookup, NRet: 1, Protect: true}); err != nil {
+		return nil, err
+	}
+	lv := ls.Get(-1)
+	ls.Pop(1)
+	if lv == LNil {
+		return nil, newApiErrorS(ApiErrorRun, fmt.Sprintf("attempt to call a nil value (global '%v')", name))
+	}
+	return lv, nil
+}
+
+/* }}} */
+
+/* Go type registry {{{ */
+
+type typeInfo struct {
+	methods map[string]LGFunction
+	mt      *LTable
+}
+
+var sharedTypes = struct {
+	sync.RWMutex
+	methods map[reflect.Type]map[string]LGFunction
+}{methods: map[reflect.Type]map[string]LGFunction{}}
+
+// RegisterType registers methods for the Go type T in L and returns the
+// metatable of T. Userdata created by NewTypedUserData or ToLValue for a T or
+// a *T get this metatable. Methods whose name starts with "__" are set as
+// metamethods, the others are looked up through __index. The metatable is
+// also stored like NewTypeMetatable does, under the name of T.
+//
+// If T is a struct, the methods of the types it embeds are inherited, unless
+// T overrides them. Embedded types must be registered before T. Use CheckType
+// in inherited methods to get the embedded value.
+//
+//	lua.RegisterType[Person](L, map[string]lua.LGFunction{
+//	    "name":       personName,
+//	    "__tostring": personToString,
+//	})
+func RegisterType[T any](L *LState, methods map[string]LGFunction) *LTable {
+	return L.RegisterTypeOf(reflect.TypeOf((*T)(nil)).Elem(), methods)
+}
+
+// RegisterTypeOf is RegisterType for a type known only at run time, such as
+// the types of the values exposed by a package that binds Go values through
+// reflection.
+func (ls *LState) RegisterTypeOf(typ reflect.Type, methods map[string]LGFunction) *LTable {
+	if ls.G.types == nil {
+		ls.G.types = map[reflect.Type]*typeInfo{}
+	}
+	info := &typeInfo{methods: methods}
+	ls.G.types[typ] = info
+	info.mt = ls.buildTypeMetatable(typ)
+	return info.mt
+}
+
+// TypeMetatable returns the metatable that NewTypedUserData gives to the
+// values of typ, registered by RegisterType or RegisterSharedType, or nil if
+// typ is not registered. A pointer type gets the metatable of the type it
+// points to.
+func (ls *LState) TypeMetatable(typ reflect.Type) *LTable {
+	return ls.typeMetatable(typ)
+}
+
+// RegisterSharedType registers methods for the Go type T in every LState.
+// States build the metatable of T the first time a T is converted to
+// userdata. Types registered with RegisterType take precedence.
+func RegisterSharedType[T any](methods map[string]LGFunction) {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	sharedTypes.Lock()
+	defer sharedTypes.Unlock()
+	sharedTypes.methods[typ] = methods
+}
+
+// CheckType returns a pointer to the T held by the userdata at position n.
+// If the userdata holds a struct that embeds a T, the embedded T is returned,
+// which lets inherited methods work on derived types. Values that are not
+// stored as pointers are copied.
+func CheckType[T any](L *LState, n int) *T {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	ud := L.CheckUserData(n)
+	rv := reflect.ValueOf(ud.Value)
+	if rv.IsValid() && rv.Kind() != reflect.Ptr {
+		cp := reflect.New(rv.Type())
+		cp.Elem().Set(rv)
+		rv = cp
+	}
+	if rv.IsValid() {
+		if found, ok := findEmbedded(rv, typ); ok {
+			// unlike Addr().Interface(), this also works for unexported embedded types
+			return (*T)(unsafe.Pointer(found.UnsafeAddr()))
+		}
+	}
+	L.ArgError(n, fmt.Sprintf("%v expected", typ))
+	return nil
+}
+
+func findEmbedded(rv reflect.Value, typ reflect.Type) (reflect.Value, bool) {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return rv, false
+		}
+		rv = rv.Elem()
+	}
+	if rv.Type() == typ {
+		return rv, true
+	}
+	if rv.Kind() == reflect.Struct {
+		for i := 0; i < rv.NumField(); i++ {
+			if rv.Type().Field(i).Anonymous {
+				if found, ok := findEmbedded(rv.Field(i), typ); ok {
+					return found, true
+				}
+			}
+		}
+	}
+	return rv, false
+}
+
+// NewTypedUserData returns a new userdata holding v, with the metatable
+// registered for the type of v (see RegisterType), if any. If v implements
+// MemorySizer, its size is charged to the memory usage of the state.
+func (ls *LState) NewTypedUserData(v interface{}) *LUserData {
+	ud := ls.NewUserDataWithSize(v, 0)
+	if v != nil {
+		if mt := ls.typeMetatable(reflect.TypeOf(v)); mt != nil {
+			ud.Metatable = mt
+		}
+	}
+	return ud
+}
+
+func (ls *LState) typeMethods(typ reflect.Type) map[string]LGFunction {
+	if info, ok := ls.G.types[typ]; ok {
+		return info.methods
+	}
+	sharedTypes.RLock()
+	defer sharedTypes.RUnlock()
+	return sharedTypes.methods[typ]
+}
+
+func (ls *LState) typeMetatable(typ reflect.Type) *LTable {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if info, ok := ls.G.types[typ]; ok && info.mt != nil {
+		return info.mt
+	}
+	methods := ls.typeMethods(typ)
+	if methods == nil {
+		return nil
+	}
+	if ls.G.types == nil {
+		ls.G.types = map[reflect.Type]*typeInfo{}
+	}
+	info := &typeInfo{methods: methods}
+	ls.G.types[typ] = info
+	info.mt = ls.buildTypeMetatable(typ)
+	return info.mt
+}
+
+func (ls *LState) buildTypeMetatable(typ reflect.Type) *LTable {
+	mt := ls.NewTypeMetatable(typ.String())
+	index := ls.NewTable()
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Struct {
+			for i := 0; i < t.NumField(); i++ {
+				if field := t.Field(i); field.Anonymous {
+					collect(field.Type)
+				}
+			}
+		}
+		for name, fn := range ls.typeMethods(t) {
+			if strings.HasPrefix(name, "__") {
+				mt.RawSetString(name, ls.NewFunction(fn))
+			} else {
+				index.RawSetString(name, ls.NewFunction(fn))
+			}
+		}
+	}
+	collect(typ)
+	mt.RawSetString("__index", index)
+	return mt
+}
+
+/* }}} */
@@ -0,0 +1,71 @@
+package lua
+
+/* per-call memory budgets {{{ */
+
+// memBudget is the budget of a call made by CallWithBudget. It counts the
+// growth of the allocated bytes of the state since the call started.
+type memBudget struct {
+	limit int64
+	base  int64
+	prev  *memBudget
+}
+
+// CallWithBudget calls fn with args in protected mode, allowing it to
+// allocate at most budget bytes in addition to the memory in use when the
+// call starts, coroutines it creates included. A call that goes over the
+// budget fails with a *LimitError whose Resource is "memory budget", even if
+// the memory limit of the state is not reached; errors.Is matches it with
+// ErrMemoryBudgetExceeded. The budget applies on top of the limits of the
+// state, and calls with a budget can be nested. The results of fn are
+// returned and removed from the stack.
+//
+//	results, err := L.CallWithBudget(512*1024, L.GetGlobal("handler"), lua.LString("event"))
+func (ls *LState) CallWithBudget(budget int64, fn LValue, args ...LValue) ([]LValue, error) {
+	prev := ls.budget
+	ls.budget = &memBudget{limit: budget, base: ls.allocatedBytes, prev: prev}
+	defer func() { ls.budget = prev }()
+
+	top := ls.GetTop()
+	ls.Push(fn)
+	for _, arg := range args {
+		ls.Push(arg)
+	}
+	if err := ls.PCall(len(args), MultRet, nil); err != nil {
+		return nil, err
+	}
+	results := make([]LValue, 0, ls.GetTop()-top)
+	for i := top + 1; i <= ls.GetTop(); i++ {
+		results = append(results, ls.Get(i))
+	}
+	ls.SetTop(top)
+	return results, nil
+}
+
+// budgetRemaining returns the bytes ls may still allocate before it runs
+// out of the tightest of its budgets, and false if it has none.
+func (ls *LState) budgetRemaining() (int64, bool) {
+	remaining, limited := int64(0), false
+	for b := ls.budget; b != nil; b = b.prev {
+		if r := b.limit - (ls.allocatedBytes - b.base); !limited || r < remaining {
+			remaining, limited = r, true
+		}
+	}
+	return remaining, limited
+}
+
+// checkBudget raises an error in L if ls went over one of its budgets.
+func (ls *LState) checkBudget(L *LState, bytes int64) {
+	if remaining, ok := ls.budgetRemaining(); !ok || remaining >= 0 {
+		return
+	}
+	ls.emergencyCollect(bytes)
+	for b := ls.budget; b != nil; b = b.prev {
+		if used := ls.allocatedBytes - b.base; used > b.limit {
+			ls.countLimitExceeded()
+			L.raiseTypedError(&LimitError{Resource: "memory budget", Limit: b.limit, Value: used},
+				"memory budget exceeded: %d bytes allocated by the call, budget is %d bytes", used, b.limit)
+		}
+	}
+}
+
+/* }}} */
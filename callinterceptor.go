@@ -0,0 +1,64 @@
+package lua
+
+/* call interceptor {{{ */
+
+// CallInterceptor is called before the calls made by scripts, see
+// SetCallInterceptor.
+type CallInterceptor func(L *LState, fn LValue, args []LValue) error
+
+type callInterceptor struct {
+	fn      CallInterceptor
+	running bool
+}
+
+// SetCallInterceptor calls fn before every call made by the scripts of this
+// state and of its threads, to Lua and Go functions alike, including those
+// made through pcall, table.sort or other library functions. fn receives
+// the called value, which can be compared with the functions the host
+// registered, and a copy of the arguments. If fn returns an error, the call
+// is not made and the script fails with it, so that errors.Is and errors.As
+// see it through the returned *ApiError; scripts can catch it with pcall.
+// This allows to deny some functions or to count their calls per run
+// without changing their bindings:
+//
+//	fetch := L.GetField(L.GetGlobal("http"), "get")
+//	calls := 0
+//	L.SetCallInterceptor(func(L *lua.LState, fn lua.LValue, args []lua.LValue) error {
+//		if fn == fetch {
+//			if calls++; calls > 100 {
+//				return errors.New("too many http calls")
+//			}
+//		}
+//		return nil
+//	})
+//
+// Calls made by the host from outside of a script and the first resume of
+// a coroutine are not intercepted. fn is not called for the
+// calls made while it runs. A nil fn removes the interceptor.
+func (ls *LState) SetCallInterceptor(fn CallInterceptor) {
+	if fn == nil {
+		ls.G.callInterceptor = nil
+	} else {
+		ls.G.callInterceptor = &callInterceptor{fn: fn}
+	}
+}
+
+// intercept calls the interceptor for a call of fn with the nargs arguments
+// found in the registry of L from base on.
+func (ci *callInterceptor) intercept(L *LState, fn LValue, base, nargs int) {
+	if ci.running {
+		return
+	}
+	ci.running = true
+	defer func() { ci.running = false }()
+	if clock := L.G.execClock; clock != nil && clock.pause() {
+		defer clock.resume()
+	}
+	args := make([]LValue, nargs)
+	copy(args, L.reg.array[base:base+nargs])
+	if err := ci.fn(L, fn, args); err != nil {
+		L.raiseTypedError(err, "%s", err.Error())
+	}
+}
+
+/* }}} */
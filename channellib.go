@@ -1,12 +1,7 @@
 package lua
 
-import (
-	"reflect"
-)
-
-func checkChannel(L *LState, idx int) reflect.Value {
-	ch := L.CheckChannel(idx)
-	return reflect.ValueOf(ch)
+func checkChannel(L *LState, idx int) chan LValue {
+	return (chan LValue)(L.CheckChannel(idx))
 }
 
 func checkGoroutineSafe(L *LState, idx int) LValue {
@@ -37,130 +32,40 @@ var channelFuncs = map[string]LGFunction{
 
 func channelMake(L *LState) int {
 	buffer := L.OptInt(1, 0)
-	L.Push(LChannel(make(chan LValue, buffer)))
-	return 1
-}
-
-func channelSelect(L *LState) int {
-	//TODO check case table size
-	cases := make([]reflect.SelectCase, L.GetTop())
-	top := L.GetTop()
-	for i := 0; i < top; i++ {
-		cas := reflect.SelectCase{
-			Dir:  reflect.SelectSend,
-			Chan: reflect.ValueOf(nil),
-			Send: reflect.ValueOf(nil),
-		}
-		tbl := L.CheckTable(i + 1)
-		dir, ok1 := tbl.RawGetInt(1).(LString)
-		if !ok1 {
-			L.ArgError(i+1, "invalid select case")
-		}
-		switch string(dir) {
-		case "<-|":
-			ch, ok := tbl.RawGetInt(2).(LChannel)
-			if !ok {
-				L.ArgError(i+1, "invalid select case")
-			}
-			cas.Chan = reflect.ValueOf((chan LValue)(ch))
-			v := tbl.RawGetInt(3)
-			if !isGoroutineSafe(v) {
-				L.ArgError(i+1, "can not send a function, userdata, thread or table that has a metatable")
-			}
-			cas.Send = reflect.ValueOf(v)
-		case "|<-":
-			ch, ok := tbl.RawGetInt(2).(LChannel)
-			if !ok {
-				L.ArgError(i+1, "invalid select case")
-			}
-			cas.Chan = reflect.ValueOf((chan LValue)(ch))
-			cas.Dir = reflect.SelectRecv
-		case "default":
-			cas.Dir = reflect.SelectDefault
-		default:
-			L.ArgError(i+1, "invalid channel direction:"+string(dir))
-		}
-		cases[i] = cas
-	}
-
-	if L.ctx != nil {
-		cases = append(cases, reflect.SelectCase{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(L.ctx.Done()),
-			Send: reflect.ValueOf(nil),
-		})
-	}
-
-	pos, recv, rok := reflect.Select(cases)
-
-	if L.ctx != nil && pos == L.GetTop() {
-		return 0
-	}
-
-	lv := LNil
-	if recv.Kind() != 0 {
-		lv, _ = recv.Interface().(LValue)
-		if lv == nil {
-			lv = LNil
-		}
-	}
-	tbl := L.Get(pos + 1).(*LTable)
-	last := tbl.RawGetInt(tbl.Len())
-	if last.Type() == LTFunction {
-		L.Push(last)
-		switch cases[pos].Dir {
-		case reflect.SelectRecv:
-			if rok {
-				L.Push(LTrue)
-			} else {
-				L.Push(LFalse)
-			}
-			L.Push(lv)
-			L.Call(2, 0)
-		case reflect.SelectSend:
-			L.Push(tbl.RawGetInt(3))
-			L.Call(1, 0)
-		case reflect.SelectDefault:
-			L.Call(0, 0)
-		}
+	if buffer < 0 {
+		L.ArgError(1, "buffer size must not be negative")
 	}
-	L.Push(LNumber(pos + 1))
-	L.Push(lv)
-	if rok {
-		L.Push(LTrue)
-	} else {
-		L.Push(LFalse)
+	size := sizeofChannel + int64(buffer)*sizeofLValue
+	if err := L.checkFits(size); err != nil {
+		L.raiseTypedError(err, "%s", err.Error())
 	}
-	return 3
+	L.trackAlloc(AllocChannel, size)
+	L.Push(LChannel(make(chan LValue, buffer)))
+	return 1
 }
 
 var channelMethods = map[string]LGFunction{
-	"receive": channelReceive,
+	"receive": Nondeterministic("channel.receive", channelReceive),
 	"send":    channelSend,
 	"close":   channelClose,
 }
 
 func channelReceive(L *LState) int {
 	rch := checkChannel(L, 1)
-	var v reflect.Value
+	defer L.creditChannels()
+	var v LValue
 	var ok bool
 	if L.ctx != nil {
-		cases := []reflect.SelectCase{{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(L.ctx.Done()),
-			Send: reflect.ValueOf(nil),
-		}, {
-			Dir:  reflect.SelectRecv,
-			Chan: rch,
-			Send: reflect.ValueOf(nil),
-		}}
-		_, v, ok = reflect.Select(cases)
+		select {
+		case <-L.ctx.Done():
+		case v, ok = <-rch:
+		}
 	} else {
-		v, ok = rch.Recv()
+		v, ok = <-rch
 	}
 	if ok {
 		L.Push(LTrue)
-		L.Push(v.Interface().(LValue))
+		L.Push(v)
 	} else {
 		L.Push(LFalse)
 		L.Push(LNil)
@@ -171,14 +76,95 @@ func channelReceive(L *LState) int {
 func channelSend(L *LState) int {
 	rch := checkChannel(L, 1)
 	v := checkGoroutineSafe(L, 2)
-	rch.Send(reflect.ValueOf(v))
+	L.creditChannels()
+	L.chargeChannelSend(LChannel(rch), v)
+	rch <- v
 	return 0
 }
 
 func channelClose(L *LState) int {
 	rch := checkChannel(L, 1)
-	rch.Close()
+	close(rch)
 	return 0
 }
 
 //
+
+/* channel accounting {{{ */
+
+// channelItem is a value sent to a buffered channel and charged to sender.
+type channelItem struct {
+	sender *LState
+	bytes  int64
+}
+
+// chargeChannelSend charges v, about to be sent to ch, to ls until it is
+// received. The items are kept by the root state, whose CollectGarbage
+// would not see them otherwise. Values sent to unbuffered channels are
+// handed over to the receiver and not charged.
+func (ls *LState) chargeChannelSend(ch LChannel, v LValue) {
+	if cap(ch) == 0 {
+		return
+	}
+	var bytes int64
+	switch v.(type) {
+	case LString, *LTable:
+		e := ls.newSizeEstimator()
+		e.push(v)
+		e.drain()
+		bytes = e.est.Total
+	}
+	if bytes == 0 {
+		return
+	}
+	ls.trackAlloc(AllocChannel, bytes)
+	root := ls.memRoot()
+	if root.chanItems == nil {
+		root.chanItems = map[LChannel][]channelItem{}
+	}
+	root.chanItems[ch] = append(root.chanItems[ch], channelItem{ls, bytes})
+}
+
+// creditChannels credits the values that were received from the channels
+// ls sent to. The channels are shared with other goroutines, so a value is
+// known to be received only once fewer values are buffered than ls sent;
+// values received by Go code are credited the same way.
+func (ls *LState) creditChannels() {
+	root := ls.memRoot()
+	for ch, items := range root.chanItems {
+		n := len(items) - len(ch)
+		if n <= 0 {
+			continue
+		}
+		for _, item := range items[:n] {
+			item.sender.releaseAlloc(item.bytes)
+		}
+		if n == len(items) {
+			delete(root.chanItems, ch)
+		} else {
+			root.chanItems[ch] = append(items[:0:0], items[n:]...)
+		}
+	}
+}
+
+// channelBytes returns the bytes charged for values still buffered in
+// channels.
+func (ls *LState) channelBytes() int64 {
+	var bytes int64
+	for _, items := range ls.memRoot().chanItems {
+		for _, item := range items {
+			bytes += item.bytes
+		}
+	}
+	return bytes
+}
+
+// memRoot returns the state that created ls and its ancestors.
+func (ls *LState) memRoot() *LState {
+	for ls.memParent != nil {
+		ls = ls.memParent
+	}
+	return ls
+}
+
+/* }}} */
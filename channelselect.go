@@ -0,0 +1,119 @@
+//go:build !tinygo
+
+package lua
+
+import (
+	"reflect"
+)
+
+func channelSelect(L *LState) int {
+	//TODO check case table size
+	cases := make([]reflect.SelectCase, L.GetTop())
+	top := L.GetTop()
+	for i := 0; i < top; i++ {
+		cas := reflect.SelectCase{
+			Dir:  reflect.SelectSend,
+			Chan: reflect.ValueOf(nil),
+			Send: reflect.ValueOf(nil),
+		}
+		tbl := L.CheckTable(i + 1)
+		dir, ok1 := tbl.RawGetInt(1).(LString)
+		if !ok1 {
+			L.ArgError(i+1, "invalid select case")
+		}
+		switch string(dir) {
+		case "<-|":
+			ch, ok := tbl.RawGetInt(2).(LChannel)
+			if !ok {
+				L.ArgError(i+1, "invalid select case")
+			}
+			cas.Chan = reflect.ValueOf((chan LValue)(ch))
+			v := tbl.RawGetInt(3)
+			if !isGoroutineSafe(v) {
+				L.ArgError(i+1, "can not send a function, userdata, thread or table that has a metatable")
+			}
+			cas.Send = reflect.ValueOf(v)
+		case "|<-":
+			ch, ok := tbl.RawGetInt(2).(LChannel)
+			if !ok {
+				L.ArgError(i+1, "invalid select case")
+			}
+			cas.Chan = reflect.ValueOf((chan LValue)(ch))
+			cas.Dir = reflect.SelectRecv
+		case "default":
+			cas.Dir = reflect.SelectDefault
+		default:
+			L.ArgError(i+1, "invalid channel direction:"+string(dir))
+		}
+		cases[i] = cas
+	}
+
+	if L.ctx != nil {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(L.ctx.Done()),
+			Send: reflect.ValueOf(nil),
+		})
+	}
+
+	var pos int
+	var rok bool
+	lv := LNil
+	if values, ok := L.replayEvent("channel.select"); ok {
+		if len(values) == 3 {
+			pos, lv, rok = int(LVAsNumber(values[0]))-1, values[1], LVAsBool(values[2])
+		}
+		if len(values) != 3 || pos < 0 || pos >= top {
+			L.RaiseError("replay diverged: invalid channel.select case")
+		}
+	} else {
+		var recv reflect.Value
+		L.creditChannels()
+		pos, recv, rok = reflect.Select(cases)
+		if cases[pos].Dir == reflect.SelectSend {
+			L.chargeChannelSend(LChannel(cases[pos].Chan.Interface().(chan LValue)), cases[pos].Send.Interface().(LValue))
+		} else {
+			L.creditChannels()
+		}
+
+		if L.ctx != nil && pos == L.GetTop() {
+			return 0
+		}
+
+		if recv.Kind() != 0 {
+			lv, _ = recv.Interface().(LValue)
+			if lv == nil {
+				lv = LNil
+			}
+		}
+		L.recordEvent("channel.select", LNumber(pos+1), lv, LBool(rok))
+	}
+	tbl := L.Get(pos + 1).(*LTable)
+	last := tbl.RawGetInt(tbl.Len())
+	if last.Type() == LTFunction {
+		L.Push(last)
+		switch cases[pos].Dir {
+		case reflect.SelectRecv:
+			if rok {
+				L.Push(LTrue)
+			} else {
+				L.Push(LFalse)
+			}
+			L.Push(lv)
+			L.Call(2, 0)
+		case reflect.SelectSend:
+			L.Push(tbl.RawGetInt(3))
+			L.Call(1, 0)
+		case reflect.SelectDefault:
+			L.Call(0, 0)
+		}
+	}
+	L.Push(LNumber(pos + 1))
+	L.Push(lv)
+	if rok {
+		L.Push(LTrue)
+	} else {
+		L.Push(LFalse)
+	}
+	return 3
+}
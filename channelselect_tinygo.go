@@ -0,0 +1,10 @@
+//go:build tinygo
+
+package lua
+
+// TinyGo does not implement reflect.Select, which channel.select needs to
+// wait on a dynamic number of channels.
+func channelSelect(L *LState) int {
+	L.RaiseError("channel.select is not supported in TinyGo builds")
+	return 0
+}
@@ -1,46 +1,90 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/chzyer/readline"
 	"github.com/yuin/gopher-lua"
 	"github.com/yuin/gopher-lua/parse"
+	"io"
 	"os"
 	"runtime/pprof"
+	"strings"
 )
 
 func main() {
 	os.Exit(mainAux())
 }
 
+// stringList is a flag that can be given multiple times.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
 func mainAux() int {
-	var opt_e, opt_l, opt_p string
-	var opt_i, opt_v, opt_dt, opt_dc bool
-	var opt_m int
+	var opt_e, opt_o, opt_prof string
+	var opt_l stringList
+	var opt_i, opt_v, opt_dt, opt_dc, opt_c, opt_p bool
+	var opt_m, opt_bench int
 	flag.StringVar(&opt_e, "e", "", "")
-	flag.StringVar(&opt_l, "l", "", "")
-	flag.StringVar(&opt_p, "p", "", "")
+	flag.Var(&opt_l, "l", "")
+	flag.StringVar(&opt_o, "o", "luac.out", "")
+	flag.StringVar(&opt_prof, "cpuprofile", "", "")
 	flag.IntVar(&opt_m, "mx", 0, "")
+	flag.IntVar(&opt_bench, "bench", 0, "")
 	flag.BoolVar(&opt_i, "i", false, "")
 	flag.BoolVar(&opt_v, "v", false, "")
 	flag.BoolVar(&opt_dt, "dt", false, "")
 	flag.BoolVar(&opt_dc, "dc", false, "")
+	flag.BoolVar(&opt_c, "c", false, "")
+	flag.BoolVar(&opt_p, "p", false, "")
 	flag.Usage = func() {
 		fmt.Println(`Usage: glua [options] [script [args]].
 Available options are:
   -e stat  execute string 'stat'
-  -l name  require library 'name'
+  -l name  require library 'name' (may be given multiple times)
   -mx MB   memory limit(default: unlimited)
   -dt      dump AST trees
   -dc      dump VM codes
+  -c       compile 'script' to a binary chunk instead of running it
+  -o file  output file for -c (default: luac.out)
+  -p       parse and compile the given scripts only, printing any errors
   -i       enter interactive mode after executing 'script'
-  -p file  write cpu profiles to the file
-  -v       show version information`)
+  -bench N run 'script' N times and print its cost
+  -cpuprofile file  write cpu profiles to the file
+  -v       show version information
+
+A binary chunk written by -c can be run like a script.`)
 	}
 	flag.Parse()
-	if len(opt_p) != 0 {
-		f, err := os.Create(opt_p)
+	if opt_p {
+		return checkFiles(flag.Args())
+	}
+	if opt_bench > 0 {
+		if flag.NArg() < 1 {
+			fmt.Println("-bench requires a script")
+			return 1
+		}
+		return benchFile(flag.Arg(0), opt_bench)
+	}
+	if opt_c {
+		if flag.NArg() != 1 {
+			fmt.Println("-c requires exactly one script")
+			return 1
+		}
+		return compileFile(flag.Arg(0), opt_o)
+	}
+	if len(opt_prof) != 0 {
+		f, err := os.Create(opt_prof)
 		if err != nil {
 			fmt.Println(err.Error())
 			os.Exit(1)
@@ -64,10 +108,13 @@ Available options are:
 		fmt.Println(lua.PackageCopyRight)
 	}
 
-	if len(opt_l) > 0 {
-		if err := L.DoFile(opt_l); err != nil {
+	for _, name := range opt_l {
+		if err := L.CallByParam(lua.P{Fn: L.GetGlobal("require"), NRet: 1}, lua.LString(name)); err != nil {
 			fmt.Println(err.Error())
+			return 1
 		}
+		L.SetGlobal(name, L.Get(-1))
+		L.Pop(1)
 	}
 
 	if nargs := flag.NArg(); nargs > 0 {
@@ -100,14 +147,14 @@ Available options are:
 				fmt.Println(proto.String())
 			}
 		}
-		if err := L.DoFile(script); err != nil {
+		if err := interruptible(L, func() error { return L.DoFile(script) }); err != nil {
 			fmt.Println(err.Error())
 			status = 1
 		}
 	}
 
 	if len(opt_e) > 0 {
-		if err := L.DoString(opt_e); err != nil {
+		if err := interruptible(L, func() error { return L.DoString(opt_e) }); err != nil {
 			fmt.Println(err.Error())
 			status = 1
 		}
@@ -119,6 +166,88 @@ Available options are:
 	return status
 }
 
+func compileScript(script string) (*lua.FunctionProto, error) {
+	file, err := os.Open(script)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	chunk, err := parse.Parse(bufio.NewReader(file), script)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, script)
+}
+
+// checkFiles compiles each script without running it, like luac -p.
+func checkFiles(scripts []string) int {
+	if len(scripts) == 0 {
+		fmt.Println("-p requires at least one script")
+		return 1
+	}
+	status := 0
+	for _, script := range scripts {
+		if _, err := compileScript(script); err != nil {
+			fmt.Println(err.Error())
+			status = 1
+		}
+	}
+	return status
+}
+
+// compileFile writes script as a binary chunk to output, like luac -o.
+func compileFile(script, output string) int {
+	proto, err := compileScript(script)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	err = lua.DumpProto(file, proto)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// benchFile runs script n times and prints a lua.BenchmarkResult.
+func benchFile(script string, n int) int {
+	src, err := os.ReadFile(script)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	result, err := lua.Benchmark(string(src), lua.BenchmarkOptions{
+		N:    n,
+		Name: script,
+		Options: lua.Options{
+			Stdout: io.Discard,
+		},
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Println(result)
+	return 0
+}
+
+// interruptible runs fn so that Ctrl-C raises a Lua error with a stack
+// traceback instead of killing the process.
+func interruptible(L *lua.LState, fn func() error) error {
+	stop := L.InterruptOnSignal(context.Background())
+	defer stop()
+	return fn()
+}
+
 // do read/eval/print/loop
 func doREPL(L *lua.LState) {
 	rl, err := readline.New("> ")
@@ -128,7 +257,7 @@ func doREPL(L *lua.LState) {
 	defer rl.Close()
 	for {
 		if str, err := loadline(rl, L); err == nil {
-			if err := L.DoString(str); err != nil {
+			if err := interruptible(L, func() error { return L.DoString(str) }); err != nil {
 				fmt.Println(err)
 			}
 		} else { // error on loadline
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"slices"
 
 	"github.com/yuin/gopher-lua/ast"
 )
@@ -165,10 +166,17 @@ type CompileError struct { // {{{
 	context *funcContext
 	Line    int
 	Message string
+	cause   error
 }
 
 func (e *CompileError) Error() string {
 	return fmt.Sprintf("compile error near line(%v) %v: %v", e.Line, e.context.Proto.SourceName, e.Message)
+}
+
+// Unwrap returns the *LimitError of a function that exceeds the limits of
+// CompileOptions, or nil.
+func (e *CompileError) Unwrap() error {
+	return e.cause
 } // }}}
 
 type codeStore struct { // {{{
@@ -306,10 +314,12 @@ type varNamePoolValue struct {
 type varNamePool struct {
 	names  []string
 	offset int
+	// indexes of the <const> and <close> variables
+	readOnly map[int]bool
 }
 
 func newVarNamePool(offset int) *varNamePool {
-	return &varNamePool{make([]string, 0, 16), offset}
+	return &varNamePool{make([]string, 0, 16), offset, nil}
 }
 
 func (vp *varNamePool) Names() []string {
@@ -351,6 +361,17 @@ func (vp *varNamePool) Register(name string) int {
 	return len(vp.names) - 1 + vp.offset
 }
 
+func (vp *varNamePool) SetReadOnly(index int) {
+	if vp.readOnly == nil {
+		vp.readOnly = map[int]bool{}
+	}
+	vp.readOnly[index] = true
+}
+
+func (vp *varNamePool) IsReadOnly(index int) bool {
+	return vp.readOnly[index]
+}
+
 /* }}} VarNamePool */
 
 /* FuncContext {{{ */
@@ -360,6 +381,7 @@ type codeBlock struct {
 	BreakLabel     int
 	Parent         *codeBlock
 	RefUpvalue     bool
+	ToBeClosed     bool
 	LineStart      int
 	LastLine       int
 	labels         map[string]*gotoLabelDesc
@@ -367,7 +389,7 @@ type codeBlock struct {
 }
 
 func newCodeBlock(localvars *varNamePool, blabel int, parent *codeBlock, pos ast.PositionHolder, firstGotoIndex int) *codeBlock {
-	bl := &codeBlock{localvars, blabel, parent, false, 0, 0, map[string]*gotoLabelDesc{}, firstGotoIndex}
+	bl := &codeBlock{localvars, blabel, parent, false, false, 0, 0, map[string]*gotoLabelDesc{}, firstGotoIndex}
 	if pos != nil {
 		bl.LineStart = pos.Line()
 		bl.LastLine = pos.LastLine()
@@ -410,6 +432,7 @@ type funcContext struct {
 	labelPc         map[int]int
 	gotosCount      int
 	unresolvedGotos map[int]*gotoLabelDesc
+	maxConstants    int
 }
 
 func newFuncContext(sourcename string, parent *funcContext) *funcContext {
@@ -426,6 +449,9 @@ func newFuncContext(sourcename string, parent *funcContext) *funcContext {
 		unresolvedGotos: map[int]*gotoLabelDesc{},
 	}
 	fc.Blocks = []*codeBlock{fc.Block}
+	if parent != nil {
+		fc.maxConstants = parent.maxConstants
+	}
 	return fc
 }
 
@@ -528,6 +554,10 @@ func (fc *funcContext) ConstIndex(value LValue) int {
 	}
 	fc.Proto.Constants = append(fc.Proto.Constants, value)
 	v := len(fc.Proto.Constants) - 1
+	if fc.maxConstants > 0 && v >= fc.maxConstants {
+		panic(&CompileError{context: fc, Line: fc.Proto.LineDefined, Message: "too many constants",
+			cause: &LimitError{Resource: "constants", Limit: int64(fc.maxConstants), Value: int64(v + 1)}})
+	}
 	if v > opMaxArgBx {
 		raiseCompileError(fc, fc.Proto.LineDefined, "too many constants")
 	}
@@ -541,6 +571,17 @@ func (fc *funcContext) BlockLocalVarsCount() int {
 	return count
 }
 
+// HasToBeClosed reports whether a to-be-closed variable is in scope, which
+// the function must close before it returns.
+func (fc *funcContext) HasToBeClosed() bool {
+	for block := fc.Block; block != nil; block = block.Parent {
+		if block.ToBeClosed {
+			return true
+		}
+	}
+	return false
+}
+
 func (fc *funcContext) RegisterLocalVar(name string) int {
 	ret := fc.Block.LocalVars.Register(name)
 	fc.Proto.DbgLocals = append(fc.Proto.DbgLocals, &DbgLocalInfo{Name: name, StartPc: fc.Code.LastPC() + 1})
@@ -562,6 +603,17 @@ func (fc *funcContext) FindLocalVar(name string) int {
 	return idx
 }
 
+// IsReadOnlyVar reports whether name refers to a <const> or <close> local
+// variable of this function or of an enclosing one.
+func (fc *funcContext) IsReadOnlyVar(name string) bool {
+	for c := fc; c != nil; c = c.Parent {
+		if idx, block := c.FindLocalVarAndBlock(name); block != nil {
+			return block.LocalVars.IsReadOnly(idx)
+		}
+	}
+	return false
+}
+
 func (fc *funcContext) LocalVars() []varNamePoolValue {
 	result := make([]varNamePoolValue, 0, 32)
 	for _, block := range fc.Blocks {
@@ -693,6 +745,9 @@ func compileAssignStmtLeft(context *funcContext, stmt *ast.AssignStmt) (int, []*
 		switch st := lhs.(type) {
 		case *ast.IdentExpr:
 			identtype := getIdentRefType(context, context, st)
+			if identtype != ecGlobal && context.IsReadOnlyVar(st.Value) {
+				raiseCompileError(context, sline(st), "attempt to assign to const variable '%s'", st.Value)
+			}
 			ec := &expcontext{identtype, regNotDefined, 0}
 			switch identtype {
 			case ecGlobal:
@@ -855,17 +910,39 @@ func compileRegAssignment(context *funcContext, names []string, exprs []ast.Expr
 
 func compileLocalAssignStmt(context *funcContext, stmt *ast.LocalAssignStmt) { // {{{
 	reg := context.RegTop()
+	isfunc := false
 	if len(stmt.Names) == 1 && len(stmt.Exprs) == 1 {
-		if _, ok := stmt.Exprs[0].(*ast.FunctionExpr); ok {
-			context.RegisterLocalVar(stmt.Names[0])
-			compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
-			return
+		_, isfunc = stmt.Exprs[0].(*ast.FunctionExpr)
+	}
+	indexes := make([]int, 0, len(stmt.Names))
+	if isfunc {
+		indexes = append(indexes, context.RegisterLocalVar(stmt.Names[0]))
+		compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
+	} else {
+		compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
+		for _, name := range stmt.Names {
+			indexes = append(indexes, context.RegisterLocalVar(name))
 		}
 	}
-
-	compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
-	for _, name := range stmt.Names {
-		context.RegisterLocalVar(name)
+	tbc := -1
+	for i, attrib := range stmt.Attribs {
+		if attrib != "" {
+			context.Block.LocalVars.SetReadOnly(indexes[i])
+		}
+		if attrib != "close" {
+			continue
+		}
+		if tbc >= 0 {
+			raiseCompileError(context, sline(stmt), "multiple to-be-closed variables in local list")
+		}
+		tbc = i
+	}
+	if tbc >= 0 {
+		// the block closes its to-be-closed variables where it closes its
+		// upvalues: on exit, break and goto.
+		context.Block.RefUpvalue = true
+		context.Block.ToBeClosed = true
+		context.Code.AddABx(OP_TBC, reg+tbc, context.ConstIndex(LString(stmt.Names[tbc])), sline(stmt))
 	}
 } // }}}
 
@@ -875,11 +952,20 @@ func compileReturnStmt(context *funcContext, stmt *ast.ReturnStmt) { // {{{
 	reg := context.RegTop()
 	a := reg
 	lastisvaarg := false
+	// to-be-closed variables are closed once the results are computed, so
+	// a call can not be a tail call.
+	tbc := context.HasToBeClosed()
+	closeTbc := func() {
+		if tbc {
+			code.AddABC(OP_CLOSE, 0, 0, 0, sline(stmt))
+		}
+	}
 
 	if lenexprs == 1 {
 		switch ex := stmt.Exprs[0].(type) {
 		case *ast.IdentExpr:
 			if idx := context.FindLocalVar(ex.Value); idx > -1 {
+				closeTbc()
 				code.AddABC(OP_RETURN, idx, 2, 0, sline(stmt))
 				return
 			}
@@ -888,8 +974,11 @@ func compileReturnStmt(context *funcContext, stmt *ast.ReturnStmt) { // {{{
 				reg += compileExpr(context, reg, ex, ecnone(0))
 			} else {
 				reg += compileExpr(context, reg, ex, ecnone(-2))
-				code.SetOpCode(code.LastPC(), OP_TAILCALL)
+				if !tbc {
+					code.SetOpCode(code.LastPC(), OP_TAILCALL)
+				}
 			}
+			closeTbc()
 			code.AddABC(OP_RETURN, a, 0, 0, sline(stmt))
 			return
 		}
@@ -907,6 +996,7 @@ func compileReturnStmt(context *funcContext, stmt *ast.ReturnStmt) { // {{{
 	if lastisvaarg {
 		count = 0
 	}
+	closeTbc()
 	context.Code.AddABC(OP_RETURN, a, count, 0, sline(stmt))
 } // }}}
 
@@ -1019,9 +1109,11 @@ func compileRepeatStmt(context *funcContext, stmt *ast.RepeatStmt) { // {{{
 } // }}}
 
 func compileBreakStmt(context *funcContext, stmt *ast.BreakStmt) { // {{{
+	refUpvalue := false
 	for block := context.Block; block != nil; block = block.Parent {
+		refUpvalue = refUpvalue || block.RefUpvalue
 		if label := block.BreakLabel; label != labelNoJump {
-			if block.RefUpvalue {
+			if refUpvalue {
 				context.Code.AddABC(OP_CLOSE, block.Parent.LocalVars.LastIndex(), 0, 0, sline(stmt))
 			}
 			context.Code.AddASbx(OP_JMP, 0, label, sline(stmt))
@@ -1132,7 +1224,9 @@ func compileLabelStmt(context *funcContext, stmt *ast.LabelStmt, isLastStmt bool
 } // }}}
 
 func compileGotoStmt(context *funcContext, stmt *ast.GotoStmt) { // {{{
-	context.Code.AddABC(OP_CLOSE, 0, 0, 0, sline(stmt))
+	// the variables in scope stay open unless the goto leaves their block,
+	// see FindLabel and ResolveCurrentBlockGotosWithParentBlock.
+	context.Code.AddABC(OP_CLOSE, context.BlockLocalVarsCount(), 0, 0, sline(stmt))
 	context.Code.AddASbx(OP_JMP, 0, labelNoJump, sline(stmt))
 	label := newLabelDesc(-1, stmt.Label, context.Code.LastPC(), sline(stmt), context.BlockLocalVarsCount())
 	context.AddUnresolvedGoto(label)
@@ -1212,7 +1306,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 	case *ast.StringConcatOpExpr:
 		compileStringConcatOpExpr(context, reg, ex, ec)
 		return sused
-	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr:
+	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr, *ast.UnaryBNotOpExpr:
 		compileUnaryOpExpr(context, reg, ex, ec)
 		return sused
 	case *ast.RelationalOpExpr:
@@ -1286,6 +1380,28 @@ func constFold(exp ast.Expr) ast.Expr { // {{{
 				return &constLValueExpr{Value: luaModulo(lvalue, rvalue)}
 			case "^":
 				return &constLValueExpr{Value: LNumber(math.Pow(float64(lvalue), float64(rvalue)))}
+			case "//":
+				return &constLValueExpr{Value: LNumber(math.Floor(float64(lvalue / rvalue)))}
+			case "&", "|", "~", "<<", ">>":
+				// operands without an integer representation raise an
+				// error at run time.
+				x, xok := luaToInteger(lvalue)
+				y, yok := luaToInteger(rvalue)
+				if !xok || !yok {
+					return expr
+				}
+				switch expr.Operator {
+				case "&":
+					return &constLValueExpr{Value: LNumber(x & y)}
+				case "|":
+					return &constLValueExpr{Value: LNumber(x | y)}
+				case "~":
+					return &constLValueExpr{Value: LNumber(x ^ y)}
+				case "<<":
+					return &constLValueExpr{Value: LNumber(luaShiftLeft(x, y))}
+				default:
+					return &constLValueExpr{Value: LNumber(luaShiftLeft(x, -y))}
+				}
 			default:
 				panic(fmt.Sprintf("unknown binop: %v", expr.Operator))
 			}
@@ -1298,6 +1414,14 @@ func constFold(exp ast.Expr) ast.Expr { // {{{
 			return &constLValueExpr{Value: LNumber(-value)}
 		}
 		return expr
+	case *ast.UnaryBNotOpExpr:
+		expr.Expr = constFold(expr.Expr)
+		if value, ok := lnumberValue(expr.Expr); ok {
+			if x, ok := luaToInteger(value); ok {
+				return &constLValueExpr{Value: LNumber(^x)}
+			}
+		}
+		return expr
 	default:
 
 		return exp
@@ -1330,6 +1454,9 @@ func compileFunctionExpr(context *funcContext, funcexpr *ast.FunctionExpr, ec *e
 
 	compileChunk(context, funcexpr.Stmts, false)
 
+	if context.HasToBeClosed() {
+		context.Code.AddABC(OP_CLOSE, 0, 0, 0, eline(funcexpr))
+	}
 	context.Code.AddABC(OP_RETURN, 0, 1, 0, eline(funcexpr))
 	context.EndScope()
 	context.CheckUnresolvedGoto()
@@ -1337,16 +1464,31 @@ func compileFunctionExpr(context *funcContext, funcexpr *ast.FunctionExpr, ec *e
 	context.Proto.DbgSourcePositions = context.Code.PosList()
 	context.Proto.DbgUpvalues = context.Upvalues.Names()
 	context.Proto.NumUpvalues = uint8(len(context.Proto.DbgUpvalues))
-	for _, clv := range context.Proto.Constants {
+	for i, clv := range context.Proto.Constants {
 		sv := ""
 		if slv, ok := clv.(LString); ok {
-			sv = string(slv)
+			sv = sharedString(string(slv))
+			context.Proto.Constants[i] = LString(sv)
 		}
 		context.Proto.stringConstants = append(context.Proto.stringConstants, sv)
 	}
 	patchCode(context)
+	clipProto(context.Proto)
 } // }}}
 
+// clipProto gives back the room that the compiler reserved in the slices of
+// proto, which would otherwise stay allocated as long as the function.
+func clipProto(proto *FunctionProto) {
+	proto.Code = slices.Clone(proto.Code)
+	proto.Constants = slices.Clone(proto.Constants)
+	proto.FunctionPrototypes = slices.Clone(proto.FunctionPrototypes)
+	proto.DbgSourcePositions = slices.Clone(proto.DbgSourcePositions)
+	proto.DbgLocals = slices.Clone(proto.DbgLocals)
+	proto.DbgCalls = slices.Clone(proto.DbgCalls)
+	proto.DbgUpvalues = slices.Clone(proto.DbgUpvalues)
+	proto.stringConstants = slices.Clone(proto.stringConstants)
+}
+
 func compileTableExpr(context *funcContext, reg int, ex *ast.TableExpr, ec *expcontext) { // {{{
 	code := context.Code
 	/*
@@ -1446,6 +1588,18 @@ func compileArithmeticOpExpr(context *funcContext, reg int, expr *ast.Arithmetic
 		op = OP_MOD
 	case "^":
 		op = OP_POW
+	case "//":
+		op = OP_IDIV
+	case "&":
+		op = OP_BAND
+	case "|":
+		op = OP_BOR
+	case "~":
+		op = OP_BXOR
+	case "<<":
+		op = OP_SHL
+	case ">>":
+		op = OP_SHR
 	}
 	context.Code.AddABC(op, a, b, c, sline(expr))
 } // }}}
@@ -1501,6 +1655,15 @@ func compileUnaryOpExpr(context *funcContext, reg int, expr ast.Expr, ec *expcon
 	case *ast.UnaryLenOpExpr:
 		opcode = OP_LEN
 		operandexpr = ex.Expr
+	case *ast.UnaryBNotOpExpr:
+		exp := constFold(ex)
+		if lvexpr, ok := exp.(*constLValueExpr); ok {
+			exp.SetLine(sline(expr))
+			compileExpr(context, reg, lvexpr, ec)
+			return
+		}
+		opcode = OP_BNOT
+		operandexpr = ex.Expr
 	}
 
 	a := savereg(ec, reg)
@@ -1780,27 +1943,14 @@ func patchCode(context *funcContext) { // {{{
 		curop := opGetOpCode(inst)
 		switch curop {
 		case OP_CLOSURE:
+			if reg := opGetArgA(inst); reg > maxreg {
+				maxreg = reg
+			}
 			pc += int(context.Proto.FunctionPrototypes[opGetArgBx(inst)].NumUpvalues)
 			moven = 0
 			continue
-		case OP_SETGLOBAL, OP_SETUPVAL, OP_EQ, OP_LT, OP_LE, OP_TEST,
-			OP_TAILCALL, OP_RETURN, OP_FORPREP, OP_FORLOOP, OP_TFORLOOP,
-			OP_SETLIST, OP_CLOSE:
-			/* nothing to do */
-		case OP_CALL:
-			if reg := opGetArgA(inst) + opGetArgC(inst) - 2; reg > maxreg {
-				maxreg = reg
-			}
 		case OP_VARARG:
-			if reg := opGetArgA(inst) + opGetArgB(inst) - 1; reg > maxreg {
-				maxreg = reg
-			}
-		case OP_SELF:
-			if reg := opGetArgA(inst) + 1; reg > maxreg {
-				maxreg = reg
-			}
-		case OP_LOADNIL:
-			if reg := opGetArgB(inst); reg > maxreg {
+			if reg := intMax(opMaxRegister(inst), opGetArgA(inst)+opGetArgB(inst)-1); reg > maxreg {
 				maxreg = reg
 			}
 		case OP_JMP: // jump to jump optimization
@@ -1823,7 +1973,7 @@ func patchCode(context *funcContext) { // {{{
 				context.Code.SetSbx(pc, distance)
 			}
 		default:
-			if reg := opGetArgA(inst); reg > maxreg {
+			if reg := opMaxRegister(inst); reg > maxreg {
 				maxreg = reg
 			}
 		}
@@ -1847,6 +1997,17 @@ func patchCode(context *funcContext) { // {{{
 } // }}}
 
 func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) { // {{{
+	return CompileWithOptions(chunk, name, CompileOptions{})
+}
+
+// CompileOptions bounds the functions built by CompileWithOptions.
+type CompileOptions struct {
+	// MaxConstants is the maximum number of constants of each function. 0
+	// means the limit of the instruction set.
+	MaxConstants int
+}
+
+func CompileWithOptions(chunk []ast.Stmt, name string, opts CompileOptions) (proto *FunctionProto, err error) {
 	defer func() {
 		if rcv := recover(); rcv != nil {
 			if _, ok := rcv.(*CompileError); ok {
@@ -1864,6 +2025,7 @@ func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) {
 		funcexpr.SetLastLine(eline(chunk[len(chunk)-1]) + 1)
 	}
 	context := newFuncContext(name, nil)
+	context.maxConstants = opts.MaxConstants
 	compileFunctionExpr(context, funcexpr, ecnone(0))
 	proto = context.Proto
 	return
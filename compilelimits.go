@@ -0,0 +1,83 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/yuin/gopher-lua/parse"
+)
+
+/* compile limits {{{ */
+
+// CompileLimits bounds the chunks that Load and the functions built on it
+// accept, so that loading untrusted source can not exhaust the memory or
+// the stack of the host. A chunk over a limit fails to load with an
+// *ApiError of type ApiErrorSyntax whose cause is a *LimitError, matched by
+// ErrCompileLimitExceeded. Zero fields mean no limit.
+type CompileLimits struct {
+	// MaxChunkSize is the maximum size in bytes of a source or binary chunk.
+	// It also bounds long chains of binary operators, which nest as deep as
+	// they are long.
+	MaxChunkSize int64
+	// MaxNestingDepth is the maximum depth of nested brackets, blocks,
+	// functions and unary operators of a source chunk. 200 is the limit of
+	// the reference implementation.
+	MaxNestingDepth int
+	// MaxConstants is the maximum number of constants of a function.
+	MaxConstants int
+}
+
+// ErrCompileLimitExceeded matches, with errors.Is, the *LimitError of a
+// chunk that exceeds the CompileLimits of the state.
+var ErrCompileLimitExceeded = errors.New("compile limit exceeded")
+
+// limitChunk returns a reader of the chunk read from br, or an error if it is
+// larger than allowed.
+func (ls *LState) limitChunk(br *bufio.Reader, name string) (*bufio.Reader, error) {
+	max := ls.Options.CompileLimits.MaxChunkSize
+	if max <= 0 {
+		return br, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(br, max+1))
+	if err != nil {
+		return nil, newApiErrorE(ApiErrorFile, err)
+	}
+	if int64(len(data)) > max {
+		cause := &LimitError{Resource: "chunk size", Limit: max, Value: int64(len(data))}
+		return nil, &ApiError{ApiErrorSyntax, LString(fmt.Sprintf("%s: chunk too large: more than %d bytes", name, max)), "", cause}
+	}
+	return bufio.NewReader(bytes.NewReader(data)), nil
+}
+
+// syntaxError returns the error of a chunk that does not parse or compile.
+func (ls *LState) syntaxError(err error) *ApiError {
+	if errors.Is(err, parse.ErrTooManyLevels) {
+		max := ls.Options.CompileLimits.MaxNestingDepth
+		return &ApiError{ApiErrorSyntax, LString(err.Error()), "", &LimitError{Resource: "nesting depth", Limit: int64(max), Value: int64(max) + 1}}
+	}
+	return newApiErrorE(ApiErrorSyntax, err)
+}
+
+// checkConstants returns an error if a function of a binary chunk has more
+// constants than allowed.
+func (ls *LState) checkConstants(proto *FunctionProto, name string) error {
+	max := ls.Options.CompileLimits.MaxConstants
+	if max <= 0 {
+		return nil
+	}
+	if n := len(proto.Constants); n > max {
+		cause := &LimitError{Resource: "constants", Limit: int64(max), Value: int64(n)}
+		return &ApiError{ApiErrorSyntax, LString(fmt.Sprintf("%s: too many constants", name)), "", cause}
+	}
+	for _, child := range proto.FunctionPrototypes {
+		if err := ls.checkConstants(child, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* }}} */
@@ -19,8 +19,10 @@ const LNumberScanFormat = "%f"
 const LuaVersion = "Lua 5.1"
 
 var LuaPath = "LUA_PATH"
+var LuaCPath = "LUA_CPATH"
 var LuaLDir string
 var LuaPathDefault string
+var LuaCPathDefault string
 var LuaOS string
 var LuaDirSep string
 var LuaPathSep = ";"
@@ -34,10 +36,12 @@ func init() {
 		LuaLDir = "/usr/local/share/lua/5.1"
 		LuaDirSep = "/"
 		LuaPathDefault = "./?.lua;" + LuaLDir + "/?.lua;" + LuaLDir + "/?/init.lua"
+		LuaCPathDefault = "./?.so;/usr/local/lib/lua/5.1/?.so"
 	} else { // windows
 		LuaOS = "windows"
 		LuaLDir = "!\\lua"
 		LuaDirSep = "\\"
 		LuaPathDefault = ".\\?.lua;" + LuaLDir + "\\?.lua;" + LuaLDir + "\\?\\init.lua"
+		LuaCPathDefault = ".\\?.dll;!\\?.dll"
 	}
 }
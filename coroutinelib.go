@@ -8,16 +8,22 @@ func OpenCoroutine(L *LState) int {
 }
 
 var coFuncs = map[string]LGFunction{
-	"create":  coCreate,
-	"yield":   coYield,
-	"resume":  coResume,
-	"running": coRunning,
-	"status":  coStatus,
-	"wrap":    coWrap,
+	"close":       coClose,
+	"create":      coCreate,
+	"isyieldable": coIsYieldable,
+	"yield":       coYield,
+	"resume":      coResume,
+	"running":     coRunning,
+	"status":      coStatus,
+	"wrap":        coWrap,
 }
 
 func coCreate(L *LState) int {
 	fn := L.CheckFunction(1)
+	if max := L.G.maxCoroutines; max > 0 && L.G.coroutines >= max {
+		L.raiseTypedError(&LimitError{Resource: "coroutines", Limit: int64(max), Value: int64(L.G.coroutines) + 1},
+			"too many coroutines: %d are alive, limit is %d", L.G.coroutines, max)
+	}
 	newthread, _ := L.NewThread()
 	base := 0
 	newthread.stack.Push(callFrame{
@@ -90,6 +96,34 @@ func coRunning(L *LState) int {
 	return 1
 }
 
+func coIsYieldable(L *LState) int {
+	th := L
+	if L.GetTop() > 0 {
+		th = L.CheckThread(1)
+	}
+	L.Push(LBool(th != L.G.MainThread))
+	return 1
+}
+
+func coClose(L *LState) int {
+	th := L.CheckThread(1)
+	if th == L {
+		L.RaiseError("cannot close a running coroutine")
+	}
+	for p := L.Parent; p != nil; p = p.Parent {
+		if p == th {
+			L.RaiseError("cannot close a normal coroutine")
+		}
+	}
+	if errobj := L.closeThread(th); errobj != LNil {
+		L.Push(LFalse)
+		L.Push(errobj)
+		return 2
+	}
+	L.Push(LTrue)
+	return 1
+}
+
 func coStatus(L *LState) int {
 	L.Push(LString(L.Status(L.CheckThread(1))))
 	return 1
@@ -110,3 +144,25 @@ func coWrap(L *LState) int {
 }
 
 //
+
+// SetMaxCoroutines makes coroutine.create and coroutine.wrap fail once n
+// threads created from this state are alive, with a *LimitError whose
+// Resource is "coroutines", matched by ErrCoroutineLimitExceeded. A thread
+// is alive until its function returns or fails; threads created by the host
+// with NewThread count as well but are never refused. Suspended coroutines
+// that are no longer referenced stay alive until CollectGarbage finds them
+// unreachable. A limit of 0 removes it.
+func (ls *LState) SetMaxCoroutines(n int) {
+	ls.G.maxCoroutines = n
+}
+
+// GetMaxCoroutines returns the limit set by SetMaxCoroutines (0 if none).
+func (ls *LState) GetMaxCoroutines() int {
+	return ls.G.maxCoroutines
+}
+
+// GetCoroutineCount returns the number of threads created from this state
+// that are alive, as counted by SetMaxCoroutines.
+func (ls *LState) GetCoroutineCount() int {
+	return ls.G.coroutines
+}
@@ -132,6 +132,9 @@ func debugSetMetatable(L *LState) int {
 	L.CheckTypes(2, LTNil, LTTable)
 	obj := L.Get(1)
 	mt := L.Get(2)
+	if m, ok := L.metatable(obj, true).(*LTable); ok && m.protected {
+		L.RaiseError("cannot change a protected metatable")
+	}
 	L.SetMetatable(obj, mt)
 	L.SetTop(1)
 	return 1
@@ -0,0 +1,79 @@
+package lua
+
+import "strings"
+
+/* denied functions {{{ */
+
+// DenyFunctions disables the library functions named by names, written as
+// they are reached from the globals, e.g. "os.exit", "string.dump" or
+// "collectgarbage". A denied function is removed from the tables reachable
+// from the globals, the registry and the metatables of the built-in types,
+// so that aliases such as package.loaded.os.exit go as well, and a Go
+// function raises an error when called through a reference that is left,
+// e.g. an upvalue or a read-only table. Names that do not lead to a function,
+// such as those of a library that is not open, are ignored.
+//
+// NewState calls it with Options.Deny once the libraries are opened;
+// libraries opened later are not affected.
+func (ls *LState) DenyFunctions(names ...string) {
+	denied := map[*LFunction]bool{}
+	for _, name := range names {
+		var lv LValue = ls.G.Global
+		for _, field := range strings.Split(name, ".") {
+			tb, ok := lv.(*LTable)
+			if !ok {
+				lv = LNil
+				break
+			}
+			lv = tb.RawGetString(field)
+		}
+		fn, ok := lv.(*LFunction)
+		if !ok {
+			continue
+		}
+		denied[fn] = true
+		if fn.IsG {
+			fn.GFunction = deniedFunction(name)
+		}
+	}
+	if len(denied) == 0 {
+		return
+	}
+
+	visited := map[*LTable]bool{}
+	pending := []LValue{ls.G.Global, ls.G.Registry}
+	for _, mt := range ls.G.builtinMts {
+		pending = append(pending, mt)
+	}
+	for len(pending) > 0 {
+		tb, ok := pending[len(pending)-1].(*LTable)
+		pending = pending[:len(pending)-1]
+		if !ok || visited[tb] {
+			continue
+		}
+		visited[tb] = true
+		pending = append(pending, tb.Metatable)
+		var keys []LValue
+		tb.ForEach(func(key, value LValue) {
+			if fn, ok := value.(*LFunction); ok && denied[fn] {
+				keys = append(keys, key)
+			}
+			pending = append(pending, key, value)
+		})
+		if tb.readonly {
+			continue
+		}
+		for _, key := range keys {
+			tb.RawSet(key, LNil)
+		}
+	}
+}
+
+func deniedFunction(name string) LGFunction {
+	return func(L *LState) int {
+		L.RaiseError("'%s' is disabled", name)
+		return 0
+	}
+}
+
+/* }}} */
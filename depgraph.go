@@ -0,0 +1,458 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+/* require() dependency graph {{{ */
+
+// DependencyHeuristics enables the resolution of require() calls whose
+// argument is not a string literal.
+type DependencyHeuristics uint
+
+const (
+	// HeuristicConcat resolves concatenations of string literals, as in
+	// require("app." .. "config").
+	HeuristicConcat DependencyHeuristics = 1 << iota
+	// HeuristicLocalConstants resolves locals that are assigned a string
+	// once, as in local name = "app.config"; require(name).
+	HeuristicLocalConstants
+	// HeuristicPcall resolves optional dependencies loaded with
+	// pcall(require, "name").
+	HeuristicPcall
+
+	// HeuristicAll enables every heuristic.
+	HeuristicAll = HeuristicConcat | HeuristicLocalConstants | HeuristicPcall
+)
+
+// DependencyOptions configures Dependencies.
+type DependencyOptions struct {
+	// Heuristics used to resolve require() calls without a literal argument.
+	Heuristics DependencyHeuristics
+	// RequireFuncs are the names of additional global functions that load
+	// modules like require.
+	RequireFuncs []string
+	// Load returns the source of a module, or an error wrapping
+	// fs.ErrNotExist if there is no such Lua module. By default modules are
+	// searched in Path, on FS if it is set and on the OS file system
+	// otherwise.
+	Load func(module string) (io.ReadCloser, error)
+	// Path is a package.path like list of templates. It defaults to the
+	// value of LUA_PATH or LuaPathDefault.
+	Path string
+	FS   fs.FS
+}
+
+// Dependency is a module required by a chunk.
+type Dependency struct {
+	Module string
+	// Line is the line of the require() call.
+	Line int
+	// Heuristic is set if the module name was not a string literal.
+	Heuristic bool
+}
+
+// DependencyGraph maps every module reachable from a root module to the
+// modules it requires.
+type DependencyGraph struct {
+	Root     string
+	Requires map[string][]Dependency
+	// Dynamic lists, for every module, the lines of require() calls whose
+	// argument could not be resolved.
+	Dynamic map[string][]int
+	// Missing holds the required modules that have no Lua source, such as
+	// modules implemented in Go, in sorted order.
+	Missing []string
+}
+
+// Dependencies parses the source of module root, then the sources of the
+// modules it requires, recursively, and returns their dependency graph.
+// Only calls of the global require function (or of RequireFuncs) are taken
+// into account; calls through other variables, and modules loaded in other
+// ways, are not.
+func Dependencies(root string, src io.Reader, opts *DependencyOptions) (*DependencyGraph, error) {
+	if opts == nil {
+		opts = &DependencyOptions{}
+	}
+	g := &DependencyGraph{Root: root, Requires: map[string][]Dependency{}, Dynamic: map[string][]int{}}
+	missing := map[string]bool{}
+	pending := []string{root}
+	for len(pending) > 0 {
+		module := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := g.Requires[module]; ok || missing[module] {
+			continue
+		}
+		r := src
+		if module != root {
+			rc, err := opts.load(module)
+			if errors.Is(err, fs.ErrNotExist) {
+				missing[module] = true
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			r = rc
+		}
+		chunk, err := parse.Parse(r, module)
+		if rc, ok := r.(io.Closer); ok && module != root {
+			rc.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		deps, dynamic := ChunkDependencies(chunk, opts)
+		g.Requires[module] = deps
+		if len(dynamic) > 0 {
+			g.Dynamic[module] = dynamic
+		}
+		for i := len(deps) - 1; i >= 0; i-- {
+			pending = append(pending, deps[i].Module)
+		}
+	}
+	for module := range missing {
+		g.Missing = append(g.Missing, module)
+	}
+	sort.Strings(g.Missing)
+	return g, nil
+}
+
+func (opts *DependencyOptions) load(module string) (io.ReadCloser, error) {
+	if opts.Load != nil {
+		return opts.Load(module)
+	}
+	path := opts.Path
+	if path == "" {
+		path = loGetPath(LuaPath, LuaPathDefault)
+	}
+	sep := string(os.PathSeparator)
+	if opts.FS != nil {
+		sep = "/"
+	}
+	name := strings.Replace(module, ".", sep, -1)
+	for _, pattern := range strings.Split(path, ";") {
+		file := strings.Replace(pattern, "?", name, -1)
+		var rc io.ReadCloser
+		var err error
+		if opts.FS != nil {
+			rc, err = opts.FS.Open(fsPath(file))
+		} else {
+			rc, err = os.Open(file)
+		}
+		if err == nil {
+			return rc, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("module %v not found: %w", module, fs.ErrNotExist)
+}
+
+// ChunkDependencies returns the modules required by a parsed chunk in the
+// order of appearance, each once, and the lines of the require() calls
+// whose argument could not be resolved.
+func ChunkDependencies(chunk []ast.Stmt, opts *DependencyOptions) ([]Dependency, []int) {
+	if opts == nil {
+		opts = &DependencyOptions{}
+	}
+	w := &depWalker{opts: opts, funcs: map[string]bool{"require": true}, consts: map[string]string{}, seen: map[string]bool{}}
+	for _, name := range opts.RequireFuncs {
+		w.funcs[name] = true
+	}
+	if opts.Heuristics&HeuristicLocalConstants != 0 {
+		w.collectConstants(chunk, map[string]int{})
+	}
+	v := &astVisitor{expr: func(expr ast.Expr) {
+		if call, ok := expr.(*ast.FuncCallExpr); ok {
+			w.call(call)
+		}
+	}}
+	v.stmts(chunk)
+	return w.deps, w.dynamic
+}
+
+type depWalker struct {
+	opts    *DependencyOptions
+	funcs   map[string]bool
+	consts  map[string]string
+	seen    map[string]bool
+	deps    []Dependency
+	dynamic []int
+}
+
+// collectConstants finds the locals that are assigned a string literal
+// once and never again. Locals of the same name in different scopes are
+// considered the same, which errs on the side of not resolving.
+func (w *depWalker) collectConstants(chunk []ast.Stmt, assigned map[string]int) {
+	v := &astVisitor{stmt: func(stmt ast.Stmt) {
+		switch s := stmt.(type) {
+		case *ast.LocalAssignStmt:
+			for i, name := range s.Names {
+				assigned[name]++
+				if i < len(s.Exprs) {
+					if str, ok := s.Exprs[i].(*ast.StringExpr); ok {
+						w.consts[name] = str.Value
+					}
+				}
+			}
+		case *ast.AssignStmt:
+			for _, lhs := range s.Lhs {
+				if ident, ok := lhs.(*ast.IdentExpr); ok {
+					assigned[ident.Value]++
+				}
+			}
+		case *ast.NumberForStmt:
+			assigned[s.Name]++
+		case *ast.GenericForStmt:
+			for _, name := range s.Names {
+				assigned[name]++
+			}
+		case *ast.FuncDefStmt:
+			for _, name := range s.Func.ParList.Names {
+				assigned[name]++
+			}
+		}
+	}, expr: func(expr ast.Expr) {
+		if fn, ok := expr.(*ast.FunctionExpr); ok {
+			for _, name := range fn.ParList.Names {
+				assigned[name]++
+			}
+		}
+	}}
+	v.stmts(chunk)
+	for name, n := range assigned {
+		if n != 1 {
+			delete(w.consts, name)
+		}
+	}
+}
+
+// astVisitor calls stmt and expr, if set, with every statement and
+// expression of a chunk, including those of nested functions.
+type astVisitor struct {
+	stmt func(ast.Stmt)
+	expr func(ast.Expr)
+}
+
+func (v *astVisitor) stmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		if v.stmt != nil {
+			v.stmt(stmt)
+		}
+		switch s := stmt.(type) {
+		case *ast.AssignStmt:
+			v.exprs(s.Lhs)
+			v.exprs(s.Rhs)
+		case *ast.LocalAssignStmt:
+			v.exprs(s.Exprs)
+		case *ast.FuncCallStmt:
+			v.visit(s.Expr)
+		case *ast.DoBlockStmt:
+			v.stmts(s.Stmts)
+		case *ast.WhileStmt:
+			v.visit(s.Condition)
+			v.stmts(s.Stmts)
+		case *ast.RepeatStmt:
+			v.stmts(s.Stmts)
+			v.visit(s.Condition)
+		case *ast.IfStmt:
+			v.visit(s.Condition)
+			v.stmts(s.Then)
+			v.stmts(s.Else)
+		case *ast.NumberForStmt:
+			v.visit(s.Init)
+			v.visit(s.Limit)
+			v.visit(s.Step)
+			v.stmts(s.Stmts)
+		case *ast.GenericForStmt:
+			v.exprs(s.Exprs)
+			v.stmts(s.Stmts)
+		case *ast.FuncDefStmt:
+			v.stmts(s.Func.Stmts)
+		case *ast.ReturnStmt:
+			v.exprs(s.Exprs)
+		}
+	}
+}
+
+func (v *astVisitor) exprs(exprs []ast.Expr) {
+	for _, expr := range exprs {
+		v.visit(expr)
+	}
+}
+
+func (v *astVisitor) visit(expr ast.Expr) {
+	if expr == nil {
+		return
+	}
+	if v.expr != nil {
+		v.expr(expr)
+	}
+	switch e := expr.(type) {
+	case *ast.AttrGetExpr:
+		v.visit(e.Object)
+		v.visit(e.Key)
+	case *ast.TableExpr:
+		for _, field := range e.Fields {
+			v.visit(field.Key)
+			v.visit(field.Value)
+		}
+	case *ast.FuncCallExpr:
+		v.visit(e.Func)
+		v.visit(e.Receiver)
+		v.exprs(e.Args)
+	case *ast.LogicalOpExpr:
+		v.visit(e.Lhs)
+		v.visit(e.Rhs)
+	case *ast.RelationalOpExpr:
+		v.visit(e.Lhs)
+		v.visit(e.Rhs)
+	case *ast.StringConcatOpExpr:
+		v.visit(e.Lhs)
+		v.visit(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		v.visit(e.Lhs)
+		v.visit(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		v.visit(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		v.visit(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		v.visit(e.Expr)
+	case *ast.UnaryBNotOpExpr:
+		v.visit(e.Expr)
+	case *ast.FunctionExpr:
+		v.stmts(e.Stmts)
+	}
+}
+
+func (w *depWalker) call(e *ast.FuncCallExpr) {
+	args := e.Args
+	if w.isRequire(e.Func) {
+		// require(name)
+	} else if ident, ok := e.Func.(*ast.IdentExpr); ok && ident.Value == "pcall" &&
+		w.opts.Heuristics&HeuristicPcall != 0 && len(args) > 0 && w.isRequire(args[0]) {
+		args = args[1:]
+	} else {
+		return
+	}
+	if len(args) == 0 {
+		w.dynamic = append(w.dynamic, e.Line())
+		return
+	}
+	if str, ok := args[0].(*ast.StringExpr); ok {
+		w.add(Dependency{Module: str.Value, Line: e.Line(), Heuristic: len(args) != len(e.Args)})
+		return
+	}
+	if name, ok := w.constant(args[0]); ok {
+		w.add(Dependency{Module: name, Line: e.Line(), Heuristic: true})
+		return
+	}
+	w.dynamic = append(w.dynamic, e.Line())
+}
+
+func (w *depWalker) isRequire(expr ast.Expr) bool {
+	ident, ok := expr.(*ast.IdentExpr)
+	return ok && w.funcs[ident.Value]
+}
+
+// constant evaluates expr to a string using the enabled heuristics.
+func (w *depWalker) constant(expr ast.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.StringExpr:
+		return e.Value, true
+	case *ast.IdentExpr:
+		s, ok := w.consts[e.Value]
+		return s, ok
+	case *ast.StringConcatOpExpr:
+		if w.opts.Heuristics&HeuristicConcat == 0 {
+			return "", false
+		}
+		lhs, ok := w.constant(e.Lhs)
+		if !ok {
+			return "", false
+		}
+		rhs, ok := w.constant(e.Rhs)
+		return lhs + rhs, ok
+	}
+	return "", false
+}
+
+func (w *depWalker) add(dep Dependency) {
+	if !w.seen[dep.Module] {
+		w.seen[dep.Module] = true
+		w.deps = append(w.deps, dep)
+	}
+}
+
+// Cycles returns the cycles of the graph. Every cycle is listed once,
+// starting with its smallest module name.
+func (g *DependencyGraph) Cycles() [][]string {
+	var cycles [][]string
+	seen := map[string]bool{}
+	var stack []string
+	onStack := map[string]int{}
+	var visit func(module string)
+	visit = func(module string) {
+		if i, ok := onStack[module]; ok {
+			cycle := append([]string(nil), stack[i:]...)
+			min := 0
+			for j := range cycle {
+				if cycle[j] < cycle[min] {
+					min = j
+				}
+			}
+			cycles = append(cycles, append(cycle[min:], cycle[:min]...))
+			return
+		}
+		if seen[module] {
+			return
+		}
+		seen[module] = true
+		onStack[module] = len(stack)
+		stack = append(stack, module)
+		for _, dep := range g.Requires[module] {
+			visit(dep.Module)
+		}
+		stack = stack[:len(stack)-1]
+		delete(onStack, module)
+	}
+	visit(g.Root)
+	return cycles
+}
+
+// Order returns the modules of the graph, each after the modules it
+// requires, which is the order in which they can be preloaded. Missing
+// modules are not included. It fails if the graph has a cycle.
+func (g *DependencyGraph) Order() ([]string, error) {
+	if cycles := g.Cycles(); len(cycles) > 0 {
+		return nil, fmt.Errorf("dependency cycle: %v", strings.Join(append(cycles[0], cycles[0][0]), " -> "))
+	}
+	var order []string
+	done := map[string]bool{}
+	var visit func(module string)
+	visit = func(module string) {
+		if _, ok := g.Requires[module]; !ok || done[module] {
+			return
+		}
+		done[module] = true
+		for _, dep := range g.Requires[module] {
+			visit(dep.Module)
+		}
+		order = append(order, module)
+	}
+	visit(g.Root)
+	return order, nil
+}
+
+/* }}} */
@@ -0,0 +1,51 @@
+package lua
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/* deterministic execution {{{ */
+
+// stoppedClock is the Clock of a deterministic state without Options.Clock.
+type stoppedClock struct{}
+
+func (stoppedClock) Now() time.Time { return time.Unix(0, 0).UTC() }
+
+// setupDeterminism applies Options.Deterministic and Options.Clock.
+func (ls *LState) setupDeterminism() {
+	ls.G.clock = ls.Options.Clock
+	if ls.Options.Deterministic {
+		if ls.G.clock == nil {
+			ls.G.clock = stoppedClock{}
+		}
+		ls.G.rand = rand.New(rand.NewSource(ls.Options.RandomSeed))
+		ls.G.objectIDs = map[LValue]uint64{}
+	}
+	if ls.G.clock != nil {
+		ls.G.clockStart = ls.G.clock.Now()
+	}
+}
+
+// objectString returns lv.String(), with a number in place of the address of
+// a reference type in a deterministic state. The numbered objects are kept
+// alive for the life of the state.
+func (ls *LState) objectString(lv LValue) string {
+	if ls.G.objectIDs == nil {
+		return lv.String()
+	}
+	switch lv.(type) {
+	case *LTable, *LFunction, *LState, *LUserData, LChannel:
+	default:
+		return lv.String()
+	}
+	id, ok := ls.G.objectIDs[lv]
+	if !ok {
+		id = uint64(len(ls.G.objectIDs) + 1)
+		ls.G.objectIDs[lv] = id
+	}
+	return fmt.Sprintf("%s: 0x%08x", lv.Type().String(), id)
+}
+
+/* }}} */
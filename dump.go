@@ -0,0 +1,297 @@
+package lua
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+/* binary chunks {{{ */
+
+// BinaryChunkSignature is the prefix of every binary chunk written by DumpProto.
+// Load, LoadFile and DoFile run binary chunks as well as source code.
+//
+// The format is specific to GopherLua and not compatible with luac. Load
+// checks binary chunks with VerifyProto before they are run, which does not
+// make a chunk from an untrusted source safe to run; see SetChunkVerifier.
+const BinaryChunkSignature = "\x1bGLua"
+
+const binaryChunkVersion = 1
+
+// maxBinaryChunkCount bounds the length of every list in a binary chunk so
+// that a corrupted chunk can not make UndumpProto allocate arbitrary amounts of memory.
+const maxBinaryChunkCount = 1 << 26
+
+const (
+	binaryConstNil byte = iota
+	binaryConstFalse
+	binaryConstTrue
+	binaryConstNumber
+	binaryConstString
+)
+
+type protoDumper struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (d *protoDumper) bytes(b []byte) {
+	if d.err == nil {
+		_, d.err = d.w.Write(b)
+	}
+}
+
+func (d *protoDumper) byte(b byte) {
+	if d.err == nil {
+		d.err = d.w.WriteByte(b)
+	}
+}
+
+func (d *protoDumper) int(i int) {
+	d.bytes(d.buf[:binary.PutVarint(d.buf[:], int64(i))])
+}
+
+func (d *protoDumper) string(s string) {
+	d.int(len(s))
+	if d.err == nil {
+		_, d.err = d.w.WriteString(s)
+	}
+}
+
+func (d *protoDumper) proto(p *FunctionProto) {
+	d.string(p.SourceName)
+	d.int(p.LineDefined)
+	d.int(p.LastLineDefined)
+	d.bytes([]byte{p.NumUpvalues, p.NumParameters, p.IsVarArg, p.NumUsedRegisters})
+
+	d.int(len(p.Code))
+	for _, inst := range p.Code {
+		binary.LittleEndian.PutUint32(d.buf[:4], inst)
+		d.bytes(d.buf[:4])
+	}
+
+	d.int(len(p.Constants))
+	for _, c := range p.Constants {
+		switch v := c.(type) {
+		case *LNilType:
+			d.byte(binaryConstNil)
+		case LBool:
+			if v {
+				d.byte(binaryConstTrue)
+			} else {
+				d.byte(binaryConstFalse)
+			}
+		case LNumber:
+			d.byte(binaryConstNumber)
+			binary.LittleEndian.PutUint64(d.buf[:8], math.Float64bits(float64(v)))
+			d.bytes(d.buf[:8])
+		case LString:
+			d.byte(binaryConstString)
+			d.string(string(v))
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("can not dump a constant of type %v", c.Type().String())
+			}
+		}
+	}
+
+	d.int(len(p.FunctionPrototypes))
+	for _, child := range p.FunctionPrototypes {
+		d.proto(child)
+	}
+
+	d.int(len(p.DbgSourcePositions))
+	for _, pos := range p.DbgSourcePositions {
+		d.int(pos)
+	}
+	d.int(len(p.DbgLocals))
+	for _, local := range p.DbgLocals {
+		d.string(local.Name)
+		d.int(local.StartPc)
+		d.int(local.EndPc)
+	}
+	d.int(len(p.DbgCalls))
+	for _, call := range p.DbgCalls {
+		d.string(call.Name)
+		d.int(call.Pc)
+	}
+	d.int(len(p.DbgUpvalues))
+	for _, name := range p.DbgUpvalues {
+		d.string(name)
+	}
+}
+
+// DumpProto writes proto to w as a binary chunk.
+func DumpProto(w io.Writer, proto *FunctionProto) error {
+	d := &protoDumper{w: bufio.NewWriter(w)}
+	d.bytes([]byte(BinaryChunkSignature))
+	d.bytes([]byte{binaryChunkVersion, LNumberBit / 8})
+	d.proto(proto)
+	if d.err != nil {
+		return d.err
+	}
+	return d.w.Flush()
+}
+
+type protoUndumper struct {
+	r   *bufio.Reader
+	buf [8]byte
+	err error
+}
+
+func (u *protoUndumper) fail(err error) {
+	if u.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		u.err = err
+	}
+}
+
+func (u *protoUndumper) bytes(n int) []byte {
+	if u.err != nil {
+		return u.buf[:n]
+	}
+	if _, err := io.ReadFull(u.r, u.buf[:n]); err != nil {
+		u.fail(err)
+	}
+	return u.buf[:n]
+}
+
+func (u *protoUndumper) byte() byte {
+	return u.bytes(1)[0]
+}
+
+func (u *protoUndumper) int() int {
+	if u.err != nil {
+		return 0
+	}
+	i, err := binary.ReadVarint(u.r)
+	if err != nil {
+		u.fail(err)
+	}
+	return int(i)
+}
+
+func (u *protoUndumper) count() int {
+	n := u.int()
+	if n < 0 || n > maxBinaryChunkCount {
+		u.fail(errors.New("malformed binary chunk"))
+		return 0
+	}
+	return n
+}
+
+// string reads a string. Like readList, it grows the string as its bytes
+// are read.
+func (u *protoUndumper) string() string {
+	n := u.count()
+	if u.err != nil || n == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.Grow(min(n, undumpPrealloc))
+	if _, err := io.CopyN(&b, u.r, int64(n)); err != nil {
+		u.fail(err)
+	}
+	return b.String()
+}
+
+// undumpPrealloc is the number of elements allocated for a list before they
+// are read.
+const undumpPrealloc = 64
+
+// readList reads a count followed by as many elements, read by read. The
+// list grows as the elements are read rather than being allocated from the
+// count, so that a corrupted count fails at the end of the input instead of
+// allocating up to maxBinaryChunkCount elements.
+func readList[T any](u *protoUndumper, read func() T) []T {
+	n := u.count()
+	list := make([]T, 0, min(n, undumpPrealloc))
+	for i := 0; i < n && u.err == nil; i++ {
+		list = append(list, read())
+	}
+	if cap(list) == len(list) {
+		return list
+	}
+	exact := make([]T, len(list))
+	copy(exact, list)
+	return exact
+}
+
+func (u *protoUndumper) proto() *FunctionProto {
+	p := newFunctionProto(u.string())
+	p.LineDefined = u.int()
+	p.LastLineDefined = u.int()
+	header := u.bytes(4)
+	p.NumUpvalues, p.NumParameters, p.IsVarArg, p.NumUsedRegisters = header[0], header[1], header[2], header[3]
+
+	p.Code = readList(u, func() uint32 { return binary.LittleEndian.Uint32(u.bytes(4)) })
+	p.Constants = readList(u, u.constant)
+	p.stringConstants = make([]string, len(p.Constants))
+	for i, c := range p.Constants {
+		if s, ok := c.(LString); ok {
+			p.stringConstants[i] = string(s)
+		}
+	}
+	p.FunctionPrototypes = readList(u, u.proto)
+
+	p.DbgSourcePositions = readList(u, u.int)
+	p.DbgLocals = readList(u, func() *DbgLocalInfo {
+		return &DbgLocalInfo{Name: u.string(), StartPc: u.int(), EndPc: u.int()}
+	})
+	p.DbgCalls = readList(u, func() DbgCall { return DbgCall{Name: u.string(), Pc: u.int()} })
+	p.DbgUpvalues = readList(u, u.string)
+	if u.err == nil && len(p.DbgSourcePositions) != len(p.Code) {
+		u.fail(errors.New("malformed binary chunk"))
+	}
+	return p
+}
+
+func (u *protoUndumper) constant() LValue {
+	switch u.byte() {
+	case binaryConstNil:
+		return LNil
+	case binaryConstFalse:
+		return LFalse
+	case binaryConstTrue:
+		return LTrue
+	case binaryConstNumber:
+		return LNumber(math.Float64frombits(binary.LittleEndian.Uint64(u.bytes(8))))
+	case binaryConstString:
+		return LString(sharedString(u.string()))
+	}
+	u.fail(errors.New("malformed binary chunk"))
+	return LNil
+}
+
+// UndumpProto reads a binary chunk written by DumpProto.
+func UndumpProto(r io.Reader) (*FunctionProto, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	u := &protoUndumper{r: br}
+	signature := make([]byte, len(BinaryChunkSignature))
+	if _, err := io.ReadFull(br, signature); err != nil || string(signature) != BinaryChunkSignature {
+		return nil, errors.New("not a binary chunk")
+	}
+	if version := u.byte(); u.err == nil && version != binaryChunkVersion {
+		return nil, fmt.Errorf("binary chunk version mismatch: got %v, expected %v", version, binaryChunkVersion)
+	}
+	if size := u.byte(); u.err == nil && size != LNumberBit/8 {
+		return nil, fmt.Errorf("binary chunk number size mismatch: got %v, expected %v", size, LNumberBit/8)
+	}
+	proto := u.proto()
+	if u.err != nil {
+		return nil, u.err
+	}
+	return proto, nil
+}
+
+/* }}} */
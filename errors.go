@@ -0,0 +1,210 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/* runtime error categories {{{ */
+
+// The following types classify runtime errors raised by the VM. They are
+// available as the Cause of the *ApiError returned by PCall, DoString and
+// friends, so hosts can inspect them with errors.As:
+//
+//	var ie *lua.IndexError
+//	if errors.As(err, &ie) {
+//		...
+//	}
+//
+// The Lua-visible error value is unchanged: scripts still receive the
+// usual error message string.
+
+// TypeError is raised when a function receives an argument of an unexpected type.
+type TypeError struct {
+	// Function is the name of the function that received the argument.
+	Function string
+	// Arg is the 1-based argument position.
+	Arg int
+	// Expected is a human readable list of the accepted types.
+	Expected string
+	// Value is the offending argument.
+	Value LValue
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("bad argument #%v to %v (%v expected, got %v)", e.Arg, e.Function, e.Expected, e.Value.Type().String())
+}
+
+// ArithmeticError is raised when an arithmetic or concatenation operator is
+// applied to operands that do not support it.
+type ArithmeticError struct {
+	// Op is the operator name without the leading underscores, e.g. "add", "unm", "concat".
+	Op string
+	// Lhs is the left operand, or the operand of a unary operator.
+	Lhs LValue
+	// Rhs is the right operand. It is nil for unary operators.
+	Rhs LValue
+}
+
+func (e *ArithmeticError) Error() string {
+	if e.Rhs == nil {
+		return fmt.Sprintf("cannot perform %v operation on %v", e.Op, e.Lhs.Type().String())
+	}
+	return fmt.Sprintf("cannot perform %v operation between %v and %v", e.Op, e.Lhs.Type().String(), e.Rhs.Type().String())
+}
+
+// IndexError is raised when a value that is not a table and has no __index
+// or __newindex metamethod is indexed.
+type IndexError struct {
+	// Object is the value that was indexed.
+	Object LValue
+	// Key is the key that was used.
+	Key LValue
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("attempt to index a non-table object(%v) with key '%v'", e.Object.Type().String(), e.Key.String())
+}
+
+// CallError is raised when a value that is not callable is called.
+type CallError struct {
+	// Name is the name of the called expression as known to the compiler, or "?".
+	Name string
+	// Value is the value that was called.
+	Value LValue
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("attempt to call a %v value (%v)", e.Value.Type().String(), e.Name)
+}
+
+// StackOverflowError is raised when the call stack or the registry can not grow any more.
+type StackOverflowError struct {
+	// Stack is either "call stack" or "registry".
+	Stack string
+	// Size is the size of the stack when the overflow occurred.
+	Size int
+}
+
+func (e *StackOverflowError) Error() string {
+	return fmt.Sprintf("%v overflow (size %v)", e.Stack, e.Size)
+}
+
+// LimitError is raised when a script exceeds a resource limit set by the host.
+type LimitError struct {
+	// Resource is the name of the exhausted resource, e.g. "memory".
+	Resource string
+	// Limit is the configured limit.
+	Limit int64
+	// Value is the amount that would have been used.
+	Value int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v limit exceeded: %v used, limit is %v", e.Resource, e.Value, e.Limit)
+}
+
+// ErrMemoryLimitExceeded matches, with errors.Is, the *LimitError raised
+// when a script exceeds the limit set by SetMemoryLimit:
+//
+//	if errors.Is(err, lua.ErrMemoryLimitExceeded) {
+//		...
+//	}
+var ErrMemoryLimitExceeded = errors.New("memory limit exceeded")
+
+// ErrMemoryBudgetExceeded matches, with errors.Is, the *LimitError raised
+// when a call made by CallWithBudget exceeds its budget.
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// ErrInstructionLimitExceeded matches, with errors.Is, the *LimitError
+// raised when a script exceeds the limit set by SetInstructionLimit.
+var ErrInstructionLimitExceeded = errors.New("instruction limit exceeded")
+
+// ErrPatternStepLimitExceeded matches, with errors.Is, the *LimitError
+// raised when a pattern match exceeds the limit set by SetPatternStepLimit.
+var ErrPatternStepLimitExceeded = errors.New("pattern step limit exceeded")
+
+// ErrCoroutineLimitExceeded matches, with errors.Is, the *LimitError raised
+// when a script creates more coroutines than allowed by SetMaxCoroutines.
+var ErrCoroutineLimitExceeded = errors.New("coroutine limit exceeded")
+
+// ErrStringTooLong matches, with errors.Is, the *LimitError raised when a
+// script builds a string longer than allowed by SetMaxStringLength.
+var ErrStringTooLong = errors.New("string too long")
+
+// ErrTableTooLarge matches, with errors.Is, the *LimitError raised when a
+// script grows a table beyond the size allowed by SetMaxTableEntries.
+var ErrTableTooLarge = errors.New("table too large")
+
+// Is reports whether target is the sentinel error of the resource of e:
+// ErrMemoryLimitExceeded, ErrMemoryBudgetExceeded,
+// ErrInstructionLimitExceeded, ErrExecutionTimeLimitExceeded,
+// ErrPatternStepLimitExceeded, ErrCoroutineLimitExceeded, ErrStringTooLong,
+// ErrTableTooLarge or ErrCompileLimitExceeded.
+func (e *LimitError) Is(target error) bool {
+	return target == ErrMemoryLimitExceeded && e.Resource == "memory" ||
+		target == ErrMemoryBudgetExceeded && e.Resource == "memory budget" ||
+		target == ErrInstructionLimitExceeded && e.Resource == "instructions" ||
+		target == ErrExecutionTimeLimitExceeded && e.Resource == "execution time" ||
+		target == ErrPatternStepLimitExceeded && e.Resource == "pattern steps" ||
+		target == ErrCoroutineLimitExceeded && e.Resource == "coroutines" ||
+		target == ErrStringTooLong && e.Resource == "string length" ||
+		target == ErrTableTooLarge && e.Resource == "table entries" ||
+		target == ErrCompileLimitExceeded && (e.Resource == "chunk size" || e.Resource == "nesting depth" || e.Resource == "constants")
+}
+
+// InterruptError is raised when a script is interrupted by a signal (see
+// InterruptOnSignal).
+type InterruptError struct {
+	// Signal is the received signal.
+	Signal os.Signal
+}
+
+func (e *InterruptError) Error() string {
+	return fmt.Sprintf("interrupted by signal: %v", e.Signal)
+}
+
+/* }}} */
+
+// raiseTypedError raises a Lua error whose *ApiError carries cause.
+func (ls *LState) raiseTypedError(cause error, format string, args ...interface{}) {
+	ls.errorCause = cause
+	ls.raiseError(1, format, args...)
+}
+
+// raiseContextError raises the error of the done context of this state, so
+// that errors.Is matches it with context.Canceled or
+// context.DeadlineExceeded. If the context was cancelled with a cause, such
+// as an *InterruptError, the cause is raised instead.
+func (ls *LState) raiseContextError() {
+	err := ls.ctx.Err()
+	if cause := context.Cause(ls.ctx); cause != nil && cause != err {
+		ls.raiseTypedError(cause, "%s", cause.Error())
+	}
+	ls.raiseTypedError(err, "%s", err.Error())
+}
+
+// takeErrorCause returns and clears the cause recorded by raiseTypedError.
+func (ls *LState) takeErrorCause() error {
+	cause := ls.errorCause
+	ls.errorCause = nil
+	return cause
+}
+
+// currentCallName returns the name of the function being called by the
+// current Lua frame, as recorded by the compiler.
+func (ls *LState) currentCallName() string {
+	cf := ls.currentFrame
+	if cf == nil || cf.Fn.IsG {
+		return "?"
+	}
+	pc := cf.Pc - 1
+	for _, call := range cf.Fn.Proto.DbgCalls {
+		if call.Pc == pc {
+			return call.Name
+		}
+	}
+	return "?"
+}
@@ -0,0 +1,469 @@
+package lua
+
+import (
+	"sort"
+	"unsafe"
+)
+
+/* size estimation {{{ */
+
+// SizeEstimate is the result of EstimateSize, in bytes.
+type SizeEstimate struct {
+	// Total is the sum of all other fields.
+	Total int64
+	// Tables includes the array and hash parts of every table.
+	Tables int64
+	// TableArrays is the part of Tables used by array parts, TableHashes the
+	// part used by hash parts and table headers.
+	TableArrays int64
+	TableHashes int64
+	// Strings counts every distinct string once. Strings of the shared pool
+	// (see ShareString) only count for their header.
+	Strings int64
+	// SharedStrings is the length of the pooled strings referenced by the
+	// state. It is not included in Total since the pool is shared by all
+	// states.
+	SharedStrings int64
+	// Functions includes closures and their upvalues, but not their prototypes.
+	Functions int64
+	// Protos holds compiled code: instructions, constants and debug information.
+	Protos int64
+	// UserData only includes the Go values stored in userdata that were
+	// created by NewUserDataWithSize.
+	UserData int64
+	// Threads includes the registry and call stack of every reachable thread.
+	Threads int64
+	// Channels includes channel buffers, but not the values queued in them.
+	Channels int64
+	// Objects is the number of distinct objects that were visited.
+	Objects int
+}
+
+// Sizes of the objects that the SizingModel does not cover. Other objects
+// are sized by the model of the incremental accounting (see TrackAlloc) so
+// that both can be compared.
+const (
+	sizeofLValue  = 16 // an interface value
+	sizeofString  = 16 // a string header
+	sizeofChannel = 96
+	sizeofUpvalue = int64(unsafe.Sizeof(Upvalue{}))
+)
+
+type sizeEstimator struct {
+	m       *SizingModel
+	est     SizeEstimate
+	counts  objectCounts
+	visited map[interface{}]struct{}
+	strings map[*byte]struct{}
+	pending []LValue
+}
+
+// objectCounts counts the objects visited by a sizeEstimator by kind.
+type objectCounts struct {
+	tables, strings, closures, userData, coroutines, channels int
+}
+
+// EstimateSize walks every object reachable from the globals, the registry
+// and the stack of this state and adds up their sizes. Shared and cyclic
+// references are counted once.
+//
+// Unlike GetAllocatedBytes, which is updated incrementally as objects are
+// created and only decreases when weak tables are collected, the estimate
+// reflects what is retained right now. Comparing both helps calibrating
+// memory limits and detecting drift in long-lived states. Walking a large state is expensive, so do not call this
+// on a hot path.
+func (ls *LState) EstimateSize() *SizeEstimate {
+	return &ls.estimate().est
+}
+
+// estimate walks the state for EstimateSize. The tainted strings, see
+// Taint, count as well since the state keeps them.
+func (ls *LState) estimate() *sizeEstimator {
+	e := ls.walk()
+	if ls.G.taint != nil {
+		for _, s := range ls.G.taint.strs {
+			e.string(s)
+		}
+		e.drain()
+	}
+	return e
+}
+
+// walk visits everything reachable from the roots of the state.
+func (ls *LState) walk() *sizeEstimator {
+	e := ls.newSizeEstimator()
+	e.push(ls.G.Registry)
+	if ls.G.hostRegistry != nil {
+		e.push(ls.G.hostRegistry)
+	}
+	e.push(ls.G.Global)
+	e.push(ls.Env)
+	for _, mt := range ls.G.builtinMts {
+		e.push(mt)
+	}
+	e.push(ls)
+	if ls.G.MainThread != nil {
+		e.push(ls.G.MainThread)
+	}
+	e.drain()
+	return e
+}
+
+func (ls *LState) newSizeEstimator() *sizeEstimator {
+	return &sizeEstimator{
+		m:       ls.sizing(),
+		visited: map[interface{}]struct{}{},
+		strings: map[*byte]struct{}{},
+	}
+}
+
+// drain visits the pending values and updates the total.
+func (e *sizeEstimator) drain() {
+	for len(e.pending) > 0 {
+		lv := e.pending[len(e.pending)-1]
+		e.pending = e.pending[:len(e.pending)-1]
+		e.visit(lv)
+	}
+	e.est.Total = e.est.Tables + e.est.Strings + e.est.Functions + e.est.Protos + e.est.UserData + e.est.Threads + e.est.Channels
+}
+
+// MemoryCategory is an entry of MemoryBreakdown.
+type MemoryCategory struct {
+	// Name is one of "table arrays", "table hashes", "strings", "closures",
+	// "prototypes", "userdata", "coroutines" and "channels".
+	Name  string
+	Bytes int64
+}
+
+// MemoryBreakdown tells what the memory retained by this state is made of,
+// largest category first. It is based on EstimateSize and shares its cost,
+// so it is meant to explain a failure, such as a script hitting its memory
+// limit, rather than for monitoring. Coroutines include the main thread.
+func (ls *LState) MemoryBreakdown() []MemoryCategory {
+	categories := ls.EstimateSize().categories()
+	sort.SliceStable(categories, func(i, j int) bool { return categories[i].Bytes > categories[j].Bytes })
+	return categories
+}
+
+// MemoryStats is returned by GetMemoryStats.
+type MemoryStats struct {
+	// AllocatedBytes and PeakAllocatedBytes are the bytes charged to the
+	// state, see GetAllocatedBytes and GetPeakAllocatedBytes.
+	AllocatedBytes     int64
+	PeakAllocatedBytes int64
+	// Tables, Strings, Closures, UserData, Coroutines and Channels are the
+	// numbers of live objects of each kind, those reachable from the state.
+	// Equal strings are counted once if they share their bytes. Coroutines do
+	// not include the main thread.
+	Tables     int
+	Strings    int
+	Closures   int
+	UserData   int
+	Coroutines int
+	Channels   int
+	// Size is the size of the live objects, in total and by category.
+	Size SizeEstimate
+}
+
+// GetMemoryStats returns the number of live objects of each kind and their
+// size as computed by EstimateSize, along with the bytes charged to the
+// state. Like EstimateSize, it walks the whole state, so it suits periodic
+// monitoring, e.g. per tenant, rather than a hot path.
+func (ls *LState) GetMemoryStats() *MemoryStats {
+	e := ls.estimate()
+	return &MemoryStats{
+		AllocatedBytes:     ls.GetAllocatedBytes(),
+		PeakAllocatedBytes: ls.GetPeakAllocatedBytes(),
+		Tables:             e.counts.tables,
+		Strings:            e.counts.strings,
+		Closures:           e.counts.closures,
+		UserData:           e.counts.userData,
+		Coroutines:         e.counts.coroutines,
+		Channels:           e.counts.channels,
+		Size:               e.est,
+	}
+}
+
+func (est *SizeEstimate) categories() []MemoryCategory {
+	return []MemoryCategory{
+		{"table arrays", est.TableArrays},
+		{"table hashes", est.TableHashes},
+		{"strings", est.Strings},
+		{"closures", est.Functions},
+		{"prototypes", est.Protos},
+		{"userdata", est.UserData},
+		{"coroutines", est.Threads},
+		{"channels", est.Channels},
+	}
+}
+
+func (e *sizeEstimator) push(lv LValue) {
+	if lv != nil && lv != LNil {
+		e.pending = append(e.pending, lv)
+	}
+}
+
+func (e *sizeEstimator) firstVisit(obj interface{}) bool {
+	if _, ok := e.visited[obj]; ok {
+		return false
+	}
+	e.visited[obj] = struct{}{}
+	e.est.Objects++
+	return true
+}
+
+func (e *sizeEstimator) string(s string) {
+	if len(s) == 0 {
+		return
+	}
+	data := unsafe.StringData(s)
+	if _, ok := e.strings[data]; ok {
+		return
+	}
+	e.strings[data] = struct{}{}
+	e.est.Objects++
+	e.counts.strings++
+	if isSharedString(s) {
+		e.est.Strings += e.m.StringHeader
+		e.est.SharedStrings += int64(len(s))
+		return
+	}
+	e.est.Strings += int64(len(s)) + e.m.StringHeader
+}
+
+func (e *sizeEstimator) visit(lv LValue) {
+	switch v := lv.(type) {
+	case LString:
+		e.string(string(v))
+	case *LTable:
+		if !e.firstVisit(v) {
+			return
+		}
+		e.counts.tables++
+		array := int64(cap(v.array)) * e.m.ArraySlot
+		hash := e.m.Table + int64(len(v.strdict)+len(v.dict)+len(v.s2i))*e.m.HashEntry + int64(cap(v.sorted))*e.m.ArraySlot
+		e.est.Tables += array + hash
+		e.est.TableArrays += array
+		e.est.TableHashes += hash
+		e.push(v.Metatable)
+		for _, value := range v.array {
+			e.push(value)
+		}
+		for key, value := range v.strdict {
+			e.string(key)
+			e.push(value)
+		}
+		for key, value := range v.dict {
+			e.push(key)
+			e.push(value)
+		}
+	case *LFunction:
+		if !e.firstVisit(v) {
+			return
+		}
+		e.counts.closures++
+		e.est.Functions += e.m.Closure + int64(len(v.Upvalues))*e.m.Upvalue
+		if v.Env != nil {
+			e.push(v.Env)
+		}
+		for _, uv := range v.Upvalues {
+			if uv != nil && e.firstVisit(uv) {
+				e.est.Functions += sizeofUpvalue
+				e.push(uv.Value())
+			}
+		}
+		if v.Proto != nil {
+			e.proto(v.Proto)
+		}
+	case *LUserData:
+		if !e.firstVisit(v) {
+			return
+		}
+		e.counts.userData++
+		e.est.UserData += e.m.UserData + v.size
+		if v.Env != nil {
+			e.push(v.Env)
+		}
+		e.push(v.Metatable)
+	case *LState:
+		if !e.firstVisit(v) {
+			return
+		}
+		if v.memParent != nil {
+			e.counts.coroutines++
+		}
+		e.est.Threads += e.m.Thread
+		if v.reg != nil {
+			e.est.Threads += int64(cap(v.reg.array)) * e.m.ArraySlot
+			for i := 0; i < v.reg.top && i < len(v.reg.array); i++ {
+				e.push(v.reg.array[i])
+			}
+		}
+		if v.Env != nil {
+			e.push(v.Env)
+		}
+		for cf := v.currentFrame; cf != nil; cf = cf.Parent {
+			e.est.Threads += e.m.CallFrame
+			if cf.Fn != nil {
+				e.push(cf.Fn)
+			}
+		}
+	case LChannel:
+		if e.firstVisit(v) {
+			e.counts.channels++
+			e.est.Channels += sizeofChannel + int64(cap(v))*sizeofLValue
+		}
+	}
+}
+
+func (e *sizeEstimator) proto(p *FunctionProto) {
+	if !e.firstVisit(p) {
+		return
+	}
+	e.est.Protos += protoSize(p)
+	for _, c := range p.Constants {
+		if s, ok := c.(LString); ok {
+			e.string(string(s))
+		}
+	}
+	for _, child := range p.FunctionPrototypes {
+		e.proto(child)
+	}
+}
+
+// protoSize returns the size of the code and debug information of p,
+// without its string constants and child prototypes.
+func protoSize(p *FunctionProto) int64 {
+	size := int64(unsafe.Sizeof(*p)) + int64(cap(p.Code))*4 + int64(cap(p.Constants))*sizeofLValue +
+		int64(cap(p.DbgSourcePositions))*8 + int64(len(p.DbgLocals))*int64(unsafe.Sizeof(DbgLocalInfo{})+8) +
+		int64(cap(p.DbgCalls))*int64(unsafe.Sizeof(DbgCall{})) + int64(cap(p.DbgUpvalues)+cap(p.stringConstants))*sizeofString
+	for _, local := range p.DbgLocals {
+		size += int64(len(local.Name))
+	}
+	for _, name := range p.DbgUpvalues {
+		size += int64(len(name))
+	}
+	return size
+}
+
+/* }}} */
+
+/* memory snapshots {{{ */
+
+// MemorySnapshot records what the memory retained by a state is made of, to
+// be compared with a later snapshot by DiffMemory.
+type MemorySnapshot struct {
+	total      int64
+	categories map[string]int64
+	globals    map[string]int64
+}
+
+// Total returns the bytes retained when the snapshot was taken, as computed
+// by EstimateSize.
+func (s *MemorySnapshot) Total() int64 {
+	return s.total
+}
+
+// MemorySnapshot takes a snapshot of the memory retained by this state. It
+// walks the state like EstimateSize and has the same cost. Besides the
+// categories of MemoryBreakdown, it records the bytes retained through each
+// global variable other than _G. An object reachable from several globals
+// is attributed to the first one in sorted order.
+func (ls *LState) MemorySnapshot() *MemorySnapshot {
+	s := &MemorySnapshot{categories: map[string]int64{}, globals: map[string]int64{}}
+	e := ls.newSizeEstimator()
+	var names []string
+	values := map[string]LValue{}
+	ls.G.Global.ForEach(func(key, value LValue) {
+		if name, ok := key.(LString); ok && value != ls.G.Global {
+			names = append(names, string(name))
+			values[string(name)] = value
+		}
+	})
+	sort.Strings(names)
+	// functions refer to the globals through their environment, keep the
+	// walk from going back to all the globals
+	e.visited[ls.G.Global] = struct{}{}
+	for _, name := range names {
+		before := e.est.Total
+		e.push(values[name])
+		e.drain()
+		s.globals[name] = e.est.Total - before
+	}
+	delete(e.visited, ls.G.Global)
+
+	e.push(ls.G.Registry)
+	if ls.G.hostRegistry != nil {
+		e.push(ls.G.hostRegistry)
+	}
+	e.push(ls.G.Global)
+	e.push(ls.Env)
+	for _, mt := range ls.G.builtinMts {
+		e.push(mt)
+	}
+	e.push(ls)
+	if ls.G.MainThread != nil {
+		e.push(ls.G.MainThread)
+	}
+	e.drain()
+	s.total = e.est.Total
+	for _, c := range e.est.categories() {
+		s.categories[c.Name] = c.Bytes
+	}
+	return s
+}
+
+// MemoryGrowth is an entry of a MemoryDiff.
+type MemoryGrowth struct {
+	// Name is a category of MemoryBreakdown or the name of a global variable.
+	Name   string
+	Before int64
+	After  int64
+	// Delta is After - Before, negative if the memory shrank.
+	Delta int64
+}
+
+// MemoryDiff is the result of DiffMemory.
+type MemoryDiff struct {
+	// Total is the change of the retained bytes.
+	Total int64
+	// Categories and Globals list the categories and global variables whose
+	// size changed, largest growth first. A global that was created or
+	// deleted has a Before or After of 0.
+	Categories []MemoryGrowth
+	Globals    []MemoryGrowth
+}
+
+// DiffMemory compares two snapshots of the same state, for instance taken
+// before and after the requests handled by a long-lived state, to find
+// which global variable or kind of object keeps growing.
+func DiffMemory(before, after *MemorySnapshot) *MemoryDiff {
+	return &MemoryDiff{
+		Total:      after.total - before.total,
+		Categories: diffSizes(before.categories, after.categories),
+		Globals:    diffSizes(before.globals, after.globals),
+	}
+}
+
+func diffSizes(before, after map[string]int64) []MemoryGrowth {
+	var growth []MemoryGrowth
+	for name, old := range before {
+		if cur := after[name]; cur != old {
+			growth = append(growth, MemoryGrowth{Name: name, Before: old, After: cur, Delta: cur - old})
+		}
+	}
+	for name, cur := range after {
+		if _, ok := before[name]; !ok && cur != 0 {
+			growth = append(growth, MemoryGrowth{Name: name, After: cur, Delta: cur})
+		}
+	}
+	sort.Slice(growth, func(i, j int) bool {
+		if growth[i].Delta != growth[j].Delta {
+			return growth[i].Delta > growth[j].Delta
+		}
+		return growth[i].Name < growth[j].Name
+	})
+	return growth
+}
+
+/* }}} */
@@ -0,0 +1,103 @@
+package lua
+
+import (
+	"errors"
+	"time"
+)
+
+/* execution time limit {{{ */
+
+// ErrExecutionTimeLimitExceeded matches, with errors.Is, the *LimitError
+// raised when a script exceeds the limit set by SetExecutionTimeLimit.
+var ErrExecutionTimeLimitExceeded = errors.New("execution time limit exceeded")
+
+// execClock measures the time spent running Lua code. It runs while a main
+// loop executes and is paused while a Go function is called.
+type execClock struct {
+	limit   time.Duration
+	used    time.Duration
+	since   time.Time
+	running bool
+}
+
+// execClockInterval is the number of instructions between two checks of the
+// clock, which is too slow to read at every instruction.
+const execClockInterval = 256
+
+func (c *execClock) resume() bool {
+	if c.running {
+		return false
+	}
+	c.since = time.Now()
+	c.running = true
+	return true
+}
+
+func (c *execClock) pause() bool {
+	if !c.running {
+		return false
+	}
+	c.used += time.Since(c.since)
+	c.running = false
+	return true
+}
+
+func (c *execClock) elapsed() time.Duration {
+	if c.running {
+		return c.used + time.Since(c.since)
+	}
+	return c.used
+}
+
+// check raises an error in L once the clock went past its limit.
+func (c *execClock) check(L *LState) {
+	if used := c.elapsed(); used > c.limit {
+		L.raiseTypedError(&LimitError{Resource: "execution time", Limit: int64(c.limit), Value: int64(used)},
+			"execution time limit exceeded: ran for %v, limit is %v", used, c.limit)
+	}
+}
+
+// SetExecutionTimeLimit aborts scripts once they have run for d in total,
+// with a *LimitError whose Resource is "execution time" and whose Limit
+// and Value are in nanoseconds, matched by ErrExecutionTimeLimitExceeded.
+// Only the time spent executing Lua code counts: the clock stops while a Go
+// function runs, e.g. while a library function blocks on I/O, and resumes
+// when it returns or calls back into Lua. The time accumulates across calls
+// and the threads of this state until ResetExecutionTime. Threads created
+// before the limit was set are not measured. A limit of 0 removes it.
+//
+// Unlike a context deadline, the limit is a policy of the state that needs
+// no plumbing, but it is not deterministic; see SetInstructionLimit for a
+// limit that is.
+func (ls *LState) SetExecutionTimeLimit(d time.Duration) {
+	if d <= 0 {
+		ls.G.execClock = nil
+	} else if ls.G.execClock == nil {
+		ls.G.execClock = &execClock{limit: d}
+	} else {
+		ls.G.execClock.limit = d
+	}
+	ls.updateMainLoop()
+}
+
+// GetExecutionTime returns the time spent running Lua code since the limit
+// was set or ResetExecutionTime was called, or 0 if no limit is set.
+func (ls *LState) GetExecutionTime() time.Duration {
+	if ls.G.execClock == nil {
+		return 0
+	}
+	return ls.G.execClock.elapsed()
+}
+
+// ResetExecutionTime sets the time counted against the limit set by
+// SetExecutionTimeLimit back to zero.
+func (ls *LState) ResetExecutionTime() {
+	if c := ls.G.execClock; c != nil {
+		c.used = 0
+		if c.running {
+			c.since = time.Now()
+		}
+	}
+}
+
+/* }}} */
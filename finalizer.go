@@ -0,0 +1,142 @@
+//go:build go1.24 && !tinygo
+
+package lua
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"weak"
+)
+
+/* userdata finalizers {{{ */
+
+// finalizersOnGC reports whether finalizers run when Go's garbage collector
+// finds the userdata unreachable, which needs weak pointers.
+const finalizersOnGC = true
+
+var finalizerMu sync.Mutex
+
+type userDataFinalizer struct {
+	seq  uint64
+	ud   weak.Pointer[LUserData]
+	fn   func(interface{})
+	done bool
+}
+
+type finalizerSet struct {
+	seq     uint64
+	entries map[*userDataFinalizer]struct{}
+}
+
+// SetUserDataFinalizer arranges for fn to be called with the Value of ud
+// once ud is no longer reachable, or when the LState that created ud is
+// closed, whichever comes first. fn is called at most once. When ud becomes
+// unreachable, fn runs on the goroutine of Go's garbage collector finalizers,
+// so it must not use the LState. Calling SetUserDataFinalizer again replaces
+// the finalizer, and a nil fn removes it.
+//
+// This lets hosts release files, connections and other resources held by
+// userdata whose scripts never call an explicit close method.
+func SetUserDataFinalizer(ud *LUserData, fn func(v interface{})) {
+	finalizerMu.Lock()
+	defer finalizerMu.Unlock()
+	if ud.fin != nil {
+		if fn != nil {
+			ud.fin.fn = fn
+			return
+		}
+		ud.fin.done = true
+		if ud.g != nil && ud.g.finalizers != nil {
+			delete(ud.g.finalizers.entries, ud.fin)
+		}
+		ud.fin = nil
+		runtime.SetFinalizer(ud, nil)
+		return
+	}
+	if fn == nil {
+		return
+	}
+	fin := &userDataFinalizer{ud: weak.Make(ud), fn: fn}
+	ud.fin = fin
+	if ud.g != nil {
+		if ud.g.finalizers == nil {
+			ud.g.finalizers = &finalizerSet{entries: map[*userDataFinalizer]struct{}{}}
+		}
+		ud.g.finalizers.seq++
+		fin.seq = ud.g.finalizers.seq
+		ud.g.finalizers.entries[fin] = struct{}{}
+	}
+	runtime.SetFinalizer(ud, finalizeUserData)
+}
+
+func finalizeUserData(ud *LUserData) {
+	finalizerMu.Lock()
+	fin := ud.fin
+	if fin == nil || fin.done {
+		finalizerMu.Unlock()
+		return
+	}
+	fin.done = true
+	if ud.g != nil && ud.g.finalizers != nil {
+		delete(ud.g.finalizers.entries, fin)
+	}
+	finalizerMu.Unlock()
+	fin.fn(ud.Value)
+}
+
+// runFinalizers calls the finalizers of every userdata created by g that is
+// still alive, most recently registered first.
+func (g *Global) runFinalizers() {
+	finalizerMu.Lock()
+	if g.finalizers == nil {
+		finalizerMu.Unlock()
+		return
+	}
+	var uds []*LUserData
+	for fin := range g.finalizers.entries {
+		// a nil pointer means Go's garbage collector already queued the
+		// finalizer of the userdata
+		if ud := fin.ud.Value(); ud != nil {
+			fin.done = true
+			runtime.SetFinalizer(ud, nil)
+			uds = append(uds, ud)
+		}
+	}
+	g.finalizers = nil
+	finalizerMu.Unlock()
+
+	sort.Slice(uds, func(i, j int) bool { return uds[i].fin.seq > uds[j].fin.seq })
+	for _, ud := range uds {
+		ud.fin.fn(ud.Value)
+	}
+}
+
+// finalizeUnreachable calls the finalizers of the userdata created by g for
+// which live returns false, most recently registered first, and returns how
+// many were called.
+func (g *Global) finalizeUnreachable(live func(*LUserData) bool) int {
+	finalizerMu.Lock()
+	if g.finalizers == nil {
+		finalizerMu.Unlock()
+		return 0
+	}
+	var uds []*LUserData
+	for fin := range g.finalizers.entries {
+		if ud := fin.ud.Value(); ud != nil && !live(ud) {
+			fin.done = true
+			delete(g.finalizers.entries, fin)
+			runtime.SetFinalizer(ud, nil)
+			uds = append(uds, ud)
+		}
+	}
+	finalizerMu.Unlock()
+
+	sort.Slice(uds, func(i, j int) bool { return uds[i].fin.seq > uds[j].fin.seq })
+	for _, ud := range uds {
+		ud.fin.fn(ud.Value)
+	}
+	return len(uds)
+}
+
+/* }}} */
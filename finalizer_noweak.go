@@ -0,0 +1,93 @@
+//go:build tinygo || !go1.24
+
+package lua
+
+import (
+	"sync"
+)
+
+/* userdata finalizers {{{ */
+
+// TinyGo and Go before 1.24 have no weak pointers, which the state needs to
+// find the userdata whose finalizers must run when it is closed without
+// keeping them alive. Userdata with a finalizer are kept instead, and their
+// finalizers run when the LState that created them is closed, or when
+// collectgarbage finds them unreachable.
+
+const finalizersOnGC = false
+
+var finalizerMu sync.Mutex
+
+type userDataFinalizer struct {
+	fn func(interface{})
+}
+
+type finalizerSet struct {
+	uds []*LUserData
+}
+
+// SetUserDataFinalizer arranges for fn to be called with the Value of ud when
+// the LState that created ud is closed, or when collectgarbage finds ud
+// unreachable. Calling SetUserDataFinalizer again replaces the finalizer, and
+// a nil fn removes it.
+func SetUserDataFinalizer(ud *LUserData, fn func(v interface{})) {
+	finalizerMu.Lock()
+	defer finalizerMu.Unlock()
+	if ud.fin != nil {
+		ud.fin.fn = fn
+		return
+	}
+	if fn == nil || ud.g == nil {
+		return
+	}
+	ud.fin = &userDataFinalizer{fn: fn}
+	if ud.g.finalizers == nil {
+		ud.g.finalizers = &finalizerSet{}
+	}
+	ud.g.finalizers.uds = append(ud.g.finalizers.uds, ud)
+}
+
+func (g *Global) runFinalizers() {
+	finalizerMu.Lock()
+	if g.finalizers == nil {
+		finalizerMu.Unlock()
+		return
+	}
+	uds := g.finalizers.uds
+	g.finalizers = nil
+	finalizerMu.Unlock()
+
+	for i := len(uds) - 1; i >= 0; i-- {
+		if fn := uds[i].fin.fn; fn != nil {
+			fn(uds[i].Value)
+		}
+	}
+}
+
+func (g *Global) finalizeUnreachable(live func(*LUserData) bool) int {
+	finalizerMu.Lock()
+	if g.finalizers == nil {
+		finalizerMu.Unlock()
+		return 0
+	}
+	var dead []*LUserData
+	uds := g.finalizers.uds[:0]
+	for _, ud := range g.finalizers.uds {
+		if live(ud) {
+			uds = append(uds, ud)
+		} else {
+			dead = append(dead, ud)
+		}
+	}
+	g.finalizers.uds = uds
+	finalizerMu.Unlock()
+
+	for i := len(dead) - 1; i >= 0; i-- {
+		if fn := dead[i].fin.fn; fn != nil {
+			fn(dead[i].Value)
+		}
+	}
+	return len(dead)
+}
+
+/* }}} */
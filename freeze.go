@@ -0,0 +1,50 @@
+package lua
+
+/* frozen tables {{{ */
+
+// FreezeTable makes tb read-only, like SetTableReadOnly, together with the
+// tables reachable from its keys, its values and its metatable. It prepares
+// the tables so that reading them, iterating over them included, does not
+// change them: a frozen table, such as a configuration shared by many
+// untrusted scripts, can be used by states that run on other goroutines
+// without being copied. SetTableReadOnly makes a frozen table writable again.
+func (ls *LState) FreezeTable(tb *LTable) {
+	visited := map[*LTable]struct{}{}
+	pending := []*LTable{tb}
+	for len(pending) > 0 {
+		tb := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := visited[tb]; ok {
+			continue
+		}
+		visited[tb] = struct{}{}
+		ls.SetTableReadOnly(tb, true)
+		if order := tb.iterationOrder(); order == IterationSorted {
+			tb.hashKeys(order)
+		}
+		push := func(lv LValue) {
+			if t, ok := lv.(*LTable); ok {
+				pending = append(pending, t)
+			}
+		}
+		push(tb.Metatable)
+		tb.ForEach(func(key, value LValue) {
+			push(key)
+			push(value)
+		})
+	}
+}
+
+func tableFreeze(L *LState) int {
+	tb := L.CheckTable(1)
+	L.SetTableReadOnly(tb, true)
+	L.SetTop(1)
+	return 1
+}
+
+func tableIsFrozen(L *LState) int {
+	L.Push(LBool(L.CheckTable(1).readonly))
+	return 1
+}
+
+/* }}} */
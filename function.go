@@ -3,7 +3,6 @@ package lua
 import (
 	"fmt"
 	"strings"
-	"unsafe"
 )
 
 const (
@@ -156,9 +155,10 @@ func (fp *FunctionProto) str(level int, count int) string {
 // newLFunctionL creates a new Lua function with memory tracking.
 func (ls *LState) newLFunctionL(proto *FunctionProto, env *LTable, nupvalue int) *LFunction {
 	// Calculate memory: base struct + upvalues slice
-	size := int64(unsafe.Sizeof(LFunction{})) + int64(nupvalue)*8
+	m := ls.sizing()
+	size := m.Closure + int64(nupvalue)*m.Upvalue
 
-	ls.TrackAlloc(size)
+	ls.trackAlloc(AllocFunction, size)
 
 	return &LFunction{
 		IsG: false,
@@ -173,9 +173,10 @@ func (ls *LState) newLFunctionL(proto *FunctionProto, env *LTable, nupvalue int)
 // newLFunctionG creates a new Go function with memory tracking.
 func (ls *LState) newLFunctionG(gfunc LGFunction, env *LTable, nupvalue int) *LFunction {
 	// Calculate memory: base struct + upvalues slice
-	size := int64(unsafe.Sizeof(LFunction{})) + int64(nupvalue)*8
+	m := ls.sizing()
+	size := m.Closure + int64(nupvalue)*m.Upvalue
 
-	ls.TrackAlloc(size)
+	ls.trackAlloc(AllocFunction, size)
 
 	return &LFunction{
 		IsG: true,
@@ -0,0 +1,220 @@
+// Package fuzz provides fuzzing entry points for GopherLua.
+//
+// Every target comes in two flavours: a go-fuzz style function taking the
+// raw input and returning 1 if the input was valid (so go-fuzz can prioritise
+// it), 0 otherwise, and a native Go fuzz test helper:
+//
+//	func FuzzParse(f *testing.F) { fuzz.FuzzParse(f) }
+//
+// A target only fails by panicking, which means a bug in GopherLua.
+package fuzz
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+// MaxInputSize is the largest input the targets look at. Longer inputs are
+// ignored so that pathological patterns do not report slow inputs as hangs.
+var MaxInputSize = 1 << 16
+
+/* go-fuzz entry points {{{ */
+
+// Lex scans data as Lua source code until the end of input or the first error.
+func Lex(data []byte) int {
+	if len(data) > MaxInputSize {
+		return 0
+	}
+	sc := parse.NewScanner(bytes.NewReader(data), "fuzz")
+	lexer := &parse.Lexer{}
+	for i := 0; ; i++ {
+		if i > len(data)+1 {
+			panic("lexer does not make progress")
+		}
+		tok, err := sc.Scan(lexer)
+		if err != nil {
+			return 0
+		}
+		if tok.Type == parse.EOF {
+			return 1
+		}
+		lexer.PrevTokenType = tok.Type
+	}
+}
+
+// Parse parses data as a Lua chunk.
+func Parse(data []byte) int {
+	if len(data) > MaxInputSize {
+		return 0
+	}
+	if _, err := parse.Parse(bytes.NewReader(data), "fuzz"); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// Compile parses and compiles data as a Lua chunk, and checks that the
+// result survives a binary chunk round trip.
+func Compile(data []byte) int {
+	if len(data) > MaxInputSize {
+		return 0
+	}
+	chunk, err := parse.Parse(bytes.NewReader(data), "fuzz")
+	if err != nil {
+		return 0
+	}
+	proto, err := lua.Compile(chunk, "fuzz")
+	if err != nil {
+		return 0
+	}
+	var buf bytes.Buffer
+	if err := lua.DumpProto(&buf, proto); err != nil {
+		panic(err)
+	}
+	proto2, err := lua.UndumpProto(&buf)
+	if err != nil {
+		panic(err)
+	}
+	if proto.String() != proto2.String() {
+		panic("binary chunk does not round trip")
+	}
+	return 1
+}
+
+// Pattern matches a Lua pattern against a subject. The input is split at the
+// first zero byte into the pattern and the subject.
+func Pattern(data []byte) int {
+	if len(data) > MaxInputSize {
+		return 0
+	}
+	pattern, subject := data, []byte{}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		pattern, subject = data[:i], data[i+1:]
+	}
+	if _, err := pm.Find(string(pattern), subject, 0, -1); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// Undump reads data as a binary chunk.
+func Undump(data []byte) int {
+	if len(data) > MaxInputSize {
+		return 0
+	}
+	if _, err := lua.UndumpProto(bytes.NewReader(data)); err != nil {
+		return 0
+	}
+	return 1
+}
+
+/* }}} */
+
+/* native fuzzing {{{ */
+
+// Seeds returns a small corpus of Lua snippets that exercise most of the
+// syntax. It is used by the Fuzz* helpers.
+func Seeds() [][]byte {
+	seeds := make([][]byte, len(seedSources))
+	for i, src := range seedSources {
+		seeds[i] = []byte(src)
+	}
+	return seeds
+}
+
+var seedSources = []string{
+	``,
+	`local a, b = 1, "two" -- comment`,
+	`return function(...) local t = {...}; return #t, select("#", ...) end`,
+	`for i = 1, 10, 2 do if i % 3 == 0 then break elseif i > 5 then goto done end end ::done::`,
+	`local t = {1, 2, x = 3, ["y"] = {}, [4] = 5.5e3, 0x1F}; t.x = t[1] .. t.y`,
+	`while true do repeat local x = not nil and 1 or 2 until x end end`,
+	`local s = [==[long
+string]==] .. "esc\n\t\"\065" --[[ block
+comment ]]`,
+	`local o = setmetatable({}, {__index = function(t, k) return k end}); o:method(1)(2)`,
+	"%a+%d*\x00hello123 world",
+	"(%w+)=(%w+)\x00key=value, a=b",
+	"%b()\x00(nested (parens))",
+	"[^%s]-$\x00trailing  ",
+}
+
+// AddSeeds adds Seeds and every file in the given directories to the corpus of f.
+func AddSeeds(f *testing.F, dirs ...string) {
+	for _, seed := range Seeds() {
+		f.Add(seed)
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(data)
+		}
+	}
+}
+
+// WriteCorpus writes Seeds to dir, one file per seed, to bootstrap a go-fuzz corpus.
+func WriteCorpus(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, seed := range Seeds() {
+		if err := os.WriteFile(filepath.Join(dir, "seed"+strconv.Itoa(i)), seed, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fuzzTarget(f *testing.F, target func([]byte) int, dirs []string) {
+	AddSeeds(f, dirs...)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		target(data)
+	})
+}
+
+// FuzzLex runs Lex as a native fuzz test. dirs are optional corpus directories.
+func FuzzLex(f *testing.F, dirs ...string) { fuzzTarget(f, Lex, dirs) }
+
+// FuzzParse runs Parse as a native fuzz test. dirs are optional corpus directories.
+func FuzzParse(f *testing.F, dirs ...string) { fuzzTarget(f, Parse, dirs) }
+
+// FuzzCompile runs Compile as a native fuzz test. dirs are optional corpus directories.
+func FuzzCompile(f *testing.F, dirs ...string) { fuzzTarget(f, Compile, dirs) }
+
+// FuzzPattern runs Pattern as a native fuzz test. dirs are optional corpus directories.
+func FuzzPattern(f *testing.F, dirs ...string) { fuzzTarget(f, Pattern, dirs) }
+
+// FuzzUndump runs Undump as a native fuzz test. dirs are optional corpus
+// directories. The seeds are added as binary chunks.
+func FuzzUndump(f *testing.F, dirs ...string) {
+	for _, seed := range Seeds() {
+		if chunk, err := parse.Parse(bytes.NewReader(seed), "seed"); err == nil {
+			if proto, err := lua.Compile(chunk, "seed"); err == nil {
+				var buf bytes.Buffer
+				if lua.DumpProto(&buf, proto) == nil {
+					f.Add(buf.Bytes())
+				}
+			}
+		}
+	}
+	fuzzTarget(f, Undump, dirs)
+}
+
+/* }}} */
@@ -0,0 +1,18 @@
+package fuzz
+
+import (
+	"testing"
+)
+
+func FuzzLexer(f *testing.F)    { FuzzLex(f) }
+func FuzzParser(f *testing.F)   { FuzzParse(f, "../_glua-tests") }
+func FuzzCompiler(f *testing.F) { FuzzCompile(f, "../_glua-tests") }
+func FuzzPatterns(f *testing.F) { FuzzPattern(f) }
+func FuzzUndumper(f *testing.F) { FuzzUndump(f) }
+
+func TestWriteCorpus(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteCorpus(dir); err != nil {
+		t.Fatal(err)
+	}
+}
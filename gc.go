@@ -0,0 +1,112 @@
+package lua
+
+/* explicit collection {{{ */
+
+// CollectStats is the result of CollectGarbage.
+type CollectStats struct {
+	// Finalized is the number of unreachable userdata whose finalizer was
+	// called.
+	Finalized int
+	// WeakEntries is the number of entries removed from weak tables.
+	WeakEntries int
+	// Before and After are the bytes charged to the state before and after
+	// the collection, see GetAllocatedBytes.
+	Before int64
+	After  int64
+}
+
+// CollectGarbage walks everything reachable from the globals, the registry
+// and the stack of this state, calls the finalizers (see
+// SetUserDataFinalizer) of the userdata that can no longer be reached,
+// removes the dead entries of weak tables, forgets the coroutines that can
+// no longer be resumed (see SetMaxCoroutines) and the tainted strings it can
+// no longer reach (see Taint), and then resets the bytes
+// charged to this state to the size of what is still reachable, as reported
+// by EstimateSize, and of the values it sent to channels that were not
+// received yet.
+//
+// The incremental accounting only grows as objects are created, so the
+// charge of a long-lived state drifts away from what it really retains.
+// Calling CollectGarbage from time to time corrects it, at the cost of
+// walking the whole state.
+//
+// Like CollectWeakTables, CollectGarbage can not see values that are only
+// referenced from Go. Userdata that the host still uses must be kept
+// reachable from the state, for instance with RegistrySet, or their
+// finalizers will run.
+func (ls *LState) CollectGarbage() *CollectStats {
+	stats := &CollectStats{Before: ls.allocatedBytes}
+	c := ls.markReachable()
+	for _, tb := range c.weak {
+		stats.WeakEntries += c.sweep(tb)
+	}
+	stats.Finalized = ls.G.finalizeUnreachable(func(ud *LUserData) bool {
+		return c.isMarked(ud)
+	})
+	ls.G.coroutines = c.liveThreads(ls.G)
+	if ls.G.taint != nil {
+		ls.G.taint.sweep(ls.walk().strings)
+	}
+	stats.After = ls.RecomputeMemoryUsage()
+	ls.gcStepCredit = 0
+	return stats
+}
+
+// RecomputeMemoryUsage resets the bytes charged to this state, see
+// GetAllocatedBytes, to the size of what is still reachable from it, as
+// reported by EstimateSize, plus the values it sent to channels that were not
+// received yet, and returns the new count. The memory of tables, strings and
+// functions the scripts no longer reference is so credited back, and a
+// long-running state whose live set stays small does not drift into its
+// limit. The peak, see GetPeakAllocatedBytes, is kept.
+//
+// It is the accounting part of CollectGarbage, without the finalizers and
+// the sweep of weak tables, so the values only referenced by weak tables
+// are still counted. Like CollectGarbage, it walks the whole state.
+func (ls *LState) RecomputeMemoryUsage() int64 {
+	ls.creditChannels()
+	ls.setAllocatedBytes(ls.EstimateSize().Total + ls.channelBytes())
+	if ls.maxBytes > 0 && ls.allocatedBytes <= ls.maxBytes/10*9 {
+		ls.warnedNearLimit = false
+	}
+	ls.rearmMemoryThreshold()
+	ls.gcEstimate = ls.allocatedBytes
+	return ls.allocatedBytes
+}
+
+const (
+	// defaultGCPause and defaultGCStepMul are the values of
+	// collectgarbage("setpause") and collectgarbage("setstepmul") of a new
+	// state, those of PUC Lua.
+	defaultGCPause   = 200
+	defaultGCStepMul = 200
+)
+
+// gcStep is collectgarbage("step", kb): every call is worth kb kilobytes
+// times the step multiplier of collection work, and runs CollectGarbage
+// once the work adds up to the bytes charged since the previous collection.
+// A step of 0 always collects. It reports whether a collection ran.
+func (ls *LState) gcStep(kb int) bool {
+	if kb > 0 {
+		ls.gcStepCredit += int64(kb) * 1024 * int64(ls.gcStepMul) / 100
+		if ls.gcStepCredit < ls.allocatedBytes-ls.gcEstimate {
+			return false
+		}
+	}
+	ls.CollectGarbage()
+	return true
+}
+
+// liveThreads counts the marked threads of g that are not dead, except the
+// main thread.
+func (c *weakCollector) liveThreads(g *Global) int {
+	n := 0
+	for lv := range c.marked {
+		if th, ok := lv.(*LState); ok && th.G == g && th.memParent != nil && !th.Dead {
+			n++
+		}
+	}
+	return n
+}
+
+/* }}} */
@@ -0,0 +1,151 @@
+package lua
+
+import (
+	"fmt"
+	"sort"
+)
+
+/* global environment diffing {{{ */
+
+// GlobalsSnapshot is a copy of the global variables of a state, taken by
+// LState.GlobalsSnapshot. Tables are copied one level deep, so fields added
+// to a global table such as string are noticed as well.
+type GlobalsSnapshot struct {
+	values map[string]LValue
+	fields map[string]map[LValue]LValue
+}
+
+// GlobalChangeKind tells how a global variable changed.
+type GlobalChangeKind int
+
+const (
+	GlobalCreated GlobalChangeKind = iota
+	GlobalModified
+	GlobalDeleted
+)
+
+var globalChangeKindNames = [...]string{"created", "modified", "deleted"}
+
+func (k GlobalChangeKind) String() string {
+	return globalChangeKindNames[k]
+}
+
+// GlobalChange describes a global variable that differs between two
+// snapshots.
+type GlobalChange struct {
+	Name string
+	Kind GlobalChangeKind
+	// Before and After are the values in the two snapshots. Before is LNil
+	// for created variables and After is LNil for deleted ones. Both are the
+	// same table if only the fields of a table changed.
+	Before LValue
+	After  LValue
+	// Fields lists the fields of a table that were created, modified or
+	// deleted in place, in sorted order.
+	Fields []string
+}
+
+func (c *GlobalChange) String() string {
+	switch c.Kind {
+	case GlobalCreated:
+		return fmt.Sprintf("created %v: %v", c.Name, summarizeValue(c.After))
+	case GlobalDeleted:
+		return fmt.Sprintf("deleted %v: %v", c.Name, summarizeValue(c.Before))
+	}
+	if c.Before == c.After {
+		return fmt.Sprintf("modified %v: %v fields changed %v", c.Name, summarizeValue(c.After), c.Fields)
+	}
+	return fmt.Sprintf("modified %v: %v -> %v", c.Name, summarizeValue(c.Before), summarizeValue(c.After))
+}
+
+// summarizeValue describes the type and size of lv.
+func summarizeValue(lv LValue) string {
+	switch v := lv.(type) {
+	case LString:
+		return fmt.Sprintf("string (%v bytes)", len(v))
+	case LNumber, LBool:
+		return fmt.Sprintf("%v %v", lv.Type().String(), lv.String())
+	case *LTable:
+		n := 0
+		v.ForEach(func(LValue, LValue) { n++ })
+		return fmt.Sprintf("table (%v entries)", n)
+	case *LFunction:
+		if v.IsG {
+			return "function (Go)"
+		}
+		return fmt.Sprintf("function (%v:%v)", v.Proto.SourceName, v.Proto.LineDefined)
+	}
+	return lv.Type().String()
+}
+
+// GlobalsSnapshot takes a snapshot of the global variables, to be compared
+// with a later one by DiffGlobals.
+func (ls *LState) GlobalsSnapshot() *GlobalsSnapshot {
+	s := &GlobalsSnapshot{values: map[string]LValue{}, fields: map[string]map[LValue]LValue{}}
+	ls.G.Global.ForEach(func(key, value LValue) {
+		name := key.String()
+		s.values[name] = value
+		if tb, ok := value.(*LTable); ok && tb != ls.G.Global {
+			fields := map[LValue]LValue{}
+			tb.ForEach(func(k, v LValue) { fields[k] = v })
+			s.fields[name] = fields
+		}
+	})
+	return s
+}
+
+// DiffGlobals returns the global variables that were created, modified or
+// deleted between two snapshots, sorted by name. A variable is modified if
+// it holds another value, or if it holds the same table and the fields of
+// that table changed. Tables nested deeper are not compared.
+func DiffGlobals(before, after *GlobalsSnapshot) []GlobalChange {
+	var changes []GlobalChange
+	for name, old := range before.values {
+		cur, ok := after.values[name]
+		switch {
+		case !ok:
+			changes = append(changes, GlobalChange{Name: name, Kind: GlobalDeleted, Before: old, After: LNil})
+		case !globalValueEqual(old, cur):
+			changes = append(changes, GlobalChange{Name: name, Kind: GlobalModified, Before: old, After: cur})
+		default:
+			if fields := diffFields(before.fields[name], after.fields[name]); len(fields) > 0 {
+				changes = append(changes, GlobalChange{Name: name, Kind: GlobalModified, Before: old, After: cur, Fields: fields})
+			}
+		}
+	}
+	for name, cur := range after.values {
+		if _, ok := before.values[name]; !ok {
+			changes = append(changes, GlobalChange{Name: name, Kind: GlobalCreated, Before: LNil, After: cur})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// globalValueEqual compares values by identity, and numbers by value so that
+// NaN compares equal to itself.
+func globalValueEqual(a, b LValue) bool {
+	if an, ok := a.(LNumber); ok {
+		bn, ok := b.(LNumber)
+		return ok && (an == bn || an != an && bn != bn)
+	}
+	return a == b
+}
+
+func diffFields(before, after map[LValue]LValue) []string {
+	var fields []string
+	for key, old := range before {
+		if cur, ok := after[key]; !ok || !globalValueEqual(old, cur) {
+			fields = append(fields, key.String())
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			fields = append(fields, key.String())
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+/* }}} */
@@ -0,0 +1,64 @@
+package lua
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"os"
+)
+
+/* io file system {{{ */
+
+// WritableFS is an fs.FS in which the io library can also create and write
+// files, see SetIoFS. flag and perm are those of os.OpenFile; the returned
+// file must implement io.Writer when flag opens it for writing.
+type WritableFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+}
+
+// SetIoFS makes io.open, io.lines, io.input and io.output open files in fsys
+// instead of the operating system's file system, with paths resolved as by
+// LoadFS. Files can only be read unless fsys implements WritableFS, and
+// file:seek works on files that implement io.Seeker. io.popen and io.tmpfile
+// fail while a file system is set, as they would escape it. The standard
+// files are not affected. Passing nil restores the default behaviour.
+func (ls *LState) SetIoFS(fsys fs.FS) {
+	ls.G.ioFS = fsys
+}
+
+// newFSFile opens path in the file system set by SetIoFS.
+func newFSFile(L *LState, path string, flag int, perm os.FileMode, writable, readable bool) (*LUserData, error) {
+	name := fsPath(path)
+	var fp fs.File
+	var err error
+	if flag == os.O_RDONLY {
+		fp, err = L.G.ioFS.Open(name)
+	} else if wfs, ok := L.G.ioFS.(WritableFS); ok {
+		fp, err = wfs.OpenFile(name, flag, perm)
+	} else {
+		err = &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	if err != nil {
+		return nil, err
+	}
+	lfile := &lFile{vf: fp, name: name}
+	if writable {
+		w, ok := fp.(io.Writer)
+		if !ok {
+			fp.Close()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		lfile.writer, lfile.sink = w, w
+	}
+	ud := L.NewUserData()
+	ud.Value = lfile
+	if readable {
+		lfile.reader = bufio.NewReaderSize(fp, fileDefaultReadBuffer)
+		lfile.chargeReadBuffer(L)
+	}
+	L.SetMetatable(ud, L.GetTypeMetatable(lFileClass))
+	return ud, nil
+}
+
+/* }}} */
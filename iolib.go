@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"syscall"
@@ -13,14 +14,14 @@ import (
 var ioFuncs = map[string]LGFunction{
 	"close":   ioClose,
 	"flush":   ioFlush,
-	"lines":   ioLines,
-	"input":   ioInput,
-	"output":  ioOutput,
-	"open":    ioOpenFile,
-	"popen":   ioPopen,
-	"read":    ioRead,
+	"lines":   audited("io.lines", ioLines),
+	"input":   audited("io.input", ioInput),
+	"output":  audited("io.output", ioOutput),
+	"open":    audited("io.open", ioOpenFile),
+	"popen":   audited("io.popen", ioPopen),
+	"read":    Nondeterministic("io.read", ioRead),
 	"type":    ioType,
-	"tmpfile": ioTmpFile,
+	"tmpfile": audited("io.tmpfile", ioTmpFile),
 	"write":   ioWrite,
 }
 
@@ -29,10 +30,17 @@ const lFileClass = "FILE*"
 type lFile struct {
 	fp     *os.File
 	pp     *exec.Cmd
+	vf     fs.File
 	writer io.Writer
 	reader *bufio.Reader
 	stdout io.ReadCloser
 	closed bool
+	// name and sink are only used by lFileStream and lFileFS files
+	name string
+	sink io.Writer
+	// bytes charged for the read and write buffers
+	bufBytes   int64
+	writeBytes int64
 }
 
 type lFileType int
@@ -40,6 +48,8 @@ type lFileType int
 const (
 	lFileFile lFileType = iota
 	lFileProcess
+	lFileStream
+	lFileFS
 )
 
 const fileDefOutIndex = 1
@@ -66,6 +76,9 @@ func newFile(L *LState, file *os.File, path string, flag int, perm os.FileMode,
 	ud := L.NewUserData()
 	var err error
 	if file == nil {
+		if L.G.ioFS != nil {
+			return newFSFile(L, path, flag, perm, writable, readable)
+		}
 		file, err = os.OpenFile(path, flag, perm)
 		if err != nil {
 			return nil, err
@@ -78,6 +91,7 @@ func newFile(L *LState, file *os.File, path string, flag int, perm os.FileMode,
 	}
 	if readable {
 		lfile.reader = bufio.NewReaderSize(file, fileDefaultReadBuffer)
+		lfile.chargeReadBuffer(L)
 	}
 	L.SetMetatable(ud, L.GetTypeMetatable(lFileClass))
 	return ud, nil
@@ -97,6 +111,7 @@ func newProcess(L *LState, cmd string, writable, readable bool) (*LUserData, err
 	if readable {
 		lfile.stdout, err = pp.StdoutPipe()
 		lfile.reader = bufio.NewReaderSize(lfile.stdout, fileDefaultReadBuffer)
+		lfile.chargeReadBuffer(L)
 	}
 	if err != nil {
 		return nil, err
@@ -110,11 +125,31 @@ func newProcess(L *LState, cmd string, writable, readable bool) (*LUserData, err
 	return ud, nil
 }
 
+// newStream wraps a host supplied reader or writer that is not an *os.File
+// (e.g. the Options.Stdout of a state running on js/wasm).
+func newStream(L *LState, name string, reader io.Reader, writer io.Writer) *LUserData {
+	ud := L.NewUserData()
+	lfile := &lFile{fp: nil, pp: nil, writer: writer, reader: nil, stdout: nil, closed: false, name: name, sink: writer}
+	if reader != nil {
+		lfile.reader = bufio.NewReaderSize(reader, fileDefaultReadBuffer)
+		lfile.chargeReadBuffer(L)
+	}
+	ud.Value = lfile
+	L.SetMetatable(ud, L.GetTypeMetatable(lFileClass))
+	return ud
+}
+
 func (file *lFile) Type() lFileType {
-	if file.fp == nil {
+	if file.fp != nil {
+		return lFileFile
+	}
+	if file.pp != nil {
 		return lFileProcess
 	}
-	return lFileFile
+	if file.vf != nil {
+		return lFileFS
+	}
+	return lFileStream
 }
 
 func (file *lFile) Name() string {
@@ -123,17 +158,58 @@ func (file *lFile) Name() string {
 		return fmt.Sprintf("file %s", file.fp.Name())
 	case lFileProcess:
 		return fmt.Sprintf("process %s", file.pp.Path)
+	case lFileStream:
+		return fmt.Sprintf("stream %s", file.name)
+	case lFileFS:
+		return fmt.Sprintf("file %s", file.name)
 	}
 	return ""
 }
 
+// seeker returns the file under file if it can seek, nil otherwise.
+func (file *lFile) seeker() io.ReadSeeker {
+	switch file.Type() {
+	case lFileFile:
+		return file.fp
+	case lFileFS:
+		if s, ok := file.vf.(io.ReadSeeker); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// chargeReadBuffer charges the read buffer of file to L.
+func (file *lFile) chargeReadBuffer(L *LState) {
+	L.trackAlloc(AllocUserData, fileDefaultReadBuffer)
+	file.bufBytes = fileDefaultReadBuffer
+}
+
+// chargeWriteBuffer charges a write buffer of size bytes to L, in place of
+// the previous one. The size is checked first, so that a huge buffer fails
+// before it is allocated.
+func (file *lFile) chargeWriteBuffer(L *LState, size int64) {
+	if err := L.checkFits(size); err != nil {
+		L.raiseTypedError(err, "%s", err.Error())
+	}
+	L.releaseAlloc(file.writeBytes)
+	L.trackAlloc(AllocUserData, size)
+	file.writeBytes = size
+}
+
+// releaseBuffers credits the buffers of a closed file to L.
+func (file *lFile) releaseBuffers(L *LState) {
+	L.releaseAlloc(file.bufBytes + file.writeBytes)
+	file.bufBytes, file.writeBytes = 0, 0
+}
+
 func (file *lFile) AbandonReadBuffer() error {
-	if file.Type() == lFileFile && file.reader != nil {
-		_, err := file.fp.Seek(-int64(file.reader.Buffered()), 1)
+	if s := file.seeker(); s != nil && file.reader != nil {
+		_, err := s.Seek(-int64(file.reader.Buffered()), 1)
 		if err != nil {
 			return err
 		}
-		file.reader = bufio.NewReaderSize(file.fp, fileDefaultReadBuffer)
+		file.reader = bufio.NewReaderSize(s, fileDefaultReadBuffer)
 	}
 	return nil
 }
@@ -166,17 +242,6 @@ func fileIsReadable(L *LState, file *lFile) int {
 	return 0
 }
 
-var stdFiles = []struct {
-	name     string
-	file     *os.File
-	writable bool
-	readable bool
-}{
-	{"stdout", os.Stdout, true, false},
-	{"stdin", os.Stdin, false, true},
-	{"stderr", os.Stderr, true, false},
-}
-
 func OpenIo(L *LState) int {
 	mod := L.RegisterModule(IoLibName, map[string]LGFunction{}).(*LTable)
 	mt := L.NewTypeMetatable(lFileClass)
@@ -184,9 +249,31 @@ func OpenIo(L *LState) int {
 	L.SetFuncs(mt, fileMethods)
 	mt.RawSetString("lines", L.NewClosure(fileLines, L.NewFunction(fileLinesIter)))
 
+	stdFiles := []struct {
+		name   string
+		stream interface{}
+	}{
+		{"stdout", L.Options.Stdout},
+		{"stdin", L.Options.Stdin},
+		{"stderr", L.Options.Stderr},
+	}
 	for _, finfo := range stdFiles {
-		file, _ := newFile(L, finfo.file, "", 0, os.FileMode(0), finfo.writable, finfo.readable)
-		mod.RawSetString(finfo.name, file)
+		reader, readable := finfo.stream.(io.Reader)
+		writer, writable := finfo.stream.(io.Writer)
+		readable = readable && finfo.name == "stdin"
+		writable = writable && finfo.name != "stdin"
+		if fp, ok := finfo.stream.(*os.File); ok {
+			file, _ := newFile(L, fp, "", 0, os.FileMode(0), writable, readable)
+			mod.RawSetString(finfo.name, file)
+			continue
+		}
+		if !readable {
+			reader = nil
+		}
+		if !writable {
+			writer = nil
+		}
+		mod.RawSetString(finfo.name, newStream(L, finfo.name, reader, writer))
 	}
 	uv := L.CreateTable(2, 0)
 	uv.RawSetInt(fileDefOutIndex, mod.RawGetString("stdout"))
@@ -194,7 +281,7 @@ func OpenIo(L *LState) int {
 	for name, fn := range ioFuncs {
 		mod.RawSetString(name, L.NewClosure(fn, uv))
 	}
-	mod.RawSetString("lines", L.NewClosure(ioLines, uv, L.NewClosure(ioLinesIter, uv)))
+	mod.RawSetString("lines", L.NewClosure(ioFuncs["lines"], uv, L.NewClosure(ioLinesIter, uv)))
 	// Modifications are being made in-place rather than returned?
 	L.Push(mod)
 	return 1
@@ -213,7 +300,7 @@ var fileMethods = map[string]LGFunction{
 
 func fileToString(L *LState) int {
 	file := checkFile(L)
-	if file.Type() == lFileFile {
+	if file.Type() != lFileProcess {
 		if file.closed {
 			L.Push(LString("file (closed)"))
 		} else {
@@ -268,6 +355,7 @@ func fileCloseAux(L *LState, file *lFile) int {
 		}
 	}
 	file.AbandonReadBuffer()
+	file.releaseBuffers(L)
 
 	switch file.Type() {
 	case lFileFile:
@@ -276,6 +364,15 @@ func fileCloseAux(L *LState, file *lFile) int {
 		}
 		L.Push(LTrue)
 		return 1
+	case lFileFS:
+		if err = file.vf.Close(); err != nil {
+			goto errreturn
+		}
+		L.Push(LTrue)
+		return 1
+	case lFileStream:
+		L.Push(LTrue)
+		return 1
 	case lFileProcess:
 		if file.stdout != nil {
 			file.stdout.Close() // ignore errors
@@ -328,6 +425,14 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 		L.Push(LString("*l"))
 	}
 	var err error
+	// the bytes read are charged as they arrive and credited once they are
+	// copied to the result
+	var charged int64
+	track := func(n int) {
+		L.trackAlloc(AllocString, int64(n))
+		charged += int64(n)
+	}
+	defer func() { L.releaseAlloc(charged) }()
 	top := L.GetTop()
 	for i := idx; i <= top; i++ {
 		switch lv := L.Get(i).(type) {
@@ -343,7 +448,7 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 			}
 			var buf []byte
 			var iseof bool
-			buf, err, iseof = readBufioSize(file.reader, size)
+			buf, err, iseof = readBufioSize(file.reader, size, track)
 			if iseof {
 				L.Push(LNil)
 				goto normalreturn
@@ -351,6 +456,7 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 			if err != nil {
 				goto errreturn
 			}
+			L.trackString(len(buf))
 			L.Push(LString(string(buf)))
 		case LString:
 			options := L.CheckString(i)
@@ -372,19 +478,16 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 					L.Push(v)
 				case 'a':
 					var buf []byte
-					buf, err = io.ReadAll(file.reader)
-					if err == io.EOF {
-						L.Push(emptyLString)
-						goto normalreturn
-					}
+					buf, err = readBufioAll(file.reader, track)
 					if err != nil {
 						goto errreturn
 					}
+					L.trackString(len(buf))
 					L.Push(LString(string(buf)))
 				case 'l':
 					var buf []byte
 					var iseof bool
-					buf, err, iseof = readBufioLine(file.reader)
+					buf, err, iseof = readBufioLine(file.reader, track)
 					if iseof {
 						L.Push(LNil)
 						goto normalreturn
@@ -392,6 +495,7 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 					if err != nil {
 						goto errreturn
 					}
+					L.trackString(len(buf))
 					L.Push(LString(string(buf)))
 				default:
 					L.ArgError(2, "invalid options:"+string(opt))
@@ -413,10 +517,20 @@ var fileSeekOptions = []string{"set", "cur", "end"}
 
 func fileSeek(L *LState) int {
 	file := checkFile(L)
-	if file.Type() != lFileFile {
+	switch file.Type() {
+	case lFileProcess:
 		L.Push(LNil)
 		L.Push(LString("can not seek a process."))
 		return 2
+	case lFileStream:
+		L.Push(LNil)
+		L.Push(LString("can not seek a stream."))
+		return 2
+	}
+	if file.seeker() == nil {
+		L.Push(LNil)
+		L.Push(LString("can not seek " + file.Name() + "."))
+		return 2
 	}
 
 	top := L.GetTop()
@@ -435,7 +549,7 @@ func fileSeek(L *LState) int {
 		goto errreturn
 	}
 
-	pos, err = file.fp.Seek(L.CheckInt64(3), L.CheckOption(2, fileSeekOptions))
+	pos, err = file.seeker().Seek(L.CheckInt64(3), L.CheckOption(2, fileSeekOptions))
 	if err != nil {
 		goto errreturn
 	}
@@ -476,6 +590,7 @@ func fileLinesIter(L *LState) int {
 		}
 		L.RaiseError(err.Error())
 	}
+	L.trackString(len(buf))
 	L.Push(LString(string(buf)))
 	return 1
 }
@@ -505,9 +620,13 @@ func fileSetVBuf(L *LState) int {
 	}
 	switch filebufOptions[L.CheckOption(2, filebufOptions)] {
 	case "no":
+		L.releaseAlloc(file.writeBytes)
+		file.writeBytes = 0
 		switch file.Type() {
 		case lFileFile:
 			file.writer = file.fp
+		case lFileStream, lFileFS:
+			file.writer = file.sink
 		case lFileProcess:
 			file.writer, err = file.pp.StdinPipe()
 			if err != nil {
@@ -516,9 +635,15 @@ func fileSetVBuf(L *LState) int {
 		}
 	case "full", "line": // TODO line buffer not supported
 		bufsize := L.OptInt(3, fileDefaultWriteBuffer)
+		if bufsize <= 0 {
+			bufsize = fileDefaultWriteBuffer
+		}
+		file.chargeWriteBuffer(L, int64(bufsize))
 		switch file.Type() {
 		case lFileFile:
 			file.writer = bufio.NewWriterSize(file.fp, bufsize)
+		case lFileStream, lFileFS:
+			file.writer = bufio.NewWriterSize(file.sink, bufsize)
 		case lFileProcess:
 			writer, err = file.pp.StdinPipe()
 			if err != nil {
@@ -592,6 +717,7 @@ func ioLinesIter(L *LState) int {
 		}
 		L.RaiseError(err.Error())
 	}
+	L.trackString(len(buf))
 	L.Push(LString(string(buf)))
 	return 1
 }
@@ -661,6 +787,11 @@ func ioPopen(L *LState) int {
 		L.SetTop(1)
 		L.Push(LString("r"))
 	}
+	if !processSupported || L.G.ioFS != nil {
+		L.Push(LNil)
+		L.Push(LString("'popen' not supported"))
+		return 2
+	}
 	var file *LUserData
 	var err error
 
@@ -703,6 +834,9 @@ func ioType(L *LState) int {
 }
 
 func ioTmpFile(L *LState) int {
+	if L.G.ioFS != nil {
+		L.RaiseError("'tmpfile' not supported")
+	}
 	file, err := os.CreateTemp("", "")
 	if err != nil {
 		L.Push(LNil)
@@ -0,0 +1,126 @@
+package lua
+
+/* isolated environments {{{ */
+
+// NewIsolatedEnv returns a new table to be used as the globals of a chunk,
+// see DoStringInEnv. Globals that it does not define are read from a
+// read-only copy of the globals of the state, the standard libraries
+// included, that is taken on the first call and shared by the environments
+// of the state. Scripts running in different environments thus can not see
+// each other's globals nor modify the libraries they share. _G refers to the
+// environment itself, and getfenv, load, loadstring and loadfile see the
+// environment of their caller in place of the globals of the state.
+func (ls *LState) NewIsolatedEnv() *LTable {
+	env := ls.NewTable()
+	ls.isolateEnv(env)
+	return env
+}
+
+// DoStringInEnv is like DoString but runs source with env as its globals
+// table, and so do the functions it defines. An env without a metatable is
+// set up as by NewIsolatedEnv; a nil env is replaced by a new one.
+func (ls *LState) DoStringInEnv(source string, env *LTable) error {
+	fn, err := ls.LoadString(source)
+	if err != nil {
+		return err
+	}
+	return ls.doInEnv(fn, env)
+}
+
+// DoFileInEnv is like DoFile but runs the file with env as its globals
+// table, see DoStringInEnv.
+func (ls *LState) DoFileInEnv(path string, env *LTable) error {
+	fn, err := ls.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	return ls.doInEnv(fn, env)
+}
+
+func (ls *LState) doInEnv(fn *LFunction, env *LTable) error {
+	if env == nil {
+		env = ls.NewIsolatedEnv()
+	} else if env.Metatable == LNil {
+		ls.isolateEnv(env)
+	}
+	fn.Env = env
+	ls.Push(fn)
+	return ls.PCall(0, MultRet, nil)
+}
+
+// isolateEnv makes env fall back to the shared copy of the globals.
+func (ls *LState) isolateEnv(env *LTable) {
+	if ls.G.isolatedEnvMt == nil {
+		shared := ls.copyReadOnly(ls.G.Global, map[*LTable]*LTable{})
+		ls.SetTableReadOnly(shared, false)
+		for _, name := range envBoundFuncs {
+			if fn, ok := shared.RawGetString(name).(*LFunction); ok && fn.IsG {
+				shared.RawSetString(name, ls.NewFunction(bindCallerEnv(fn.GFunction)))
+			}
+		}
+		ls.SetTableReadOnly(shared, true)
+		mt := ls.CreateTable(0, 2)
+		mt.RawSetString("__index", shared)
+		mt.RawSetString("__metatable", LFalse)
+		ls.SetTableReadOnly(mt, true)
+		ls.G.isolatedEnvMt = mt
+	}
+	if env.RawGetString("_G") == LNil {
+		env.RawSetString("_G", env)
+	}
+	env.Metatable = ls.G.isolatedEnvMt
+}
+
+// envBoundFuncs are the functions that would hand the globals of the state
+// to scripts running in an isolated environment.
+var envBoundFuncs = []string{"getfenv", "load", "loadstring", "loadfile"}
+
+// bindCallerEnv wraps fn so that the globals of the state it returns, as a
+// table or as the environment of a new function, are replaced by the
+// environment of the Lua function that called it.
+func bindCallerEnv(fn LGFunction) LGFunction {
+	return func(L *LState) int {
+		n := fn(L)
+		cf := L.currentFrame
+		if cf == nil || cf.Parent == nil || cf.Parent.Fn.IsG {
+			return n
+		}
+		env := cf.Parent.Fn.Env
+		for i := 1; i <= n; i++ {
+			switch lv := L.Get(-i).(type) {
+			case *LTable:
+				if lv == L.G.Global {
+					L.Replace(-i, env)
+				}
+			case *LFunction:
+				if !lv.IsG && lv.Env == L.G.Global {
+					lv.Env = env
+				}
+			}
+		}
+		return n
+	}
+}
+
+// copyReadOnly returns a read-only copy of tb and of the tables reachable
+// from it, copies maps the tables to their copies.
+func (ls *LState) copyReadOnly(tb *LTable, copies map[*LTable]*LTable) *LTable {
+	if c, ok := copies[tb]; ok {
+		return c
+	}
+	c := ls.NewTable()
+	copies[tb] = c
+	tb.ForEach(func(key, value LValue) {
+		if t, ok := key.(*LTable); ok {
+			key = ls.copyReadOnly(t, copies)
+		}
+		if t, ok := value.(*LTable); ok {
+			value = ls.copyReadOnly(t, copies)
+		}
+		c.RawSet(key, value)
+	})
+	ls.SetTableReadOnly(c, true)
+	return c
+}
+
+/* }}} */
@@ -2,6 +2,7 @@ package lua
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,6 +12,16 @@ import (
 
 var loLoaders = []LGFunction{loLoaderPreload, loLoaderLua}
 
+// PluginLoaderSymbol is the symbol require() looks up in Go plugins found on
+// package.cpath. It must be declared as
+//
+//	func Loader(L *lua.LState) int
+//
+// and behaves like a function registered in package.preload. Plugins are only
+// searched when Options.AllowPlugins is set, and must be built against the
+// same version of this package as the host.
+const PluginLoaderSymbol = "Loader"
+
 func loGetPath(env string, defpath string) string {
 	path := os.Getenv(env)
 	if len(path) == 0 {
@@ -28,7 +39,14 @@ func loGetPath(env string, defpath string) string {
 }
 
 func loFindFile(L *LState, name, pname string) (string, string) {
-	name = strings.Replace(name, ".", string(os.PathSeparator), -1)
+	// Lua modules are looked up in the script file system set by LoadFS,
+	// plugins on package.cpath always live on the OS file system.
+	useFS := L.G.scriptFS != nil && pname == "path"
+	if useFS {
+		name = strings.Replace(name, ".", "/", -1)
+	} else {
+		name = strings.Replace(name, ".", string(os.PathSeparator), -1)
+	}
 	lv := L.GetField(L.GetField(L.Get(EnvironIndex), "package"), pname)
 	path, ok := lv.(LString)
 	if !ok {
@@ -37,7 +55,13 @@ func loFindFile(L *LState, name, pname string) (string, string) {
 	messages := []string{}
 	for _, pattern := range strings.Split(string(path), ";") {
 		luapath := strings.Replace(pattern, "?", name, -1)
-		if _, err := os.Stat(luapath); err == nil {
+		var err error
+		if useFS {
+			_, err = fs.Stat(L.G.scriptFS, fsPath(luapath))
+		} else {
+			_, err = os.Stat(luapath)
+		}
+		if err == nil {
 			return luapath, ""
 		} else {
 			messages = append(messages, err.Error())
@@ -51,10 +75,16 @@ func OpenPackage(L *LState) int {
 
 	L.SetField(packagemod, "preload", L.NewTable())
 
-	loaders := L.CreateTable(len(loLoaders), 0)
+	loaders := L.CreateTable(len(loLoaders)+2, 0)
 	for i, loader := range loLoaders {
 		L.RawSetInt(loaders, i+1, L.NewFunction(loader))
 	}
+	if len(L.G.moduleSearchers) > 0 {
+		loaders.Insert(2, L.NewFunction(loLoaderHost))
+	}
+	if L.Options.AllowPlugins {
+		loaders.Append(L.NewFunction(loLoaderPlugin))
+	}
 	L.SetField(packagemod, "loaders", loaders)
 	L.SetField(L.Get(RegistryIndex), "_LOADERS", loaders)
 
@@ -62,8 +92,16 @@ func OpenPackage(L *LState) int {
 	L.SetField(packagemod, "loaded", loaded)
 	L.SetField(L.Get(RegistryIndex), "_LOADED", loaded)
 
-	L.SetField(packagemod, "path", LString(loGetPath(LuaPath, LuaPathDefault)))
-	L.SetField(packagemod, "cpath", emptyLString)
+	if L.G.scriptFS != nil {
+		L.SetField(packagemod, "path", LString(LuaFSPathDefault))
+	} else {
+		L.SetField(packagemod, "path", LString(loGetPath(LuaPath, LuaPathDefault)))
+	}
+	if L.Options.AllowPlugins {
+		L.SetField(packagemod, "cpath", LString(loGetPath(LuaCPath, LuaCPathDefault)))
+	} else {
+		L.SetField(packagemod, "cpath", emptyLString)
+	}
 
 	L.SetField(packagemod, "config", LString(LuaDirSep+"\n"+LuaPathSep+
 		"\n"+LuaPathMark+"\n"+LuaExecDir+"\n"+LuaIgMark+"\n"))
@@ -73,7 +111,7 @@ func OpenPackage(L *LState) int {
 }
 
 var loFuncs = map[string]LGFunction{
-	"loadlib": loLoadLib,
+	"loadlib": audited("package.loadlib", loLoadLib),
 	"seeall":  loSeeAll,
 }
 
@@ -107,9 +145,36 @@ func loLoaderLua(L *LState) int {
 	return 1
 }
 
+func loLoaderPlugin(L *LState) int {
+	name := L.CheckString(1)
+	path, msg := loFindFile(L, name, "cpath")
+	if len(path) == 0 {
+		L.Push(LString(msg))
+		return 1
+	}
+	fn, _, err := openPluginSymbol(path, PluginLoaderSymbol)
+	if err != nil {
+		L.RaiseError("error loading module '%s' from file '%s':\n\t%s", name, path, err.Error())
+	}
+	L.Push(L.NewFunction(fn))
+	return 1
+}
+
 func loLoadLib(L *LState) int {
-	L.RaiseError("loadlib is not supported")
-	return 0
+	if !L.Options.AllowPlugins {
+		L.RaiseError("loadlib is not supported")
+	}
+	path := L.CheckString(1)
+	symbol := L.CheckString(2)
+	fn, where, err := openPluginSymbol(path, symbol)
+	if err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		L.Push(LString(where))
+		return 3
+	}
+	L.Push(L.NewFunction(fn))
+	return 1
 }
 
 func loSeeAll(L *LState) int {
@@ -0,0 +1,382 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* multi-tenant state manager {{{ */
+
+// ErrManagerClosed is returned by StateManager.Do after Close.
+var ErrManagerClosed = errors.New("state manager is closed")
+
+// ManagerOptions configures a StateManager. Zero values disable the
+// corresponding limit.
+type ManagerOptions struct {
+	// Options used to create the state of every tenant.
+	StateOptions Options
+	// Setup is called once with every new state, before its first use, to
+	// register host functions and load code. A state whose Setup fails is
+	// closed and the error is returned by Do.
+	Setup func(tenant string, L *LState) error
+	// TenantMemoryLimit is the memory limit of every state, see SetMemoryLimit.
+	TenantMemoryLimit int64
+	// MaxTotalMemory caps the memory allocated by all states together. Idle
+	// states are evicted, least recently used first, to make room for a
+	// tenant, and each execution may only use what is left by the others.
+	MaxTotalMemory int64
+	// MaxConcurrent is the number of executions that may run at the same time
+	// across all tenants. Further calls to Do wait for a free slot.
+	MaxConcurrent int
+	// RateLimit is the number of executions a tenant may start per
+	// RateInterval, which defaults to a second. Calls to Do beyond that fail
+	// with a *LimitError.
+	RateLimit    int
+	RateInterval time.Duration
+	// IdleTimeout is how long a state may stay unused before it is evicted.
+	IdleTimeout time.Duration
+}
+
+// TenantMetrics holds the counters of a tenant. They survive the eviction of
+// its state.
+type TenantMetrics struct {
+	// Executions is the number of calls to Do that ran.
+	Executions int64
+	// Errors is the number of executions that returned an error.
+	Errors int64
+	// Rejected is the number of calls to Do refused by the rate or memory limits.
+	Rejected int64
+	// Evictions is the number of times the state of the tenant was evicted.
+	Evictions int64
+	// AllocatedBytes is the memory charged to the state after its last
+	// execution, see GetAllocatedBytes. It is 0 while no state is loaded.
+	AllocatedBytes int64
+	// Busy is the total time spent executing.
+	Busy time.Duration
+	// LastUsed is the time the last execution ended.
+	LastUsed time.Time
+}
+
+type tenantState struct {
+	name    string
+	mu      sync.Mutex // serializes the executions of the tenant
+	L       *LState
+	busy    bool
+	users   int   // calls to Do running or waiting for the tenant
+	reserve int64 // memory granted to the running execution
+	tokens  float64
+	refill  time.Time
+	metrics TenantMetrics
+}
+
+// StateManager owns one LState per tenant, created on first use, and
+// enforces limits shared by all tenants: total memory, concurrent executions
+// and the rate of executions of every tenant. States that stay idle are
+// evicted and recreated when needed, so a tenant must not rely on globals
+// surviving between executions unless the manager has no IdleTimeout and
+// no MaxTotalMemory.
+//
+// A StateManager is safe for concurrent use. Executions of the same tenant
+// are serialized, executions of different tenants run in parallel.
+type StateManager struct {
+	opts    ManagerOptions
+	mu      sync.Mutex
+	tenants map[string]*tenantState
+	slots   chan struct{}
+	closed  bool
+}
+
+// NewStateManager returns a manager configured by opts.
+func NewStateManager(opts ManagerOptions) *StateManager {
+	if opts.RateInterval <= 0 {
+		opts.RateInterval = time.Second
+	}
+	m := &StateManager{opts: opts, tenants: map[string]*tenantState{}}
+	if opts.MaxConcurrent > 0 {
+		m.slots = make(chan struct{}, opts.MaxConcurrent)
+	}
+	return m
+}
+
+// Do runs fn with the state of tenant, creating it if needed. ctx is set as
+// the context of the state while fn runs and bounds the wait for an
+// execution slot. The error of fn is returned as is. Do fails with a
+// *LimitError if the tenant exceeded its rate limit or if there is not
+// enough memory left for it.
+func (m *StateManager) Do(ctx context.Context, tenant string, fn func(L *LState) error) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	m.evictIdleLocked(time.Now())
+	ts := m.tenants[tenant]
+	if ts == nil {
+		ts = &tenantState{name: tenant, tokens: float64(m.opts.RateLimit), refill: time.Now()}
+		m.tenants[tenant] = ts
+	}
+	if err := m.takeToken(ts, time.Now()); err != nil {
+		ts.metrics.Rejected++
+		m.mu.Unlock()
+		return err
+	}
+	// a tenant in use can not be removed while Do waits for it
+	ts.users++
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		ts.users--
+		m.mu.Unlock()
+	}()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if m.slots != nil {
+		select {
+		case m.slots <- struct{}{}:
+			defer func() { <-m.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	L, limit, err := m.acquire(ts)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	defer func() {
+		L.RemoveContext()
+		m.release(ts, L, start, err)
+	}()
+	if limit > 0 {
+		L.SetMemoryLimit(limit)
+	}
+	L.SetContext(ctx)
+	err = fn(L)
+	return err
+}
+
+// takeToken consumes one execution of the rate limit of ts.
+func (m *StateManager) takeToken(ts *tenantState, now time.Time) error {
+	if m.opts.RateLimit <= 0 {
+		return nil
+	}
+	rate := float64(m.opts.RateLimit) / float64(m.opts.RateInterval)
+	ts.tokens += float64(now.Sub(ts.refill)) * rate
+	if ts.tokens > float64(m.opts.RateLimit) {
+		ts.tokens = float64(m.opts.RateLimit)
+	}
+	ts.refill = now
+	if ts.tokens < 1 {
+		return &LimitError{Resource: "execution rate", Limit: int64(m.opts.RateLimit), Value: int64(m.opts.RateLimit) + 1}
+	}
+	ts.tokens--
+	return nil
+}
+
+// acquire marks ts busy, creates its state if needed and returns the memory
+// limit of the execution.
+func (m *StateManager) acquire(ts *tenantState) (*LState, int64, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, 0, ErrManagerClosed
+	}
+	ts.busy = true
+	L := ts.L
+	m.mu.Unlock()
+
+	// a busy state is never evicted, so it can be created without the lock
+	if L == nil {
+		L = NewState(m.opts.StateOptions)
+		if m.opts.Setup != nil {
+			if err := m.opts.Setup(ts.name, L); err != nil {
+				L.Close()
+				m.mu.Lock()
+				ts.busy = false
+				m.mu.Unlock()
+				return nil, 0, err
+			}
+		}
+		m.mu.Lock()
+		ts.L = L
+		ts.metrics.AllocatedBytes = L.GetAllocatedBytes()
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limit := m.opts.TenantMemoryLimit
+	if m.opts.MaxTotalMemory > 0 {
+		available := m.opts.MaxTotalMemory - m.usedLocked(ts)
+		for available <= ts.metrics.AllocatedBytes && m.evictLRULocked(ts) {
+			available = m.opts.MaxTotalMemory - m.usedLocked(ts)
+		}
+		if available <= ts.metrics.AllocatedBytes {
+			ts.busy = false
+			ts.metrics.Rejected++
+			return nil, 0, &LimitError{Resource: "total memory", Limit: m.opts.MaxTotalMemory,
+				Value: m.opts.MaxTotalMemory - available + ts.metrics.AllocatedBytes}
+		}
+		if limit <= 0 || limit > available {
+			limit = available
+		}
+	}
+	ts.reserve = limit
+	return L, limit, nil
+}
+
+func (m *StateManager) release(ts *tenantState, L *LState, start time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	ts.busy = false
+	ts.reserve = 0
+	ts.metrics.Executions++
+	if err != nil {
+		ts.metrics.Errors++
+	}
+	ts.metrics.Busy += now.Sub(start)
+	ts.metrics.LastUsed = now
+	if ts.L == L {
+		ts.metrics.AllocatedBytes = L.GetAllocatedBytes()
+	}
+	if m.closed && ts.L != nil {
+		ts.L.Close()
+		ts.L = nil
+	}
+}
+
+// usedLocked returns the memory used by the tenants other than except.
+// Running executions count for the memory they were granted.
+func (m *StateManager) usedLocked(except *tenantState) int64 {
+	var used int64
+	for _, ts := range m.tenants {
+		switch {
+		case ts == except:
+		case ts.busy && ts.reserve > 0:
+			used += ts.reserve
+		default:
+			used += ts.metrics.AllocatedBytes
+		}
+	}
+	return used
+}
+
+// evictLRULocked evicts the idle state that was used least recently, other
+// than except, and reports whether there was one.
+func (m *StateManager) evictLRULocked(except *tenantState) bool {
+	var lru *tenantState
+	for _, ts := range m.tenants {
+		if ts != except && ts.L != nil && !ts.busy && (lru == nil || ts.metrics.LastUsed.Before(lru.metrics.LastUsed)) {
+			lru = ts
+		}
+	}
+	if lru == nil {
+		return false
+	}
+	m.evictLocked(lru)
+	return true
+}
+
+func (m *StateManager) evictLocked(ts *tenantState) {
+	ts.L.Close()
+	ts.L = nil
+	ts.metrics.AllocatedBytes = 0
+	ts.metrics.Evictions++
+}
+
+func (m *StateManager) evictIdleLocked(now time.Time) int {
+	if m.opts.IdleTimeout <= 0 {
+		return 0
+	}
+	evicted := 0
+	for _, ts := range m.tenants {
+		if ts.L != nil && !ts.busy && now.Sub(ts.metrics.LastUsed) > m.opts.IdleTimeout {
+			m.evictLocked(ts)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// EvictIdle closes the states that have been idle for longer than
+// IdleTimeout and returns how many were evicted. Do calls it as well, so it
+// only needs to be called to release memory when the manager is not used.
+func (m *StateManager) EvictIdle() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.evictIdleLocked(time.Now())
+}
+
+// Evict closes the state of tenant unless it is running, and reports whether
+// it did. The next call to Do creates a new state.
+func (m *StateManager) Evict(tenant string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := m.tenants[tenant]
+	if ts == nil || ts.L == nil || ts.busy {
+		return false
+	}
+	m.evictLocked(ts)
+	return true
+}
+
+// Remove evicts the state of tenant and forgets its metrics. It reports
+// false if the tenant is unknown, running or waiting to run.
+func (m *StateManager) Remove(tenant string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := m.tenants[tenant]
+	if ts == nil || ts.busy || ts.users > 0 {
+		return false
+	}
+	if ts.L != nil {
+		ts.L.Close()
+	}
+	delete(m.tenants, tenant)
+	return true
+}
+
+// Metrics returns the counters of tenant, and false if it is unknown.
+func (m *StateManager) Metrics(tenant string) (TenantMetrics, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := m.tenants[tenant]
+	if ts == nil {
+		return TenantMetrics{}, false
+	}
+	return ts.metrics, true
+}
+
+// Tenants returns the names of the known tenants in sorted order.
+func (m *StateManager) Tenants() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.tenants))
+	for name := range m.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes every idle state. Running states are closed when their
+// execution ends, and later calls to Do fail.
+func (m *StateManager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for _, ts := range m.tenants {
+		if ts.L != nil && !ts.busy {
+			ts.L.Close()
+			ts.L = nil
+		}
+	}
+}
+
+/* }}} */
@@ -9,6 +9,10 @@ func OpenMath(L *LState) int {
 	mod := L.RegisterModule(MathLibName, mathFuncs).(*LTable)
 	mod.RawSetString("pi", LNumber(math.Pi))
 	mod.RawSetString("huge", LNumber(math.MaxFloat64))
+	// numbers are floats: the bounds of the numbers that have an integer
+	// representation, see luaToInteger
+	mod.RawSetString("maxinteger", LNumber(math.Nextafter(1<<63, 0)))
+	mod.RawSetString("mininteger", LNumber(-(1 << 63)))
 	L.Push(mod)
 	return 1
 }
@@ -36,13 +40,16 @@ var mathFuncs = map[string]LGFunction{
 	"modf":       mathModf,
 	"pow":        mathPow,
 	"rad":        mathRad,
-	"random":     mathRandom,
+	"random":     Nondeterministic("math.random", mathRandom),
 	"randomseed": mathRandomseed,
 	"sin":        mathSin,
 	"sinh":       mathSinh,
 	"sqrt":       mathSqrt,
 	"tan":        mathTan,
 	"tanh":       mathTanh,
+	"tointeger":  mathToInteger,
+	"type":       mathType,
+	"ult":        mathUlt,
 }
 
 func mathAbs(L *LState) int {
@@ -160,6 +167,7 @@ func mathMin(L *LState) int {
 }
 
 func mathMod(L *LState) int {
+	L.warnDeprecated("math.mod", "math.fmod")
 	lhs := L.CheckNumber(1)
 	rhs := L.CheckNumber(2)
 	L.Push(luaModulo(lhs, rhs))
@@ -184,22 +192,30 @@ func mathRad(L *LState) int {
 }
 
 func mathRandom(L *LState) int {
+	float64, intn := rand.Float64, rand.Intn
+	if r := L.G.rand; r != nil {
+		float64, intn = r.Float64, r.Intn
+	}
 	switch L.GetTop() {
 	case 0:
-		L.Push(LNumber(rand.Float64()))
+		L.Push(LNumber(float64()))
 	case 1:
 		n := L.CheckInt(1)
-		L.Push(LNumber(rand.Intn(n) + 1))
+		L.Push(LNumber(intn(n) + 1))
 	default:
 		min := L.CheckInt(1)
 		max := L.CheckInt(2) + 1
-		L.Push(LNumber(rand.Intn(max-min) + min))
+		L.Push(LNumber(intn(max-min) + min))
 	}
 	return 1
 }
 
 func mathRandomseed(L *LState) int {
-	rand.Seed(L.CheckInt64(1))
+	if r := L.G.rand; r != nil {
+		r.Seed(L.CheckInt64(1))
+	} else {
+		rand.Seed(L.CheckInt64(1))
+	}
 	return 0
 }
 
@@ -228,4 +244,42 @@ func mathTanh(L *LState) int {
 	return 1
 }
 
+func mathToInteger(L *LState) int {
+	if n, ok := L.CheckAny(1).(LNumber); ok {
+		if _, ok := luaToInteger(n); ok {
+			L.Push(n)
+			return 1
+		}
+	}
+	L.Push(LNil)
+	return 1
+}
+
+// mathType tells "integer" for the numbers that have an integer
+// representation, as numbers have no integer subtype.
+func mathType(L *LState) int {
+	n, ok := L.CheckAny(1).(LNumber)
+	if !ok {
+		L.Push(LNil)
+	} else if _, ok := luaToInteger(n); ok {
+		L.Push(LString("integer"))
+	} else {
+		L.Push(LString("float"))
+	}
+	return 1
+}
+
+func mathUlt(L *LState) int {
+	m, ok1 := luaToInteger(L.CheckNumber(1))
+	if !ok1 {
+		L.ArgError(1, "number has no integer representation")
+	}
+	n, ok2 := luaToInteger(L.CheckNumber(2))
+	if !ok2 {
+		L.ArgError(2, "number has no integer representation")
+	}
+	L.Push(LBool(uint64(m) < uint64(n)))
+	return 1
+}
+
 //
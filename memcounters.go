@@ -0,0 +1,65 @@
+package lua
+
+import "sync/atomic"
+
+/* memory counters {{{ */
+
+// MemoryCounters mirrors the memory accounting of a state so that it can be
+// read from other goroutines while the state runs, e.g. by a metrics
+// exporter. The state updates it as it allocates; reading GetAllocatedBytes
+// from another goroutine is a data race.
+type MemoryCounters struct {
+	allocated atomic.Int64
+	peak      atomic.Int64
+	limit     atomic.Int64
+	exceeded  atomic.Int64
+}
+
+// Allocated returns the last value of GetAllocatedBytes.
+func (c *MemoryCounters) Allocated() int64 {
+	return c.allocated.Load()
+}
+
+// Peak returns the last value of GetPeakAllocatedBytes.
+func (c *MemoryCounters) Peak() int64 {
+	return c.peak.Load()
+}
+
+// Limit returns the memory limit of the state (0 if none).
+func (c *MemoryCounters) Limit() int64 {
+	return c.limit.Load()
+}
+
+// LimitExceeded returns how many allocations failed because they exceeded
+// the memory limit of the state, its quota group or a budget.
+func (c *MemoryCounters) LimitExceeded() int64 {
+	return c.exceeded.Load()
+}
+
+// MemoryCounters returns the counters of ls, which it keeps up to date from
+// the first call on. It must be called from the goroutine that runs ls.
+func (ls *LState) MemoryCounters() *MemoryCounters {
+	if ls.counters == nil {
+		ls.counters = &MemoryCounters{}
+		ls.publishMemory()
+	}
+	return ls.counters
+}
+
+// publishMemory copies the accounting of ls to its counters.
+func (ls *LState) publishMemory() {
+	if c := ls.counters; c != nil {
+		c.allocated.Store(ls.allocatedBytes)
+		c.peak.Store(ls.peakBytes)
+		c.limit.Store(ls.maxBytes)
+	}
+}
+
+// countLimitExceeded counts an allocation of ls that did not fit.
+func (ls *LState) countLimitExceeded() {
+	if ls.counters != nil {
+		ls.counters.exceeded.Add(1)
+	}
+}
+
+/* }}} */
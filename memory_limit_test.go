@@ -1,6 +1,12 @@
 package lua
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -75,6 +81,22 @@ func TestMemoryLimit_TableInsert(t *testing.T) {
 	}
 }
 
+func TestMemoryLimit_TableMove(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	errorIfScriptFail(t, L, `src = {} for i = 1, 1000 do src[i] = i end`)
+	L.ResetMemoryUsage()
+	errorIfScriptFail(t, L, `dst = table.move(src, 1, #src, 1, {})`)
+	if allocated := L.GetAllocatedBytes(); allocated < 1000*L.sizing().ArraySlot {
+		t.Errorf("Expected table.move to charge the destination growth, got %d bytes", allocated)
+	}
+
+	L.ResetMemoryUsage()
+	L.SetMemoryLimit(4 * 1024)
+	errorIfScriptNotFail(t, L, `table.move(src, 1, #src, 1, {})`, "memory limit exceeded")
+}
+
 func TestMemoryLimit_ArrayGrowth(t *testing.T) {
 	L := NewState()
 	defer L.Close()
@@ -467,6 +489,34 @@ func TestMemoryLimit_StringChar(t *testing.T) {
 	}
 }
 
+func TestMemoryLimit_StringPack(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	L.ResetMemoryUsage()
+	L.SetMemoryLimit(1024 * 1024) // 1MB limit
+
+	err := L.DoString(`assert(#string.pack("c1000 s4 z", "", "abc", "de") == 1000 + 4 + 3 + 3)`)
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = L.DoString(`return string.pack("c1000000000", "")`)
+	runtime.ReadMemStats(&after)
+
+	if err == nil {
+		t.Fatal("Expected memory limit error, got nil")
+	}
+	if !strings.Contains(err.Error(), "memory limit exceeded") {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Errorf("Expected the refused string not to be built, %d bytes allocated", allocated)
+	}
+}
+
 func TestMemoryLimit_StringFormat(t *testing.T) {
 	L := NewState()
 	defer L.Close()
@@ -505,6 +555,20 @@ func TestMemoryLimit_StringFormat(t *testing.T) {
 	if !strings.Contains(err.Error(), "memory limit exceeded") {
 		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
 	}
+
+	// only %q can grow a string argument
+	L.SetMemoryLimit(0)
+	if err := L.DoString(`s = string.rep("x", 300 * 1024)`); err != nil {
+		t.Fatal(err)
+	}
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 700*1024)
+	if err := L.DoString(`local f = string.format("%s", s)`); err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	err = L.DoString(`local f = string.format("%q", s)`)
+	if err == nil || !strings.Contains(err.Error(), "bytes requested") {
+		t.Errorf("Expected a memory limit error with the requested size, got: %v", err)
+	}
 }
 
 func TestMemoryLimit_StringSub(t *testing.T) {
@@ -795,3 +859,977 @@ func TestMemoryLimit_RecursiveTable(t *testing.T) {
 		t.Error("Expected non-zero memory allocation for recursive tables")
 	}
 }
+
+func TestMemoryLimit_Coroutines(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	L.ResetMemoryUsage()
+	L.SetCoroutineMemoryLimit(256 * 1024)
+
+	err := L.DoString(`
+		local runaway = coroutine.create(function()
+			local t = {}
+			for i = 1, 100000 do
+				t[i] = {}
+			end
+		end)
+		local ok, msg = coroutine.resume(runaway)
+		assert(not ok and msg:find("memory limit exceeded"), msg)
+
+		local co = coroutine.create(function()
+			local t = {}
+			for i = 1, 100 do
+				t[i] = {}
+			end
+			return #t
+		end)
+		local ok, n = coroutine.resume(co)
+		assert(ok and n == 100, n)
+	`)
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+
+	// coroutine allocations count against the limit of the main state too
+	if L.GetAllocatedBytes() < 64*1024 {
+		t.Errorf("Expected coroutine allocations to be charged to the main state, got %d bytes", L.GetAllocatedBytes())
+	}
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 128*1024)
+	err = L.DoString(`
+		local co = coroutine.create(function()
+			local t = {}
+			for i = 1, 10000 do
+				t[i] = {}
+			end
+		end)
+		local ok, msg = coroutine.resume(co)
+		assert(not ok and msg:find("memory limit exceeded"), msg)
+	`)
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+}
+
+func TestMemoryLimit_Threshold(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	L.ResetMemoryUsage()
+	L.SetMemoryLimit(1024 * 1024)
+	var calls []uint64
+	L.SetMemoryThreshold(100*1024, func(used, limit uint64) {
+		calls = append(calls, used)
+		if limit != 1024*1024 {
+			t.Errorf("Expected limit %d, got %d", 1024*1024, limit)
+		}
+	})
+
+	err := L.DoString(`
+		local t = {}
+		for i = 1, 2000 do
+			t[i] = {}
+		end
+	`)
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if len(calls) != 1 || calls[0] < 100*1024 {
+		t.Fatalf("Expected one call above the threshold, got %v", calls)
+	}
+
+	// the callback fires again once the usage dropped below the threshold
+	L.ResetMemoryUsage()
+	err = L.DoString(`
+		local t = {}
+		for i = 1, 2000 do
+			t[i] = {}
+		end
+	`)
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if len(calls) != 2 {
+		t.Errorf("Expected two calls, got %v", calls)
+	}
+}
+
+type testBlob struct{ data []byte }
+
+func (b *testBlob) LuaSize() uint64 { return uint64(len(b.data)) }
+
+func TestMemoryLimit_UserDataSize(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	L.ResetMemoryUsage()
+	L.SetMemoryLimit(64 * 1024)
+	L.NewUserDataWithSize(make([]byte, 16*1024), 16*1024)
+	if L.GetAllocatedBytes() < 16*1024 {
+		t.Errorf("Expected the payload to be charged, got %d bytes", L.GetAllocatedBytes())
+	}
+
+	L.SetGlobal("blob", L.NewFunction(func(L *LState) int {
+		L.Push(L.ToLValue(&testBlob{data: make([]byte, 16*1024)}))
+		return 1
+	}))
+	err := L.DoString(`
+		local blobs = {}
+		for i = 1, 10 do
+			blobs[i] = blob()
+		end
+	`)
+	if err == nil || !strings.Contains(err.Error(), "memory limit exceeded") {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+
+	// a size the counters cannot hold is rejected instead of wrapping around
+	for _, size := range []uint64{math.MaxUint64, math.MaxInt64} {
+		L := NewState()
+		used := L.GetAllocatedBytes()
+		L.SetGlobal("huge", L.NewFunction(func(L *LState) int {
+			L.Push(L.ToLValue(&hugeBlob{size: size}))
+			return 1
+		}))
+		err := L.DoString(`huge()`)
+		if err == nil || !strings.Contains(err.Error(), "userdata too large") {
+			t.Errorf("Expected 'userdata too large' error for %d bytes, got: %v", size, err)
+		}
+		if L.GetAllocatedBytes() < used {
+			t.Errorf("Expected the usage to stay above %d bytes, got %d", used, L.GetAllocatedBytes())
+		}
+		L.Close()
+	}
+}
+
+type hugeBlob struct{ size uint64 }
+
+func (b *hugeBlob) LuaSize() uint64 { return b.size }
+
+func TestMemoryLimit_Peak(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	L.ResetMemoryUsage()
+	L.ResetPeak()
+	if L.GetPeakAllocatedBytes() != 0 {
+		t.Errorf("Expected a peak of 0, got %d", L.GetPeakAllocatedBytes())
+	}
+	if err := L.DoString(`local s = string.rep("x", 100000)`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	peak := L.GetPeakAllocatedBytes()
+	if peak < 100000 {
+		t.Errorf("Expected a peak of at least 100000 bytes, got %d", peak)
+	}
+
+	L.ResetMemoryUsage()
+	if L.GetPeakAllocatedBytes() != peak {
+		t.Errorf("Expected ResetMemoryUsage to keep the peak, got %d", L.GetPeakAllocatedBytes())
+	}
+	L.ResetPeak()
+	if L.GetPeakAllocatedBytes() != L.GetAllocatedBytes() {
+		t.Errorf("Expected the peak to be reset to %d, got %d", L.GetAllocatedBytes(), L.GetPeakAllocatedBytes())
+	}
+}
+
+func TestMemoryLimit_RecomputeMemoryUsage(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	base := L.RecomputeMemoryUsage()
+	L.SetMemoryLimit(base + 512*1024)
+	// each round allocates more than the limit leaves, but keeps nothing
+	for i := 0; i < 3; i++ {
+		if err := L.DoString(`
+			local t = {}
+			for i = 1, 1000 do t[i] = string.rep("x", 100) .. i end
+			t = nil
+		`); err != nil {
+			t.Fatalf("Expected success in round %d, got error: %v", i, err)
+		}
+		before := L.GetAllocatedBytes()
+		after := L.RecomputeMemoryUsage()
+		if after >= before || after != L.GetAllocatedBytes() {
+			t.Fatalf("Expected the usage to go down from %d bytes, got %d", before, after)
+		}
+		if after > base+16*1024 {
+			t.Errorf("Expected about %d bytes once the table is released, got %d", base, after)
+		}
+	}
+	if L.GetPeakAllocatedBytes() <= L.GetAllocatedBytes() {
+		t.Errorf("Expected the peak to be kept, got %d", L.GetPeakAllocatedBytes())
+	}
+
+	if err := L.DoString(`kept = string.rep("y", 100000)`); err != nil {
+		t.Fatal(err)
+	}
+	if used := L.RecomputeMemoryUsage(); used < base+100000 {
+		t.Errorf("Expected the reachable string to stay charged, got %d bytes", used)
+	}
+}
+
+func TestMemoryLimit_GetMemoryStats(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	before := L.GetMemoryStats()
+	if before.Tables == 0 || before.Closures == 0 || before.Strings == 0 || before.Coroutines != 0 {
+		t.Errorf("Unexpected stats of a new state: %+v", before)
+	}
+	if err := L.DoString(`
+		tables = {}
+		for i = 1, 10 do tables[i] = {} end
+		fns = {}
+		for i = 1, 5 do fns[i] = function() return i end end
+		co = coroutine.create(function() coroutine.yield() end)
+		coroutine.resume(co)
+		s1, s2 = string.rep("a", 1000), string.rep("b", 1000)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("ud", L.NewUserData())
+	after := L.GetMemoryStats()
+	if grown := after.Tables - before.Tables; grown != 12 {
+		t.Errorf("Expected 12 more tables, got %d", grown)
+	}
+	if grown := after.Closures - before.Closures; grown != 6 {
+		t.Errorf("Expected 6 more closures, got %d", grown)
+	}
+	if after.Coroutines != 1 || after.UserData != before.UserData+1 {
+		t.Errorf("Expected a coroutine and a userdata more, got %+v", after)
+	}
+	if after.Strings < before.Strings+2 || after.Size.Strings < before.Size.Strings+2000 {
+		t.Errorf("Expected the strings to be counted, got %+v", after)
+	}
+	if after.Size != *L.EstimateSize() || after.AllocatedBytes != L.GetAllocatedBytes() ||
+		after.PeakAllocatedBytes != L.GetPeakAllocatedBytes() {
+		t.Errorf("Expected the stats to match EstimateSize and GetAllocatedBytes, got %+v", after)
+	}
+
+	if err := L.DoString(`tables, fns, co = nil, nil, nil`); err != nil {
+		t.Fatal(err)
+	}
+	if stats := L.GetMemoryStats(); stats.Tables != before.Tables || stats.Coroutines != 0 {
+		t.Errorf("Expected the released objects not to be counted, got %+v", stats)
+	}
+}
+
+func TestMemoryLimit_HostAllocations(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	L.ResetMemoryUsage()
+	L.SetMemoryLimit(256 * 1024)
+	L.SetGlobal("big", L.NewFunction(func(L *LState) int {
+		L.Push(L.NewString(strings.Repeat("x", 16*1024)))
+		return 1
+	}))
+	err := L.DoString(`
+		local strs = {}
+		for i = 1, 100 do
+			strs[i] = big()
+		end
+	`)
+	if err == nil || !strings.Contains(err.Error(), "memory limit exceeded") {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+
+	L.ResetMemoryUsage()
+	before := L.GetAllocatedBytes()
+	tb := L.NewTable()
+	for i := 0; i < 1000; i++ {
+		L.SetField(tb, fmt.Sprintf("key%d", i), LNumber(i))
+	}
+	if grown := L.GetAllocatedBytes() - before; grown < 1000*48 {
+		t.Errorf("Expected the hash part to be charged, got %d bytes", grown)
+	}
+
+	L.ResetMemoryUsage()
+	err = L.DoString(`
+		local t = {}
+		for i = 1, 100000 do
+			t["k" .. i] = true
+		end
+	`)
+	if err == nil || !strings.Contains(err.Error(), "memory limit exceeded") {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+}
+
+func TestMemoryLimit_HostStrings(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	blob := strings.Repeat("s", 1024*1024)
+	ShareString(blob)
+	defer UnshareString(blob)
+	before := L.GetAllocatedBytes()
+	for i := 0; i < 3; i++ {
+		L.Push(L.NewString(blob))
+	}
+	if grown := L.GetAllocatedBytes() - before; grown >= int64(len(blob)) {
+		t.Errorf("Expected a shared string to be charged its header only, got %d bytes", grown)
+	}
+	L.SetTop(0)
+
+	before = L.GetAllocatedBytes()
+	L.Push(L.NewString(strings.Repeat("y", 64*1024)))
+	if grown := L.GetAllocatedBytes() - before; grown < 64*1024 {
+		t.Errorf("Expected a new string to be charged, got %d bytes", grown)
+	}
+	before = L.GetAllocatedBytes()
+	L.Push(L.ToLValue([]byte(strings.Repeat("z", 64*1024))))
+	if grown := L.GetAllocatedBytes() - before; grown < 64*1024 {
+		t.Errorf("Expected a converted string to be charged, got %d bytes", grown)
+	}
+	L.SetTop(0)
+
+	// a string the host holds is charged when it is created, not each time
+	// it is returned
+	config := L.NewString(strings.Repeat("c", 1024))
+	L.SetGlobal("config", L.NewFunction(func(L *LState) int {
+		L.Push(config)
+		return 1
+	}))
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 256*1024)
+	if err := L.DoString(`
+		local conf = {}
+		for i = 1, 10000 do
+			local c = config()
+			conf.value = c
+		end
+	`); err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+}
+
+func TestMemoryLimit_QuotaGroup(t *testing.T) {
+	g := NewQuotaGroup(0)
+	L1 := NewState()
+	defer L1.Close()
+	L2 := NewState()
+	L1.JoinQuotaGroup(g)
+	L2.JoinQuotaGroup(g)
+	if g.States() != 2 {
+		t.Errorf("Expected 2 states, got %d", g.States())
+	}
+	if g.Used() != L1.GetAllocatedBytes()+L2.GetAllocatedBytes() {
+		t.Errorf("Expected %d bytes used, got %d", L1.GetAllocatedBytes()+L2.GetAllocatedBytes(), g.Used())
+	}
+
+	g.SetLimit(g.Used() + 256*1024)
+	if err := L1.DoString(`s = string.rep("x", 200 * 1024)`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	err := L2.DoString(`s = string.rep("x", 200 * 1024)`)
+	if !errors.Is(err, ErrMemoryLimitExceeded) || !strings.Contains(err.Error(), "memory quota exceeded") {
+		t.Errorf("Expected 'memory quota exceeded' error, got: %v", err)
+	}
+
+	L2.Close()
+	if g.States() != 1 || g.Used() != L1.GetAllocatedBytes() {
+		t.Errorf("Expected the closed state to leave the group, got %d states and %d bytes", g.States(), g.Used())
+	}
+	L1.ResetMemoryUsage()
+	if g.Used() != 0 {
+		t.Errorf("Expected 0 bytes used, got %d", g.Used())
+	}
+}
+
+func TestMemoryLimit_ScriptAPI(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	if err := L.DoString(`
+		assert(memory.limit() == nil and memory.remaining() == nil)
+		assert(memory.used() > 0)
+		assert(collectgarbage("count") == memory.used() / 1024)
+	`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 512*1024)
+	err := L.DoString(`
+		assert(memory.limit() == memory.used() + memory.remaining())
+		local before = memory.remaining()
+		local s = string.rep("x", 100000)
+		assert(memory.remaining() <= before - 100000)
+
+		-- stop before the limit is hit
+		local chunks = {}
+		while memory.remaining() > 64 * 1024 do
+			chunks[#chunks + 1] = string.rep("x", 16 * 1024)
+		end
+	`)
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+
+	g := NewQuotaGroup(L.GetAllocatedBytes() + 32*1024)
+	L.JoinQuotaGroup(g)
+	if err := L.DoString(`assert(memory.remaining() < 32 * 1024)`); err != nil {
+		t.Errorf("Expected the quota group to bound the remaining memory, got error: %v", err)
+	}
+}
+
+func TestMemoryLimit_CallStack(t *testing.T) {
+	L := NewState(Options{MinimizeStackMemory: true, CallStackSize: 1000000, RegistryMaxSize: 10000000})
+	defer L.Close()
+
+	L.ResetMemoryUsage()
+	if err := L.DoString(`
+		local function depth(n) if n == 0 then return 0 end return 1 + depth(n - 1) end
+		assert(depth(1000) == 1000)
+	`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	// the frames of returned calls are given back
+	used := L.GetAllocatedBytes()
+	if err := L.DoString(`
+		local function depth(n) if n == 0 then return 0 end return 1 + depth(n - 1) end
+		assert(depth(1000) == 1000)
+	`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if grown := L.GetAllocatedBytes() - used; grown > 10*1024 {
+		t.Errorf("Expected the call stack to be released, got %d bytes more", grown)
+	}
+
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 1024*1024)
+	err := L.DoString(`
+		local function depth(n) if n == 0 then return 0 end return 1 + depth(n - 1) end
+		depth(500000)
+	`)
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+}
+
+func TestAllocHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	bytes := map[AllocKind]uint64{}
+	lines := map[int]uint64{}
+	L.SetAllocHook(func(kind AllocKind, n uint64, source string, line int) {
+		bytes[kind] += n
+		if source == "<string>" {
+			lines[line] += n
+		}
+	})
+	if err := L.DoString(`
+		local t = {}
+		local s = string.rep("x", 100000)
+		local co = coroutine.wrap(function() return {1, 2, 3} end)
+		co()
+	`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if bytes[AllocTable] == 0 || bytes[AllocFunction] == 0 || bytes[AllocString] < 100000 {
+		t.Errorf("Expected table, function and string allocations, got %v", bytes)
+	}
+	if lines[3] < 100000 {
+		t.Errorf("Expected the string to be allocated on line 3, got %v", lines)
+	}
+	if lines[4] == 0 {
+		t.Errorf("Expected the allocations of the coroutine on line 4, got %v", lines)
+	}
+
+	L.SetAllocHook(nil)
+	bytes = map[AllocKind]uint64{}
+	if err := L.DoString(`local t = {}`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if len(bytes) != 0 {
+		t.Errorf("Expected the hook to be removed, got %v", bytes)
+	}
+}
+
+func TestMemoryLimit_CoroutineCreation(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	L.ResetMemoryUsage()
+	co, _ := L.NewThread()
+	if co.GetAllocatedBytes() < int64(RegistrySize)*16 {
+		t.Errorf("Expected the registry of the coroutine to be charged, got %d bytes", co.GetAllocatedBytes())
+	}
+	if L.GetAllocatedBytes() < co.GetAllocatedBytes() {
+		t.Errorf("Expected the coroutine to be charged to its parent, got %d bytes", L.GetAllocatedBytes())
+	}
+
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 1024*1024)
+	err := L.DoString(`
+		local cos = {}
+		for i = 1, 1000 do
+			cos[i] = coroutine.create(function() end)
+		end
+	`)
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+}
+
+func TestMemoryLimit_CoroutineClose(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	err := L.DoString(`
+		cos = {}
+		for i = 1, 100 do
+			cos[i] = coroutine.create(function() coroutine.yield() end)
+			coroutine.resume(cos[i])
+		end
+	`)
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	before := L.GetAllocatedBytes()
+	if err := L.DoString(`for _, co in ipairs(cos) do coroutine.close(co) end`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if freed := before - L.GetAllocatedBytes(); freed < 100*int64(RegistrySize)*16 {
+		t.Errorf("Expected the registries of the coroutines to be released, got %d bytes", freed)
+	}
+	if L.GetCoroutineCount() != 0 {
+		t.Errorf("Expected no coroutine alive, got %d", L.GetCoroutineCount())
+	}
+}
+
+func TestMemoryLimit_SizingModel(t *testing.T) {
+	model := DefaultSizingModel
+	model.Table = 1000
+	model.StringHeader = 500
+	L := NewState(Options{SizingModel: &model})
+	defer L.Close()
+
+	before := L.GetAllocatedBytes()
+	L.NewTable()
+	if grown := L.GetAllocatedBytes() - before; grown < 1000 {
+		t.Errorf("Expected a table to cost at least 1000 bytes, got %d", grown)
+	}
+	before = L.GetAllocatedBytes()
+	L.Push(L.NewString("abc"))
+	if grown := L.GetAllocatedBytes() - before; grown != 503 {
+		t.Errorf("Expected a string of 3 bytes to cost 503 bytes, got %d", grown)
+	}
+	L.Pop(1)
+
+	// coroutines share the model of their parent
+	co, _ := L.NewThread()
+	before = co.GetAllocatedBytes()
+	co.NewTable()
+	if grown := co.GetAllocatedBytes() - before; grown < 1000 {
+		t.Errorf("Expected a table of a coroutine to cost at least 1000 bytes, got %d", grown)
+	}
+
+	D := NewState()
+	defer D.Close()
+	if got, want := L.EstimateSize().Tables, D.EstimateSize().Tables; got <= want {
+		t.Errorf("Expected EstimateSize to use the sizing model, got %d tables bytes, default is %d", got, want)
+	}
+}
+
+func TestMemoryLimit_GCRetry(t *testing.T) {
+	garbage := `
+		for i = 1, 100 do
+			local s = string.rep("x", 50000)
+		end
+	`
+	L := NewState()
+	defer L.Close()
+
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 300*1024)
+	if err := L.DoString(garbage); !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+
+	L.SetMemoryPolicy(MemoryPolicyGCRetry)
+	L.CollectGarbage()
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 300*1024)
+	if err := L.DoString(garbage); err != nil {
+		t.Errorf("Expected the garbage to be collected, got error: %v", err)
+	}
+
+	err := L.DoString(`
+		local live = {}
+		for i = 1, 100 do
+			live[i] = string.rep("x", 50000)
+		end
+	`)
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+}
+
+func TestMemoryLimit_CompiledChunks(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	before := L.GetAllocatedBytes()
+	if _, err := L.LoadString(`local a, b = "compiled", "constants" return a .. b`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if L.GetAllocatedBytes()-before < int64(len("compiledconstants")) {
+		t.Errorf("Expected the chunk to be charged, got %d bytes", L.GetAllocatedBytes()-before)
+	}
+
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 256*1024)
+	source := strings.Repeat("x = 1 ", 50000)
+	if _, err := L.LoadString(source); !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+	err := L.DoString(`
+		local fn, msg = loadstring(string.rep("x = 1 ", 20000))
+		assert(fn == nil and msg:find("memory limit exceeded"), msg)
+	`)
+	if err != nil {
+		t.Errorf("Expected load to fail cleanly, got error: %v", err)
+	}
+}
+
+func TestMemoryLimit_GsubBuffers(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	if err := L.DoString(`s = string.rep("x", 10000)`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	L.ResetMemoryUsage()
+	L.ResetPeak()
+	if err := L.DoString(`r = s:gsub("x", "yy")`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	used, peak := L.GetAllocatedBytes(), L.GetPeakAllocatedBytes()
+	// the 10000 matches and replacements are charged while the result is built
+	if peak < used+10000*2 {
+		t.Errorf("Expected the temporary buffers in the peak, got %d bytes used and a peak of %d", used, peak)
+	}
+	if used > 2*20000 {
+		t.Errorf("Expected the temporary buffers to be released, got %d bytes", used)
+	}
+
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 100*1024)
+	err := L.DoString(`r = s:gsub("x", "yy")`)
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+}
+
+func TestMemoryLimit_CallWithBudget(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	if err := L.DoString(`
+		function fill(n)
+			local t = {}
+			for i = 1, n do t[i] = string.rep("x", 100) .. i end
+			return #t
+		end
+	`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	fill := L.GetGlobal("fill")
+
+	results, err := L.CallWithBudget(512*1024, fill, LNumber(10))
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if len(results) != 1 || results[0] != LNumber(10) {
+		t.Errorf("Expected the results of the call, got %v", results)
+	}
+
+	_, err = L.CallWithBudget(64*1024, fill, LNumber(100000))
+	if !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Fatalf("Expected 'memory budget exceeded' error, got: %v", err)
+	}
+	if errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected a budget error, not a limit error")
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("Expected an empty stack, got %d values", L.GetTop())
+	}
+
+	// the budget is gone once the call returns
+	if err := L.CallByParam(P{Fn: fill, NRet: 1, Protect: true}, LNumber(2000)); err != nil {
+		t.Errorf("Expected success without a budget, got error: %v", err)
+	}
+	L.Pop(1)
+
+	// the state limit still applies within a larger budget
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 64*1024)
+	_, err = L.CallWithBudget(1<<30, fill, LNumber(100000))
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+	L.SetMemoryLimit(0)
+
+	// nested budgets and coroutines are charged to the enclosing budget
+	L.SetGlobal("budgeted", L.NewFunction(func(L *LState) int {
+		_, err := L.CallWithBudget(1<<30, L.CheckFunction(1), L.CheckNumber(2))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		return 0
+	}))
+	if err := L.DoString(`
+		function nested(n)
+			local co = coroutine.wrap(function() budgeted(fill, n) end)
+			co()
+		end
+	`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	_, err = L.CallWithBudget(512*1024, L.GetGlobal("nested"), LNumber(100000))
+	if err == nil || !strings.Contains(err.Error(), "memory budget exceeded") {
+		t.Errorf("Expected 'memory budget exceeded' error, got: %v", err)
+	}
+}
+
+func TestMemoryLimit_ReserveMemory(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	base := L.GetAllocatedBytes()
+	L.SetMemoryLimit(base + 1024*1024)
+
+	if err := L.ReserveMemory(512 * 1024); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if used := L.GetAllocatedBytes() - base; used != 512*1024 {
+		t.Errorf("Expected 524288 reserved bytes, got %d", used)
+	}
+
+	err := L.ReserveMemory(768 * 1024)
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+	if used := L.GetAllocatedBytes() - base; used != 512*1024 {
+		t.Errorf("Expected a failed reservation to charge nothing, got %d bytes", used)
+	}
+
+	L.ReleaseMemory(512 * 1024)
+	if used := L.GetAllocatedBytes(); used != base {
+		t.Errorf("Expected %d bytes after the release, got %d", base, used)
+	}
+	if err := L.ReserveMemory(768 * 1024); err != nil {
+		t.Errorf("Expected success after the release, got error: %v", err)
+	}
+	L.ReleaseMemory(768 * 1024)
+
+	// reservations made by Go functions count against the limit of scripts
+	L.SetGlobal("decode", L.NewFunction(func(L *LState) int {
+		if err := L.ReserveMemory(int64(L.CheckInt(1))); err != nil {
+			L.RaiseError("%v", err)
+		}
+		return 0
+	}))
+	if err := L.DoString(`decode(900 * 1024)`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if err := L.DoString(`local s = string.rep("x", 200 * 1024)`); err == nil {
+		t.Errorf("Expected the script to hit the limit")
+	}
+}
+
+func TestMemoryLimit_TableSort(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	if err := L.DoString(`t = {} for i = 1, 20000 do t[i] = i end`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 1024*1024)
+
+	if err := L.DoString(`table.sort(t, function(a, b) return a > b end)`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	err := L.DoString(`table.sort(t, function(a, b) return tostring(a) .. "x" < tostring(b) .. "x" end)`)
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected the comparator to hit the limit, got: %v", err)
+	}
+}
+
+func TestMemoryLimit_PreflightStringSize(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	if err := L.DoString(`a = string.rep("x", 4 * 1024 * 1024)`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 64*1024)
+
+	for _, src := range []string{
+		`b = a .. a`,
+		`b = table.concat({a, a})`,
+		`b = string.rep(a, 2)`,
+		`b = string.format("%s%s", a, a)`,
+		`b = string.format(string.rep("%1000000d", 100), 1, 2, 3, 4, 5)`,
+	} {
+		var before, after runtime.MemStats
+		used := L.GetAllocatedBytes()
+		runtime.ReadMemStats(&before)
+		err := L.DoString(src)
+		runtime.ReadMemStats(&after)
+		if !errors.Is(err, ErrMemoryLimitExceeded) {
+			t.Errorf("%s: expected 'memory limit exceeded' error, got: %v", src, err)
+		}
+		// a refused result is not charged either
+		if charged := L.GetAllocatedBytes() - used; charged > 16*1024 {
+			t.Errorf("%s: expected the refused result not to be charged, got %d bytes", src, charged)
+		}
+		// the result is refused before it is built
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2*1024*1024 {
+			t.Errorf("%s: expected no allocation of the result, got %d bytes", src, allocated)
+		}
+	}
+
+	// the state still allocates normally after a caught refusal
+	peak := L.GetPeakAllocatedBytes()
+	if err := L.DoString(`
+	assert(not pcall(string.rep, "x", 2^40))
+	assert(not pcall(function() return a .. a end))
+	local s = string.rep("y", 1024) .. "z"
+	`); err != nil {
+		t.Errorf("Expected success after a refused string, got error: %v", err)
+	}
+	if L.GetPeakAllocatedBytes()-peak > 16*1024 {
+		t.Errorf("Expected refused strings not to raise the peak, got %d", L.GetPeakAllocatedBytes())
+	}
+
+	L.SetMemoryLimit(0)
+	if err := L.DoString(`b = string.rep("xx", 2^62)`); err == nil || !strings.Contains(err.Error(), "resulting string too large") {
+		t.Errorf("Expected 'resulting string too large' error, got: %v", err)
+	}
+}
+
+func TestMemoryLimit_MemoryCounters(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	c := L.MemoryCounters()
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 64*1024)
+	if c.Allocated() != L.GetAllocatedBytes() || c.Limit() != L.GetMemoryLimit() {
+		t.Errorf("Expected the counters to mirror the state, got %d/%d", c.Allocated(), c.Limit())
+	}
+
+	if err := L.DoString(`local s = string.rep("x", 16 * 1024)`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if c.Allocated() != L.GetAllocatedBytes() || c.Peak() != L.GetPeakAllocatedBytes() {
+		t.Errorf("Expected the counters to follow allocations, got %d/%d", c.Allocated(), c.Peak())
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := L.DoString(`local s = string.rep("x", 128 * 1024)`); err == nil {
+			t.Fatal("Expected memory limit error, got nil")
+		}
+	}
+	if n := c.LimitExceeded(); n != 2 {
+		t.Errorf("Expected 2 exceeded limits, got %d", n)
+	}
+
+	L.CollectGarbage()
+	if c.Allocated() != L.GetAllocatedBytes() {
+		t.Errorf("Expected the counters to follow CollectGarbage, got %d", c.Allocated())
+	}
+}
+
+func TestMemoryLimit_Channels(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 1024*1024)
+	if err := L.DoString(`channel.make(1e12)`); !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+
+	// values stashed in a channel stay charged after a collection
+	if err := L.DoString(`
+		local ch = channel.make(1000)
+		for i = 1, 100 do ch:send(string.rep("x", 1024) .. i) end
+		stash = ch
+	`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	ch := L.GetGlobal("stash").(LChannel)
+	L.SetGlobal("stash", LNil)
+	L.CollectGarbage()
+	if used := L.GetAllocatedBytes(); used < 100*1024 {
+		t.Errorf("Expected the buffered values to stay charged, got %d bytes", used)
+	}
+
+	// and are credited once received, here by Go code
+	before := L.GetAllocatedBytes()
+	for i := 0; i < 100; i++ {
+		<-ch
+	}
+	L.CollectGarbage()
+	if used := L.GetAllocatedBytes(); used > before-100*1024 {
+		t.Errorf("Expected received values to be credited, got %d bytes, %d before", used, before)
+	}
+
+	// a script can not stash more than its limit
+	err := L.DoString(`
+		local ch = channel.make(100000)
+		for i = 1, 100000 do ch:send(string.rep("z", 1024) .. i) end
+	`)
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("Expected 'memory limit exceeded' error, got: %v", err)
+	}
+}
+
+func TestMemoryLimit_IoBuffers(t *testing.T) {
+	dir := t.TempDir()
+	small, large := filepath.Join(dir, "small"), filepath.Join(dir, "large")
+	if err := os.WriteFile(small, []byte(strings.Repeat("x", 100*1024)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(large, []byte(strings.Repeat("x", 2*1024*1024)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("small", LString(small))
+	L.SetGlobal("large", LString(large))
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 512*1024)
+
+	before := L.GetAllocatedBytes()
+	if err := L.DoString(`
+		local f = io.open(small)
+		s = f:read("*a")
+		f:close()
+	`); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	// the result is charged, the buffers used to read it are not
+	if used := L.GetAllocatedBytes() - before; used < 100*1024 || used > 140*1024 {
+		t.Errorf("Expected about 100KB to be charged, got %d bytes", used)
+	}
+	L.SetGlobal("s", LNil)
+	L.CollectGarbage()
+
+	for _, src := range []string{
+		`local f = io.open(large) local s = f:read("*a") f:close()`,
+		`local f = io.open(large) local s = f:read(4 * 1024 * 1024) f:close()`,
+		`local f = io.open(large) local s = f:read("*l") f:close()`,
+		`local f = io.open(large .. ".out", "w") f:setvbuf("full", 1e12) f:close()`,
+	} {
+		if err := L.DoString(src); !errors.Is(err, ErrMemoryLimitExceeded) {
+			t.Errorf("%s: expected 'memory limit exceeded' error, got: %v", src, err)
+		}
+		L.CollectGarbage()
+	}
+
+	// a huge size does not allocate a huge buffer up front
+	if err := L.DoString(`
+		local f = io.open(small)
+		s = f:read(1e12)
+		f:close()
+		assert(#s == 100 * 1024)
+	`); err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+}
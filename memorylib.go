@@ -0,0 +1,62 @@
+package lua
+
+func OpenMemory(L *LState) int {
+	mod := L.RegisterModule(MemoryLibName, memoryFuncs)
+	L.Push(mod)
+	return 1
+}
+
+var memoryFuncs = map[string]LGFunction{
+	"used":      memoryUsed,
+	"limit":     memoryLimit,
+	"remaining": memoryRemaining,
+}
+
+// memoryRemaining returns the bytes ls may still allocate before it hits the
+// tightest of its limits, including those of the states that created it and
+// of their quota groups and budgets, and false if there is no limit.
+func (ls *LState) memoryRemaining() (int64, bool) {
+	remaining, limited := int64(0), false
+	bound := func(r int64) {
+		if !limited || r < remaining {
+			remaining, limited = r, true
+		}
+	}
+	for st := ls; st != nil; st = st.memParent {
+		if st.maxBytes > 0 {
+			bound(st.maxBytes - st.allocatedBytes)
+		}
+		if st.quota != nil {
+			if limit := st.quota.Limit(); limit > 0 {
+				bound(limit - st.quota.Used())
+			}
+		}
+		if r, ok := st.budgetRemaining(); ok {
+			bound(r)
+		}
+	}
+	return max(remaining, 0), limited
+}
+
+func memoryUsed(L *LState) int {
+	L.Push(LNumber(L.GetAllocatedBytes()))
+	return 1
+}
+
+func memoryLimit(L *LState) int {
+	if limit := L.GetMemoryLimit(); limit > 0 {
+		L.Push(LNumber(limit))
+	} else {
+		L.Push(LNil)
+	}
+	return 1
+}
+
+func memoryRemaining(L *LState) int {
+	if remaining, ok := L.memoryRemaining(); ok {
+		L.Push(LNumber(remaining))
+	} else {
+		L.Push(LNil)
+	}
+	return 1
+}
@@ -0,0 +1,179 @@
+// Package metrics exports the memory accounting of Lua states to expvar and
+// Prometheus.
+//
+// An Exporter reads the lua.MemoryCounters of the states registered with it,
+// so it can be scraped while the states run:
+//
+//	exp := metrics.NewExporter()
+//	exp.Register("worker-1", L)
+//	expvar.Publish("lua_memory", exp)
+//	http.Handle("/metrics", exp)
+//
+// The package does not depend on the Prometheus client. Its Metrics can be
+// turned into a prometheus.Collector with a few lines:
+//
+//	func (c collector) Collect(ch chan<- prometheus.Metric) {
+//		for _, m := range c.exp.Metrics() {
+//			typ := prometheus.GaugeValue
+//			if m.Counter {
+//				typ = prometheus.CounterValue
+//			}
+//			desc := prometheus.NewDesc(m.Name, m.Help, []string{"state"}, nil)
+//			ch <- prometheus.MustNewConstMetric(desc, typ, m.Value, m.State)
+//		}
+//	}
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Metric is the value of one metric of one state.
+type Metric struct {
+	// Name is the name of the metric, e.g. "lua_memory_allocated_bytes".
+	Name string
+	Help string
+	// Counter tells whether the metric only grows; it is a gauge otherwise.
+	Counter bool
+	// State is the name the state was registered with.
+	State string
+	Value float64
+}
+
+// Sample is the memory accounting of one state.
+type Sample struct {
+	State         string `json:"state"`
+	Allocated     int64  `json:"allocated"`
+	Peak          int64  `json:"peak"`
+	Limit         int64  `json:"limit"`
+	LimitExceeded int64  `json:"limit_exceeded"`
+}
+
+var descs = []struct {
+	name    string
+	help    string
+	counter bool
+	value   func(*Sample) int64
+}{
+	{"lua_memory_allocated_bytes", "Bytes allocated by the Lua state.", false,
+		func(s *Sample) int64 { return s.Allocated }},
+	{"lua_memory_peak_bytes", "Highest number of bytes allocated by the Lua state.", false,
+		func(s *Sample) int64 { return s.Peak }},
+	{"lua_memory_limit_bytes", "Memory limit of the Lua state, 0 if none.", false,
+		func(s *Sample) int64 { return s.Limit }},
+	{"lua_memory_limit_exceeded_total", "Allocations of the Lua state that exceeded a memory limit.", true,
+		func(s *Sample) int64 { return s.LimitExceeded }},
+}
+
+// Exporter exports the memory accounting of a set of named states. It is
+// safe for concurrent use and implements expvar.Var and http.Handler.
+type Exporter struct {
+	mu     sync.Mutex
+	states map[string]*lua.MemoryCounters
+}
+
+// NewExporter returns an exporter without states.
+func NewExporter() *Exporter {
+	return &Exporter{states: map[string]*lua.MemoryCounters{}}
+}
+
+// Register adds L under name, replacing the state registered under the
+// same name. It calls L.MemoryCounters, so it must be called from the
+// goroutine that runs L.
+func (e *Exporter) Register(name string, L *lua.LState) {
+	counters := L.MemoryCounters()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.states[name] = counters
+}
+
+// Unregister removes the state registered under name, e.g. once it is
+// closed.
+func (e *Exporter) Unregister(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.states, name)
+}
+
+// Samples returns the accounting of the registered states, sorted by name.
+func (e *Exporter) Samples() []Sample {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	samples := make([]Sample, 0, len(e.states))
+	for name, c := range e.states {
+		samples = append(samples, Sample{
+			State:         name,
+			Allocated:     c.Allocated(),
+			Peak:          c.Peak(),
+			Limit:         c.Limit(),
+			LimitExceeded: c.LimitExceeded(),
+		})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].State < samples[j].State })
+	return samples
+}
+
+// Metrics returns the metrics of the registered states, grouped by name.
+func (e *Exporter) Metrics() []Metric {
+	samples := e.Samples()
+	metrics := make([]Metric, 0, len(descs)*len(samples))
+	for _, d := range descs {
+		for i := range samples {
+			metrics = append(metrics, Metric{
+				Name:    d.name,
+				Help:    d.help,
+				Counter: d.counter,
+				State:   samples[i].State,
+				Value:   float64(d.value(&samples[i])),
+			})
+		}
+	}
+	return metrics
+}
+
+// String returns the samples as a JSON array, for expvar.
+func (e *Exporter) String() string {
+	b, err := json.Marshal(e.Samples())
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format.
+func (e *Exporter) WriteText(w io.Writer) error {
+	last := ""
+	for _, m := range e.Metrics() {
+		if m.Name != last {
+			typ := "gauge"
+			if m.Counter {
+				typ = "counter"
+			}
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, typ); err != nil {
+				return err
+			}
+			last = m.Name
+		}
+		if _, err := fmt.Fprintf(w, "%s{state=\"%s\"} %v\n", m.Name, labelEscaper.Replace(m.State), m.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	e.WriteText(w)
+}
+
+// labelEscaper escapes label values as the text exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
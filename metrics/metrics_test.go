@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestExporter(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.SetMemoryLimit(L.GetAllocatedBytes() + 64*1024)
+
+	exp := NewExporter()
+	exp.Register(`worker "1"`, L)
+	if err := L.DoString(`local s = string.rep("x", 128 * 1024)`); err == nil {
+		t.Fatal("Expected memory limit error, got nil")
+	}
+
+	var samples []Sample
+	if err := json.Unmarshal([]byte(exp.String()), &samples); err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].Allocated != L.GetAllocatedBytes() || samples[0].LimitExceeded != 1 {
+		t.Errorf("unexpected samples %+v", samples)
+	}
+
+	rec := httptest.NewRecorder()
+	exp.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE lua_memory_allocated_bytes gauge",
+		"# TYPE lua_memory_limit_exceeded_total counter",
+		`lua_memory_limit_exceeded_total{state="worker \"1\""} 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %q in\n%s", line, body)
+		}
+	}
+
+	exp.Unregister(`worker "1"`)
+	if n := len(exp.Metrics()); n != 0 {
+		t.Errorf("expected no metrics, got %d", n)
+	}
+}
@@ -0,0 +1,94 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* module searchers {{{ */
+
+// ModuleSource is a module found by a ModuleSearcher: either a Go function,
+// called by require like a function of package.preload, or the source of a
+// Lua chunk.
+type ModuleSource struct {
+	Loader LGFunction
+	Source string
+	// Chunkname names the chunk in error messages; it defaults to the
+	// module name.
+	Chunkname string
+}
+
+// ModuleSearcher looks up a module for require, e.g. in a database or in
+// embedded assets. It returns nil and no error if it does not know the
+// module, so that require tries the next searcher. An error aborts require.
+type ModuleSearcher func(name string) (*ModuleSource, error)
+
+// AddModuleSearcher makes require ask searcher for the modules that are not
+// in package.preload, before it looks them up on package.path. Searchers
+// are asked in the order they were added, and are shared by all threads of
+// this state.
+func (ls *LState) AddModuleSearcher(searcher ModuleSearcher) {
+	ls.G.moduleSearchers = append(ls.G.moduleSearchers, searcher)
+	if len(ls.G.moduleSearchers) > 1 {
+		return
+	}
+	if loaders, ok := ls.GetField(ls.Get(RegistryIndex), "_LOADERS").(*LTable); ok {
+		loaders.Insert(2, ls.NewFunction(loLoaderHost))
+	}
+}
+
+// SetRequireWhitelist makes require fail for the modules whose names are not
+// in names, before any searcher is asked, so that scripts can not load
+// anything else from package.path. Modules that are already loaded, the
+// standard libraries included, are not affected. A nil names removes the
+// whitelist; an empty one rejects every module.
+func (ls *LState) SetRequireWhitelist(names []string) {
+	if names == nil {
+		ls.G.requireWhitelist = nil
+		return
+	}
+	ls.G.requireWhitelist = make(map[string]bool, len(names))
+	for _, name := range names {
+		ls.G.requireWhitelist[name] = true
+	}
+}
+
+// checkRequireWhitelist raises an error if the whitelist rejects name.
+func (ls *LState) checkRequireWhitelist(name string) {
+	if wl := ls.G.requireWhitelist; wl != nil && !wl[name] {
+		ls.RaiseError("module %s not allowed", name)
+	}
+}
+
+func loLoaderHost(L *LState) int {
+	name := L.CheckString(1)
+	messages := []string{}
+	for _, searcher := range L.G.moduleSearchers {
+		src, err := searcher(name)
+		if err != nil {
+			L.raiseTypedError(err, "error loading module '%s':\n\t%s", name, err.Error())
+		}
+		if src == nil {
+			messages = append(messages, fmt.Sprintf("no module '%s' in host searcher", name))
+			continue
+		}
+		if src.Loader != nil {
+			L.Push(L.NewFunction(src.Loader))
+			return 1
+		}
+		chunkname := src.Chunkname
+		if chunkname == "" {
+			chunkname = name
+		}
+		fn, err := L.Load(strings.NewReader(src.Source), chunkname)
+		if err != nil {
+			L.raiseTypedError(err, "error loading module '%s':\n\t%s", name, err.Error())
+		}
+		L.Push(fn)
+		return 1
+	}
+	L.Push(LString(strings.Join(messages, "\n\t")))
+	return 1
+}
+
+/* }}} */
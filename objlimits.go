@@ -0,0 +1,58 @@
+package lua
+
+/* string length and table size limits {{{ */
+
+// SetMaxStringLength makes the scripts of this state and of its threads fail
+// when they build a string longer than n bytes, e.g. with string.rep, the
+// .. operator or table.concat, with a *LimitError whose Resource is
+// "string length", matched by ErrStringTooLong. Strings pushed by the host
+// are checked as well. Unlike the memory limit, the error tells which object
+// is too big. A limit of 0 removes it.
+func (ls *LState) SetMaxStringLength(n int) {
+	ls.G.maxStringLength = n
+}
+
+// GetMaxStringLength returns the limit set by SetMaxStringLength (0 if
+// none).
+func (ls *LState) GetMaxStringLength() int {
+	return ls.G.maxStringLength
+}
+
+// SetMaxTableEntries makes the scripts of this state and of its threads fail
+// when they add an entry to a table that already has n, with a *LimitError
+// whose Resource is "table entries", matched by ErrTableTooLarge. The
+// entries of a table are the slots of its array part, holes included, and
+// the keys of its hash part, including those that were set to nil since the
+// table does not release them. Overwriting an entry is always allowed. A
+// limit of 0 removes it.
+func (ls *LState) SetMaxTableEntries(n int) {
+	ls.G.maxTableEntries = n
+}
+
+// GetMaxTableEntries returns the limit set by SetMaxTableEntries (0 if
+// none).
+func (ls *LState) GetMaxTableEntries() int {
+	return ls.G.maxTableEntries
+}
+
+// checkStringLength raises an error if a string of n bytes is too long.
+func (ls *LState) checkStringLength(n int) {
+	if max := ls.G.maxStringLength; max > 0 && n > max {
+		ls.raiseTypedError(&LimitError{Resource: "string length", Limit: int64(max), Value: int64(n)},
+			"string too long: %d bytes, limit is %d bytes", n, max)
+	}
+}
+
+// checkEntries raises an error if tb can not grow by added entries.
+func (tb *LTable) checkEntries(added int) {
+	if tb.ls == nil {
+		return
+	}
+	max := tb.ls.G.maxTableEntries
+	if n := len(tb.array) + len(tb.keys) + added; max > 0 && n > max {
+		tb.ls.raiseTypedError(&LimitError{Resource: "table entries", Limit: int64(max), Value: int64(n)},
+			"table too large: %d entries, limit is %d", n, max)
+	}
+}
+
+/* }}} */
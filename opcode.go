@@ -96,8 +96,18 @@ const (
 	OP_VARARG /*     A B     R(A) R(A+1) ... R(A+B-1) = vararg            */
 
 	OP_NOP /* NOP */
+
+	OP_IDIV /*      A B C   R(A) := RK(B) // RK(C)                          */
+	OP_BAND /*      A B C   R(A) := RK(B) & RK(C)                           */
+	OP_BOR  /*      A B C   R(A) := RK(B) | RK(C)                           */
+	OP_BXOR /*      A B C   R(A) := RK(B) ~ RK(C)                           */
+	OP_SHL  /*      A B C   R(A) := RK(B) << RK(C)                          */
+	OP_SHR  /*      A B C   R(A) := RK(B) >> RK(C)                          */
+	OP_BNOT /*      A B     R(A) := ~R(B)                                   */
+
+	OP_TBC /*       A Bx    mark R(A), named Kst(Bx), to be closed           */
 )
-const opCodeMax = OP_NOP
+const opCodeMax = OP_TBC
 
 type opArgMode int
 
@@ -168,6 +178,14 @@ var opProps = []opProp{
 	opProp{"CLOSURE", false, true, opArgModeU, opArgModeN, opTypeABx},
 	opProp{"VARARG", false, true, opArgModeU, opArgModeN, opTypeABC},
 	opProp{"NOP", false, false, opArgModeR, opArgModeN, opTypeASbx},
+	opProp{"IDIV", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"BAND", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"BOR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"BXOR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"SHL", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"SHR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"BNOT", false, true, opArgModeR, opArgModeN, opTypeABC},
+	opProp{"TBC", false, false, opArgModeK, opArgModeN, opTypeABx},
 }
 
 func opGetOpCode(inst uint32) int {
@@ -258,6 +276,44 @@ func opRkAsk(value int) int {
 	return value | opBitRk
 }
 
+// opMaxRegister returns the highest register inst reads or writes, or -1 if
+// it uses none. A range that ends at the top of the stack, like the
+// arguments of a CALL with B 0, only counts its first register.
+func opMaxRegister(inst uint32) int {
+	op := opGetOpCode(inst)
+	prop := &opProps[op]
+	a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+	reg := -1
+	if prop.Type == opTypeABC {
+		if prop.ModeArgB == opArgModeR || prop.ModeArgB == opArgModeK && !opIsK(b) {
+			reg = b
+		}
+		if prop.ModeArgC == opArgModeR || prop.ModeArgC == opArgModeK && !opIsK(c) {
+			reg = intMax(reg, c)
+		}
+	}
+	switch op {
+	case OP_JMP, OP_NOP, OP_EQ, OP_LT, OP_LE:
+		return reg
+	case OP_CALL:
+		reg = intMax(reg, a+c-2)
+		fallthrough
+	case OP_TAILCALL:
+		reg = intMax(reg, a+b-1)
+	case OP_RETURN, OP_VARARG:
+		reg = intMax(reg, a+b-2)
+	case OP_SELF:
+		reg = intMax(reg, a+1)
+	case OP_SETLIST:
+		reg = intMax(reg, a+b)
+	case OP_FORPREP, OP_FORLOOP:
+		reg = intMax(reg, a+3)
+	case OP_TFORLOOP:
+		reg = intMax(reg, a+2+c)
+	}
+	return intMax(reg, a)
+}
+
 func opToString(inst uint32) string {
 	op := opGetOpCode(inst)
 	if op > opCodeMax {
@@ -366,6 +422,22 @@ func opToString(inst uint32) string {
 		buf += fmt.Sprintf(";  R(%v) R(%v+1) ... R(%v+%v-1) = vararg", arga, arga, arga, argb)
 	case OP_NOP:
 		/* nothing to do */
+	case OP_IDIV:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) // RK(%v)", arga, argb, argc)
+	case OP_BAND:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) & RK(%v)", arga, argb, argc)
+	case OP_BOR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) | RK(%v)", arga, argb, argc)
+	case OP_BXOR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) ~ RK(%v)", arga, argb, argc)
+	case OP_SHL:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) << RK(%v)", arga, argb, argc)
+	case OP_SHR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) >> RK(%v)", arga, argb, argc)
+	case OP_BNOT:
+		buf += fmt.Sprintf("; R(%v) := ~R(%v)", arga, argb)
+	case OP_TBC:
+		buf += fmt.Sprintf("; mark R(%v), named Kst(%v), to be closed", arga, argbx)
 	}
 	return buf
 }
@@ -53,22 +53,29 @@ func OpenOs(L *LState) int {
 }
 
 var osFuncs = map[string]LGFunction{
-	"clock":     osClock,
+	"clock":     Nondeterministic("os.clock", osClock),
 	"difftime":  osDiffTime,
-	"execute":   osExecute,
-	"exit":      osExit,
-	"date":      osDate,
-	"getenv":    osGetEnv,
-	"remove":    osRemove,
-	"rename":    osRename,
-	"setenv":    osSetEnv,
+	"execute":   audited("os.execute", osExecute),
+	"exit":      audited("os.exit", osExit),
+	"date":      Nondeterministic("os.date", osDate),
+	"getenv":    audited("os.getenv", Nondeterministic("os.getenv", osGetEnv)),
+	"remove":    audited("os.remove", osRemove),
+	"rename":    audited("os.rename", osRename),
+	"setenv":    audited("os.setenv", osSetEnv),
 	"setlocale": osSetLocale,
-	"time":      osTime,
-	"tmpname":   osTmpname,
+	"time":      Nondeterministic("os.time", osTime),
+	"tmpname":   audited("os.tmpname", Nondeterministic("os.tmpname", osTmpname)),
 }
 
 func osClock(L *LState) int {
-	L.Push(LNumber(float64(time.Now().Sub(startedAt)) / float64(time.Second)))
+	if c := L.G.clock; c != nil {
+		return osClockAux(L, c.Now().Sub(L.G.clockStart))
+	}
+	return osClockAux(L, time.Now().Sub(startedAt))
+}
+
+func osClockAux(L *LState, elapsed time.Duration) int {
+	L.Push(LNumber(float64(elapsed) / float64(time.Second)))
 	return 1
 }
 
@@ -78,6 +85,10 @@ func osDiffTime(L *LState) int {
 }
 
 func osExecute(L *LState) int {
+	if !processSupported {
+		L.Push(LNumber(1))
+		return 1
+	}
 	var procAttr os.ProcAttr
 	procAttr.Files = []*os.File{os.Stdin, os.Stdout, os.Stderr}
 	cmd, args := popenArgs(L.CheckString(1))
@@ -104,7 +115,16 @@ func osExit(L *LState) int {
 }
 
 func osDate(L *LState) int {
-	t := time.Now()
+	if c := L.G.clock; c != nil {
+		return osDateAux(L, c.Now())
+	}
+	return osDateAux(L, time.Now())
+}
+
+// osDateAux formats now, or the time given as second argument in the
+// location of now.
+func osDateAux(L *LState, now time.Time) int {
+	t := now
 	isUTC := false
 	cfmt := "%c"
 	if L.GetTop() >= 1 {
@@ -114,7 +134,7 @@ func osDate(L *LState) int {
 			isUTC = true
 		}
 		if L.GetTop() >= 2 {
-			t = time.Unix(L.CheckInt64(2), 0)
+			t = time.Unix(L.CheckInt64(2), 0).In(now.Location())
 		}
 		if isUTC {
 			t = t.UTC()
@@ -135,7 +155,9 @@ func osDate(L *LState) int {
 			return 1
 		}
 	}
-	L.Push(LString(strftime(t, cfmt)))
+	result := strftime(t, cfmt)
+	L.trackString(len(result))
+	L.Push(LString(result))
 	return 1
 }
 
@@ -144,6 +166,7 @@ func osGetEnv(L *LState) int {
 	if len(v) == 0 {
 		L.Push(LNil)
 	} else {
+		L.trackString(len(v))
 		L.Push(LString(v))
 	}
 	return 1
@@ -192,12 +215,21 @@ func osSetEnv(L *LState) int {
 }
 
 func osTime(L *LState) int {
+	if c := L.G.clock; c != nil {
+		return osTimeAux(L, c.Now())
+	}
+	return osTimeAux(L, time.Now())
+}
+
+// osTimeAux returns now, or the time described by a table in the location
+// of now.
+func osTimeAux(L *LState, now time.Time) int {
 	if L.GetTop() == 0 {
-		L.Push(LNumber(time.Now().Unix()))
+		L.Push(LNumber(now.Unix()))
 	} else {
 		lv := L.CheckAny(1)
 		if lv == LNil {
-			L.Push(LNumber(time.Now().Unix()))
+			L.Push(LNumber(now.Unix()))
 		} else {
 			tbl, ok := lv.(*LTable)
 			if !ok {
@@ -210,7 +242,7 @@ func osTime(L *LState) int {
 			month := getIntField(L, tbl, "month", -1)
 			year := getIntField(L, tbl, "year", -1)
 			isdst := getBoolField(L, tbl, "isdst", false)
-			t := time.Date(year, time.Month(month), day, hour, min, sec, 0, time.Local)
+			t := time.Date(year, time.Month(month), day, hour, min, sec, 0, now.Location())
 			// TODO dst
 			if false {
 				print(isdst)
@@ -228,6 +260,7 @@ func osTmpname(L *LState) int {
 	}
 	file.Close()
 	os.Remove(file.Name()) // ignore errors
+	L.trackString(len(file.Name()))
 	L.Push(LString(file.Name()))
 	return 1
 }
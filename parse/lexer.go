@@ -3,6 +3,7 @@ package parse
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
@@ -20,6 +21,15 @@ type Error struct {
 	Pos     ast.Position
 	Message string
 	Token   string
+	err     error
+}
+
+// ErrTooManyLevels matches, with errors.Is, the *Error returned when a chunk
+// nests deeper than ParseOptions.MaxDepth allows.
+var ErrTooManyLevels = errors.New("chunk has too many syntax levels")
+
+func (e *Error) Unwrap() error {
+	return e.err
 }
 
 func (e *Error) Error() string {
@@ -46,6 +56,8 @@ func isDigit(ch int) bool {
 type Scanner struct {
 	Pos    ast.Position
 	reader *bufio.Reader
+	// GotoIsIdentifier makes goto a regular identifier, as in Lua 5.1.
+	GotoIsIdentifier bool
 }
 
 func NewScanner(reader io.Reader, source string) *Scanner {
@@ -59,9 +71,11 @@ func NewScanner(reader io.Reader, source string) *Scanner {
 	}
 }
 
-func (sc *Scanner) Error(tok string, msg string) *Error { return &Error{sc.Pos, msg, tok} }
+func (sc *Scanner) Error(tok string, msg string) *Error { return &Error{sc.Pos, msg, tok, nil} }
 
-func (sc *Scanner) TokenError(tok ast.Token, msg string) *Error { return &Error{tok.Pos, msg, tok.Str} }
+func (sc *Scanner) TokenError(tok ast.Token, msg string) *Error {
+	return &Error{tok.Pos, msg, tok.Str, nil}
+}
 
 func (sc *Scanner) readNext() int {
 	ch, err := sc.reader.ReadByte()
@@ -160,9 +174,26 @@ func (sc *Scanner) scanNumber(ch int, buf *bytes.Buffer) error {
 				writeChar(buf, sc.Next())
 				hasvalue = true
 			}
+			if sc.Peek() == '.' {
+				writeChar(buf, sc.Next())
+				for isDigit(sc.Peek()) {
+					writeChar(buf, sc.Next())
+					hasvalue = true
+				}
+			}
 			if !hasvalue {
 				return sc.Error(buf.String(), "illegal hexadecimal number")
 			}
+			if ch = sc.Peek(); ch == 'p' || ch == 'P' {
+				writeChar(buf, sc.Next())
+				if ch = sc.Peek(); ch == '-' || ch == '+' {
+					writeChar(buf, sc.Next())
+				}
+				if !isDecimal(sc.Peek()) {
+					return sc.Error(buf.String(), "malformed number")
+				}
+				sc.scanDecimal(sc.Next(), buf)
+			}
 			return nil
 		} else if sc.Peek() != '.' && isDecimal(sc.Peek()) {
 			ch = sc.Next()
@@ -177,6 +208,9 @@ func (sc *Scanner) scanNumber(ch int, buf *bytes.Buffer) error {
 		if ch = sc.Peek(); ch == '-' || ch == '+' {
 			writeChar(buf, sc.Next())
 		}
+		if !isDecimal(sc.Peek()) {
+			return sc.Error(buf.String(), "malformed number")
+		}
 		sc.scanDecimal(sc.Next(), buf)
 	}
 
@@ -319,7 +353,7 @@ redo:
 		if err != nil {
 			goto finally
 		}
-		if typ, ok := reservedWords[tok.Str]; ok {
+		if typ, ok := reservedWords[tok.Str]; ok && !(typ == TGoto && sc.GotoIsIdentifier) {
 			tok.Type = typ
 		}
 	case isDecimal(ch):
@@ -369,13 +403,18 @@ redo:
 				tok.Str = "~="
 				sc.Next()
 			} else {
-				err = sc.Error("~", "Invalid '~' token")
+				tok.Type = ch
+				tok.Str = string(rune(ch))
 			}
 		case '<':
 			if sc.Peek() == '=' {
 				tok.Type = TLte
 				tok.Str = "<="
 				sc.Next()
+			} else if sc.Peek() == '<' {
+				tok.Type = TShl
+				tok.Str = "<<"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(rune(ch))
@@ -385,6 +424,10 @@ redo:
 				tok.Type = TGte
 				tok.Str = ">="
 				sc.Next()
+			} else if sc.Peek() == '>' {
+				tok.Type = TShr
+				tok.Str = ">>"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(rune(ch))
@@ -418,7 +461,16 @@ redo:
 				tok.Type = ch
 				tok.Str = string(rune(ch))
 			}
-		case '+', '*', '/', '%', '^', '#', '(', ')', '{', '}', ']', ';', ',':
+		case '/':
+			if sc.Peek() == '/' {
+				tok.Type = T2Slash
+				tok.Str = "//"
+				sc.Next()
+			} else {
+				tok.Type = ch
+				tok.Str = string(rune(ch))
+			}
+		case '+', '*', '%', '^', '#', '&', '|', '(', ')', '{', '}', ']', ';', ',':
 			tok.Type = ch
 			tok.Str = string(rune(ch))
 		default:
@@ -441,6 +493,10 @@ type Lexer struct {
 	PNewLine      bool
 	Token         ast.Token
 	PrevTokenType int
+
+	maxDepth int
+	depth    int
+	unary    int
 }
 
 func (lx *Lexer) Lex(lval *yySymType) int {
@@ -452,11 +508,42 @@ func (lx *Lexer) Lex(lval *yySymType) int {
 	if tok.Type < 0 {
 		return 0
 	}
+	if lx.maxDepth > 0 {
+		lx.checkDepth(tok)
+	}
 	lval.token = tok
 	lx.Token = tok
 	return int(tok.Type)
 }
 
+// checkDepth tracks how deep tok nests the chunk: brackets and blocks open
+// a level until they are closed, and unary operators one until the operand
+// that follows them.
+func (lx *Lexer) checkDepth(tok ast.Token) {
+	switch tok.Type {
+	case '(', '{', '[', TFunction, TIf, TDo, TRepeat:
+		lx.depth++
+		lx.unary = 0
+	case ')', '}', ']', TEnd, TUntil:
+		lx.depth--
+		lx.unary = 0
+	case TNot, '#':
+		lx.unary++
+	case '-', '~':
+		switch lx.PrevTokenType {
+		case TIdent, TNumber, TString, TNil, TTrue, TFalse, T3Comma, TEnd, ')', ']', '}':
+			lx.unary = 0
+		default:
+			lx.unary++
+		}
+	default:
+		lx.unary = 0
+	}
+	if lx.depth+lx.unary > lx.maxDepth {
+		panic(&Error{tok.Pos, ErrTooManyLevels.Error(), tok.Str, ErrTooManyLevels})
+	}
+}
+
 func (lx *Lexer) Error(message string) {
 	panic(lx.scanner.Error(lx.Token.Str, message))
 }
@@ -465,8 +552,24 @@ func (lx *Lexer) TokenError(tok ast.Token, message string) {
 	panic(lx.scanner.TokenError(tok, message))
 }
 
+// ParseOptions changes the syntax accepted by ParseWithOptions.
+type ParseOptions struct {
+	// GotoIsIdentifier makes goto a regular identifier, as in Lua 5.1.
+	GotoIsIdentifier bool
+	// MaxDepth bounds how deep brackets, blocks, functions and unary
+	// operators nest, which bounds the recursion of the compiler. 0 means
+	// no limit.
+	MaxDepth int
+}
+
 func Parse(reader io.Reader, name string) (chunk []ast.Stmt, err error) {
-	lexer := &Lexer{NewScanner(reader, name), nil, false, ast.Token{Str: ""}, TNil}
+	return ParseWithOptions(reader, name, ParseOptions{})
+}
+
+func ParseWithOptions(reader io.Reader, name string, opts ParseOptions) (chunk []ast.Stmt, err error) {
+	scanner := NewScanner(reader, name)
+	scanner.GotoIsIdentifier = opts.GotoIsIdentifier
+	lexer := &Lexer{scanner: scanner, Token: ast.Token{Str: ""}, PrevTokenType: TNil, maxDepth: opts.MaxDepth}
 	chunk = nil
 	defer func() {
 		if e := recover(); e != nil {
@@ -16,6 +16,8 @@ import (
 %type<exprlist> varlist
 %type<expr> var
 %type<namelist> namelist
+%type<stmt> attnamelist
+%type<token> attrib
 %type<exprlist> exprlist
 %type<expr> expr
 %type<expr> string
@@ -56,15 +58,20 @@ import (
 
 /* Literals */
 %token<token> TEqeq TNeq TLte TGte T2Comma T3Comma T2Colon TIdent TNumber TString '{' '('
+%token<token> T2Slash TShl TShr
 
 /* Operators */
 %left TOr
 %left TAnd
 %left '>' '<' TGte TLte TEqeq TNeq
+%left '|'
+%left '~'
+%left '&'
+%left TShl TShr
 %right T2Comma
 %left '+' '-'
-%left '*' '/' '%'
-%right UNARY /* not # -(unary) */
+%left '*' '/' T2Slash '%'
+%right UNARY /* not # -(unary) ~(unary) */
 %right '^'
 
 %%
@@ -180,12 +187,13 @@ stat:
             $$.SetLine($1.Pos.Line)
             $$.SetLastLine($4.LastLine())
         } | 
-        TLocal namelist '=' exprlist {
-            $$ = &ast.LocalAssignStmt{Names: $2, Exprs:$4}
+        TLocal attnamelist '=' exprlist {
+            $2.(*ast.LocalAssignStmt).Exprs = $4
+            $$ = $2
             $$.SetLine($1.Pos.Line)
         } |
-        TLocal namelist {
-            $$ = &ast.LocalAssignStmt{Names: $2, Exprs:[]ast.Expr{}}
+        TLocal attnamelist {
+            $$ = $2
             $$.SetLine($1.Pos.Line)
         } |
         T2Colon TIdent T2Colon {
@@ -273,6 +281,37 @@ namelist:
             $$ = append($1, $3.Str)
         }
 
+attnamelist:
+        TIdent attrib {
+            stmt := &ast.LocalAssignStmt{Names: []string{$1.Str}, Exprs: []ast.Expr{}}
+            if $2.Str != "" {
+                stmt.Attribs = []string{$2.Str}
+            }
+            $$ = stmt
+        } |
+        attnamelist ',' TIdent attrib {
+            stmt := $1.(*ast.LocalAssignStmt)
+            stmt.Names = append(stmt.Names, $3.Str)
+            if $4.Str != "" && stmt.Attribs == nil {
+                stmt.Attribs = make([]string, len(stmt.Names)-1)
+            }
+            if stmt.Attribs != nil {
+                stmt.Attribs = append(stmt.Attribs, $4.Str)
+            }
+            $$ = stmt
+        }
+
+attrib:
+        {
+            $$ = ast.Token{}
+        } |
+        '<' TIdent '>' {
+            if $2.Str != "const" && $2.Str != "close" {
+                yylex.(*Lexer).TokenError($2, "unknown attribute '" + $2.Str + "'")
+            }
+            $$ = $2
+        }
+
 exprlist:
         expr {
             $$ = []ast.Expr{$1}
@@ -374,6 +413,30 @@ expr:
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "^", Rhs: $3}
             $$.SetLine($1.Line())
         } |
+        expr T2Slash expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "//", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr '&' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "&", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr '|' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "|", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr '~' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "~", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr TShl expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "<<", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr TShr expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: ">>", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
         '-' expr %prec UNARY {
             $$ = &ast.UnaryMinusOpExpr{Expr: $2}
             $$.SetLine($2.Line())
@@ -385,6 +448,10 @@ expr:
         '#' expr %prec UNARY {
             $$ = &ast.UnaryLenOpExpr{Expr: $2}
             $$.SetLine($2.Line())
+        } |
+        '~' expr %prec UNARY {
+            $$ = &ast.UnaryBNotOpExpr{Expr: $2}
+            $$.SetLine($2.Line())
         }
 
 string: 
@@ -0,0 +1,106 @@
+package lua
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/* pausing {{{ */
+
+// pauseGate holds the scripts of a state while it is paused.
+type pauseGate struct {
+	paused atomic.Bool
+	mu     sync.Mutex
+	resume chan struct{}
+}
+
+// SetPausable allows Pause to suspend this state and the threads created
+// from it from now on. The scripts of a pausable state run in the slower
+// main loop that also implements the instruction and time limits. It must
+// be called from the goroutine that runs the state, before Pause is called
+// from other goroutines.
+func (ls *LState) SetPausable(pausable bool) {
+	if !pausable {
+		if gate := ls.G.pause; gate != nil {
+			gate.unpause()
+		}
+		ls.G.pause = nil
+	} else if ls.G.pause == nil {
+		ls.G.pause = &pauseGate{}
+	}
+	ls.updateMainLoop()
+}
+
+// Pause suspends the scripts of this state at the next instruction, until
+// Unpause is called, for instance to throttle them while the host is short
+// of memory. Everything is preserved, and the scripts continue as if
+// nothing happened. Go functions called by the scripts are not interrupted:
+// the scripts stop when they return. The time spent paused does not count
+// against the execution time limit, and cancelling the context of the state
+// ends the pause with an error. Pause can be called from any goroutine; it
+// returns false if the state is not pausable (see SetPausable).
+//
+// Pause and Unpause are not to be confused with Resume, which resumes a
+// coroutine.
+func (ls *LState) Pause() bool {
+	gate := ls.G.pause
+	if gate == nil {
+		return false
+	}
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	if !gate.paused.Load() {
+		gate.resume = make(chan struct{})
+		gate.paused.Store(true)
+	}
+	return true
+}
+
+// Unpause lets the scripts suspended by Pause continue. It can be called
+// from any goroutine.
+func (ls *LState) Unpause() {
+	if gate := ls.G.pause; gate != nil {
+		gate.unpause()
+	}
+}
+
+// IsPaused reports whether Pause was called and Unpause was not since. It
+// can be called from any goroutine.
+func (ls *LState) IsPaused() bool {
+	gate := ls.G.pause
+	return gate != nil && gate.paused.Load()
+}
+
+func (gate *pauseGate) unpause() {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	if gate.paused.Load() {
+		gate.paused.Store(false)
+		close(gate.resume)
+	}
+}
+
+// wait blocks L until the gate is opened.
+func (gate *pauseGate) wait(L *LState) {
+	gate.mu.Lock()
+	resume := gate.resume
+	paused := gate.paused.Load()
+	gate.mu.Unlock()
+	if !paused {
+		return
+	}
+	if clock := L.G.execClock; clock != nil && clock.pause() {
+		defer clock.resume()
+	}
+	if L.ctx == nil {
+		<-resume
+		return
+	}
+	select {
+	case <-resume:
+	case <-L.ctx.Done():
+		L.raiseContextError()
+	}
+}
+
+/* }}} */
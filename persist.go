@@ -0,0 +1,510 @@
+package lua
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+/* state persistence {{{ */
+
+// PersistSignature is the prefix of every snapshot written by Persist.
+const PersistSignature = "\x1bGLuaState"
+
+const persistVersion = 1
+
+const (
+	persistNil byte = iota
+	persistFalse
+	persistTrue
+	persistNumber
+	persistString
+	persistRef
+	persistTable
+	persistModule
+	persistFunction
+	persistPermanent
+)
+
+const (
+	persistReadOnly byte = 1 << iota
+	persistOrdered
+)
+
+// Persist writes the modules of package.loaded, including the globals, and
+// everything reachable from them to w: tables, strings, numbers, Lua
+// functions with their upvalues and prototypes. Shared and cyclic
+// references are preserved. Restore reads the snapshot back into another
+// state.
+//
+// Go functions and userdata can not be written. They are persisted by name
+// instead, if they can be found a few fields deep in a module, such as
+// string.format or a global function registered by the host, and resolved by
+// name in the state that is restored. Persist fails if it finds a coroutine,
+// a channel or another Go value. Upvalues are restored closed.
+func (ls *LState) Persist(w io.Writer) error {
+	loaded, ok := ls.GetField(ls.Get(RegistryIndex), "_LOADED").(*LTable)
+	if !ok {
+		return errors.New("package.loaded not found")
+	}
+	p := &statePersister{
+		d:       &protoDumper{w: bufio.NewWriter(w)},
+		ids:     map[interface{}]int{},
+		modules: map[*LTable]string{},
+		names:   map[LValue][]string{},
+	}
+	namedObjects(loaded, func(name string, lv LValue) {
+		switch v := lv.(type) {
+		case *LTable:
+			if _, ok := p.modules[v]; !ok {
+				p.modules[v] = name
+			}
+		case *LFunction:
+			if v.IsG {
+				p.names[v] = append(p.names[v], name)
+			}
+		case *LUserData:
+			p.names[v] = append(p.names[v], name)
+		}
+	})
+	names := sortedModuleNames(loaded)
+
+	p.d.bytes([]byte(PersistSignature))
+	p.d.bytes([]byte{persistVersion, LNumberBit / 8})
+	p.d.int(len(names))
+	for _, name := range names {
+		p.d.string(name)
+		p.value(loaded.RawGetString(name))
+	}
+	if p.d.err != nil {
+		return p.d.err
+	}
+	return p.d.w.Flush()
+}
+
+type statePersister struct {
+	d       *protoDumper
+	ids     map[interface{}]int
+	modules map[*LTable]string
+	names   map[LValue][]string
+}
+
+func (p *statePersister) fail(format string, args ...interface{}) {
+	if p.d.err == nil {
+		p.d.err = fmt.Errorf(format, args...)
+	}
+}
+
+// ref writes a reference to obj if it has been written before.
+func (p *statePersister) ref(obj interface{}) bool {
+	if id, ok := p.ids[obj]; ok {
+		p.d.byte(persistRef)
+		p.d.int(id)
+		return true
+	}
+	p.ids[obj] = len(p.ids)
+	return false
+}
+
+func (p *statePersister) value(lv LValue) {
+	if p.d.err != nil {
+		return
+	}
+	switch v := lv.(type) {
+	case *LNilType:
+		p.d.byte(persistNil)
+		return
+	case LBool:
+		if v {
+			p.d.byte(persistTrue)
+		} else {
+			p.d.byte(persistFalse)
+		}
+		return
+	case LNumber:
+		p.d.byte(persistNumber)
+		binary.LittleEndian.PutUint64(p.d.buf[:8], math.Float64bits(float64(v)))
+		p.d.bytes(p.d.buf[:8])
+		return
+	case LString:
+		p.d.byte(persistString)
+		p.d.string(string(v))
+		return
+	}
+	if names, ok := p.names[lv]; ok {
+		if !p.ref(lv) {
+			p.d.byte(persistPermanent)
+			p.d.int(len(names))
+			for _, name := range names {
+				p.d.string(name)
+			}
+		}
+		return
+	}
+	switch v := lv.(type) {
+	case *LTable:
+		if p.ref(v) {
+			return
+		}
+		if name, ok := p.modules[v]; ok {
+			p.d.byte(persistModule)
+			p.d.string(name)
+		} else {
+			p.d.byte(persistTable)
+		}
+		p.table(v)
+	case *LFunction:
+		if v.IsG {
+			p.fail("can not persist a Go function that is not a field of a module")
+			return
+		}
+		if p.ref(v) {
+			return
+		}
+		p.d.byte(persistFunction)
+		p.function(v)
+	default:
+		p.fail("can not persist a %v", lv.Type().String())
+	}
+}
+
+func (p *statePersister) table(tb *LTable) {
+	var flags byte
+	if tb.readonly {
+		flags |= persistReadOnly
+	}
+	if tb.ordered {
+		flags |= persistOrdered
+	}
+	p.d.bytes([]byte{flags, byte(tb.weak)})
+	p.value(tb.Metatable)
+	var entries []LValue
+	for i, v := range tb.array {
+		if v != LNil {
+			entries = append(entries, LNumber(i+1), v)
+		}
+	}
+	for _, key := range tb.keys {
+		if v := tb.RawGetH(key); v != LNil {
+			entries = append(entries, key, v)
+		}
+	}
+	p.d.int(len(entries) / 2)
+	for _, lv := range entries {
+		p.value(lv)
+	}
+}
+
+func (p *statePersister) function(fn *LFunction) {
+	if id, ok := p.ids[fn.Proto]; ok {
+		p.d.byte(persistRef)
+		p.d.int(id)
+	} else {
+		p.ids[fn.Proto] = len(p.ids)
+		p.d.byte(persistFunction)
+		p.d.proto(fn.Proto)
+	}
+	if fn.Env != nil {
+		p.value(fn.Env)
+	} else {
+		p.value(LNil)
+	}
+	p.d.int(len(fn.Upvalues))
+	for _, uv := range fn.Upvalues {
+		if uv == nil {
+			p.d.byte(persistNil)
+			continue
+		}
+		if p.ref(uv) {
+			continue
+		}
+		p.d.byte(persistTable)
+		p.value(uv.Value())
+	}
+}
+
+// Restore reads a snapshot written by Persist into this state, which
+// usually is a new state with the same libraries and host functions as the
+// persisted one. Modules and the tables they contain are restored into the
+// tables of the same name, replacing their contents, so that the globals and
+// the standard libraries keep their identity. Restore fails if a Go function
+// or userdata of the snapshot can not be found by name. The contents are only
+// replaced once the whole snapshot has been read: if Restore fails, the state
+// is left as it was.
+func (ls *LState) Restore(r io.Reader) error {
+	loaded, ok := ls.GetField(ls.Get(RegistryIndex), "_LOADED").(*LTable)
+	if !ok {
+		return errors.New("package.loaded not found")
+	}
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	u := &stateRestorer{ls: ls, u: &protoUndumper{r: br}, names: map[string]LValue{}}
+	namedObjects(loaded, func(name string, lv LValue) {
+		u.names[name] = lv
+	})
+
+	signature := make([]byte, len(PersistSignature))
+	if _, err := io.ReadFull(br, signature); err != nil || string(signature) != PersistSignature {
+		return errors.New("not a state snapshot")
+	}
+	if version := u.u.byte(); u.u.err == nil && version != persistVersion {
+		return fmt.Errorf("state snapshot version mismatch: got %v, expected %v", version, persistVersion)
+	}
+	if size := u.u.byte(); u.u.err == nil && size != LNumberBit/8 {
+		return fmt.Errorf("state snapshot number size mismatch: got %v, expected %v", size, LNumberBit/8)
+	}
+	n := u.u.count()
+	values := map[string]LValue{}
+	for i := 0; i < n && u.u.err == nil; i++ {
+		name := u.u.string()
+		values[name] = u.value()
+	}
+	if u.u.err != nil {
+		return u.u.err
+	}
+	for _, m := range u.modules {
+		m.live.replaceContents(m.restored)
+	}
+	for name, v := range values {
+		loaded.RawSetString(name, v)
+	}
+	for _, tb := range u.readonly {
+		tb.readonly = true
+	}
+	return nil
+}
+
+type stateRestorer struct {
+	ls       *LState
+	u        *protoUndumper
+	objects  []interface{}
+	names    map[string]LValue
+	readonly []*LTable
+	modules  []restoredModule
+}
+
+// restoredModule is a module table of the state and the table its contents
+// from the snapshot are read into.
+type restoredModule struct {
+	live     *LTable
+	restored *LTable
+}
+
+func (u *stateRestorer) fail(format string, args ...interface{}) {
+	u.u.fail(fmt.Errorf(format, args...))
+}
+
+func (u *stateRestorer) ref() interface{} {
+	id := u.u.int()
+	if id < 0 || id >= len(u.objects) {
+		u.fail("malformed state snapshot")
+		return nil
+	}
+	return u.objects[id]
+}
+
+func (u *stateRestorer) value() LValue {
+	if u.u.err != nil {
+		return LNil
+	}
+	switch tag := u.u.byte(); tag {
+	case persistNil:
+		return LNil
+	case persistFalse:
+		return LFalse
+	case persistTrue:
+		return LTrue
+	case persistNumber:
+		return LNumber(math.Float64frombits(binary.LittleEndian.Uint64(u.u.bytes(8))))
+	case persistString:
+		return LString(u.u.string())
+	case persistRef:
+		if lv, ok := u.ref().(LValue); ok {
+			return lv
+		}
+		u.fail("malformed state snapshot")
+	case persistPermanent:
+		n := u.u.count()
+		var found LValue
+		var names []string
+		for i := 0; i < n; i++ {
+			name := u.u.string()
+			names = append(names, name)
+			if v, ok := u.names[name]; ok && found == nil {
+				found = v
+			}
+		}
+		if found == nil {
+			u.fail("can not restore %v: not found", names)
+			return LNil
+		}
+		u.objects = append(u.objects, found)
+		return found
+	case persistModule, persistTable:
+		// references to a module resolve to the live table, which gets the
+		// restored contents once the whole snapshot has been read
+		tb := u.ls.NewTable()
+		restored := tb
+		if tag == persistModule {
+			if live, _ := u.names[u.u.string()].(*LTable); live != nil {
+				tb = live
+				u.modules = append(u.modules, restoredModule{live: live, restored: restored})
+			}
+		}
+		u.objects = append(u.objects, tb)
+		if u.table(restored) {
+			u.readonly = append(u.readonly, tb)
+		}
+		return tb
+	case persistFunction:
+		fn := u.ls.newLFunctionL(nil, u.ls.G.Global, 0)
+		u.objects = append(u.objects, fn)
+		u.function(fn)
+		return fn
+	default:
+		u.fail("malformed state snapshot")
+	}
+	return LNil
+}
+
+// table reads the contents of tb and reports whether tb is read-only.
+func (u *stateRestorer) table(tb *LTable) bool {
+	flags := u.u.bytes(2)
+	readonly, ordered, weak := flags[0]&persistReadOnly != 0, flags[0]&persistOrdered != 0, weakMode(flags[1])
+	tb.ordered, tb.weak = ordered, weak
+	tb.Metatable = u.value()
+	n := u.u.count()
+	for i := 0; i < n && u.u.err == nil; i++ {
+		key := u.value()
+		value := u.value()
+		if key == LNil {
+			u.fail("malformed state snapshot")
+			return false
+		}
+		tb.rawSet(key, value)
+	}
+	return readonly
+}
+
+func (u *stateRestorer) function(fn *LFunction) {
+	switch u.u.byte() {
+	case persistRef:
+		proto, ok := u.ref().(*FunctionProto)
+		if !ok {
+			u.fail("malformed state snapshot")
+			return
+		}
+		fn.Proto = proto
+	case persistFunction:
+		u.objects = append(u.objects, nil)
+		id := len(u.objects) - 1
+		fn.Proto = u.u.proto()
+		u.objects[id] = fn.Proto
+	default:
+		u.fail("malformed state snapshot")
+		return
+	}
+	if env, ok := u.value().(*LTable); ok {
+		fn.Env = env
+	} else {
+		fn.Env = u.ls.G.Global
+	}
+	n := u.u.count()
+	if u.u.err == nil && n != int(fn.Proto.NumUpvalues) {
+		u.fail("malformed state snapshot")
+		return
+	}
+	fn.Upvalues = make([]*Upvalue, n)
+	for i := range fn.Upvalues {
+		switch u.u.byte() {
+		case persistNil:
+		case persistRef:
+			uv, ok := u.ref().(*Upvalue)
+			if !ok {
+				u.fail("malformed state snapshot")
+				return
+			}
+			fn.Upvalues[i] = uv
+		case persistTable:
+			uv := &Upvalue{closed: true}
+			u.objects = append(u.objects, uv)
+			uv.value = u.value()
+			fn.Upvalues[i] = uv
+		default:
+			u.fail("malformed state snapshot")
+			return
+		}
+	}
+}
+
+// replaceContents replaces the metatable, the fields and the modes of tb with
+// those of src, which must no longer be used.
+func (tb *LTable) replaceContents(src *LTable) {
+	tb.Metatable = src.Metatable
+	tb.array, tb.dict, tb.strdict, tb.keys, tb.k2i = src.array, src.dict, src.strdict, src.keys, src.k2i
+	tb.sorted, tb.s2i = src.sorted, src.s2i
+	tb.allocBytes, tb.hashCap = src.allocBytes, src.hashCap
+	tb.readonly, tb.ordered, tb.weak = false, src.ordered, src.weak
+}
+
+// namedObjects calls fn with the modules of package.loaded and the tables,
+// functions and userdata up to three fields deep in them, named by their path
+// such as "string.format" or "_G.package.loaders[1]".
+func namedObjects(loaded *LTable, fn func(name string, lv LValue)) {
+	var visit func(prefix string, tb *LTable, depth int)
+	visit = func(prefix string, tb *LTable, depth int) {
+		field := func(name string, lv LValue) {
+			if !isCollectable(lv) {
+				return
+			}
+			fn(name, lv)
+			if sub, ok := lv.(*LTable); ok && depth > 0 {
+				visit(name, sub, depth-1)
+			}
+		}
+		for i, lv := range tb.array {
+			field(fmt.Sprintf("%s[%d]", prefix, i+1), lv)
+		}
+		for _, key := range sortedStringKeys(tb) {
+			field(prefix+"."+key, tb.RawGetString(key))
+		}
+	}
+	for _, name := range sortedModuleNames(loaded) {
+		if tb, ok := loaded.RawGetString(name).(*LTable); ok {
+			fn(name, tb)
+			visit(name, tb, 2)
+		}
+	}
+}
+
+func sortedModuleNames(loaded *LTable) []string {
+	names := sortedStringKeys(loaded)
+	// the globals come first so that their functions are named after them
+	for i, name := range names {
+		if name == "_G" {
+			copy(names[1:i+1], names[:i])
+			names[0] = "_G"
+			break
+		}
+	}
+	return names
+}
+
+func sortedStringKeys(tb *LTable) []string {
+	var keys []string
+	for key, value := range tb.strdict {
+		if value != LNil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/* }}} */
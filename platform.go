@@ -0,0 +1,16 @@
+//go:build !js && !wasip1 && !tinygo
+
+package lua
+
+import (
+	"io"
+	"os"
+)
+
+// processSupported reports whether the platform can spawn child processes
+// (used by io.popen and os.execute).
+const processSupported = true
+
+func defaultStdin() io.Reader {
+	return os.Stdin
+}
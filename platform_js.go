@@ -0,0 +1,18 @@
+//go:build js
+
+package lua
+
+import (
+	"io"
+	"strings"
+)
+
+// Browsers and Node.js hosts can not spawn processes from Go, so io.popen
+// and os.execute always fail.
+const processSupported = false
+
+// There is no standard input on js/wasm; reading from io.stdin returns EOF
+// unless the host supplies Options.Stdin.
+func defaultStdin() io.Reader {
+	return strings.NewReader("")
+}
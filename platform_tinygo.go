@@ -0,0 +1,16 @@
+//go:build tinygo && !js && !wasip1
+
+package lua
+
+import (
+	"io"
+	"os"
+)
+
+// TinyGo's os/exec can not start processes, so io.popen and os.execute
+// always fail.
+const processSupported = false
+
+func defaultStdin() io.Reader {
+	return os.Stdin
+}
@@ -0,0 +1,15 @@
+//go:build wasip1
+
+package lua
+
+import (
+	"io"
+	"os"
+)
+
+// WASI has no process model, so io.popen and os.execute always fail.
+const processSupported = false
+
+func defaultStdin() io.Reader {
+	return os.Stdin
+}
@@ -0,0 +1,31 @@
+//go:build !tinygo
+
+package lua
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// openPluginSymbol opens the Go plugin at path and looks up symbol, which
+// must be a func(*LState) int or a variable of type LGFunction. The returned
+// string tells which step failed, as in package.loadlib: "open" or "init".
+func openPluginSymbol(path, symbol string) (LGFunction, string, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, "open", err
+	}
+	sym, err := p.Lookup(symbol)
+	if err != nil {
+		return nil, "init", err
+	}
+	switch fn := sym.(type) {
+	case func(*LState) int:
+		return fn, "", nil
+	case *LGFunction:
+		return *fn, "", nil
+	case *func(*LState) int:
+		return *fn, "", nil
+	}
+	return nil, "init", fmt.Errorf("symbol %s in %s is a %T, not a func(*lua.LState) int", symbol, path, sym)
+}
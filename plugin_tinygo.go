@@ -0,0 +1,11 @@
+//go:build tinygo
+
+package lua
+
+import (
+	"errors"
+)
+
+func openPluginSymbol(path, symbol string) (LGFunction, string, error) {
+	return nil, "absent", errors.New("dynamic libraries not enabled; check your Lua installation")
+}
@@ -25,6 +25,10 @@ func newError(pos int, message string, args ...interface{}) *Error {
 	return &Error{pos, fmt.Sprintf(message, args...)}
 }
 
+// ErrStepLimit is returned by FindWithStepLimit when the match takes more
+// steps than allowed.
+var ErrStepLimit = &Error{_UNKNOWN, "pattern too complex: step limit exceeded"}
+
 func (e *Error) Error() string {
 	switch e.Pos {
 	case EOS:
@@ -527,7 +531,9 @@ func compilePattern(p pattern, ps ...*iptr) []inst {
 
 // Simple recursive virtual machine based on the
 // "Regular Expression Matching: the Virtual Machine Approach" (https://swtch.com/~rsc/regexp/regexp2.html)
-func recursiveVM(src []byte, insts []inst, pc, sp, recLevel int, ms ...*MatchData) (bool, int, *MatchData) {
+// steps is the number of instructions the VM may still execute, or nil if
+// it is not limited.
+func recursiveVM(src []byte, insts []inst, steps *int64, pc, sp, recLevel int, ms ...*MatchData) (bool, int, *MatchData) {
 	recLevel++
 	if recLevel > maxRecursionLevel {
 		panic(newError(_UNKNOWN, "pattern/input too complex"))
@@ -539,6 +545,11 @@ func recursiveVM(src []byte, insts []inst, pc, sp, recLevel int, ms ...*MatchDat
 		m = ms[0]
 	}
 redo:
+	if steps != nil {
+		if *steps--; *steps < 0 {
+			panic(ErrStepLimit)
+		}
+	}
 	inst := insts[pc]
 	switch inst.OpCode {
 	case opChar:
@@ -556,14 +567,14 @@ redo:
 		pc = inst.Operand1
 		goto redo
 	case opSplit:
-		if ok, nsp, _ := recursiveVM(src, insts, inst.Operand1, sp, recLevel, m); ok {
+		if ok, nsp, _ := recursiveVM(src, insts, steps, inst.Operand1, sp, recLevel, m); ok {
 			return true, nsp, m
 		}
 		pc = inst.Operand2
 		goto redo
 	case opSave:
 		s := m.setCapture(inst.Operand1, sp)
-		if ok, nsp, _ := recursiveVM(src, insts, pc+1, sp, recLevel, m); ok {
+		if ok, nsp, _ := recursiveVM(src, insts, steps, pc+1, sp, recLevel, m); ok {
 			return true, nsp, m
 		}
 		m.restoreCapture(inst.Operand1, s)
@@ -593,7 +604,7 @@ redo:
 		return false, sp, m
 	case opNumber:
 		idx := inst.Operand1 * 2
-		if idx >= m.CaptureLength()-1 {
+		if idx >= m.CaptureLength()-1 || m.Capture(idx+1) < m.Capture(idx) {
 			panic(newError(_UNKNOWN, "invalid capture index"))
 		}
 		capture := src[m.Capture(idx):m.Capture(idx+1)]
@@ -614,6 +625,13 @@ redo:
 /* API {{{ */
 
 func Find(p string, src []byte, offset, limit int) (matches []*MatchData, err error) {
+	return FindWithStepLimit(p, src, offset, limit, 0)
+}
+
+// FindWithStepLimit is like Find but fails with ErrStepLimit once matching
+// took more than maxSteps steps of the matching VM, which bounds the time
+// spent on patterns that backtrack a lot. A maxSteps of 0 means no limit.
+func FindWithStepLimit(p string, src []byte, offset, limit int, maxSteps int64) (matches []*MatchData, err error) {
 	defer func() {
 		if v := recover(); v != nil {
 			if perr, ok := v.(*Error); ok {
@@ -625,9 +643,13 @@ func Find(p string, src []byte, offset, limit int) (matches []*MatchData, err er
 	}()
 	pat := parsePattern(newScanner([]byte(p)), true)
 	insts := compilePattern(pat)
+	var steps *int64
+	if maxSteps > 0 {
+		steps = &maxSteps
+	}
 	matches = []*MatchData{}
 	for sp := offset; sp <= len(src); {
-		ok, nsp, ms := recursiveVM(src, insts, 0, sp, 0)
+		ok, nsp, ms := recursiveVM(src, insts, steps, 0, sp, 0)
 		sp++
 		if ok {
 			if sp < nsp {
@@ -0,0 +1,32 @@
+package lua
+
+/* protected metatables {{{ */
+
+// ProtectMetatable protects mt, e.g. a type metatable made by
+// NewTypeMetatable and shared by the userdata of many scripts, against the
+// scripts whatever its fields say. getmetatable, debug.getmetatable and
+// GetMetatable return its __metatable field, or false if it has none, in
+// place of mt;
+// setmetatable and debug.setmetatable refuse to replace it on the values
+// that have it; and mt is made read-only, so that it can not be changed
+// even if a script gets hold of it, e.g. through a global.
+//
+// The host can still change it inside WithTableReadOnlyBypass, or undo the
+// protection with UnprotectMetatable.
+func (ls *LState) ProtectMetatable(mt *LTable) {
+	mt.protected = true
+	ls.SetTableReadOnly(mt, true)
+}
+
+// UnprotectMetatable undoes ProtectMetatable.
+func (ls *LState) UnprotectMetatable(mt *LTable) {
+	mt.protected = false
+	ls.SetTableReadOnly(mt, false)
+}
+
+// IsMetatableProtected reports whether mt is protected by ProtectMetatable.
+func (ls *LState) IsMetatableProtected(mt *LTable) bool {
+	return mt.protected
+}
+
+/* }}} */
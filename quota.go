@@ -0,0 +1,92 @@
+package lua
+
+import "sync/atomic"
+
+/* memory quota groups {{{ */
+
+// QuotaGroup is a memory limit shared by several states, for instance to put
+// a ceiling on the memory of the many small states of a process. The
+// allocations of every state attached with LState.JoinQuotaGroup are added
+// up atomically, and an allocation that brings the total above the limit
+// fails in the state that made it, like the limit set by SetMemoryLimit.
+// A QuotaGroup is safe for concurrent use.
+type QuotaGroup struct {
+	limit  atomic.Int64
+	used   atomic.Int64
+	states atomic.Int64
+}
+
+// NewQuotaGroup returns a group limited to limit bytes. A limit of 0 only
+// measures the memory of the group.
+func NewQuotaGroup(limit int64) *QuotaGroup {
+	g := &QuotaGroup{}
+	g.limit.Store(limit)
+	return g
+}
+
+// SetLimit changes the limit of the group. It applies to the next
+// allocations, states above the new limit are not interrupted.
+func (g *QuotaGroup) SetLimit(limit int64) {
+	g.limit.Store(limit)
+}
+
+// Limit returns the limit of the group in bytes (0 if none).
+func (g *QuotaGroup) Limit() int64 {
+	return g.limit.Load()
+}
+
+// Used returns the bytes allocated by the states of the group, as counted by
+// GetAllocatedBytes.
+func (g *QuotaGroup) Used() int64 {
+	return g.used.Load()
+}
+
+// States returns the number of states attached to the group.
+func (g *QuotaGroup) States() int {
+	return int(g.states.Load())
+}
+
+// JoinQuotaGroup attaches ls to g, detaching it from its previous group. The
+// bytes ls already allocated are charged to g without checking the limit.
+// The coroutines of ls are charged through ls and need not join. Close
+// detaches ls from its group.
+func (ls *LState) JoinQuotaGroup(g *QuotaGroup) {
+	ls.LeaveQuotaGroup()
+	if g == nil {
+		return
+	}
+	ls.quota = g
+	g.states.Add(1)
+	g.used.Add(ls.allocatedBytes)
+}
+
+// LeaveQuotaGroup detaches ls from its group and gives the bytes it
+// allocated back to the group.
+func (ls *LState) LeaveQuotaGroup() {
+	if ls.quota == nil {
+		return
+	}
+	ls.quota.used.Add(-ls.allocatedBytes)
+	ls.quota.states.Add(-1)
+	ls.quota = nil
+}
+
+// QuotaGroup returns the group ls is attached to, or nil.
+func (ls *LState) QuotaGroup() *QuotaGroup {
+	return ls.quota
+}
+
+// setAllocatedBytes replaces the allocated bytes of ls, e.g. after they were
+// measured again, charges the difference to its group and updates the peak.
+func (ls *LState) setAllocatedBytes(bytes int64) {
+	if ls.quota != nil {
+		ls.quota.used.Add(bytes - ls.allocatedBytes)
+	}
+	ls.allocatedBytes = bytes
+	if bytes > ls.peakBytes {
+		ls.peakBytes = bytes
+	}
+	ls.publishMemory()
+}
+
+/* }}} */
@@ -0,0 +1,95 @@
+package lua
+
+import (
+	"sync"
+	"time"
+)
+
+/* host call rate limits {{{ */
+
+// CallLimiter bounds how often the host functions wrapped with RateLimited
+// can be called. It is a token bucket: calls consume a token, tokens are
+// added at a fixed rate and at most burst of them are kept. A limiter can be
+// shared by several functions, and by several states, to limit a category
+// of calls such as every database query.
+type CallLimiter struct {
+	// Wait makes a call beyond the limit wait for a token instead of raising
+	// an error. The wait ends with an error if the context of the state is
+	// cancelled.
+	Wait bool
+
+	name   string
+	rate   float64
+	burst  float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewCallLimiter returns a limiter that allows rate calls per second on
+// average and up to burst calls at once. name appears in error messages.
+func NewCallLimiter(name string, rate float64, burst int) *CallLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &CallLimiter{name: name, rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller has to wait until
+// it is available. It takes nothing and returns false if the caller does not
+// want to wait.
+func (cl *CallLimiter) reserve(now time.Time, wait bool) (time.Duration, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.tokens += now.Sub(cl.last).Seconds() * cl.rate
+	if cl.tokens > cl.burst {
+		cl.tokens = cl.burst
+	}
+	cl.last = now
+	if cl.tokens >= 1 {
+		cl.tokens--
+		return 0, true
+	}
+	if !wait || cl.rate <= 0 {
+		return 0, false
+	}
+	cl.tokens--
+	return time.Duration(-cl.tokens / cl.rate * float64(time.Second)), true
+}
+
+// cancel gives back a token taken by reserve.
+func (cl *CallLimiter) cancel() {
+	cl.mu.Lock()
+	cl.tokens++
+	cl.mu.Unlock()
+}
+
+// RateLimited wraps a host function so that its calls are bounded by limiter.
+// A call beyond the limit raises an error that scripts can catch with pcall,
+// and whose cause is a *LimitError, or waits if limiter.Wait is set.
+func RateLimited(limiter *CallLimiter, fn LGFunction) LGFunction {
+	return func(L *LState) int {
+		delay, ok := limiter.reserve(time.Now(), limiter.Wait)
+		if !ok {
+			L.raiseTypedError(&LimitError{Resource: limiter.name + " call rate", Limit: int64(limiter.burst), Value: int64(limiter.burst) + 1},
+				"%v: rate limit of %v calls per second exceeded", limiter.name, limiter.rate)
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			if L.ctx != nil {
+				select {
+				case <-timer.C:
+				case <-L.ctx.Done():
+					timer.Stop()
+					limiter.cancel()
+					L.raiseContextError()
+				}
+			} else {
+				<-timer.C
+			}
+		}
+		return fn(L)
+	}
+}
+
+/* }}} */
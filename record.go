@@ -0,0 +1,197 @@
+package lua
+
+import (
+	"encoding/gob"
+	"io"
+)
+
+/* record and replay {{{ */
+
+// Recording is a log of the nondeterministic inputs that crossed into the
+// VM: the results of os.time, os.clock, os.date, os.getenv, os.tmpname,
+// math.random, io.read, channel receives and selects, and of the host
+// functions wrapped by Nondeterministic. Replaying it feeds the same inputs
+// back, so that a failing script can be reproduced deterministically.
+type Recording struct {
+	Events []RecordedEvent
+}
+
+// RecordedEvent is the result of one nondeterministic call.
+type RecordedEvent struct {
+	// Source identifies the call, e.g. "os.time".
+	Source string
+	// Values holds the results: nil, bool, float64, string or
+	// *RecordedTable. Functions, userdata, threads and channels can not be
+	// recorded and are replayed as nil.
+	Values []interface{}
+}
+
+// RecordedTable is a recorded table. Cycles are replayed as nil.
+type RecordedTable struct {
+	Keys   []interface{}
+	Values []interface{}
+}
+
+func init() {
+	gob.Register(&RecordedTable{})
+}
+
+// WriteTo writes the recording to w in a binary format.
+func (r *Recording) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := gob.NewEncoder(cw).Encode(r)
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// ReadRecording reads a recording written by Recording.WriteTo.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	rec := &Recording{}
+	if err := gob.NewDecoder(r).Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+type recordReplay struct {
+	rec       *Recording
+	replaying bool
+	next      int
+}
+
+// StartRecording starts logging the nondeterministic inputs of this state
+// and its threads, and returns the recording that they are appended to.
+func (ls *LState) StartRecording() *Recording {
+	rec := &Recording{}
+	ls.G.recordReplay = &recordReplay{rec: rec}
+	return rec
+}
+
+// StartReplay makes the nondeterministic inputs of this state and its
+// threads return the values of rec instead of being evaluated. A Lua error
+// is raised if the script makes calls in a different order than when it was
+// recorded, or more calls than were recorded.
+func (ls *LState) StartReplay(rec *Recording) {
+	ls.G.recordReplay = &recordReplay{rec: rec, replaying: true}
+}
+
+// StopRecordReplay stops recording or replaying.
+func (ls *LState) StopRecordReplay() {
+	ls.G.recordReplay = nil
+}
+
+// Nondeterministic wraps a host function whose results can not be derived
+// from its arguments, such as a database query, so that they are captured by
+// StartRecording and fed back by StartReplay. source identifies the function
+// in the recording.
+func Nondeterministic(source string, fn LGFunction) LGFunction {
+	return func(L *LState) int {
+		if values, ok := L.replayEvent(source); ok {
+			for _, v := range values {
+				L.Push(v)
+			}
+			return len(values)
+		}
+		n := fn(L)
+		if L.G.recordReplay != nil && n > 0 {
+			values := make([]LValue, n)
+			for i := range values {
+				values[i] = L.Get(-n + i)
+			}
+			L.recordEvent(source, values...)
+		}
+		return n
+	}
+}
+
+// replayEvent returns the values recorded for source if the state is
+// replaying.
+func (ls *LState) replayEvent(source string) ([]LValue, bool) {
+	rr := ls.G.recordReplay
+	if rr == nil || !rr.replaying {
+		return nil, false
+	}
+	if rr.next >= len(rr.rec.Events) {
+		ls.RaiseError("replay diverged: no more recorded events, %s called", source)
+	}
+	ev := rr.rec.Events[rr.next]
+	if ev.Source != source {
+		ls.RaiseError("replay diverged: %s recorded, %s called", ev.Source, source)
+	}
+	rr.next++
+	values := make([]LValue, len(ev.Values))
+	for i, v := range ev.Values {
+		values[i] = ls.fromRecordedValue(v)
+	}
+	return values, true
+}
+
+// recordEvent appends the values returned for source if the state is
+// recording.
+func (ls *LState) recordEvent(source string, values ...LValue) {
+	rr := ls.G.recordReplay
+	if rr == nil || rr.replaying {
+		return
+	}
+	ev := RecordedEvent{Source: source, Values: make([]interface{}, len(values))}
+	for i, v := range values {
+		ev.Values[i] = toRecordedValue(v, map[*LTable]bool{})
+	}
+	rr.rec.Events = append(rr.rec.Events, ev)
+}
+
+func toRecordedValue(lv LValue, seen map[*LTable]bool) interface{} {
+	switch v := lv.(type) {
+	case LBool:
+		return bool(v)
+	case LNumber:
+		return float64(v)
+	case LString:
+		return string(v)
+	case *LTable:
+		if seen[v] {
+			return nil
+		}
+		seen[v] = true
+		rt := &RecordedTable{}
+		v.ForEach(func(key, value LValue) {
+			rt.Keys = append(rt.Keys, toRecordedValue(key, seen))
+			rt.Values = append(rt.Values, toRecordedValue(value, seen))
+		})
+		delete(seen, v)
+		return rt
+	}
+	return nil
+}
+
+func (ls *LState) fromRecordedValue(v interface{}) LValue {
+	switch value := v.(type) {
+	case bool:
+		return LBool(value)
+	case float64:
+		return LNumber(value)
+	case string:
+		return LString(value)
+	case *RecordedTable:
+		tb := ls.NewTable()
+		for i, key := range value.Keys {
+			if k := ls.fromRecordedValue(key); k != LNil {
+				tb.RawSet(k, ls.fromRecordedValue(value.Values[i]))
+			}
+		}
+		return tb
+	}
+	return LNil
+}
+
+/* }}} */
@@ -0,0 +1,158 @@
+package lua
+
+import (
+	"fmt"
+)
+
+/* hot reload {{{ */
+
+// ReloadConflict describes a module field that ReloadModule can not update
+// without losing state.
+type ReloadConflict struct {
+	// Module is the name of the module being reloaded.
+	Module string
+	// Key is the field of the module table, or LNil if the module itself is not a table.
+	Key LValue
+	// Reason explains why the change is incompatible.
+	Reason string
+	// Old and New are the current and the reloaded values.
+	Old LValue
+	New LValue
+}
+
+func (rc *ReloadConflict) String() string {
+	if rc.Key == LNil {
+		return fmt.Sprintf("%v: %v", rc.Module, rc.Reason)
+	}
+	return fmt.Sprintf("%v.%v: %v", rc.Module, rc.Key.String(), rc.Reason)
+}
+
+// ReloadHandler decides how ReloadModule resolves a conflict. It returns true
+// to use the new value anyway, or false to keep the old one.
+type ReloadHandler func(L *LState, c *ReloadConflict) bool
+
+// ReloadModule recompiles the Lua module name from package.path and swaps it
+// into package.loaded[name] without dropping the state of the running program.
+//
+// If both the old and the new module are tables, the old table is updated in
+// place, so code holding a reference to it sees the new functions:
+//
+//   - New keys are added and keys that no longer exist are left untouched.
+//   - A function replaces the old function with the same key if they take the
+//     same parameters.
+//   - Other values replace the old ones.
+//
+// Upvalues of the new functions are joined with the upvalues of the old
+// module functions that have the same name, so module locals such as counters
+// and caches keep their current values.
+//
+// Functions whose parameters changed, values whose type changed from or to a
+// function and modules that are not tables are reported to onConflict. With a
+// nil onConflict the new value is used.
+func (ls *LState) ReloadModule(name string, onConflict ReloadHandler) error {
+	loaded, ok := ls.GetField(ls.Get(RegistryIndex), "_LOADED").(*LTable)
+	if !ok {
+		return newApiErrorS(ApiErrorRun, "package.loaded must be a table")
+	}
+	old := loaded.RawGetString(name)
+	if old == LNil {
+		return newApiErrorS(ApiErrorRun, fmt.Sprintf("module %s is not loaded", name))
+	}
+
+	path, msg := loFindFile(ls, name, "path")
+	if len(path) == 0 {
+		return newApiErrorS(ApiErrorFile, fmt.Sprintf("module %s not found:\n\t%s", name, msg))
+	}
+	fn, err := ls.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := ls.CallByParam(P{Fn: fn, NRet: 1, Protect: true}, LString(name)); err != nil {
+		return err
+	}
+	mod := ls.Get(-1)
+	ls.Pop(1)
+	if mod == LNil {
+		mod = loaded.RawGetString(name)
+	}
+
+	merge := func(L *LState) int {
+		oldtb, ok1 := old.(*LTable)
+		newtb, ok2 := mod.(*LTable)
+		if !ok1 || !ok2 {
+			if ls.reloadAccepted(onConflict, &ReloadConflict{name, LNil, "module is not a table", old, mod}) {
+				L.SetField(loaded, name, mod)
+			} else {
+				L.SetField(loaded, name, old)
+			}
+			return 0
+		}
+		if oldtb == newtb {
+			return 0
+		}
+		upvalues := moduleUpvalues(oldtb)
+		newtb.ForEach(func(key, nv LValue) {
+			ov := oldtb.RawGet(key)
+			ofn, oldIsFn := ov.(*LFunction)
+			nfn, newIsFn := nv.(*LFunction)
+			switch {
+			case oldIsFn && newIsFn:
+				if !ofn.IsG && !nfn.IsG && (ofn.Proto.NumParameters != nfn.Proto.NumParameters || ofn.Proto.IsVarArg != nfn.Proto.IsVarArg) &&
+					!ls.reloadAccepted(onConflict, &ReloadConflict{name, key, "function parameters changed", ov, nv}) {
+					return
+				}
+			case ov != LNil && oldIsFn != newIsFn:
+				if !ls.reloadAccepted(onConflict, &ReloadConflict{name, key, fmt.Sprintf("type changed from %v to %v", ov.Type().String(), nv.Type().String()), ov, nv}) {
+					return
+				}
+			}
+			if newIsFn {
+				joinUpvalues(nfn, upvalues)
+			}
+			L.RawSet(oldtb, key, nv)
+		})
+		L.SetField(loaded, name, oldtb)
+		return 0
+	}
+	return ls.CallByParam(P{Fn: ls.NewFunction(merge), NRet: 0, Protect: true})
+}
+
+func (ls *LState) reloadAccepted(onConflict ReloadHandler, c *ReloadConflict) bool {
+	if onConflict == nil {
+		return true
+	}
+	return onConflict(ls, c)
+}
+
+// moduleUpvalues collects the upvalues of the Lua functions stored in a
+// module table by name.
+func moduleUpvalues(tb *LTable) map[string]*Upvalue {
+	upvalues := map[string]*Upvalue{}
+	tb.ForEach(func(_, v LValue) {
+		fn, ok := v.(*LFunction)
+		if !ok || fn.IsG {
+			return
+		}
+		for i, name := range fn.Proto.DbgUpvalues {
+			if _, found := upvalues[name]; !found && i < len(fn.Upvalues) {
+				upvalues[name] = fn.Upvalues[i]
+			}
+		}
+	})
+	return upvalues
+}
+
+// joinUpvalues makes the upvalues of fn share the given upvalues that have
+// the same name.
+func joinUpvalues(fn *LFunction, upvalues map[string]*Upvalue) {
+	if fn.IsG {
+		return
+	}
+	for i, name := range fn.Proto.DbgUpvalues {
+		if uv, ok := upvalues[name]; ok && i < len(fn.Upvalues) {
+			fn.Upvalues[i] = uv
+		}
+	}
+}
+
+/* }}} */
@@ -0,0 +1,64 @@
+package lua
+
+import "bufio"
+
+/* safe libraries {{{ */
+
+var safeLuaLibs = []luaLib{
+	luaLib{BaseLibName, OpenBase},
+	luaLib{TabLibName, OpenTable},
+	luaLib{OsLibName, openSafeOs},
+	luaLib{StringLibName, OpenString},
+	luaLib{MathLibName, OpenMath},
+	luaLib{CoroutineLibName, OpenCoroutine},
+}
+
+// unsafeBaseFuncs are the base functions that OpenSafeLibs removes: they
+// read files or need the package library.
+var unsafeBaseFuncs = []string{"dofile", "loadfile", "require", "module", "_printregs"}
+
+// safeOsFuncs are the os functions that OpenSafeLibs keeps.
+var safeOsFuncs = map[string]LGFunction{
+	"clock":    osFuncs["clock"],
+	"date":     osFuncs["date"],
+	"difftime": osFuncs["difftime"],
+	"time":     osFuncs["time"],
+}
+
+// OpenSafeLibs loads the parts of the built-in libraries that untrusted
+// scripts can use without reaching the host: the base, table, string, math
+// and coroutine libraries, and the clock and date functions of the os
+// library. The io, package, debug, channel and memory libraries are left
+// out, as are dofile, loadfile, require and module, and load and
+// loadstring refuse binary chunks, which are not verified and can break the
+// VM. It is called by NewState instead of OpenLibs if Options.SafeLibs is
+// set. Host functions registered afterwards are available as usual.
+func (ls *LState) OpenSafeLibs() {
+	ls.G.textChunksOnly = true
+	for _, lib := range safeLuaLibs {
+		ls.Push(ls.NewFunction(lib.libFunc))
+		ls.Push(LString(lib.libName))
+		ls.Call(1, 0)
+	}
+	for _, name := range unsafeBaseFuncs {
+		ls.G.Global.RawSetString(name, LNil)
+	}
+}
+
+func openSafeOs(L *LState) int {
+	osmod := L.RegisterModule(OsLibName, safeOsFuncs)
+	L.Push(osmod)
+	return 1
+}
+
+// checkTextChunk returns false if br holds a binary chunk that the state
+// refuses to load from scripts.
+func (ls *LState) checkTextChunk(br *bufio.Reader) bool {
+	if !ls.G.textChunksOnly {
+		return true
+	}
+	c, err := br.Peek(1)
+	return err != nil || c[0] != BinaryChunkSignature[0]
+}
+
+/* }}} */
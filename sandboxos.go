@@ -0,0 +1,116 @@
+package lua
+
+import "time"
+
+/* sandboxed os library {{{ */
+
+// Clock is the source of time of the os library opened by NewSandboxOs.
+// A fixed or stepped clock makes os.time, os.date and os.clock
+// deterministic, e.g. in tests.
+type Clock interface {
+	// Now returns the current time. Its location is used by os.date and
+	// os.time to convert times.
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the Clock of the operating system.
+var SystemClock Clock = systemClock{}
+
+// SandboxOsOptions configures the os library opened by NewSandboxOs.
+type SandboxOsOptions struct {
+	// Clock tells the time to os.time, os.date and os.clock. SystemClock is
+	// used if it is nil. os.clock returns the time elapsed on it since the
+	// library was opened.
+	Clock Clock
+	// Env holds the variables os.getenv returns, in place of the process
+	// environment. os.setenv sets variables in it, and fails if it is nil.
+	Env map[string]string
+	// Allow* enable the functions that reach the host, which fail by
+	// default.
+	AllowExecute bool
+	AllowRemove  bool
+	AllowRename  bool
+	AllowTmpname bool
+}
+
+// NewSandboxOs returns a function that opens an os library for untrusted
+// scripts, to be used in place of OpenOs:
+//
+//	L.Push(L.NewFunction(lua.NewSandboxOs(lua.SandboxOsOptions{Env: env})))
+//	L.Push(lua.LString(lua.OsLibName))
+//	L.Call(1, 0)
+//
+// os.execute, os.remove, os.rename and os.tmpname raise an error unless
+// allowed by opts, and os.exit always does. Time and environment come from
+// opts instead of the process. The functions replace those of an os library
+// that is already open.
+func NewSandboxOs(opts SandboxOsOptions) LGFunction {
+	clock := opts.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	env := opts.Env
+	return func(L *LState) int {
+		start := clock.Now()
+		funcs := map[string]LGFunction{
+			"clock": Nondeterministic("os.clock", func(L *LState) int {
+				return osClockAux(L, clock.Now().Sub(start))
+			}),
+			"date": Nondeterministic("os.date", func(L *LState) int {
+				return osDateAux(L, clock.Now())
+			}),
+			"time": Nondeterministic("os.time", func(L *LState) int {
+				return osTimeAux(L, clock.Now())
+			}),
+			"getenv": Nondeterministic("os.getenv", func(L *LState) int {
+				if v, ok := env[L.CheckString(1)]; ok {
+					L.trackString(len(v))
+					L.Push(LString(v))
+				} else {
+					L.Push(LNil)
+				}
+				return 1
+			}),
+			"setenv": func(L *LState) int {
+				name, value := L.CheckString(1), L.CheckString(2)
+				if env == nil {
+					L.Push(LNil)
+					L.Push(LString("environment is read-only"))
+					return 2
+				}
+				env[name] = value
+				L.Push(LTrue)
+				return 1
+			},
+			"difftime":  osDiffTime,
+			"setlocale": osSetLocale,
+			"exit":      sandboxDenied("exit", false, nil),
+			"execute":   sandboxDenied("execute", opts.AllowExecute, osFuncs["execute"]),
+			"remove":    sandboxDenied("remove", opts.AllowRemove, osFuncs["remove"]),
+			"rename":    sandboxDenied("rename", opts.AllowRename, osFuncs["rename"]),
+			"tmpname":   sandboxDenied("tmpname", opts.AllowTmpname, osFuncs["tmpname"]),
+		}
+		osmod := L.RegisterModule(OsLibName, funcs).(*LTable)
+		L.SetFuncs(osmod, funcs)
+		L.Push(osmod)
+		return 1
+	}
+}
+
+// sandboxDenied returns fn if allowed, and a function that raises an error
+// otherwise.
+func sandboxDenied(name string, allowed bool, fn LGFunction) LGFunction {
+	if allowed {
+		return fn
+	}
+	return func(L *LState) int {
+		L.RaiseError("'%s' not permitted", name)
+		return 0
+	}
+}
+
+/* }}} */
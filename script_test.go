@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"runtime"
@@ -61,6 +62,21 @@ func testScriptCompile(t *testing.T, script string) {
 	}
 	nop := func(s string) {}
 	nop(proto.String())
+
+	var buf bytes.Buffer
+	if err := DumpProto(&buf, proto); err != nil {
+		t.Fatal(err)
+	}
+	proto2, err4 := UndumpProto(&buf)
+	if err4 != nil {
+		t.Fatal(err4)
+	}
+	if proto.String() != proto2.String() {
+		t.Errorf("%s: binary chunk does not round trip", script)
+	}
+	if err := VerifyProto(proto2); err != nil {
+		t.Errorf("%s: %v", script, err)
+	}
 }
 
 func testScriptDir(t *testing.T, tests []string, directory string) {
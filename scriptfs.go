@@ -0,0 +1,52 @@
+package lua
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+/* script file system {{{ */
+
+// LuaFSPathDefault is the package.path used while scripts are loaded from an fs.FS.
+var LuaFSPathDefault = "?.lua;?/init.lua"
+
+// LoadFS makes LoadFile, DoFile, dofile, loadfile and require read scripts
+// from fsys (typically an embed.FS) instead of the operating system's file
+// system. Paths are resolved with fs.FS semantics: they are slash separated
+// and relative to the root of fsys. Chunk names are the cleaned paths, so
+// error messages and tracebacks point at the file inside fsys.
+//
+// package.path is reset to LuaFSPathDefault. The file system is shared by all
+// threads of this state. Passing nil restores the default behaviour.
+func (ls *LState) LoadFS(fsys fs.FS) {
+	ls.G.scriptFS = fsys
+	if packagemod, ok := ls.GetField(ls.Get(EnvironIndex), LoadLibName).(*LTable); ok {
+		if fsys != nil {
+			packagemod.RawSetString("path", LString(LuaFSPathDefault))
+		} else {
+			packagemod.RawSetString("path", LString(loGetPath(LuaPath, LuaPathDefault)))
+		}
+	}
+}
+
+// fsPath converts a script path to an fs.FS path.
+func fsPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+}
+
+// openScript opens a script file, honouring LoadFS. It returns the file and
+// the chunk name to use for it.
+func (ls *LState) openScript(name string) (io.ReadCloser, string, error) {
+	if ls.G.scriptFS == nil {
+		fp, err := os.Open(name)
+		return fp, name, err
+	}
+	name = fsPath(name)
+	fp, err := ls.G.scriptFS.Open(name)
+	return fp, name, err
+}
+
+/* }}} */
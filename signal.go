@@ -0,0 +1,53 @@
+//go:build !tinygo
+
+package lua
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// InterruptOnSignal interrupts the script running in this state when one of
+// signals is received, SIGINT and SIGTERM by default. Instead of killing the
+// process, a Lua error is raised at the next instruction or blocking channel
+// operation, with a stack traceback. Scripts can catch it with pcall, and the
+// *ApiError returned to the host has an *InterruptError as its Cause.
+//
+// The state uses a context derived from ctx until stop is called, so that
+// cancelling ctx also interrupts the script; pass context.Background() if
+// there is none. InterruptOnSignal panics if ctx is nil. stop restores the
+// previous context and stops relaying signals. Only the first signal is
+// relayed: a second one has its default effect, so a script stuck in a Go
+// function can still be killed.
+func (ls *LState) InterruptOnSignal(ctx context.Context, signals ...os.Signal) (stop func()) {
+	if ctx == nil {
+		panic("lua: InterruptOnSignal with a nil context")
+	}
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	oldctx := ls.ctx
+	ictx, cancel := context.WithCancelCause(ctx)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		select {
+		case sig := <-ch:
+			signal.Stop(ch)
+			cancel(&InterruptError{Signal: sig})
+		case <-ictx.Done():
+		}
+	}()
+	ls.SetContext(ictx)
+	return func() {
+		signal.Stop(ch)
+		cancel(nil)
+		if oldctx != nil {
+			ls.SetContext(oldctx)
+		} else {
+			ls.RemoveContext()
+		}
+	}
+}
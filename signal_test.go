@@ -0,0 +1,46 @@
+//go:build !tinygo
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestInterruptOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "js" || runtime.GOOS == "wasip1" {
+		t.Skip("signals are not supported")
+	}
+	L := NewState()
+	defer L.Close()
+	stop := L.InterruptOnSignal(context.Background(), os.Interrupt)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p, _ := os.FindProcess(os.Getpid())
+		p.Signal(os.Interrupt)
+	}()
+	err := L.DoString(`
+	local ok, msg = pcall(function() while true do end end)
+	assert(not ok and msg:find("interrupted by signal"))
+	while true do end
+	`)
+	stop()
+	var ie *InterruptError
+	errorIfFalse(t, errors.As(err, &ie), "expected an *InterruptError, got %v", err)
+	errorIfNotEqual(t, os.Interrupt, ie.Signal)
+	errorIfFalse(t, L.Context() == nil, "the previous context was not restored")
+	errorIfScriptFail(t, L, `assert(true)`)
+}
+
+func TestInterruptOnSignalNilContext(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	defer func() {
+		errorIfFalse(t, recover() != nil, "expected a panic for a nil context")
+	}()
+	L.InterruptOnSignal(nil)
+}
@@ -0,0 +1,28 @@
+//go:build tinygo
+
+package lua
+
+import (
+	"context"
+	"os"
+)
+
+// TinyGo does not implement os/signal, so no signal is relayed: the state
+// only uses a context derived from ctx until stop is called, and cancelling
+// ctx still interrupts the script.
+func (ls *LState) InterruptOnSignal(ctx context.Context, signals ...os.Signal) (stop func()) {
+	if ctx == nil {
+		panic("lua: InterruptOnSignal with a nil context")
+	}
+	oldctx := ls.ctx
+	ictx, cancel := context.WithCancel(ctx)
+	ls.SetContext(ictx)
+	return func() {
+		cancel()
+		if oldctx != nil {
+			ls.SetContext(oldctx)
+		} else {
+			ls.RemoveContext()
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package lua
+
+import "unsafe"
+
+/* sizing model {{{ */
+
+// SizingModel holds the costs, in bytes, that the memory accounting charges
+// for the objects of a state (see TrackAlloc and EstimateSize). The defaults
+// follow the Go representation of the objects; hosts can tune them, for
+// instance to bring GetAllocatedBytes closer to the numbers of another Lua
+// implementation. Prototypes and channels are not covered.
+type SizingModel struct {
+	// Table is a table without array and hash parts.
+	Table int64
+	// ArraySlot is a slot of the array part of a table or of the registry.
+	ArraySlot int64
+	// HashEntry is an entry of the hash part of a table, including its
+	// share of the buckets and of the index that keeps the order of keys.
+	HashEntry int64
+	// StringHeader is added to the length of every string.
+	StringHeader int64
+	// Closure is a Lua or Go function without upvalues. Upvalue is added for
+	// each of its upvalues.
+	Closure int64
+	Upvalue int64
+	// UserData is a userdata without the payload given to
+	// NewUserDataWithSize.
+	UserData int64
+	// CallFrame is a frame of the call stack.
+	CallFrame int64
+	// Thread is a state or coroutine without its registry and call stack.
+	Thread int64
+}
+
+// DefaultSizingModel is the sizing model of states whose Options do not set
+// one.
+var DefaultSizingModel = SizingModel{
+	Table:        int64(unsafe.Sizeof(LTable{})),
+	ArraySlot:    16, // an interface value
+	HashEntry:    72, // a map entry plus its position in the key order
+	StringHeader: 16,
+	Closure:      int64(unsafe.Sizeof(LFunction{})),
+	Upvalue:      8,
+	UserData:     int64(unsafe.Sizeof(LUserData{})),
+	CallFrame:    int64(unsafe.Sizeof(callFrame{})),
+	Thread:       int64(unsafe.Sizeof(LState{})),
+}
+
+// sizing returns the sizing model of ls.
+func (ls *LState) sizing() *SizingModel {
+	if ls.Options.SizingModel != nil {
+		return ls.Options.SizingModel
+	}
+	return &DefaultSizingModel
+}
+
+// trackString charges a new string of n bytes, which must not be longer
+// than the limit set by SetMaxStringLength.
+func (ls *LState) trackString(n int) {
+	ls.checkStringLength(n)
+	ls.trackAlloc(AllocString, int64(n)+ls.sizing().StringHeader)
+}
+
+// reserveString is trackString for a string that is not built yet: if it
+// does not fit in the memory limits, the error is raised before anything is
+// charged or allocated.
+func (ls *LState) reserveString(n int) {
+	ls.checkStringLength(n)
+	size := int64(n) + ls.sizing().StringHeader
+	if err := ls.checkFits(size); err != nil {
+		ls.raiseNotFitting(err, size)
+	}
+	ls.trackAlloc(AllocString, size)
+}
+
+/* }}} */
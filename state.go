@@ -5,6 +5,7 @@ package lua
 ////////////////////////////////////////////////////////
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -15,7 +16,6 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/yuin/gopher-lua/parse"
 )
@@ -31,7 +31,8 @@ type ApiError struct {
 	Type       ApiErrorType
 	Object     LValue
 	StackTrace string
-	// Underlying error. This attribute is set only if the Type is ApiErrorFile or ApiErrorSyntax
+	// Underlying error. This attribute is set if the Type is ApiErrorFile or ApiErrorSyntax, and for
+	// runtime errors raised by the VM that have a typed category (see errors.go).
 	Cause error
 }
 
@@ -54,6 +55,12 @@ func (e *ApiError) Error() string {
 	return e.Object.String()
 }
 
+// Unwrap returns the underlying error, so errors.Is and errors.As can inspect
+// syntax errors and typed runtime errors such as *IndexError.
+func (e *ApiError) Unwrap() error {
+	return e.Cause
+}
+
 type ApiErrorType int
 
 const (
@@ -105,12 +112,90 @@ type Options struct {
 	RegistryGrowStep int
 	// Controls whether or not libraries are opened by default
 	SkipOpenLibs bool
+	// Opens the libraries with OpenSafeLibs instead of OpenLibs.
+	SafeLibs bool
+	// Makes runs of the same scripts reproducible: tables iterate in insertion order unless
+	// DeterministicIteration says otherwise, math.random is seeded with RandomSeed and does not
+	// share its generator with other states, os.time, os.date and os.clock read Clock, and
+	// tostring numbers tables, functions, threads, userdata and channels in the order it first
+	// prints them instead of showing their addresses.
+	Deterministic bool
+	// Seed of math.random in a deterministic state.
+	RandomSeed int64
+	// Clock read by os.time, os.date and os.clock in place of the system clock. A deterministic
+	// state without one uses a clock stopped at the Unix epoch.
+	Clock Clock
+	// Library functions to disable once the libraries are opened, e.g. "os.exit" or
+	// "string.dump". See LState.DenyFunctions.
+	Deny []string
 	// Tells whether a Go stacktrace should be included in a Lua stacktrace when panics occur.
 	IncludeGoStackTrace bool
 	// If `MinimizeStackMemory` is set, the call stack will be automatically grown or shrank up to a limit of
 	// `CallStackSize` in order to minimize memory usage. This does incur a slight performance penalty.
 	MinimizeStackMemory bool
-}
+	// Costs charged by the memory accounting. This defaults to `lua.DefaultSizingModel`.
+	SizingModel *SizingModel
+	// Lua 5.1 and 5.2 behaviours to enable, see CompatFlags. The zero value is Lua 5.1 with goto.
+	CompatFlags CompatFlags
+	// Order in which next(), pairs() and LTable.ForEach visit the hash part of tables.
+	// See IterationOrder.
+	DeterministicIteration IterationOrder
+	// Lets require() and package.loadlib load native modules from Go plugins (see the plugin package).
+	// Plugins run with the full privileges of the host process, so this is disabled by default.
+	AllowPlugins bool
+	// Adds table.ordered() to the table library. See LState.NewOrderedTable.
+	OrderedTables bool
+	// Adds table.freeze() and table.isfrozen() to the table library. table.freeze makes a table
+	// read-only for good, see LState.SetTableReadOnly.
+	FrozenTables bool
+	// Bounds on the chunks that can be loaded, see CompileLimits.
+	CompileLimits CompileLimits
+	// Standard streams used by print, io.read/io.write and the io.stdin/io.stdout/io.stderr files.
+	// These default to os.Stdin, os.Stdout and os.Stderr (Stdin defaults to an empty reader on js/wasm,
+	// where there is no standard input).
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// CompatFlags toggles differences between Lua 5.1 and later versions one by
+// one, so that scripts can be migrated incrementally.
+type CompatFlags uint32
+
+const (
+	// CompatTableUnpack adds table.unpack, as in Lua 5.2.
+	CompatTableUnpack CompatFlags = 1 << iota
+	// CompatNoGlobalUnpack removes the global unpack function, as in Lua 5.2.
+	CompatNoGlobalUnpack
+	// CompatNoFEnv removes getfenv and setfenv, as in Lua 5.2.
+	CompatNoFEnv
+	// CompatStrictIntegerFormat makes string.format raise an error when
+	// %d, %i, %o, %x, %X or %c get a number that has no integer
+	// representation, as in Lua 5.3. Lua 5.1 truncates it.
+	CompatStrictIntegerFormat
+	// CompatNoGoto makes goto a regular identifier, as in Lua 5.1.
+	CompatNoGoto
+
+	// CompatLua52 enables the Lua 5.2 behaviours.
+	CompatLua52 = CompatTableUnpack | CompatNoGlobalUnpack | CompatNoFEnv
+)
+
+// IterationOrder is the order in which the hash part of tables is traversed.
+// The array part is always traversed first, in index order.
+type IterationOrder int
+
+const (
+	// IterationUnordered is the default: next() and pairs() visit keys in
+	// insertion order, while LTable.ForEach follows Go's randomised map order.
+	IterationUnordered IterationOrder = iota
+	// IterationInsertion visits keys in the order they were first inserted,
+	// in next(), pairs() and LTable.ForEach alike.
+	IterationInsertion
+	// IterationSorted visits numbers in ascending order, then strings in
+	// byte-wise order, then false and true, then all other keys in insertion
+	// order. Sorting is done lazily and cached until a new key is inserted.
+	IterationSorted
+)
 
 /* }}} */
 
@@ -156,24 +241,36 @@ type callFrameStack interface {
 	IsFull() bool
 	IsEmpty() bool
 
+	// Limit is the number of frames the stack can hold, SetLimit changes it
+	// within what the stack supports.
+	Limit() int
+	SetLimit(n int)
+
 	FreeAll()
 }
 
 type fixedCallFrameStack struct {
 	array []callFrame
 	sp    int
+	limit int
 }
 
 func newFixedCallFrameStack(size int) callFrameStack {
 	return &fixedCallFrameStack{
 		array: make([]callFrame, size),
 		sp:    0,
+		limit: size,
 	}
 }
 
 func (cs *fixedCallFrameStack) IsEmpty() bool { return cs.sp == 0 }
 
-func (cs *fixedCallFrameStack) IsFull() bool { return cs.sp == len(cs.array) }
+func (cs *fixedCallFrameStack) IsFull() bool { return cs.sp >= cs.limit }
+
+func (cs *fixedCallFrameStack) Limit() int { return cs.limit }
+
+// SetLimit can not grow the stack, as frames point to their parents in it.
+func (cs *fixedCallFrameStack) SetLimit(n int) { cs.limit = min(max(n, 1), len(cs.array)) }
 
 func (cs *fixedCallFrameStack) Clear() {
 	cs.sp = 0
@@ -229,6 +326,11 @@ type autoGrowingCallFrameStack struct {
 	// It points to the next stack slot to use, so 0 means to use the 0th element in the segment, and a value of
 	// FramesPerSegment indicates that the segment is full and cannot accommodate another frame.
 	segSp uint8
+	// limit is the number of frames the stack can hold, at most
+	// len(segments) * FramesPerSegment.
+	limit int
+	// ls is charged for the segments beyond the first one, if set.
+	ls *LState
 }
 
 var segmentPool sync.Pool
@@ -253,6 +355,7 @@ func newAutoGrowingCallFrameStack(maxSize int) callFrameStack {
 		segments: make([]*callFrameStackSegment, (maxSize+(FramesPerSegment-1))/FramesPerSegment),
 		segIdx:   0,
 	}
+	cs.limit = len(cs.segments) * FramesPerSegment
 	cs.segments[0] = newCallFrameStackSegment()
 	return cs
 }
@@ -263,7 +366,19 @@ func (cs *autoGrowingCallFrameStack) IsEmpty() bool {
 
 // IsFull returns true if the stack cannot receive any more stack pushes without overflowing
 func (cs *autoGrowingCallFrameStack) IsFull() bool {
-	return int(cs.segIdx) == len(cs.segments) && cs.segSp >= FramesPerSegment
+	return cs.Sp() >= cs.limit
+}
+
+func (cs *autoGrowingCallFrameStack) Limit() int { return cs.limit }
+
+// SetLimit adds room for more segments if needed, up to what segIdx can
+// index.
+func (cs *autoGrowingCallFrameStack) SetLimit(n int) {
+	n = min(max(n, 1), (math.MaxUint16+1)*FramesPerSegment)
+	if segments := (n + FramesPerSegment - 1) / FramesPerSegment; segments > len(cs.segments) {
+		cs.segments = append(cs.segments, make([]*callFrameStackSegment, segments-len(cs.segments))...)
+	}
+	cs.limit = n
 }
 
 func (cs *autoGrowingCallFrameStack) Clear() {
@@ -271,6 +386,7 @@ func (cs *autoGrowingCallFrameStack) Clear() {
 		freeCallFrameStackSegment(cs.segments[i])
 		cs.segments[i] = nil
 	}
+	cs.release(int(cs.segIdx))
 	cs.segIdx = 0
 	cs.segSp = 0
 }
@@ -289,6 +405,9 @@ func (cs *autoGrowingCallFrameStack) Push(v callFrame) {
 	if cs.segSp >= FramesPerSegment {
 		// segment full, push new segment if allowed
 		if cs.segIdx < segIdx(len(cs.segments)-1) {
+			if cs.ls != nil {
+				cs.ls.trackAlloc(AllocStack, FramesPerSegment*cs.ls.sizing().CallFrame)
+			}
 			curSeg = newCallFrameStackSegment()
 			cs.segIdx++
 			cs.segments[cs.segIdx] = curSeg
@@ -312,6 +431,7 @@ func (cs *autoGrowingCallFrameStack) Sp() int {
 func (cs *autoGrowingCallFrameStack) SetSp(sp int) {
 	desiredSegIdx := segIdx(sp / FramesPerSegment)
 	desiredFramesInLastSeg := uint8(sp % FramesPerSegment)
+	freed := 0
 	for {
 		if cs.segIdx <= desiredSegIdx {
 			break
@@ -319,7 +439,9 @@ func (cs *autoGrowingCallFrameStack) SetSp(sp int) {
 		freeCallFrameStackSegment(cs.segments[cs.segIdx])
 		cs.segments[cs.segIdx] = nil
 		cs.segIdx--
+		freed++
 	}
+	cs.release(freed)
 	cs.segSp = desiredFramesInLastSeg
 }
 
@@ -355,11 +477,19 @@ func (cs *autoGrowingCallFrameStack) Pop() *callFrame {
 		cs.segIdx--
 		cs.segSp = FramesPerSegment
 		curSeg = cs.segments[cs.segIdx]
+		cs.release(1)
 	}
 	cs.segSp--
 	return &curSeg.array[cs.segSp]
 }
 
+// release credits the memory of n freed segments.
+func (cs *autoGrowingCallFrameStack) release(n int) {
+	if cs.ls != nil && n > 0 {
+		cs.ls.releaseAlloc(int64(n) * FramesPerSegment * cs.ls.sizing().CallFrame)
+	}
+}
+
 /* }}} */
 
 /* registry {{{ */
@@ -402,9 +532,8 @@ func (rg *registry) forceResize(newSize int) {
 	// Track memory growth for registry resize
 	oldSize := len(rg.array)
 	if newSize > oldSize {
-		additionalBytes := int64(newSize-oldSize) * 16 // LValue is 16 bytes
 		if ls, ok := rg.handler.(*LState); ok {
-			ls.TrackAlloc(additionalBytes)
+			ls.trackAlloc(AllocStack, int64(newSize-oldSize)*ls.sizing().ArraySlot)
 		}
 	}
 
@@ -662,16 +791,27 @@ func newGlobal() *Global {
 
 func panicWithTraceback(L *LState) {
 	err := newApiError(ApiErrorRun, L.Get(-1))
+	err.Cause = L.takeErrorCause()
 	err.StackTrace = L.stackTrace(0)
 	panic(err)
 }
 
 func panicWithoutTraceback(L *LState) {
 	err := newApiError(ApiErrorRun, L.Get(-1))
+	err.Cause = L.takeErrorCause()
 	panic(err)
 }
 
 func newLState(options Options) *LState {
+	if options.Stdin == nil {
+		options.Stdin = defaultStdin()
+	}
+	if options.Stdout == nil {
+		options.Stdout = os.Stdout
+	}
+	if options.Stderr == nil {
+		options.Stderr = os.Stderr
+	}
 	al := newAllocator(32)
 	ls := &LState{
 		G:       newGlobal(),
@@ -688,9 +828,13 @@ func newLState(options Options) *LState {
 		hasErrorFunc: false,
 		mainLoop:     mainLoop,
 		ctx:          nil,
+		gcPause:      defaultGCPause,
+		gcStepMul:    defaultGCStepMul,
 	}
 	if options.MinimizeStackMemory {
-		ls.stack = newAutoGrowingCallFrameStack(options.CallStackSize)
+		stack := newAutoGrowingCallFrameStack(options.CallStackSize).(*autoGrowingCallFrameStack)
+		stack.ls = ls
+		ls.stack = stack
 	} else {
 		ls.stack = newFixedCallFrameStack(options.CallStackSize)
 	}
@@ -703,36 +847,349 @@ func newLState(options Options) *LState {
 
 // TrackAlloc adds bytes to the memory allocation counter and checks against the limit.
 // Raises a Lua error if the allocation would exceed the memory limit.
+// Allocations of a coroutine are also charged to the state that created it,
+// so they count against the limits of both.
 func (ls *LState) TrackAlloc(bytes int64) {
-	ls.allocatedBytes += bytes
+	ls.trackAlloc(AllocOther, bytes)
+}
+
+// trackAlloc is TrackAlloc for an allocation of the given kind.
+func (ls *LState) trackAlloc(kind AllocKind, bytes int64) {
+	for st := ls; st != nil; st = st.memParent {
+		if st.allocHook != nil {
+			source, line := ls.allocSite()
+			st.allocHook(kind, uint64(bytes), source, line)
+			break
+		}
+	}
+
+	for st := ls; st != nil; st = st.memParent {
+		st.setAllocatedBytes(st.allocatedBytes + bytes)
+	}
+
+	for st := ls; st != nil; st = st.memParent {
+		st.pacedCollect(bytes)
+		if st.memThresholdFn != nil && !st.memThresholdFired && st.allocatedBytes >= st.memThreshold {
+			st.memThresholdFired = true
+			st.memThresholdFn(uint64(st.allocatedBytes), uint64(st.maxBytes))
+		}
+		// Only check limit if one is set
+		if st.maxBytes > 0 {
+			if st.allocatedBytes > st.maxBytes {
+				st.emergencyCollect(bytes)
+			}
+			if st.allocatedBytes > st.maxBytes {
+				st.countLimitExceeded()
+				ls.raiseTypedError(&LimitError{Resource: "memory", Limit: st.maxBytes, Value: st.allocatedBytes},
+					"memory limit exceeded: %d bytes allocated, limit is %d bytes", st.allocatedBytes, st.maxBytes)
+			}
+			if !st.warnedNearLimit && st.allocatedBytes > st.maxBytes/10*9 {
+				st.warnedNearLimit = true
+				ls.warn(WarningSandbox, "memory usage is above 90%% of the limit: %d bytes allocated, limit is %d bytes",
+					st.allocatedBytes, st.maxBytes)
+			}
+		}
+		if st.quota != nil {
+			if limit := st.quota.Limit(); limit > 0 && st.quota.Used() > limit {
+				st.emergencyCollect(bytes)
+			}
+			if limit, used := st.quota.Limit(), st.quota.Used(); limit > 0 && used > limit {
+				st.countLimitExceeded()
+				ls.raiseTypedError(&LimitError{Resource: "memory", Limit: limit, Value: used},
+					"memory quota exceeded: %d bytes allocated by the group, limit is %d bytes", used, limit)
+			}
+		}
+		st.checkBudget(ls, bytes)
+	}
+}
+
+// stackSize returns the memory of the state itself, its registry and its
+// call stack.
+func (ls *LState) stackSize() int64 {
+	m := ls.sizing()
+	size := m.Thread + int64(cap(ls.reg.array))*m.ArraySlot
+	switch cs := ls.stack.(type) {
+	case *fixedCallFrameStack:
+		size += int64(len(cs.array)) * m.CallFrame
+	case *autoGrowingCallFrameStack:
+		size += int64(len(cs.segments))*8 + FramesPerSegment*m.CallFrame
+	}
+	return size
+}
 
-	// Only check limit if one is set
-	if ls.maxBytes > 0 && ls.allocatedBytes > ls.maxBytes {
-		ls.RaiseError("memory limit exceeded: %d bytes allocated, limit is %d bytes",
-			ls.allocatedBytes, ls.maxBytes)
+// MemoryPolicy tells what happens when an allocation exceeds the memory
+// limit of a state or of its quota group.
+type MemoryPolicy int
+
+const (
+	// MemoryPolicyError raises the error right away.
+	MemoryPolicyError MemoryPolicy = iota
+	// MemoryPolicyGCRetry first runs CollectGarbage and raises the error
+	// only if the allocation still does not fit, like the allocator of PUC
+	// Lua does under a limit. The limits of coroutines set by
+	// SetCoroutineMemoryLimit raise the error right away.
+	MemoryPolicyGCRetry
+)
+
+// SetMemoryPolicy sets what happens when an allocation exceeds the memory
+// limit. With MemoryPolicyGCRetry, a collection can happen at any
+// allocation, so userdata only referenced from Go must be kept reachable
+// from the state as described by CollectGarbage. The state then also
+// collects whenever its usage grows past the pause set by
+// collectgarbage("setpause"), 200% of what it retained after the previous
+// collection by default, unless stopped by collectgarbage("stop").
+func (ls *LState) SetMemoryPolicy(policy MemoryPolicy) {
+	ls.memPolicy = policy
+	if ls.gcEstimate == 0 {
+		ls.gcEstimate = ls.allocatedBytes
+	}
+}
+
+// emergencyCollect runs CollectGarbage for an allocation of bytes that does
+// not fit, if the policy of ls asks for it. The allocation stays charged.
+func (ls *LState) emergencyCollect(bytes int64) {
+	if ls.memPolicy != MemoryPolicyGCRetry || ls.memParent != nil || ls.collecting {
+		return
+	}
+	ls.collectAllocating(bytes)
+}
+
+// pacedCollect runs CollectGarbage for an allocation of bytes that brings
+// the usage past the pause, if the policy of ls asks for it.
+func (ls *LState) pacedCollect(bytes int64) {
+	if ls.memPolicy != MemoryPolicyGCRetry || ls.memParent != nil || ls.collecting || ls.gcStopped {
+		return
+	}
+	if ls.allocatedBytes < ls.gcEstimate/100*int64(ls.gcPause) {
+		return
+	}
+	ls.collectAllocating(bytes)
+}
+
+// collectAllocating runs CollectGarbage in the middle of an allocation of
+// bytes, which stays charged.
+func (ls *LState) collectAllocating(bytes int64) {
+	ls.collecting = true
+	defer func() { ls.collecting = false }()
+	ls.CollectGarbage()
+	ls.setAllocatedBytes(ls.allocatedBytes + bytes)
+}
+
+// trackProto charges the compiled chunk proto, loaded as name. A chunk that
+// does not fit is not raised as an error but returned, like a syntax error,
+// so that Load fails cleanly when called from Go.
+func (ls *LState) trackProto(proto *FunctionProto, name string) error {
+	if err := ls.reserveAlloc(AllocProto, ls.protoTreeSize(proto)); err != nil {
+		return &ApiError{Type: ApiErrorRun, Object: LString(fmt.Sprintf("%s: %s", name, err.Error())), Cause: err}
+	}
+	return nil
+}
+
+// reserveAlloc charges an allocation of the given kind if it fits in the
+// limits of ls, and returns a *LimitError without charging it otherwise.
+func (ls *LState) reserveAlloc(kind AllocKind, bytes int64) error {
+	if err := ls.checkFits(bytes); err != nil {
+		return err
+	}
+	ls.trackAlloc(kind, bytes)
+	return nil
+}
+
+// checkFits returns a *LimitError if an allocation of bytes would not fit
+// in the limits of ls, without charging anything.
+func (ls *LState) checkFits(bytes int64) *LimitError {
+	remaining, limited := ls.memoryRemaining()
+	if limited && bytes > remaining {
+		ls.emergencyCollect(0)
+		remaining, limited = ls.memoryRemaining()
+	}
+	if limited && bytes > remaining {
+		ls.countLimitExceeded()
+		used := ls.GetAllocatedBytes()
+		return &LimitError{Resource: "memory", Limit: used + remaining, Value: used + bytes}
+	}
+	return nil
+}
+
+// raiseNotFitting raises err, returned by checkFits for an allocation of
+// bytes, as the error trackAlloc would raise for the limit, quota or budget
+// the allocation goes over, with the size that was requested. Nothing is
+// charged.
+func (ls *LState) raiseNotFitting(err *LimitError, bytes int64) {
+	for st := ls; st != nil; st = st.memParent {
+		if used := st.allocatedBytes + bytes; st.maxBytes > 0 && used > st.maxBytes {
+			ls.raiseTypedError(&LimitError{Resource: "memory", Limit: st.maxBytes, Value: used},
+				"memory limit exceeded: %d bytes requested with %d bytes allocated, limit is %d bytes",
+				bytes, st.allocatedBytes, st.maxBytes)
+		}
+		if st.quota != nil {
+			if limit, used := st.quota.Limit(), st.quota.Used()+bytes; limit > 0 && used > limit {
+				ls.raiseTypedError(&LimitError{Resource: "memory", Limit: limit, Value: used},
+					"memory quota exceeded: %d bytes requested with %d bytes allocated by the group, limit is %d bytes",
+					bytes, st.quota.Used(), limit)
+			}
+		}
+		for b := st.budget; b != nil; b = b.prev {
+			if used := st.allocatedBytes + bytes - b.base; used > b.limit {
+				ls.raiseTypedError(&LimitError{Resource: "memory budget", Limit: b.limit, Value: used},
+					"memory budget exceeded: %d bytes requested with %d bytes allocated by the call, budget is %d bytes",
+					bytes, used-bytes, b.limit)
+			}
+		}
+	}
+	ls.raiseTypedError(err, "%s", err.Error())
+}
+
+// ReserveMemory charges bytes allocated by the host on behalf of the
+// script, e.g. the buffer of a decoded image, to the same counter and
+// limits as the allocations of the VM. Unlike TrackAlloc, it does not raise
+// an error but returns a *LimitError, matched by ErrMemoryLimitExceeded,
+// and charges nothing if the bytes do not fit. The bytes should be given
+// back with ReleaseMemory once the buffer is no longer used.
+//
+//	if err := L.ReserveMemory(int64(len(buf))); err != nil {
+//		L.RaiseError("image too large: %v", err)
+//	}
+//	defer L.ReleaseMemory(int64(len(buf)))
+func (ls *LState) ReserveMemory(bytes int64) error {
+	return ls.reserveAlloc(AllocOther, bytes)
+}
+
+// ReleaseMemory gives back bytes charged with ReserveMemory or TrackAlloc.
+func (ls *LState) ReleaseMemory(bytes int64) {
+	ls.releaseAlloc(bytes)
+}
+
+// protoTreeSize returns the size of proto, of its string constants and of
+// its child prototypes.
+func (ls *LState) protoTreeSize(proto *FunctionProto) int64 {
+	size := protoSize(proto)
+	for _, c := range proto.Constants {
+		if s, ok := c.(LString); ok {
+			size += ls.sizing().StringHeader
+			if !isSharedString(string(s)) {
+				size += int64(len(s))
+			}
+		}
+	}
+	for _, child := range proto.FunctionPrototypes {
+		size += ls.protoTreeSize(child)
+	}
+	return size
+}
+
+// releaseAlloc credits bytes that are known to have been released back to
+// the memory allocation counter.
+func (ls *LState) releaseAlloc(bytes int64) {
+	for st := ls; st != nil; st = st.memParent {
+		st.setAllocatedBytes(max(st.allocatedBytes-bytes, 0))
+		st.rearmMemoryThreshold()
+	}
+}
+
+// rearmMemoryThreshold lets the threshold callback fire again once the usage
+// dropped below the threshold.
+func (ls *LState) rearmMemoryThreshold() {
+	if ls.allocatedBytes < ls.memThreshold {
+		ls.memThresholdFired = false
 	}
 }
 
 // ResetMemoryUsage resets the allocated bytes counter to zero.
 func (ls *LState) ResetMemoryUsage() {
-	ls.allocatedBytes = 0
+	ls.setAllocatedBytes(0)
+	ls.warnedNearLimit = false
+	ls.rearmMemoryThreshold()
+}
+
+// SetMemoryThreshold sets a soft memory watermark below the limit set by
+// SetMemoryLimit. fn is called with the allocated bytes and the limit (0 if
+// none) when an allocation brings the usage to threshold or above. It fires
+// once, and again only after the usage dropped below threshold, e.g. after
+// CollectGarbage or ResetMemoryUsage. fn runs in the middle of the
+// allocation, so it should only log, call CollectGarbage or cancel the
+// context of the state to wind the script down. A nil fn removes the
+// callback.
+func (ls *LState) SetMemoryThreshold(threshold int64, fn func(used, limit uint64)) {
+	ls.memThreshold = threshold
+	ls.memThresholdFn = fn
+	ls.memThresholdFired = false
 }
 
 // SetMemoryLimit sets the maximum memory limit in bytes. Set to 0 to disable limiting.
 func (ls *LState) SetMemoryLimit(maxBytes int64) {
 	ls.maxBytes = maxBytes
+	ls.warnedNearLimit = false
+	ls.publishMemory()
 }
 
-// GetAllocatedBytes returns the current number of tracked allocated bytes.
+// GetAllocatedBytes returns the current number of tracked allocated bytes,
+// including those of the coroutines created by this state.
 func (ls *LState) GetAllocatedBytes() int64 {
 	return ls.allocatedBytes
 }
 
+// GetPeakAllocatedBytes returns the highest value GetAllocatedBytes reached
+// since the state was created or ResetPeak was called.
+func (ls *LState) GetPeakAllocatedBytes() int64 {
+	return ls.peakBytes
+}
+
+// ResetPeak resets the peak returned by GetPeakAllocatedBytes to the current
+// number of allocated bytes. ResetMemoryUsage does not reset the peak.
+func (ls *LState) ResetPeak() {
+	ls.peakBytes = ls.allocatedBytes
+	ls.publishMemory()
+}
+
 // GetMemoryLimit returns the current memory limit in bytes (0 if no limit).
 func (ls *LState) GetMemoryLimit() int64 {
 	return ls.maxBytes
 }
 
+// SetCallStackLimit changes the maximum call depth of this state or
+// coroutine, set by Options.CallStackSize, e.g. to give trusted code more
+// headroom than plugin code. A call beyond it raises a *StackOverflowError.
+// The limit can be raised above Options.CallStackSize only for states
+// created with Options.MinimizeStackMemory, whose stack grows on demand;
+// it is capped at Options.CallStackSize otherwise. Coroutines created later
+// start with Options.CallStackSize.
+func (ls *LState) SetCallStackLimit(n int) {
+	ls.stack.SetLimit(n)
+}
+
+// GetCallStackLimit returns the maximum call depth of this state or
+// coroutine.
+func (ls *LState) GetCallStackLimit() int {
+	return ls.stack.Limit()
+}
+
+// SetRegistryLimit changes the number of slots the registry, which holds
+// the arguments and local variables of the running functions, can grow to,
+// set by Options.RegistryMaxSize. Growing beyond it raises a
+// *StackOverflowError. A limit below the current size stops further growth
+// but does not shrink the registry. Coroutines created later start with
+// Options.RegistryMaxSize.
+func (ls *LState) SetRegistryLimit(n int) {
+	ls.reg.maxSize = n
+}
+
+// GetRegistryLimit returns the number of slots the registry of this state
+// or coroutine can grow to.
+func (ls *LState) GetRegistryLimit() int {
+	return max(ls.reg.maxSize, len(ls.reg.array))
+}
+
+// SetCoroutineMemoryLimit sets the memory limit of the coroutines created by
+// this state from now on, and of the coroutines they create in turn. Each
+// coroutine gets its own budget, so a runaway coroutine fails without
+// exhausting the limit of the others. Its allocations still count against
+// the limit of this state as well. Set to 0 to disable limiting. The limit of
+// a single coroutine can be changed with SetMemoryLimit.
+func (ls *LState) SetCoroutineMemoryLimit(maxBytes int64) {
+	ls.coMaxBytes = maxBytes
+}
+
 /* }}} */
 
 func (ls *LState) printReg() {
@@ -915,6 +1372,9 @@ func (ls *LState) isStarted() bool {
 }
 
 func (ls *LState) kill() {
+	if !ls.Dead && ls.memParent != nil {
+		ls.G.coroutines--
+	}
 	ls.Dead = true
 	if ls.ctxCancelFn != nil {
 		ls.ctxCancelFn()
@@ -1035,7 +1495,9 @@ func (ls *LState) metatable(lvalue LValue, rawget bool) LValue {
 		oldmt := metatable
 		if tb, ok := metatable.(*LTable); ok {
 			metatable = tb.RawGetString("__metatable")
-			if metatable == LNil {
+			if metatable == LNil && tb.protected {
+				metatable = LFalse
+			} else if metatable == LNil {
 				metatable = oldmt
 			}
 		}
@@ -1181,10 +1643,10 @@ func (ls *LState) pushCallFrame(cf callFrame, fn LValue, meta bool) { // +inline
 		ls.reg.Insert(fn, cf.LocalBase)
 	}
 	if cf.Fn == nil {
-		ls.RaiseError("attempt to call a non-function object")
+		ls.raiseTypedError(&CallError{Name: ls.currentCallName(), Value: fn}, "attempt to call a non-function object")
 	}
 	if ls.stack.IsFull() {
-		ls.RaiseError("stack overflow")
+		ls.raiseTypedError(&StackOverflowError{Stack: "call stack", Size: ls.stack.Sp()}, "stack overflow")
 	}
 	ls.stack.Push(cf)
 	newcf := ls.stack.Last()
@@ -1295,6 +1757,9 @@ func (ls *LState) callR(nargs, nret, rbase int) {
 		rbase = base
 	}
 	lv := ls.reg.Get(base)
+	if ci := ls.G.callInterceptor; ci != nil && ls.currentFrame != nil {
+		ci.intercept(ls, lv, base+1, nargs)
+	}
 	fn, meta := ls.metaCall(lv)
 	ls.pushCallFrame(callFrame{
 		Fn:         fn,
@@ -1332,7 +1797,7 @@ func (ls *LState) getField(obj LValue, key LValue) LValue {
 		metaindex := ls.metaOp1(curobj, "__index")
 		if metaindex == LNil {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key.String())
+				ls.raiseTypedError(&IndexError{Object: curobj, Key: key}, "attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key.String())
 			}
 			return LNil
 		}
@@ -1363,7 +1828,7 @@ func (ls *LState) getFieldString(obj LValue, key string) LValue {
 		metaindex := ls.metaOp1(curobj, "__index")
 		if metaindex == LNil {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key)
+				ls.raiseTypedError(&IndexError{Object: curobj, Key: LString(key)}, "attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key)
 			}
 			return LNil
 		}
@@ -1395,7 +1860,7 @@ func (ls *LState) setField(obj LValue, key LValue, value LValue) {
 		metaindex := ls.metaOp1(curobj, "__newindex")
 		if metaindex == LNil {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key.String())
+				ls.raiseTypedError(&IndexError{Object: curobj, Key: key}, "attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key.String())
 			}
 			ls.RawSet(tb, key, value)
 			return
@@ -1428,7 +1893,7 @@ func (ls *LState) setFieldString(obj LValue, key string, value LValue) {
 		metaindex := ls.metaOp1(curobj, "__newindex")
 		if metaindex == LNil {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key)
+				ls.raiseTypedError(&IndexError{Object: curobj, Key: LString(key)}, "attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key)
 			}
 			tb.rawSetString(key, value)
 			return
@@ -1474,10 +1939,19 @@ func NewState(opts ...Options) *LState {
 				opts[0].RegistryGrowStep = RegistryGrowStep
 			}
 		}
+		if opts[0].Deterministic && opts[0].DeterministicIteration == IterationUnordered {
+			opts[0].DeterministicIteration = IterationInsertion
+		}
 		ls = newLState(opts[0])
-		if !opts[0].SkipOpenLibs {
+		ls.setupDeterminism()
+		if opts[0].SafeLibs && !opts[0].SkipOpenLibs {
+			ls.OpenSafeLibs()
+		} else if !opts[0].SkipOpenLibs {
 			ls.OpenLibs()
 		}
+		if len(opts[0].Deny) > 0 {
+			ls.DenyFunctions(opts[0].Deny...)
+		}
 	}
 	return ls
 }
@@ -1493,6 +1967,8 @@ func (ls *LState) Close() {
 		file.Close()
 		os.Remove(file.Name())
 	}
+	ls.G.runFinalizers()
+	ls.LeaveQuotaGroup()
 	ls.stack.FreeAll()
 	ls.stack = nil
 }
@@ -1656,33 +2132,106 @@ func (ls *LState) CreateTable(acap, hcap int) *LTable {
 	return ls.newLTable(acap, hcap)
 }
 
+// NewOrderedTable returns a new table whose hash part is always traversed in
+// insertion order by next(), pairs() and LTable.ForEach, regardless of
+// Options.DeterministicIteration. Removing a key and setting it again does
+// not move it to the end.
+func (ls *LState) NewOrderedTable() *LTable {
+	tb := ls.newLTable(defaultArrayCap, defaultHashCap)
+	tb.ordered = true
+	return tb
+}
+
+// IsTableOrdered reports whether tb has been created by NewOrderedTable.
+func (ls *LState) IsTableOrdered(tb *LTable) bool {
+	return tb.ordered
+}
+
 // NewThread returns a new LState that shares with the original state all global objects.
 // If the original state has context.Context, the new state has a new child context of the original state and this function returns its cancel function.
 func (ls *LState) NewThread() (*LState, context.CancelFunc) {
 	thread := newLState(ls.Options)
 	thread.G = ls.G
 	thread.Env = ls.Env
+	thread.instCount = ls.instCount
+	thread.memParent = ls
+	thread.maxBytes = ls.coMaxBytes
+	thread.coMaxBytes = ls.coMaxBytes
+	// the registry and call stack of the thread count as its own
+	// allocations, charged to ls as well
+	size := thread.stackSize()
+	ls.trackAlloc(AllocThread, size)
+	thread.allocatedBytes = size
+	thread.peakBytes = size
 	var f context.CancelFunc = nil
 	if ls.ctx != nil {
-		thread.mainLoop = mainLoopWithContext
 		thread.ctx, f = context.WithCancel(ls.ctx)
 		thread.ctxCancelFn = f
 	}
+	thread.updateMainLoop()
+	ls.G.coroutines++
 	return thread, f
 }
 
+// NewString returns s as a Lua string and charges it to the memory usage of
+// this state like a string built by a script (see SetMemoryLimit), so Go
+// functions should use it rather than LString(s) for the strings they
+// create. A string pooled by ShareString is charged only its header.
+// ToLValue converts strings with it.
+func (ls *LState) NewString(s string) LString {
+	switch {
+	case len(s) == 0:
+	case isSharedString(s):
+		ls.trackAlloc(AllocString, ls.sizing().StringHeader)
+	default:
+		ls.trackString(len(s))
+	}
+	return LString(s)
+}
+
 func (ls *LState) NewFunctionFromProto(proto *FunctionProto) *LFunction {
 	return ls.newLFunctionL(proto, ls.Env, int(proto.NumUpvalues))
 }
 
 func (ls *LState) NewUserData() *LUserData {
-	size := int64(unsafe.Sizeof(LUserData{}))
-	ls.TrackAlloc(size)
+	ls.trackAlloc(AllocUserData, ls.sizing().UserData)
 
 	return &LUserData{
 		Env:       ls.currentEnv(),
 		Metatable: LNil,
+		g:         ls.G,
+	}
+}
+
+// MemorySizer is implemented by userdata values that hold memory the
+// allocation tracking should account for, such as large byte slices.
+type MemorySizer interface {
+	// LuaSize returns the number of bytes held by the value.
+	LuaSize() uint64
+}
+
+// NewUserDataWithSize returns a new userdata holding value and charges size
+// bytes for it, in addition to the userdata itself, to the memory usage of
+// this state (see SetMemoryLimit). If size is 0 and value implements
+// MemorySizer, its LuaSize is charged instead. NewUserData charges nothing
+// for the value set afterwards. A size the allocation counters cannot hold
+// raises an error.
+func (ls *LState) NewUserDataWithSize(value interface{}, size uint64) *LUserData {
+	if size == 0 {
+		if sizer, ok := value.(MemorySizer); ok {
+			size = sizer.LuaSize()
+		}
 	}
+	for st := ls; st != nil; st = st.memParent {
+		if size > uint64(math.MaxInt64-max(st.allocatedBytes, 0)) {
+			ls.RaiseError("userdata too large: %d bytes", size)
+		}
+	}
+	ls.trackAlloc(AllocUserData, int64(size))
+	ud := ls.NewUserData()
+	ud.Value = value
+	ud.size = int64(size)
+	return ud
 }
 
 func (ls *LState) NewFunction(fn LGFunction) *LFunction {
@@ -1772,16 +2321,18 @@ func (ls *LState) ToThread(n int) *LState {
 /* error & debug operations {{{ */
 
 func (ls *LState) registryOverflow() {
-	ls.RaiseError("registry overflow")
+	ls.raiseTypedError(&StackOverflowError{Stack: "registry", Size: len(ls.reg.array)}, "registry overflow")
 }
 
 // This function is equivalent to luaL_error( http://www.lua.org/manual/5.1/manual.html#luaL_error ).
 func (ls *LState) RaiseError(format string, args ...interface{}) {
+	ls.errorCause = nil
 	ls.raiseError(1, format, args...)
 }
 
 // This function is equivalent to lua_error( http://www.lua.org/manual/5.1/manual.html#lua_error ).
 func (ls *LState) Error(lv LValue, level int) {
+	ls.errorCause = nil
 	if str, ok := lv.(LString); ok {
 		ls.raiseError(level, string(str))
 	} else {
@@ -2118,13 +2669,42 @@ func (ls *LState) Register(name string, fn LGFunction) {
 /* load and function call operations {{{ */
 
 func (ls *LState) Load(reader io.Reader, name string) (*LFunction, error) {
-	chunk, err := parse.Parse(reader, name)
+	br, ok := reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(reader)
+	}
+	br, err := ls.limitChunk(br, name)
 	if err != nil {
-		return nil, newApiErrorE(ApiErrorSyntax, err)
+		return nil, err
 	}
-	proto, err := Compile(chunk, name)
+	if c, err := br.Peek(1); err == nil && c[0] == BinaryChunkSignature[0] {
+		proto, err := ls.undumpChunk(br, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := ls.checkConstants(proto, name); err != nil {
+			return nil, err
+		}
+		if err := ls.trackProto(proto, name); err != nil {
+			return nil, err
+		}
+		return ls.newLFunctionL(proto, ls.currentEnv(), 0), nil
+	}
+	chunk, err := parse.ParseWithOptions(br, name, parse.ParseOptions{
+		GotoIsIdentifier: ls.Options.CompatFlags&CompatNoGoto != 0,
+		MaxDepth:         ls.Options.CompileLimits.MaxNestingDepth,
+	})
+	if err != nil {
+		return nil, ls.syntaxError(err)
+	}
+	proto, err := CompileWithOptions(chunk, name, CompileOptions{
+		MaxConstants: ls.Options.CompileLimits.MaxConstants,
+	})
 	if err != nil {
-		return nil, newApiErrorE(ApiErrorSyntax, err)
+		return nil, ls.syntaxError(err)
+	}
+	if err := ls.trackProto(proto, name); err != nil {
+		return nil, err
 	}
 	return ls.newLFunctionL(proto, ls.currentEnv(), 0), nil
 }
@@ -2139,12 +2719,14 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 	base := ls.reg.Top() - nargs - 1
 	oldpanic := ls.Panic
 	ls.Panic = panicWithoutTraceback
+	// a nested call without handler must not hide the handler of this one
+	hadErrorFunc := ls.hasErrorFunc
 	if errfunc != nil {
 		ls.hasErrorFunc = true
 	}
 	defer func() {
 		ls.Panic = oldpanic
-		ls.hasErrorFunc = false
+		ls.hasErrorFunc = hadErrorFunc
 		rcv := recover()
 		if rcv != nil {
 			if _, ok := rcv.(*ApiError); !ok {
@@ -2179,16 +2761,20 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 						ls.stack.SetSp(sp)
 						ls.currentFrame = ls.stack.Last()
 						ls.reg.SetTop(base)
+						err = ls.closeToBeClosedOnError(base, err.(*ApiError))
 					}
 				}()
+				cause := err.(*ApiError).Cause
 				ls.Call(1, 1)
 				err = newApiError(ApiErrorError, ls.Get(-1))
+				err.(*ApiError).Cause = cause
 			} else if len(err.(*ApiError).StackTrace) == 0 {
 				err.(*ApiError).StackTrace = ls.stackTrace(0)
 			}
 			ls.stack.SetSp(sp)
 			ls.currentFrame = ls.stack.Last()
 			ls.reg.SetTop(base)
+			err = ls.closeToBeClosedOnError(base, err.(*ApiError))
 		}
 		ls.stack.SetSp(sp)
 		if sp == 0 {
@@ -2367,8 +2953,8 @@ func (ls *LState) SetMx(mx int) {
 
 // SetContext set a context ctx to this LState. The provided ctx must be non-nil.
 func (ls *LState) SetContext(ctx context.Context) {
-	ls.mainLoop = mainLoopWithContext
 	ls.ctx = ctx
+	ls.updateMainLoop()
 }
 
 // Context returns the LState's context. To change the context, use WithContext.
@@ -2379,11 +2965,133 @@ func (ls *LState) Context() context.Context {
 // RemoveContext removes the context associated with this LState and returns this context.
 func (ls *LState) RemoveContext() context.Context {
 	oldctx := ls.ctx
-	ls.mainLoop = mainLoop
 	ls.ctx = nil
+	ls.updateMainLoop()
 	return oldctx
 }
 
+// updateMainLoop selects the cheapest main loop that supports the features
+// enabled on this state.
+func (ls *LState) updateMainLoop() {
+	switch {
+	case ls.instCount != nil || ls.G.execClock != nil || ls.G.stepHook != nil || ls.G.pause != nil:
+		ls.mainLoop = mainLoopWithCount
+	case ls.ctx != nil:
+		ls.mainLoop = mainLoopWithContext
+	default:
+		ls.mainLoop = mainLoop
+	}
+}
+
+// SetCountInstructions enables or disables counting of executed VM
+// instructions. Counting slows the VM down slightly. Threads created after
+// this call share the counter of this state.
+func (ls *LState) SetCountInstructions(enabled bool) {
+	if !enabled {
+		ls.instCount = nil
+	} else if ls.instCount == nil {
+		ls.instCount = new(int64)
+	}
+	ls.updateMainLoop()
+}
+
+// GetInstructionCount returns the number of VM instructions executed since
+// counting was enabled or last reset. It returns 0 if counting is disabled.
+func (ls *LState) GetInstructionCount() int64 {
+	if ls.instCount == nil {
+		return 0
+	}
+	return *ls.instCount
+}
+
+// UndefinedGlobalHandler is called when a script reads a global variable
+// that is not defined. The returned value is used as the value of the global.
+type UndefinedGlobalHandler func(L *LState, name string) LValue
+
+// SetUndefinedGlobalHandler sets the handler that is called when a script
+// reads an undefined global variable, whatever the environment of the
+// function is. It can be used to load modules lazily, to provide shims for
+// deprecated names or to raise an error suggesting a similar name. The
+// handler is shared by all threads created from this state. Pass nil to
+// remove the handler.
+func (ls *LState) SetUndefinedGlobalHandler(handler UndefinedGlobalHandler) {
+	ls.G.undefinedGlobalHandler = handler
+}
+
+func (ls *LState) undefinedGlobal(name string) LValue {
+	if v := ls.G.undefinedGlobalHandler(ls, name); v != nil {
+		return v
+	}
+	return LNil
+}
+
+// RegistrySet stores v under key in a host-private registry shared by this
+// state and its threads. Unlike globals and the Lua registry, the host
+// registry can not be reached from scripts, which makes it suitable for host
+// state and per-state caches of binding libraries. Setting LNil removes key.
+func (ls *LState) RegistrySet(key string, v LValue) {
+	if ls.G.hostRegistry == nil {
+		if v == LNil {
+			return
+		}
+		ls.G.hostRegistry = newLTable(0, 8)
+	}
+	ls.G.hostRegistry.rawSetString(key, v)
+}
+
+// RegistryGet returns the value stored under key by RegistrySet, or LNil.
+func (ls *LState) RegistryGet(key string) LValue {
+	if ls.G.hostRegistry == nil {
+		return LNil
+	}
+	return ls.G.hostRegistry.RawGetString(key)
+}
+
+// SetInstructionLimit aborts scripts once the instruction counter exceeds n,
+// with a *LimitError whose Resource is "instructions", matched by
+// ErrInstructionLimitExceeded. Unlike a context deadline, the limit is
+// deterministic: a script is stopped at the same instruction on every run.
+// It enables counting (see SetCountInstructions) and applies to the
+// instructions executed since counting was enabled or last reset, by this
+// state and the threads sharing its counter. Further calls fail as well
+// until ResetInstructionCount or a higher limit. A limit of 0 removes it.
+func (ls *LState) SetInstructionLimit(n int64) {
+	ls.G.instLimit = n
+	if n > 0 && ls.instCount == nil {
+		ls.SetCountInstructions(true)
+	}
+}
+
+// GetInstructionLimit returns the limit set by SetInstructionLimit (0 if
+// none).
+func (ls *LState) GetInstructionLimit() int64 {
+	return ls.G.instLimit
+}
+
+// SetPatternStepLimit limits the work of each call of string.find,
+// string.match, string.gmatch and string.gsub to n steps of the pattern
+// matcher, so that patterns which backtrack a lot, like "(.-)*x" against a
+// long subject, cannot run for ages. A call that needs more steps fails with
+// a *LimitError whose Resource is "pattern steps", matched by
+// ErrPatternStepLimitExceeded, which pcall can catch. A limit of 0 removes
+// it.
+func (ls *LState) SetPatternStepLimit(n int64) {
+	ls.G.patternSteps = n
+}
+
+// GetPatternStepLimit returns the limit set by SetPatternStepLimit (0 if
+// none).
+func (ls *LState) GetPatternStepLimit() int64 {
+	return ls.G.patternSteps
+}
+
+// ResetInstructionCount sets the instruction counter to zero.
+func (ls *LState) ResetInstructionCount() {
+	if ls.instCount != nil {
+		*ls.instCount = 0
+	}
+}
+
 // Converts the Lua value at the given acceptable index to the chan LValue.
 func (ls *LState) ToChannel(n int) chan LValue {
 	if lv, ok := ls.Get(n).(LChannel); ok {
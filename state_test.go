@@ -1,10 +1,27 @@
 package lua
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
+	"unsafe"
+
+	"github.com/yuin/gopher-lua/parse"
 )
 
 func TestLStateIsClosed(t *testing.T) {
@@ -642,6 +659,41 @@ func TestCoroutineApi1(t *testing.T) {
 
 }
 
+func TestCoroutineClose(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local log = {}
+	local function closer(name)
+	  return setmetatable({}, {__close = function(_, err) log[#log+1] = name .. ":" .. tostring(err) end})
+	end
+	local co = coroutine.create(function()
+	  local a <close> = closer("a")
+	  local b <close> = closer("b")
+	  coroutine.yield()
+	end)
+	coroutine.resume(co)
+	assert(coroutine.close(co) == true and coroutine.status(co) == "dead")
+	assert(table.concat(log, " ") == "b:nil a:nil")
+	assert(not coroutine.resume(co) and coroutine.close(co) == true)
+
+	log = {}
+	co = coroutine.create(function() local x <close> = closer("x") error("boom", 0) end)
+	coroutine.resume(co)
+	local ok, err = coroutine.close(co)
+	assert(not ok and err == "boom" and table.concat(log, " ") == "x:boom")
+
+	assert(coroutine.isyieldable() == false and coroutine.isyieldable(co) == true)
+	coroutine.wrap(function() assert(coroutine.isyieldable()) end)()
+	`)
+	errorIfScriptNotFail(t, L, `coroutine.wrap(function() coroutine.close(coroutine.running()) end)()`, "cannot close a running coroutine")
+	errorIfScriptNotFail(t, L, `
+	local outer
+	outer = coroutine.create(function() coroutine.wrap(function() coroutine.close(outer) end)() end)
+	local ok, err = coroutine.resume(outer)
+	error(err)`, "cannot close a normal coroutine")
+}
+
 func TestContextTimeout(t *testing.T) {
 	L := NewState()
 	defer L.Close()
@@ -718,6 +770,33 @@ func TestContextWithCroutine(t *testing.T) {
 
 }
 
+func TestScopedContext(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := L.DoStringContext(ctx, `while true do end`)
+	errorIfFalse(t, errors.Is(err, context.DeadlineExceeded), "expected a deadline error, got %v", err)
+	errorIfFalse(t, L.Context() == nil, "the scoped context must be removed")
+	errorIfScriptFail(t, L, `function loop(n) for i = 1, n do end return n end`)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = L.CallContext(ctx, P{Fn: L.GetGlobal("loop"), NRet: 1, Protect: true}, LNumber(1e9))
+	errorIfFalse(t, errors.Is(err, context.Canceled), "expected a canceled context, got %v", err)
+	errorIfNotNil(t, L.CallContext(context.Background(), P{Fn: L.GetGlobal("loop"), NRet: 1, Protect: true}, LNumber(10)))
+	errorIfNotEqual(t, LNumber(10), L.Get(-1))
+	L.Pop(1)
+
+	// the context of the state still applies and is restored
+	outer, cancelOuter := context.WithCancel(context.Background())
+	L.SetContext(outer)
+	cancelOuter()
+	err = L.DoStringContext(context.Background(), `while true do end`)
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "context canceled"), "expected a canceled context, got %v", err)
+	errorIfFalse(t, L.Context() == outer, "the context of the state must be restored")
+}
+
 func TestPCallAfterFail(t *testing.T) {
 	L := NewState()
 	defer L.Close()
@@ -826,6 +905,778 @@ func TestUninitializedVarAccess(t *testing.T) {
 	`)
 }
 
+func TestWarningHandler(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var warnings []*Warning
+	L.SetWarningHandler(func(L *LState, w *Warning) {
+		warnings = append(warnings, w)
+	})
+	errorIfScriptFail(t, L, `
+	local a = "10" + 1
+	warn("hello ", "world")
+	local t = table.getn({1, 2})
+	`)
+	errorIfNotEqual(t, 3, len(warnings))
+	errorIfNotEqual(t, WarningCoercion, warnings[0].Category)
+	errorIfNotEqual(t, "<string>", warnings[0].Source)
+	errorIfNotEqual(t, 2, warnings[0].Line)
+	errorIfNotEqual(t, WarningUser, warnings[1].Category)
+	errorIfNotEqual(t, "hello world", warnings[1].Message)
+	errorIfNotEqual(t, 3, warnings[1].Line)
+	errorIfNotEqual(t, WarningDeprecated, warnings[2].Category)
+	errorIfNotEqual(t, 4, warnings[2].Line)
+
+	warnings = nil
+	L.SetWarningHandler(nil)
+	errorIfScriptFail(t, L, `warn("ignored")`)
+	errorIfNotEqual(t, 0, len(warnings))
+}
+
+func TestWarnFunc(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var pieces []string
+	L.SetWarnFunc(func(msg string, tocont bool) {
+		pieces = append(pieces, fmt.Sprintf("%s:%v", msg, tocont))
+	})
+	handled := 0
+	L.SetWarningHandler(func(L *LState, w *Warning) { handled++ })
+	errorIfScriptFail(t, L, `
+	warn("a", "b", "c")
+	warn("@off")
+	warn("hidden")
+	warn("@unknown")
+	warn("@on")
+	warn("@shown", "!")
+	`)
+	errorIfNotEqual(t, "a:true b:true c:false @shown:true !:false", strings.Join(pieces, " "))
+	errorIfNotEqual(t, 2, handled)
+
+	pieces = nil
+	L.SetWarningHandler(nil)
+	L.Warn(WarningSandbox, "near %s", "limit")
+	errorIfNotEqual(t, "near limit:false", strings.Join(pieces, " "))
+	L.SetWarnFunc(nil)
+	errorIfScriptFail(t, L, `warn("ignored")`)
+	errorIfNotEqual(t, 1, len(pieces))
+}
+
+func TestWarningNearMemoryLimit(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	count := 0
+	L.SetWarningHandler(func(L *LState, w *Warning) {
+		if w.Category == WarningSandbox {
+			count++
+		}
+	})
+	L.ResetMemoryUsage()
+	L.SetMemoryLimit(1024 * 1024)
+	L.TrackAlloc(950 * 1024)
+	L.TrackAlloc(10)
+	errorIfNotEqual(t, 1, count)
+	L.ResetMemoryUsage()
+	L.TrackAlloc(950 * 1024)
+	errorIfNotEqual(t, 2, count)
+}
+
+func TestTypedRuntimeErrors(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	err := L.DoString(`local t = nil; return t.field`)
+	var ie *IndexError
+	errorIfFalse(t, errors.As(err, &ie), "expected IndexError, got %v", err)
+	errorIfNotEqual(t, LNil, ie.Object)
+	errorIfNotEqual(t, LString("field"), ie.Key)
+
+	err = L.DoString(`local x = {} + 1`)
+	var ae *ArithmeticError
+	errorIfFalse(t, errors.As(err, &ae), "expected ArithmeticError, got %v", err)
+	errorIfNotEqual(t, "add", ae.Op)
+	errorIfNotEqual(t, LTTable, ae.Lhs.Type())
+
+	err = L.DoString(`undefined_function()`)
+	var ce *CallError
+	errorIfFalse(t, errors.As(err, &ce), "expected CallError, got %v", err)
+	errorIfNotEqual(t, "undefined_function", ce.Name)
+
+	err = L.DoString(`string.rep({}, 1)`)
+	var te *TypeError
+	errorIfFalse(t, errors.As(err, &te), "expected TypeError, got %v", err)
+	errorIfNotEqual(t, 1, te.Arg)
+	errorIfNotEqual(t, "string", te.Expected)
+
+	err = L.DoString(`local function f() return f() + 1 end f()`)
+	var se *StackOverflowError
+	errorIfFalse(t, errors.As(err, &se), "expected StackOverflowError, got %v", err)
+
+	L.ResetMemoryUsage()
+	L.SetMemoryLimit(4096)
+	err = L.DoString(`local t = {} for i = 1, 1000 do t[i] = {} end`)
+	L.SetMemoryLimit(0)
+	var le *LimitError
+	errorIfFalse(t, errors.As(err, &le), "expected LimitError, got %v", err)
+	errorIfNotEqual(t, "memory", le.Resource)
+	errorIfFalse(t, errors.Is(err, ErrMemoryLimitExceeded), "expected ErrMemoryLimitExceeded, got %v", err)
+
+	err = L.DoString(`error("plain")`)
+	errorIfNotNil(t, errors.Unwrap(err))
+	errorIfFalse(t, !errors.Is(err, ErrMemoryLimitExceeded), "unexpected ErrMemoryLimitExceeded")
+}
+
+func TestOptionsStandardStreams(t *testing.T) {
+	var out, errout bytes.Buffer
+	L := NewState(Options{Stdin: strings.NewReader("line1\n42\n"), Stdout: &out, Stderr: &errout})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	print("a", 1)
+	io.write("b", 2, "\n")
+	io.stderr:write("oops")
+	assert(io.read() == "line1")
+	assert(io.read("*n") == 42)
+	assert(io.type(io.stdout) == "file")
+	assert(io.stdout:seek() == nil)
+	`)
+	errorIfNotEqual(t, "a\t1\nb2\n", out.String())
+	errorIfNotEqual(t, "oops", errout.String())
+}
+
+func TestPluginLoader(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `assert(#package.loaders == 2 and package.cpath == "")`)
+	errorIfScriptNotFail(t, L, `package.loadlib("mod.so", "Loader")`, "loadlib is not supported")
+
+	L2 := NewState(Options{AllowPlugins: true})
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `
+	assert(#package.loaders == 3)
+	local fn, msg, where = package.loadlib("./no-such-plugin.so", "Loader")
+	assert(fn == nil and type(msg) == "string" and where == "open")
+	package.cpath = "./?.so"
+	local ok, err = pcall(require, "no-such-plugin")
+	assert(not ok and string.find(err, "no-such-plugin.so", 1, true))
+	`)
+}
+
+func TestLoadBinaryChunk(t *testing.T) {
+	chunk, err := parse.Parse(strings.NewReader(`
+	local t = {n = 1.5, s = "str"}
+	local function add(a, b) return a + b end
+	return add(t.n, 2), t.s
+	`), "chunk")
+	errorIfNotNil(t, err)
+	proto, err := Compile(chunk, "chunk")
+	errorIfNotNil(t, err)
+	var buf bytes.Buffer
+	errorIfNotNil(t, DumpProto(&buf, proto))
+	errorIfFalse(t, strings.HasPrefix(buf.String(), BinaryChunkSignature), "missing signature")
+
+	L := NewState()
+	defer L.Close()
+	fn, err := L.Load(bytes.NewReader(buf.Bytes()), "chunk")
+	errorIfNotNil(t, err)
+	L.Push(fn)
+	L.Call(0, 2)
+	errorIfNotEqual(t, LNumber(3.5), L.Get(-2))
+	errorIfNotEqual(t, LString("str"), L.Get(-1))
+
+	_, err = L.Load(bytes.NewReader(buf.Bytes()[:buf.Len()-3]), "chunk")
+	errorIfNil(t, err)
+
+	// counts close to maxBinaryChunkCount in a truncated chunk or snapshot
+	// must fail without allocating what they announce.
+	huge := binary.AppendVarint(nil, maxBinaryChunkCount)
+	code := append([]byte(BinaryChunkSignature+"\x00\x00\x00\x00\x00\x00\x00\x00\x00"), huge...)
+	code[len(BinaryChunkSignature)], code[len(BinaryChunkSignature)+1] = binaryChunkVersion, LNumberBit/8
+	source := append([]byte(BinaryChunkSignature), binaryChunkVersion, LNumberBit/8)
+	source = append(source, huge...)
+	snapshot := append([]byte(PersistSignature), persistVersion, LNumberBit/8, 2)
+	snapshot = append(snapshot, huge...)
+	L.SetMemoryLimit(1 << 20)
+	var before, after runtime.MemStats
+	for _, data := range [][]byte{code, source, snapshot} {
+		runtime.ReadMemStats(&before)
+		if bytes.HasPrefix(data, []byte(PersistSignature)) {
+			err = L.Restore(bytes.NewReader(data))
+		} else {
+			_, err = L.Load(bytes.NewReader(data), "chunk")
+		}
+		runtime.ReadMemStats(&after)
+		errorIfNil(t, err)
+		errorIfFalse(t, after.TotalAlloc-before.TotalAlloc < 1<<20, "%d bytes allocated for a %d byte input", after.TotalAlloc-before.TotalAlloc, len(data))
+	}
+}
+
+func TestChunkVerifier(t *testing.T) {
+	chunk, err := parse.Parse(strings.NewReader(`local function f(x) return x * 2 end return f(21)`), "chunk")
+	errorIfNotNil(t, err)
+	proto, err := Compile(chunk, "chunk")
+	errorIfNotNil(t, err)
+	errorIfNotNil(t, VerifyProto(proto))
+	var buf bytes.Buffer
+	errorIfNotNil(t, DumpProto(&buf, proto))
+
+	key := []byte("secret")
+	sign := func(data []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return append(append([]byte{}, data...), mac.Sum(nil)...)
+	}
+	errBadSignature := errors.New("bad signature")
+	L := NewState()
+	defer L.Close()
+	L.SetChunkVerifier(func(name string, data []byte) error {
+		if len(data) < sha256.Size {
+			return errBadSignature
+		}
+		body := data[:len(data)-sha256.Size]
+		if !hmac.Equal(sign(body), data) {
+			return errBadSignature
+		}
+		return nil
+	})
+	errorIfNotNil(t, L.DoString(string(sign(buf.Bytes()))))
+	errorIfNotEqual(t, LNumber(42), L.Get(-1))
+	L.Pop(1)
+	err = L.DoString(buf.String())
+	errorIfFalse(t, errors.Is(err, errBadSignature), "unsigned chunk loaded: %v", err)
+	errorIfNotNil(t, L.DoString(`return 1`))
+	L.Pop(1)
+
+	bad := *proto
+	bad.Code = append([]uint32{}, proto.Code...)
+	bad.Code[len(bad.Code)-1] = opCreateABx(OP_LOADK, 0, 200)
+	errorIfFalse(t, errors.Is(VerifyProto(&bad), ErrInvalidBytecode), "missing final return accepted")
+	bad.Code = append(bad.Code, opCreateABC(OP_RETURN, 0, 1, 0))
+	bad.DbgSourcePositions = append(append([]int{}, proto.DbgSourcePositions...), 1)
+	errorIfFalse(t, errors.Is(VerifyProto(&bad), ErrInvalidBytecode), "constant out of range accepted")
+	buf.Reset()
+	errorIfNotNil(t, DumpProto(&buf, &bad))
+	L.SetChunkVerifier(nil)
+	_, err = L.Load(&buf, "bad")
+	errorIfFalse(t, errors.Is(err, ErrInvalidBytecode), "invalid bytecode loaded: %v", err)
+
+	chunk, err = parse.Parse(strings.NewReader(`local a = 1 return a`), "chunk")
+	errorIfNotNil(t, err)
+	proto, err = Compile(chunk, "chunk")
+	errorIfNotNil(t, err)
+	errorIfNotNil(t, VerifyProto(proto))
+	errorIfNotEqual(t, OP_LOADK, opGetOpCode(proto.Code[0]))
+	opSetArgA(&proto.Code[0], 255)
+	err = VerifyProto(proto)
+	errorIfFalse(t, errors.Is(err, ErrInvalidBytecode) && strings.Contains(err.Error(), "register 255 out of range"), "register out of range accepted: %v", err)
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local a, b = 6, 3
+	assert(7 // 2 == 3 and -7 // 2 == -4 and 7.5 // 2 == 3 and a // 4 == 1)
+	assert(5 & 3 == 1 and 5 | 3 == 7 and 5 ~ 3 == 6 and ~0 == -1)
+	assert(a & b == 2 and a | b == 7 and a ~ b == 5 and ~a == -7)
+	assert(1 << 4 == 16 and 256 >> 4 == 16 and a << b == 48 and a >> 1 == 3)
+	assert(-1 >> 60 == 15 and 1 << 64 == 0 and 1 << -1 == 0 and 2 >> -2 == 8)
+	assert(1 | 2 ~ 3 & 4 == 3 and 1 + 2 << 1 == 6 and "3" & 1 == 1)
+	`)
+	errorIfScriptNotFail(t, L, `local a = 6; return a & 1.5`, "number has no integer representation")
+	errorIfScriptNotFail(t, L, `return {} | 1`, "cannot perform bor operation between table and number")
+	errorIfScriptFail(t, L, `
+	local mt = {}
+	for _, event in ipairs({"idiv", "band", "bor", "bxor", "shl", "shr", "bnot"}) do
+		mt["__" .. event] = function() return event end
+	end
+	local t = setmetatable({}, mt)
+	assert(t // 2 == "idiv" and 1 & t == "band" and t | 1 == "bor" and t ~ 1 == "bxor")
+	assert(t << 1 == "shl" and t >> 1 == "shr" and ~t == "bnot")
+	`)
+}
+
+func TestLoadFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.lua":          {Data: []byte(`local util = require("lib.util"); return util.twice(dofile("data.lua"))`)},
+		"data.lua":          {Data: []byte(`return 21`)},
+		"lib/util/init.lua": {Data: []byte(`return {twice = function(n) return n * 2 end}`)},
+		"lib/broken.lua":    {Data: []byte(`error("broken")`)},
+	}
+	L := NewState()
+	defer L.Close()
+	L.LoadFS(fsys)
+	errorIfNotEqual(t, LString(LuaFSPathDefault), L.GetField(L.GetGlobal("package"), "path"))
+	errorIfNotNil(t, L.DoFile("./main.lua"))
+	errorIfNotEqual(t, LNumber(42), L.Get(-1))
+	L.Pop(1)
+
+	err := L.DoFile("lib/broken.lua")
+	errorIfNil(t, err)
+	errorIfFalse(t, strings.Contains(err.Error(), "lib/broken.lua:1: broken"), "unexpected chunk name: %v", err)
+	errorIfScriptNotFail(t, L, `require("missing")`, "module missing not found")
+
+	L.LoadFS(nil)
+	errorIfNil(t, L.DoFile("main.lua"))
+}
+
+func TestModuleSearcher(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	modules := map[string]string{
+		"greet":  `return {hello = function(n) return "hello " .. n end}`,
+		"broken": `return {`,
+	}
+	L.AddModuleSearcher(func(name string) (*ModuleSource, error) {
+		if src, ok := modules[name]; ok {
+			return &ModuleSource{Source: src}, nil
+		}
+		return nil, nil
+	})
+	L.AddModuleSearcher(func(name string) (*ModuleSource, error) {
+		switch name {
+		case "answer":
+			return &ModuleSource{Loader: func(L *LState) int {
+				L.Push(LNumber(42))
+				return 1
+			}}, nil
+		case "secret":
+			return nil, errors.New("access denied")
+		}
+		return nil, nil
+	})
+	errorIfScriptFail(t, L, `
+	assert(require("greet").hello("lua") == "hello lua")
+	assert(require("answer") == 42)
+	`)
+	errorIfScriptNotFail(t, L, `require("broken")`, "error loading module 'broken'")
+	errorIfScriptNotFail(t, L, `require("missing")`, "no module 'missing' in host searcher")
+	errorIfScriptNotFail(t, L, `require("secret")`, "access denied")
+
+	L.SetRequireWhitelist([]string{"greet", "fresh"})
+	modules["fresh"] = `return "fresh"`
+	errorIfScriptFail(t, L, `assert(require("greet") and require("string") and require("answer") == 42)`)
+	errorIfScriptFail(t, L, `assert(require("fresh") == "fresh")`)
+	errorIfScriptNotFail(t, L, `require("os_module")`, "module os_module not allowed")
+	L.SetRequireWhitelist(nil)
+	errorIfScriptNotFail(t, L, `require("os_module")`, "not found")
+
+	L2 := NewState(Options{SkipOpenLibs: true})
+	defer L2.Close()
+	L2.AddModuleSearcher(func(name string) (*ModuleSource, error) {
+		return &ModuleSource{Source: `return ...`, Chunkname: "@db/" + name}, nil
+	})
+	L2.OpenLibs()
+	errorIfScriptFail(t, L2, `assert(require("any") == "any")`)
+}
+
+type dirWritableFS string
+
+func (d dirWritableFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(d)).Open(name)
+}
+
+func (d dirWritableFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	return os.OpenFile(filepath.Join(string(d), filepath.FromSlash(name)), flag, perm)
+}
+
+func TestPopenUnsupported(t *testing.T) {
+	if processSupported {
+		t.Skip("processes are supported on " + runtime.GOOS)
+	}
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local p, err = io.popen("ls")
+	assert(p == nil and err == "'popen' not supported")
+	assert(os.execute("ls") == 1)
+	`)
+}
+
+func TestSetIoFS(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetIoFS(fstest.MapFS{"data/lines.txt": {Data: []byte("one\ntwo\nthree\n")}})
+	errorIfScriptFail(t, L, `
+	local n = 0
+	for line in io.lines("/data/../data/lines.txt") do n = n + 1 end
+	assert(n == 3)
+	local f = assert(io.open("data/lines.txt"))
+	assert(f:read("*l") == "one")
+	assert(f:seek("set", 4) == 4 and f:read("*a") == "two\nthree\n")
+	assert(f:close())
+	local f, err = io.open("data/lines.txt", "w")
+	assert(f == nil and err:find("permission denied"))
+	assert(io.open("missing.txt") == nil)
+	local p, err = io.popen("ls")
+	assert(p == nil and err == "'popen' not supported")
+	assert(not pcall(io.tmpfile))
+	`)
+
+	dir := t.TempDir()
+	L.SetIoFS(dirWritableFS(dir))
+	errorIfScriptFail(t, L, `
+	local f = assert(io.open("out.txt", "w"))
+	assert(f:write("hello ", 42))
+	assert(f:close())
+	f = assert(io.open("out.txt", "a+"))
+	f:write("!")
+	f:seek("set")
+	assert(f:read("*a") == "hello 42!")
+	f:close()
+	`)
+	data, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, "hello 42!", string(data))
+
+	L.SetIoFS(nil)
+	errorIfScriptFail(t, L, `assert(io.open("data/lines.txt") == nil)`)
+}
+
+func TestReloadModule(t *testing.T) {
+	fsys := fstest.MapFS{
+		"counter.lua": {Data: []byte(`
+		local M = {}
+		local count = 0
+		M.step = 1
+		function M.inc() count = count + M.step; return count end
+		function M.reset(n) count = n end
+		return M`)},
+	}
+	L := NewState()
+	defer L.Close()
+	L.LoadFS(fsys)
+	errorIfScriptFail(t, L, `counter = require("counter"); counter.inc(); counter.inc()`)
+
+	fsys["counter.lua"] = &fstest.MapFile{Data: []byte(`
+		local M = {}
+		local count = 0
+		M.step = 10
+		function M.inc() count = count + M.step; return count * 100 end
+		function M.get() return count end
+		function M.reset() count = 0 end
+		return M`)}
+	var conflicts []string
+	errorIfNotNil(t, L.ReloadModule("counter", func(L *LState, c *ReloadConflict) bool {
+		conflicts = append(conflicts, c.String())
+		return false
+	}))
+	errorIfNotEqual(t, "counter.reset: function parameters changed", strings.Join(conflicts, ";"))
+	errorIfScriptFail(t, L, `
+	assert(counter == require("counter"))
+	assert(counter.get() == 2)
+	assert(counter.inc() == 1200)
+	counter.reset(5)
+	assert(counter.get() == 5)
+	`)
+
+	err := L.ReloadModule("nothing", nil)
+	errorIfNil(t, err)
+}
+
+func TestCallGlobal(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	handlers = {}
+	function handlers.on_event(name, x, list, opts)
+		assert(name == "click" and x == 10 and #list == 2 and opts.flag == true)
+		return name .. x, {1, 2, 3}, {a = 1}, nil
+	end
+	function fail() error("boom") end
+	`)
+	results, err := L.CallGlobal("handlers.on_event", "click", 10, []string{"a", "b"}, map[string]bool{"flag": true})
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, 4, len(results))
+	errorIfNotEqual(t, "click10", results[0])
+	errorIfNotEqual(t, 3, len(results[1].([]interface{})))
+	errorIfNotEqual(t, float64(1), results[2].(map[interface{}]interface{})["a"])
+	errorIfNotNil(t, results[3])
+	errorIfNotEqual(t, 0, L.GetTop())
+
+	_, err = L.CallGlobal("fail")
+	errorIfNil(t, err)
+	errorIfFalse(t, strings.Contains(err.Error(), "boom") && strings.Contains(err.Error(), "stack traceback"), "unexpected error: %v", err)
+	_, err = L.CallGlobal("handlers.missing")
+	errorIfNil(t, err)
+	_, err = L.CallGlobal("nothing.here")
+	errorIfNil(t, err)
+	errorIfNotEqual(t, 0, L.GetTop())
+}
+
+func TestToLValueCycles(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	m := map[string]interface{}{"name": "root"}
+	m["self"] = m
+	list := []interface{}{1, nil}
+	list[1] = list
+	m["list"] = list
+	L.SetGlobal("m", L.ToLValue(m))
+	errorIfScriptFail(t, L, `
+	assert(m.self == m and m.self.self.name == "root")
+	assert(m.list[1] == 1 and m.list[2] == m.list)
+	`)
+}
+
+func TestInstructionCount(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfNotEqual(t, int64(0), L.GetInstructionCount())
+	L.SetCountInstructions(true)
+	errorIfScriptFail(t, L, `local x = 0; for i = 1, 100 do x = x + i end`)
+	n := L.GetInstructionCount()
+	errorIfFalse(t, n > 200, "too few instructions counted: %v", n)
+	errorIfScriptFail(t, L, `coroutine.wrap(function() for i = 1, 100 do end end)()`)
+	errorIfFalse(t, L.GetInstructionCount() > n+100, "coroutine instructions are not counted")
+	L.ResetInstructionCount()
+	errorIfNotEqual(t, int64(0), L.GetInstructionCount())
+	L.SetCountInstructions(false)
+	errorIfScriptFail(t, L, `local x = 1`)
+	errorIfNotEqual(t, int64(0), L.GetInstructionCount())
+}
+
+func TestInstructionLimit(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetInstructionLimit(1000)
+	errorIfNotEqual(t, int64(1000), L.GetInstructionLimit())
+	errorIfScriptFail(t, L, `local x = 0; for i = 1, 10 do x = x + i end`)
+	err := L.DoString(`while true do end`)
+	errorIfFalse(t, errors.Is(err, ErrInstructionLimitExceeded), "expected an instruction limit error, got %v", err)
+	errorIfFalse(t, !errors.Is(err, ErrMemoryLimitExceeded), "expected no memory limit error")
+	errorIfNotEqual(t, int64(1001), L.GetInstructionCount())
+
+	// the counter is shared with coroutines and is only cleared explicitly
+	L.ResetInstructionCount()
+	errorIfScriptNotFail(t, L, `coroutine.wrap(function() while true do end end)()`, "instruction limit exceeded")
+	errorIfScriptNotFail(t, L, `local x = 1`, "instruction limit exceeded")
+	L.ResetInstructionCount()
+	errorIfScriptFail(t, L, `local x = 1`)
+
+	L.SetInstructionLimit(0)
+	errorIfScriptFail(t, L, `for i = 1, 2000 do end`)
+}
+
+func TestExecutionTimeLimit(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetExecutionTimeLimit(50 * time.Millisecond)
+	err := L.DoString(`while true do end`)
+	errorIfFalse(t, errors.Is(err, ErrExecutionTimeLimitExceeded), "expected an execution time limit error, got %v", err)
+	errorIfFalse(t, L.GetExecutionTime() >= 50*time.Millisecond, "unexpected execution time %v", L.GetExecutionTime())
+
+	// time spent in Go functions does not count
+	L.ResetExecutionTime()
+	L.SetGlobal("sleep", L.NewFunction(func(L *LState) int {
+		time.Sleep(100 * time.Millisecond)
+		return 0
+	}))
+	errorIfScriptFail(t, L, `sleep()`)
+	errorIfFalse(t, L.GetExecutionTime() < 50*time.Millisecond, "unexpected execution time %v", L.GetExecutionTime())
+
+	// but Lua code called back from Go does, as do coroutines
+	L.ResetExecutionTime()
+	errorIfScriptFail(t, L, `
+	local ok, err = pcall(function() while true do end end)
+	assert(not ok and err:find("execution time limit exceeded"))
+	`)
+	L.ResetExecutionTime()
+	errorIfScriptNotFail(t, L, `coroutine.wrap(function() while true do end end)()`, "execution time limit exceeded")
+
+	L.SetExecutionTimeLimit(0)
+	errorIfScriptFail(t, L, `for i = 1, 100000 do end`)
+	errorIfNotEqual(t, time.Duration(0), L.GetExecutionTime())
+}
+
+func TestStepHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	calls := 0
+	L.SetStepHook(100, func(L *LState) error {
+		calls++
+		return nil
+	})
+	L.SetCountInstructions(true)
+	errorIfScriptFail(t, L, `for i = 1, 1000 do end`)
+	errorIfNotEqual(t, int(L.GetInstructionCount()/100), calls)
+
+	errStop := errors.New("stopped by the host")
+	L.SetStepHook(10, func(L *LState) error {
+		if v, ok := L.GetGlobal("i").(LNumber); ok && v >= 50 {
+			return errStop
+		}
+		return nil
+	})
+	err := L.DoString(`i = 0 while true do i = i + 1 end`)
+	errorIfFalse(t, errors.Is(err, errStop), "expected the error of the hook, got %v", err)
+	errorIfScriptFail(t, L, `i = nil`)
+	errorIfScriptNotFail(t, L, `i = 0 coroutine.wrap(function() while true do i = i + 1 end end)()`, "stopped by the host")
+
+	L.SetStepHook(0, nil)
+	errorIfScriptFail(t, L, `i = 0 while i < 100 do i = i + 1 end`)
+}
+
+func TestCallStackLimit(t *testing.T) {
+	depth := func(L *LState) int {
+		errorIfScriptFail(t, L, `
+		depth = 0
+		local function f() depth = depth + 1 f() end
+		pcall(f)
+		`)
+		return int(L.GetGlobal("depth").(LNumber))
+	}
+
+	L := NewState(Options{CallStackSize: 200})
+	defer L.Close()
+	full := depth(L)
+	L.SetCallStackLimit(100)
+	errorIfNotEqual(t, 100, L.GetCallStackLimit())
+	errorIfNotEqual(t, full-100, depth(L))
+	err := L.DoString(`local function f() f() end f()`)
+	var se *StackOverflowError
+	errorIfFalse(t, errors.As(err, &se), "expected StackOverflowError, got %v", err)
+	// a fixed stack can not grow
+	L.SetCallStackLimit(1000)
+	errorIfNotEqual(t, 200, L.GetCallStackLimit())
+
+	L2 := NewState(Options{CallStackSize: 200, MinimizeStackMemory: true})
+	defer L2.Close()
+	L2.SetCallStackLimit(1000)
+	errorIfNotEqual(t, 1000, L2.GetCallStackLimit())
+	errorIfNotEqual(t, 800, depth(L2)-full)
+
+	// coroutines have their own limit
+	L2.SetGlobal("limit", L2.NewFunction(func(L *LState) int {
+		L.CheckThread(1).SetCallStackLimit(L.CheckInt(2))
+		return 0
+	}))
+	errorIfScriptFail(t, L2, `
+	local n = 0
+	local function f() n = n + 1 f() end
+	local co = coroutine.create(f)
+	limit(co, 50)
+	assert(not coroutine.resume(co))
+	assert(n <= 50)
+	`)
+}
+
+func TestRegistryLimit(t *testing.T) {
+	L := NewState(Options{RegistrySize: 1024, RegistryMaxSize: 1024 * 64})
+	defer L.Close()
+	errorIfNotEqual(t, 1024*64, L.GetRegistryLimit())
+	src := `local t = {} for i = 1, 5000 do t[i] = i end return unpack(t)`
+	errorIfScriptFail(t, L, src)
+	L.SetRegistryLimit(2048)
+	err := L.DoString(src)
+	var se *StackOverflowError
+	errorIfFalse(t, errors.As(err, &se), "expected StackOverflowError, got %v", err)
+	errorIfNotEqual(t, "registry", se.Stack)
+}
+
+func TestBenchmark(t *testing.T) {
+	result, err := Benchmark(`local t = {} for i = 1, 100 do t[i] = tostring(i) end`, BenchmarkOptions{N: 5})
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, 5, result.N)
+	errorIfFalse(t, result.InstructionsPerRun() > 300, "unexpected instruction count: %v", result)
+	errorIfFalse(t, result.PeakMemory > 0 && result.AllocatedBytes >= result.PeakMemory, "unexpected memory stats: %v", result)
+
+	// the peak is kept when a collection credits memory back
+	result, err = Benchmark(`local t = {} for i = 1, 1000 do t[i] = string.rep("x", 100) .. i end t = nil collectgarbage()`, BenchmarkOptions{})
+	errorIfNotNil(t, err)
+	errorIfFalse(t, result.PeakMemory > 100*1000 && result.PeakMemory > result.AllocatedBytes, "unexpected memory stats: %v", result)
+
+	_, err = Benchmark(`error("boom")`, BenchmarkOptions{N: 3})
+	errorIfNil(t, err)
+}
+
+func TestEstimateSize(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	base := L.EstimateSize()
+	errorIfFalse(t, base.Total > 0 && base.Tables > 0 && base.Functions > 0, "unexpected estimate: %+v", base)
+
+	errorIfScriptFail(t, L, `
+	big = {}
+	for i = 1, 1000 do big[i] = string.rep("x", 100) .. i end
+	big.self = big
+	big.alias = big
+	`)
+	grown := L.EstimateSize()
+	errorIfFalse(t, grown.Strings-base.Strings > 100*1000, "strings are not counted: %+v", grown)
+	errorIfFalse(t, grown.Tables-base.Tables > 1000*16, "tables are not counted: %+v", grown)
+
+	errorIfScriptFail(t, L, `big = nil`)
+	shrunk := L.EstimateSize()
+	errorIfFalse(t, shrunk.Total < grown.Total-100*1000, "released objects are still counted: %+v", shrunk)
+}
+
+func TestMemoryBreakdown(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	big = {}
+	for i = 1, 10000 do big[i] = i end
+	`)
+	breakdown := L.MemoryBreakdown()
+	errorIfNotEqual(t, 8, len(breakdown))
+	errorIfNotEqual(t, "table arrays", breakdown[0].Name)
+	est := L.EstimateSize()
+	errorIfNotEqual(t, est.Tables, est.TableArrays+est.TableHashes)
+	var total int64
+	for _, c := range breakdown {
+		total += c.Bytes
+	}
+	errorIfNotEqual(t, est.Total, total)
+}
+
+func TestDiffMemory(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	cache = {}
+	function handle(i)
+		cache[i] = {id = i, name = "request " .. i}
+	end
+	`)
+	before := L.MemorySnapshot()
+	errorIfNotEqual(t, L.EstimateSize().Total, before.Total())
+	errorIfScriptFail(t, L, `for i = 1, 1000 do handle(i) end`)
+	diff := DiffMemory(before, L.MemorySnapshot())
+	errorIfFalse(t, diff.Total > 0, "no growth: %+v", diff)
+	// the key constants of handle are now attributed to cache
+	errorIfNotEqual(t, "cache", diff.Globals[0].Name)
+	errorIfFalse(t, diff.Globals[0].Delta > 1000*int64(DefaultSizingModel.Table), "growth is too small: %+v", diff.Globals[0])
+	errorIfNotEqual(t, "table hashes", diff.Categories[0].Name)
+
+	errorIfScriptFail(t, L, `cache = nil`)
+	diff = DiffMemory(before, L.MemorySnapshot())
+	errorIfFalse(t, diff.Total < 0, "no shrink: %+v", diff)
+	errorIfNotEqual(t, int64(0), diff.Globals[len(diff.Globals)-1].After)
+}
+
+func TestShareString(t *testing.T) {
+	blob := strings.Repeat("0123456789", 10000)
+	shared := ShareString(blob)
+	defer UnshareString(blob)
+	errorIfNotEqual(t, shared, ShareString(strings.Repeat("0123456789", 10000)))
+
+	src := "lookup = \"" + strings.Repeat("0123456789", 10000) + "\""
+	for i := 0; i < 2; i++ {
+		L := NewState()
+		errorIfScriptFail(t, L, src)
+		lookup := string(L.GetGlobal("lookup").(LString))
+		errorIfFalse(t, unsafe.StringData(lookup) == unsafe.StringData(string(shared)), "constant is not shared")
+		est := L.EstimateSize()
+		errorIfNotEqual(t, int64(len(blob)), est.SharedStrings)
+		errorIfFalse(t, est.Strings < int64(len(blob)), "shared string is fully charged: %+v", est)
+		before := L.GetAllocatedBytes()
+		_, err := L.LoadString(src)
+		errorIfNotNil(t, err)
+		errorIfFalse(t, L.GetAllocatedBytes()-before < int64(len(blob)), "shared constant is fully charged: %d bytes", L.GetAllocatedBytes()-before)
+		L.Close()
+	}
+}
+
 func BenchmarkCallFrameStackPushPopAutoGrow(t *testing.B) {
 	stack := newAutoGrowingCallFrameStack(256)
 
@@ -1004,3 +1855,1266 @@ func BenchmarkRegistrySetTop(t *testing.B) {
 		reg.SetTop(0)
 	}
 }
+
+func TestUserDataFinalizer(t *testing.T) {
+	L := NewState()
+	var closed []string
+	for _, name := range []string{"a", "b", "c"} {
+		ud := L.NewUserData()
+		ud.Value = name
+		SetUserDataFinalizer(ud, func(v interface{}) { closed = append(closed, v.(string)) })
+		if name == "b" {
+			SetUserDataFinalizer(ud, nil)
+		}
+		L.SetGlobal(name, ud)
+	}
+	L.Close()
+	errorIfNotEqual(t, "c a", strings.Join(closed, " "))
+	if !finalizersOnGC {
+		return
+	}
+
+	L = NewState()
+	defer L.Close()
+	done := make(chan interface{}, 1)
+	func() {
+		ud := L.NewUserData()
+		ud.Value = "unreachable"
+		SetUserDataFinalizer(ud, func(v interface{}) { done <- v })
+	}()
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		select {
+		case v := <-done:
+			errorIfNotEqual(t, "unreachable", v)
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Error("finalizer was not called")
+}
+
+func TestRegistrySetGet(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfNotEqual(t, LNil, L.RegistryGet("cache"))
+	cache := L.NewTable()
+	L.RegistrySet("cache", cache)
+	errorIfNotEqual(t, cache, L.RegistryGet("cache"))
+
+	co, _ := L.NewThread()
+	errorIfNotEqual(t, cache, co.RegistryGet("cache"))
+
+	errorIfScriptFail(t, L, `assert(cache == nil)`)
+	L.RegistrySet("cache", LNil)
+	errorIfNotEqual(t, LNil, L.RegistryGet("cache"))
+}
+
+func TestUndefinedGlobalHandler(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var missed []string
+	L.SetUndefinedGlobalHandler(func(L *LState, name string) LValue {
+		missed = append(missed, name)
+		switch name {
+		case "lazy":
+			mod := L.NewTable()
+			mod.RawSetString("value", LNumber(42))
+			L.SetGlobal(name, mod)
+			return mod
+		case "prnt":
+			L.RaiseError("undefined global '%s', did you mean 'print'?", name)
+		}
+		return nil
+	})
+	errorIfScriptFail(t, L, `
+	assert(lazy.value == 42)
+	assert(lazy.value == 42)
+	assert(undefined == nil)
+	local f = setfenv(function() return lazy end, {})
+	assert(f().value == 42)
+	`)
+	errorIfNotEqual(t, "lazy undefined lazy", strings.Join(missed, " "))
+	errorIfScriptNotFail(t, L, `prnt("x")`, "did you mean 'print'")
+
+	L.SetUndefinedGlobalHandler(nil)
+	errorIfScriptFail(t, L, `assert(prnt == nil)`)
+}
+
+type testAnimal struct {
+	Name string
+}
+
+type testDog struct {
+	testAnimal
+	Tricks int
+}
+
+func TestRegisterType(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	RegisterType[testAnimal](L, map[string]LGFunction{
+		"name": func(L *LState) int {
+			L.Push(LString(CheckType[testAnimal](L, 1).Name))
+			return 1
+		},
+		"speak": func(L *LState) int {
+			L.Push(LString("..."))
+			return 1
+		},
+		"__tostring": func(L *LState) int {
+			L.Push(LString("animal " + CheckType[testAnimal](L, 1).Name))
+			return 1
+		},
+	})
+	mt := RegisterType[testDog](L, map[string]LGFunction{
+		"speak": func(L *LState) int {
+			L.Push(LString("woof"))
+			return 1
+		},
+	})
+	errorIfNotEqual(t, mt, L.GetTypeMetatable("lua.testDog"))
+
+	L.SetGlobal("cat", L.ToLValue(&testAnimal{Name: "tom"}))
+	L.SetGlobal("dog", L.ToLValue(&testDog{testAnimal: testAnimal{Name: "rex"}}))
+	L.SetGlobal("plain", L.NewTypedUserData(testAnimal{Name: "copy"}))
+	errorIfScriptFail(t, L, `
+	assert(cat:name() == "tom" and cat:speak() == "...")
+	assert(tostring(cat) == "animal tom")
+	assert(dog:name() == "rex" and dog:speak() == "woof")
+	assert(plain:name() == "copy")
+	`)
+	errorIfScriptNotFail(t, L, `cat.name(io.stdout)`, "lua.testAnimal expected")
+	errorIfNotEqual(t, mt, L.TypeMetatable(reflect.TypeOf(&testDog{})))
+	errorIfNil(t, L.TypeMetatable(reflect.TypeOf(testAnimal{})))
+	errorIfFalse(t, L.TypeMetatable(reflect.TypeOf(0)) == nil, "int is not registered")
+	intMt := L.RegisterTypeOf(reflect.TypeOf(0), map[string]LGFunction{"__len": func(L *LState) int { return 0 }})
+	errorIfNotEqual(t, intMt, L.TypeMetatable(reflect.TypeOf(0)))
+
+	type shared struct{}
+	RegisterSharedType[shared](map[string]LGFunction{
+		"ok": func(L *LState) int {
+			L.Push(LTrue)
+			return 1
+		},
+	})
+	L2 := NewState()
+	defer L2.Close()
+	L2.SetGlobal("s", L2.ToLValue(&shared{}))
+	errorIfScriptFail(t, L2, `assert(s:ok())`)
+}
+
+func TestCompatFlags(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	assert(unpack and getfenv and setfenv and table.unpack == nil)
+	assert(string.format("%d", 3.7) == "3")
+	`)
+	errorIfScriptNotFail(t, L, `local goto = 1`, "syntax error")
+
+	L52 := NewState(Options{CompatFlags: CompatLua52 | CompatStrictIntegerFormat})
+	defer L52.Close()
+	errorIfScriptFail(t, L52, `
+	assert(unpack == nil and getfenv == nil and setfenv == nil)
+	local a, b = table.unpack({1, 2})
+	assert(a == 1 and b == 2)
+	assert(string.format("%5.1f %d %%d %x", 3.7, 3, 255) == "  3.7 3 %d ff")
+	`)
+	errorIfScriptNotFail(t, L52, `string.format("%s %d", "x", 3.7)`, "bad argument #3.*no integer representation")
+
+	L51 := NewState(Options{CompatFlags: CompatNoGoto})
+	defer L51.Close()
+	errorIfScriptFail(t, L51, `local goto = 1; assert(goto == 1)`)
+}
+
+func TestRecordReplay(t *testing.T) {
+	src := `
+	local ch = channel.make(1)
+	ch:send({n = 1})
+	local ok, v = ch:receive()
+	local n = lookup("key")
+	return string.format("%d %d %s %d %d", os.time(), math.random(1000000), tostring(ok), v.n, n)
+	`
+	calls := 0
+	lookup := Nondeterministic("lookup", func(L *LState) int {
+		calls++
+		L.Push(LNumber(calls * 10))
+		return 1
+	})
+	run := func(L *LState) (string, error) {
+		L.SetGlobal("lookup", L.NewFunction(lookup))
+		if err := L.DoString(src); err != nil {
+			return "", err
+		}
+		defer L.Pop(1)
+		return L.ToString(-1), nil
+	}
+
+	L := NewState()
+	defer L.Close()
+	rec := L.StartRecording()
+	recorded, err := run(L)
+	errorIfNotNil(t, err)
+	L.StopRecordReplay()
+	errorIfNotEqual(t, 4, len(rec.Events))
+
+	var buf bytes.Buffer
+	_, err = rec.WriteTo(&buf)
+	errorIfNotNil(t, err)
+	rec, err = ReadRecording(&buf)
+	errorIfNotNil(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	L2 := NewState()
+	defer L2.Close()
+	L2.StartReplay(rec)
+	replayed, err := run(L2)
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, recorded, replayed)
+	errorIfNotEqual(t, 1, calls)
+
+	L2.StartReplay(&Recording{Events: []RecordedEvent{{Source: "math.random", Values: []interface{}{1.0}}}})
+	errorIfScriptNotFail(t, L2, `os.time()`, "replay diverged: math.random recorded, os.time called")
+}
+
+func TestPersistRestore(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("host", L.NewFunction(func(L *LState) int {
+		L.Push(LString("host"))
+		return 1
+	}))
+	errorIfScriptFail(t, L, `
+	local shared = 0
+	function inc() shared = shared + 1; return shared end
+	function get() return shared end
+	fmt = string.format
+	config = {name = "app", list = {1, 2, 3}, ratio = 0.5}
+	config.self = config
+	config.list.owner = config
+	setmetatable(config, {__index = function(t, k) return k .. "?" end})
+	counter = inc
+	call = host
+	inc(); inc()
+	`)
+	var buf bytes.Buffer
+	errorIfNotNil(t, L.Persist(&buf))
+
+	L2 := NewState()
+	defer L2.Close()
+	L2.SetGlobal("host", L2.NewFunction(func(L *LState) int {
+		L.Push(LString("host"))
+		return 1
+	}))
+	errorIfNotNil(t, L2.Restore(bytes.NewReader(buf.Bytes())))
+	errorIfScriptFail(t, L2, `
+	assert(get() == 2)
+	assert(inc() == 3 and get() == 3 and counter == inc)
+	assert(fmt == string.format and fmt("%d", 1) == "1")
+	assert(config.name == "app" and config.ratio == 0.5 and #config.list == 3)
+	assert(config.self == config and config.list.owner == config)
+	assert(config.missing == "missing?")
+	assert(call == host and call() == "host")
+	assert(package.loaded.string == string and _G == _G._G)
+	`)
+
+	L3 := NewState()
+	defer L3.Close()
+	err := L3.Restore(bytes.NewReader(buf.Bytes()))
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "_G.host"), "expected an error about _G.host, got %v", err)
+	errorIfScriptFail(t, L3, `
+	assert(string.format("%d", 1) == "1" and type(print) == "function" and config == nil)
+	`)
+
+	errorIfNil(t, L2.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()/2])))
+	errorIfScriptFail(t, L2, `
+	assert(get() == 3 and config.self == config and fmt("%d", 1) == "1")
+	`)
+
+	errorIfScriptFail(t, L, `co = coroutine.create(function() end)`)
+	errorIfNil(t, L.Persist(&buf))
+	errorIfNil(t, L2.Restore(strings.NewReader("not a snapshot")))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	L := NewState()
+	var closed []string
+	for _, name := range []string{"kept", "dropped"} {
+		ud := L.NewUserData()
+		ud.Value = name
+		SetUserDataFinalizer(ud, func(v interface{}) { closed = append(closed, v.(string)) })
+		L.SetGlobal(name, ud)
+	}
+	dropped := L.GetGlobal("dropped")
+	errorIfScriptFail(t, L, `
+	cache = setmetatable({}, {__mode = "v"})
+	cache[1] = {}
+	for i = 1, 1000 do local t = {i, tostring(i)} end
+	dropped = nil
+	`)
+	stats := L.CollectGarbage()
+	runtime.KeepAlive(dropped)
+	errorIfNotEqual(t, "dropped", strings.Join(closed, " "))
+	errorIfNotEqual(t, 1, stats.Finalized)
+	errorIfNotEqual(t, 1, stats.WeakEntries)
+	errorIfFalse(t, stats.After < stats.Before, "expected less than %d bytes, got %d", stats.Before, stats.After)
+	errorIfNotEqual(t, L.EstimateSize().Total, L.GetAllocatedBytes())
+
+	stats = L.CollectGarbage()
+	errorIfNotEqual(t, 0, stats.Finalized)
+	L.Close()
+	errorIfNotEqual(t, "dropped kept", strings.Join(closed, " "))
+}
+
+func TestCollectGarbageOptions(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	for i = 1, 100 do local s = string.rep("x", 10000) .. i end
+	local before = collectgarbage("count")
+	collectgarbage()
+	assert(collectgarbage("count") < before - 900)
+	local s = string.rep("x", 100000) .. "y"
+	s = nil
+	assert(collectgarbage("step", 1) == false)
+	assert(collectgarbage("step", 100) == true)
+	assert(collectgarbage("step") == true)
+	assert(collectgarbage("setpause", 150) == 200 and collectgarbage("setpause", 200) == 150)
+	assert(collectgarbage("setstepmul", 400) == 200)
+	assert(collectgarbage("isrunning"))
+	collectgarbage("stop")
+	assert(not collectgarbage("isrunning"))
+	collectgarbage("restart")
+	assert(collectgarbage("isrunning"))
+	`)
+	errorIfScriptNotFail(t, L, `collectgarbage("nope")`, "invalid option 'nope'")
+
+	L.SetMemoryPolicy(MemoryPolicyGCRetry)
+	L.CollectGarbage()
+	before := L.GetAllocatedBytes()
+	errorIfScriptFail(t, L, `for i = 1, 100 do local s = string.rep("x", 50000) .. i end`)
+	errorIfFalse(t, L.GetAllocatedBytes() < 3*before, "expected paced collections, got %d bytes from %d", L.GetAllocatedBytes(), before)
+
+	errorIfScriptFail(t, L, `collectgarbage("stop")`)
+	before = L.GetAllocatedBytes()
+	errorIfScriptFail(t, L, `for i = 1, 100 do local s = string.rep("x", 50000) .. i end`)
+	errorIfFalse(t, L.GetAllocatedBytes() > before+100*50000, "expected no collection, got %d bytes from %d", L.GetAllocatedBytes(), before)
+}
+
+func TestStateManager(t *testing.T) {
+	m := NewStateManager(ManagerOptions{
+		Setup: func(tenant string, L *LState) error {
+			L.SetGlobal("tenant", LString(tenant))
+			return L.DoString(`count = 0`)
+		},
+		MaxConcurrent: 2,
+		RateLimit:     3,
+		RateInterval:  time.Hour,
+	})
+	defer m.Close()
+	run := func(tenant string) (string, error) {
+		var result string
+		err := m.Do(context.Background(), tenant, func(L *LState) error {
+			if err := L.DoString(`count = count + 1; result = tenant .. count`); err != nil {
+				return err
+			}
+			result = L.GetGlobal("result").String()
+			return nil
+		})
+		return result, err
+	}
+	for _, want := range []string{"a1", "a2", "a3"} {
+		got, err := run("a")
+		errorIfNotNil(t, err)
+		errorIfNotEqual(t, want, got)
+	}
+	_, err := run("a")
+	var le *LimitError
+	errorIfFalse(t, errors.As(err, &le) && le.Resource == "execution rate", "expected a rate limit error, got %v", err)
+	got, err := run("b")
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, "b1", got)
+
+	errorIfFalse(t, m.Evict("b"), "b was not evicted")
+	got, err = run("b")
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, "b1", got)
+
+	metrics, ok := m.Metrics("a")
+	errorIfFalse(t, ok, "no metrics for a")
+	errorIfNotEqual(t, int64(3), metrics.Executions)
+	errorIfNotEqual(t, int64(1), metrics.Rejected)
+	errorIfFalse(t, metrics.AllocatedBytes > 0, "no memory accounted for a")
+	metrics, _ = m.Metrics("b")
+	errorIfNotEqual(t, int64(1), metrics.Evictions)
+	errorIfNotEqual(t, "a b", strings.Join(m.Tenants(), " "))
+
+	L := NewState()
+	size := L.GetAllocatedBytes()
+	L.Close()
+	m = NewStateManager(ManagerOptions{MaxTotalMemory: size * 3 / 2})
+	defer m.Close()
+	noop := func(L *LState) error { return nil }
+	errorIfNotNil(t, m.Do(context.Background(), "a", noop))
+	errorIfNotNil(t, m.Do(context.Background(), "b", noop))
+	metrics, _ = m.Metrics("a")
+	errorIfNotEqual(t, int64(1), metrics.Evictions)
+	err = m.Do(context.Background(), "b", func(L *LState) error {
+		return L.DoString(`local t = {} for i = 1, 100000 do t[i] = {} end`)
+	})
+	errorIfFalse(t, errors.As(err, &le) && le.Resource == "memory", "expected a memory limit error, got %v", err)
+
+	m.Close()
+	errorIfFalse(t, errors.Is(m.Do(context.Background(), "a", noop), ErrManagerClosed), "expected ErrManagerClosed")
+}
+
+func TestStateManagerRemoveWhileWaiting(t *testing.T) {
+	var mu sync.Mutex
+	var states []*LState
+	m := NewStateManager(ManagerOptions{
+		Setup: func(tenant string, L *LState) error {
+			mu.Lock()
+			states = append(states, L)
+			mu.Unlock()
+			return nil
+		},
+		MaxConcurrent: 1,
+	})
+	noop := func(L *LState) error { return nil }
+
+	// b waits for the slot held by a, before its execution starts
+	running, hold := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 2)
+	go func() {
+		done <- m.Do(context.Background(), "a", func(L *LState) error {
+			close(running)
+			<-hold
+			return nil
+		})
+	}()
+	<-running
+	go func() { done <- m.Do(context.Background(), "b", noop) }()
+	for len(m.Tenants()) < 2 {
+		runtime.Gosched()
+	}
+	errorIfFalse(t, !m.Remove("b"), "removed a tenant waiting for a slot")
+	close(hold)
+	errorIfNotNil(t, <-done)
+	errorIfNotNil(t, <-done)
+	metrics, ok := m.Metrics("b")
+	errorIfFalse(t, ok && metrics.Executions == 1, "lost the execution of b: %+v", metrics)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				errorIfNotNil(t, m.Do(context.Background(), "c", noop))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Remove("c")
+				runtime.Gosched()
+			}
+		}()
+	}
+	wg.Wait()
+	m.Close()
+	for _, L := range states {
+		errorIfFalse(t, L.stack == nil, "the state of a removed tenant was not closed")
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	calls := 0
+	query := func(L *LState) int {
+		calls++
+		return 0
+	}
+	db := NewCallLimiter("db", 0.001, 2)
+	L.SetGlobal("query", L.NewFunction(RateLimited(db, query)))
+	L.SetGlobal("lookup", L.NewFunction(RateLimited(db, query)))
+	errorIfScriptFail(t, L, `query(); lookup()`)
+	errorIfScriptFail(t, L, `
+	local ok, msg = pcall(query)
+	assert(not ok and msg:find("db: rate limit of 0.001 calls per second exceeded"), msg)
+	`)
+	err := L.DoString(`lookup()`)
+	var le *LimitError
+	errorIfFalse(t, errors.As(err, &le) && le.Resource == "db call rate", "expected a *LimitError, got %v", err)
+	errorIfNotEqual(t, 2, calls)
+
+	waiting := NewCallLimiter("http", 50, 1)
+	waiting.Wait = true
+	L.SetGlobal("fetch", L.NewFunction(RateLimited(waiting, query)))
+	start := time.Now()
+	errorIfScriptFail(t, L, `fetch(); fetch(); fetch()`)
+	errorIfFalse(t, time.Since(start) >= 30*time.Millisecond, "calls were not delayed")
+	errorIfNotEqual(t, 5, calls)
+
+	slow := NewCallLimiter("slow", 0.001, 1)
+	slow.Wait = true
+	L.SetGlobal("fetch", L.NewFunction(RateLimited(slow, query)))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	errorIfScriptNotFail(t, L, `fetch(); fetch()`, "context deadline exceeded")
+	errorIfNotEqual(t, 6, calls)
+}
+
+func TestTaint(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("input", L.NewFunction(TaintSource(func(L *LState) int {
+		L.Push(LString("1; DROP TABLE users"))
+		L.Push(LNumber(1))
+		return 2
+	})))
+	var queries []string
+	L.SetGlobal("query", L.NewFunction(TaintSink("query", nil, func(L *LState) int {
+		queries = append(queries, L.CheckString(1))
+		return 0
+	})))
+	var reported []int
+	L.SetGlobal("log", L.NewFunction(TaintSink("log", func(L *LState, err *TaintError) bool {
+		reported = append(reported, err.Arg)
+		return true
+	}, func(L *LState) int { return 0 })))
+	L.SetGlobal("istainted", L.NewFunction(func(L *LState) int {
+		L.Push(LBool(L.IsTainted(L.Get(1))))
+		return 1
+	}))
+	errorIfScriptFail(t, L, `
+	local id, n = input()
+	assert(istainted(id) and not istainted(n))
+	assert(istainted("id = " .. id))
+	assert(istainted(table.concat({"a", id}, ",")))
+	assert(istainted(id:sub(4)))
+	assert(istainted(("x"):gsub("x", id)))
+	assert(istainted(id:gsub("%d", "2")))
+	assert(istainted(("x"):gsub("x", function() return id end)))
+	assert(istainted(string.format("id = %s", id)))
+	assert(istainted(id:upper()) and istainted(id:lower()) and istainted(id:reverse()) and istainted(id:rep(2)))
+	assert(not istainted(#id .. "") and not istainted("1; DROP TABLE users"))
+	assert(not istainted(("x"):gsub("x", "y")))
+
+	query("SELECT 1")
+	local ok, msg = pcall(query, "SELECT * FROM t WHERE id = " .. id)
+	assert(not ok and msg:find("tainted string passed as argument #1 to query"), msg)
+	log("ok", id)
+	`)
+	errorIfNotEqual(t, "SELECT 1", strings.Join(queries, ";"))
+	errorIfNotEqual(t, 1, len(reported))
+	errorIfNotEqual(t, 2, reported[0])
+
+	err := L.DoString(`query(input())`)
+	var te *TaintError
+	errorIfFalse(t, errors.As(err, &te) && te.Function == "query", "expected a *TaintError, got %v", err)
+
+	// the state keeps the tainted strings it references, and they count in
+	// its size, until a collection finds them unreachable
+	errorIfScriptFail(t, L, `
+	local id = input()
+	kept = id:sub(4, 7)
+	built = ""
+	for i = 1, 100 do built = built .. id end
+	`)
+	size := L.EstimateSize().Strings
+	errorIfFalse(t, len(L.G.taint.strs) > 100, "expected the tainted strings to be kept, got %d", len(L.G.taint.strs))
+	L.CollectGarbage()
+	errorIfFalse(t, len(L.G.taint.strs) == 2, "expected the tainted strings of kept and built to be kept, got %d", len(L.G.taint.strs))
+	errorIfFalse(t, L.EstimateSize().Strings < size/10, "expected the forgotten tainted strings not to be counted")
+	errorIfScriptFail(t, L, `assert(istainted(kept) and istainted(built))`)
+}
+
+func TestDiffGlobals(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `counter = 1; config = {debug = false}; legacy = "x"`)
+	before := L.GlobalsSnapshot()
+	errorIfScriptFail(t, L, `
+	counter = counter + 1
+	config.debug = true
+	legacy = nil
+	helper = function() end
+	function string.trim(s) return s end
+	`)
+	changes := DiffGlobals(before, L.GlobalsSnapshot())
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.Kind.String()+" "+c.Name)
+	}
+	errorIfNotEqual(t, "modified config,modified counter,created helper,deleted legacy,modified string", strings.Join(got, ","))
+	errorIfNotEqual(t, "modified counter: number 1 -> number 2", changes[1].String())
+	errorIfNotEqual(t, "trim", strings.Join(changes[4].Fields, ","))
+	errorIfNotEqual(t, "deleted legacy: string (1 bytes)", changes[3].String())
+	errorIfNotEqual(t, 0, len(DiffGlobals(before, before)))
+}
+
+func TestDependencies(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/config.lua": {Data: []byte(`return {}`)},
+		"app/db.lua":     {Data: []byte(`local config = require "app.config"; local json = require("json")`)},
+		"app/util.lua":   {Data: []byte(`local name = "app.db"; return function() return require(name) end`)},
+		"app/a.lua":      {Data: []byte(`require("app.b")`)},
+		"app/b.lua":      {Data: []byte(`require("app.a")`)},
+	}
+	src := `
+	local db = require("app.db")
+	local util = require("app." .. "util")
+	local ok, yaml = pcall(require, "yaml")
+	local plugin = require(os.getenv("PLUGIN"))
+	load_module("app.config")
+	`
+	opts := &DependencyOptions{Heuristics: HeuristicAll, RequireFuncs: []string{"load_module"}, Path: "?.lua", FS: fsys}
+	g, err := Dependencies("main", strings.NewReader(src), opts)
+	errorIfNotNil(t, err)
+	var got []string
+	for _, dep := range g.Requires["main"] {
+		got = append(got, dep.Module)
+	}
+	errorIfNotEqual(t, "app.db app.util yaml app.config", strings.Join(got, " "))
+	errorIfNotEqual(t, false, g.Requires["main"][0].Heuristic)
+	errorIfNotEqual(t, true, g.Requires["main"][1].Heuristic)
+	errorIfNotEqual(t, 5, g.Dynamic["main"][0])
+	errorIfNotEqual(t, "app.db", g.Requires["app.util"][0].Module)
+	errorIfNotEqual(t, "json yaml", strings.Join(g.Missing, " "))
+	order, err := g.Order()
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, "app.config app.db app.util main", strings.Join(order, " "))
+
+	g, err = Dependencies("main", strings.NewReader(src), &DependencyOptions{Path: "?.lua", FS: fsys})
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, 1, len(g.Requires["main"]))
+	errorIfNotEqual(t, 2, len(g.Dynamic["main"]))
+
+	g, err = Dependencies("app.a", strings.NewReader(`require("app.b")`), opts)
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, "app.a app.b", strings.Join(g.Cycles()[0], " "))
+	_, err = g.Order()
+	errorIfNotEqual(t, "dependency cycle: app.a -> app.b -> app.a", err.Error())
+}
+
+func TestPatternStepLimit(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetPatternStepLimit(100000)
+	errorIfNotEqual(t, int64(100000), L.GetPatternStepLimit())
+	errorIfScriptFail(t, L, `assert(string.find("hello world", "o w") == 5)`)
+	err := L.DoString(`string.find(string.rep("a", 200), ".-.-.-.-b")`)
+	errorIfFalse(t, errors.Is(err, ErrPatternStepLimitExceeded), "expected a pattern step limit error, got %v", err)
+	for _, call := range []string{`string.match(s, p)`, `string.gmatch(s, p)`, `string.gsub(s, p, "")`} {
+		errorIfScriptFail(t, L, `
+		local s, p = string.rep("a", 200), ".-.-.-.-b"
+		local ok, err = pcall(function() return `+call+` end)
+		assert(not ok and err:find("pattern step limit exceeded"))
+		`)
+	}
+
+	L.SetPatternStepLimit(0)
+	errorIfScriptFail(t, L, `assert(string.find(string.rep("a", 20), ".-.-.-.-b") == nil)`)
+}
+
+func TestMaxCoroutines(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetMaxCoroutines(3)
+	errorIfNotEqual(t, 3, L.GetMaxCoroutines())
+
+	// finished and failed coroutines are not alive
+	errorIfScriptFail(t, L, `
+	for i = 1, 10 do
+		coroutine.wrap(function() end)()
+		pcall(coroutine.wrap(function() error("x") end))
+		coroutine.resume(coroutine.create(function() error("x") end))
+	end
+	`)
+	errorIfNotEqual(t, 0, L.GetCoroutineCount())
+
+	err := L.DoString(`
+	cos = {}
+	for i = 1, 10 do
+		cos[i] = coroutine.create(function() coroutine.yield() end)
+		coroutine.resume(cos[i])
+	end
+	`)
+	errorIfFalse(t, errors.Is(err, ErrCoroutineLimitExceeded), "expected a coroutine limit error, got %v", err)
+	errorIfNotEqual(t, 3, L.GetCoroutineCount())
+	errorIfScriptNotFail(t, L, `coroutine.wrap(function() end)`, "too many coroutines")
+
+	// suspended coroutines that can not be reached are forgotten by a collection
+	errorIfScriptFail(t, L, `cos = nil`)
+	L.CollectGarbage()
+	errorIfNotEqual(t, 0, L.GetCoroutineCount())
+	errorIfScriptFail(t, L, `
+	local co = coroutine.create(function() coroutine.yield() end)
+	assert(coroutine.resume(co))
+	`)
+
+	L.SetMaxCoroutines(0)
+	errorIfScriptFail(t, L, `for i = 1, 10 do coroutine.wrap(function() coroutine.yield() end)() end`)
+}
+
+func TestMaxStringLengthAndTableEntries(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetMaxStringLength(100)
+	errorIfNotEqual(t, 100, L.GetMaxStringLength())
+	errorIfScriptFail(t, L, `s = string.rep("a", 100)`)
+	err := L.DoString(`s = string.rep("a", 101)`)
+	errorIfFalse(t, errors.Is(err, ErrStringTooLong), "expected a string length error, got %v", err)
+	for _, expr := range []string{`s .. "b"`, `table.concat({s, "b"})`, `s:upper() .. "b"`, `string.format("%s!", s)`, `s:gsub("a", "bb")`, `string.pack("c101", "")`} {
+		errorIfScriptNotFail(t, L, `local x = `+expr, "string too long")
+	}
+	errorIfScriptFail(t, L, `assert(#(s:sub(1, 50) .. s:sub(1, 50)) == 100)`)
+	L.SetMaxStringLength(0)
+	errorIfScriptFail(t, L, `s = string.rep("a", 1000)`)
+
+	L.SetMaxTableEntries(10)
+	errorIfNotEqual(t, 10, L.GetMaxTableEntries())
+	errorIfScriptFail(t, L, `
+	t = {}
+	for i = 1, 5 do t[i] = i end
+	for i = 1, 5 do t["k" .. i] = i end
+	t[1], t.k1 = "x", "y"
+	`)
+	for _, stmt := range []string{`t[6] = 6`, `t.k6 = 6`, `t[true] = 1`, `table.insert(t, 6)`, `table.insert(t, 1, 0)`, `rawset(t, "k6", 6)`, `local u = {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}`, `local u = {}; u[20] = 1`} {
+		err := L.DoString(stmt)
+		errorIfFalse(t, errors.Is(err, ErrTableTooLarge), "%s: expected a table size error, got %v", stmt, err)
+	}
+	errorIfScriptFail(t, L, `
+	local ok, err = pcall(function() t.k6 = 6 end)
+	assert(not ok and err:find("table too large"))
+	`)
+	L.SetMaxTableEntries(0)
+	errorIfScriptFail(t, L, `for i = 1, 100 do t[i] = i end`)
+}
+
+func TestCallInterceptor(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	fetched := 0
+	fetch := L.NewFunction(func(L *LState) int {
+		fetched++
+		return 0
+	})
+	L.SetGlobal("fetch", fetch)
+	calls, fetches := 0, 0
+	L.SetCallInterceptor(func(L *LState, fn LValue, args []LValue) error {
+		calls++
+		if fn == fetch {
+			if fetches++; fetches > 3 {
+				return errors.New("too many fetches")
+			}
+			errorIfNotEqual(t, LString("url"), args[0])
+		}
+		return nil
+	})
+	errorIfScriptFail(t, L, `
+	local function f(x) return x end
+	f(1)
+	fetch("url")
+	pcall(fetch, "url")
+	table.sort({3, 2, 1}, function(a, b) return a < b end)
+	local ok, err = pcall(function()
+		fetch("url")
+		fetch("url")
+	end)
+	assert(not ok and err:find("too many fetches"))
+	`)
+	errorIfNotEqual(t, 3, fetched)
+	errorIfFalse(t, calls > 6, "unexpected number of calls %v", calls)
+
+	err := L.DoString(`fetch("url")`)
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "too many fetches"), "expected the interceptor error, got %v", err)
+	errorIfNotEqual(t, 3, fetched)
+
+	L.SetCallInterceptor(nil)
+	errorIfScriptFail(t, L, `fetch("url")`)
+	errorIfNotEqual(t, 4, fetched)
+}
+
+func TestCompileLimits(t *testing.T) {
+	L := NewState(Options{CompileLimits: CompileLimits{MaxChunkSize: 1000, MaxNestingDepth: 20, MaxConstants: 10}})
+	defer L.Close()
+	errorIfScriptFail(t, L, `local t = {{{1}}}; assert(-(-t[1][1][1]) == 1 and not not t)`)
+
+	var lerr *LimitError
+	for _, src := range []string{
+		strings.Repeat(" ", 1001),
+		"return " + strings.Repeat("{", 21) + strings.Repeat("}", 21),
+		"return " + strings.Repeat("(", 30) + "1" + strings.Repeat(")", 30),
+		strings.Repeat("do ", 21) + strings.Repeat("end ", 21),
+		"return " + strings.Repeat("not ", 25) + "true",
+		"return " + strings.Repeat("- ", 25) + "1",
+		"local t = {'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k'}",
+		"return function() return {'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k'} end",
+	} {
+		_, err := L.LoadString(src)
+		errorIfFalse(t, errors.Is(err, ErrCompileLimitExceeded), "%.40q: expected a compile limit error, got %v", src, err)
+		errorIfFalse(t, errors.As(err, &lerr), "%.40q: expected a *LimitError", src)
+		if aerr, ok := err.(*ApiError); ok {
+			errorIfNotEqual(t, ApiErrorSyntax, aerr.Type)
+		}
+	}
+
+	// binary chunks are checked as well
+	L2 := NewState()
+	defer L2.Close()
+	fn, err := L2.LoadString("return {'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k'}")
+	errorIfNotNil(t, err)
+	var buf bytes.Buffer
+	errorIfNotNil(t, DumpProto(&buf, fn.Proto))
+	_, err = L.Load(&buf, "binary")
+	errorIfFalse(t, errors.Is(err, ErrCompileLimitExceeded), "expected a compile limit error, got %v", err)
+}
+
+func TestPause(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfFalse(t, !L.Pause(), "a state that is not pausable can not be paused")
+	L.SetPausable(true)
+
+	var progress atomic.Int64
+	L.SetGlobal("tick", L.NewFunction(func(L *LState) int {
+		progress.Add(1)
+		return 0
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`for i = 1, 100000 do tick() end`)
+	}()
+	for progress.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	errorIfFalse(t, L.Pause(), "the state must be pausable")
+	errorIfFalse(t, L.IsPaused(), "the state must be paused")
+	time.Sleep(10 * time.Millisecond)
+	paused := progress.Load()
+	time.Sleep(20 * time.Millisecond)
+	errorIfNotEqual(t, paused, progress.Load())
+	L.Unpause()
+	errorIfNotNil(t, <-done)
+	errorIfNotEqual(t, int64(100000), progress.Load())
+
+	// cancelling the context ends the pause
+	ctx, cancel := context.WithCancel(context.Background())
+	L.SetContext(ctx)
+	L.Pause()
+	go func() {
+		done <- L.DoString(`for i = 1, 10 do tick() end`)
+	}()
+	cancel()
+	err := <-done
+	errorIfFalse(t, errors.Is(err, context.Canceled), "expected a canceled context, got %v", err)
+}
+
+func TestIsolatedEnv(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("shared", LNumber(1))
+	a, b := L.NewIsolatedEnv(), L.NewIsolatedEnv()
+	errorIfNotNil(t, L.DoStringInEnv(`
+	counter = 1
+	function inc() counter = counter + 1 end
+	inc()
+	assert(_G.counter == 2 and shared == 1 and string.rep("a", 2) == "aa")
+	assert(getfenv(0) == _G and getfenv(inc) == _G)
+	assert(loadstring("return counter")() == 2)
+	assert(load("leaked = true") and loadstring("leaked = true")() == nil)
+	assert(not pcall(function() string.rep = nil end))
+	assert(not pcall(function() _G.string.upper = nil end))
+	assert(getmetatable(_G) == false)
+	`, a))
+	errorIfNotNil(t, L.DoStringInEnv(`assert(counter == nil and inc == nil and type(string.rep) == "function")`, b))
+	errorIfNotEqual(t, LNumber(2), a.RawGetString("counter"))
+	errorIfNotEqual(t, LTrue, a.RawGetString("leaked"))
+	errorIfNotEqual(t, LNil, L.GetGlobal("counter"))
+	errorIfNotEqual(t, LNil, L.GetGlobal("leaked"))
+
+	env := L.NewTable()
+	env.RawSetString("name", LString("plain"))
+	errorIfNotNil(t, L.DoStringInEnv(`result = name .. tostring(#table.concat({}))`, env))
+	errorIfNotEqual(t, LString("plain0"), env.RawGetString("result"))
+	errorIfNotNil(t, L.DoStringInEnv(`x = 1`, nil))
+	errorIfNotEqual(t, LNil, L.GetGlobal("x"))
+	errorIfNotNil(t, L.DoString(`assert(type(string.rep) == "function")`))
+}
+
+func TestLoadMode(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	fn, err := L.LoadString(`return 1`)
+	errorIfNotNil(t, err)
+	var buf bytes.Buffer
+	errorIfNotNil(t, DumpProto(&buf, fn.Proto))
+	L.SetGlobal("binary", LString(buf.String()))
+	errorIfScriptFail(t, L, `
+	assert(load("return 1")() == 1)
+	assert(load(binary)() == 1 and load(binary, "b", "b")() == 1)
+	local fn, err = load(binary, "b", "t")
+	assert(fn == nil and err == "attempt to load a binary chunk (mode is 't')")
+	fn, err = load("return 1", "t", "b")
+	assert(fn == nil and err == "attempt to load a text chunk (mode is 'b')")
+	local parts = {"return ", "x"}
+	local i = 0
+	fn = load(function() i = i + 1; return parts[i] end, "parts", "t", {x = 7})
+	assert(fn() == 7 and x == nil)
+	assert(load("return x", "env", "bt", nil)() == nil)
+	assert(not pcall(load, 1))
+	`)
+}
+
+func TestLoadFileEnv(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	path := filepath.Join(t.TempDir(), "chunk.lua")
+	errorIfNotNil(t, os.WriteFile(path, []byte(`x = 1; return function() return y end`), 0o644))
+	L.SetGlobal("path", LString(path))
+	errorIfScriptFail(t, L, `
+	local env = {y = "env"}
+	local inner = loadfile(path, "t", env)()
+	assert(env.x == 1 and x == nil and inner() == "env")
+	local fn, err = loadfile(path, "b")
+	assert(fn == nil and err == "attempt to load a text chunk (mode is 'b')")
+	assert(loadfile(path)() and x == 1)
+	assert(not pcall(loadfile, path, "t", 1))
+	`)
+}
+
+func TestLenMetamethod(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local store = {10, 20, 30}
+	local p = setmetatable({}, {__len = function() return #store end, __index = store, __newindex = store})
+	assert(#p == 3 and table.concat(p, ",") == "10,20,30" and select("#", unpack(p)) == 3)
+	table.insert(p, 40)
+	table.insert(p, 1, 5)
+	assert(table.concat(store, ",") == "5,10,20,30,40")
+	assert(table.remove(p) == 40 and table.remove(p, 1) == 5)
+	assert(table.concat(store, ",") == "10,20,30" and next(p) == nil)
+	store[4], store[5] = 5, 15
+	table.sort(p, function(a, b) return a > b end)
+	assert(table.concat(store, ",") == "30,20,15,10,5" and next(p) == nil)
+	`)
+	errorIfScriptNotFail(t, L, `table.insert(setmetatable({}, {__len = function() return 2 end}), 9, 1)`, "position out of bounds")
+	errorIfScriptNotFail(t, L, `table.concat(setmetatable({}, {__len = function() return "x" end}))`, "object length is not a number")
+	for _, n := range []string{"0/0", "1e300", "1.5"} {
+		errorIfScriptNotFail(t, L, `table.insert(setmetatable({}, {__len = function() return `+n+` end}), 1)`, "object length is not an integer")
+		errorIfScriptNotFail(t, L, `unpack(setmetatable({}, {__len = function() return `+n+` end}))`, "object length is not an integer")
+	}
+}
+
+func TestPairsMetamethod(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	mt := L.NewTable()
+	L.SetField(mt, "__pairs", L.NewFunction(func(L *LState) int {
+		items := L.CheckUserData(1).Value.([]string)
+		L.Push(L.NewFunction(func(L *LState) int {
+			i := L.CheckInt(2) + 1
+			if i > len(items) {
+				return 0
+			}
+			L.Push(LNumber(i))
+			L.Push(LString(items[i-1]))
+			return 2
+		}))
+		L.Push(L.Get(1))
+		L.Push(LNumber(0))
+		return 3
+	}))
+	ud := L.NewUserData()
+	ud.Value = []string{"a", "b", "c"}
+	ud.Metatable = mt
+	L.SetGlobal("list", ud)
+	errorIfScriptFail(t, L, `
+	local s = ""
+	for i, v in pairs(list) do s = s .. i .. v end
+	assert(s == "1a2b3c")
+	local inner = {x = 1}
+	local proxy = setmetatable({}, {__pairs = function(t) return next, inner, nil end})
+	local n = 0
+	for k, v in pairs(proxy) do assert(k == "x" and v == 1); n = n + 1 end
+	assert(n == 1)
+	`)
+	errorIfScriptNotFail(t, L, `pairs(1)`, "table expected")
+}
+
+func TestDenyFunctions(t *testing.T) {
+	L := NewState(Options{Deny: []string{"string.rep", "os.exit", "collectgarbage", "no.such.lib"}})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	assert(string.rep == nil and ("x").rep == nil and package.loaded.string.rep == nil)
+	assert(os.exit == nil and collectgarbage == nil and _G.collectgarbage == nil)
+	assert(string.upper("a") == "A")
+	`)
+
+	L2 := NewState()
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `local rep = string.rep; function repeat3(s) return rep(s, 3) end`)
+	frozen := L2.NewTable()
+	frozen.RawSetString("rep", L2.GetField(L2.GetGlobal("string"), "rep"))
+	L2.SetTableReadOnly(frozen, true)
+	L2.SetGlobal("frozen", frozen)
+	L2.DenyFunctions("string.rep")
+	errorIfScriptNotFail(t, L2, `repeat3("a")`, "'string.rep' is disabled")
+	errorIfScriptNotFail(t, L2, `frozen.rep("a", 2)`, "'string.rep' is disabled")
+	errorIfScriptFail(t, L2, `assert(string.rep == nil)`)
+}
+
+func TestProtectMetatable(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	mt := L.NewTypeMetatable("point")
+	L.SetField(mt, "__index", L.NewFunction(func(L *LState) int {
+		L.Push(LNumber(1))
+		return 1
+	}))
+	L.ProtectMetatable(mt)
+	errorIfFalse(t, L.IsMetatableProtected(mt), "metatable is not protected")
+	ud := L.NewUserData()
+	L.SetMetatable(ud, mt)
+	L.SetGlobal("p", ud)
+	L.SetGlobal("mt", mt)
+	errorIfScriptFail(t, L, `
+	assert(p.x == 1)
+	assert(getmetatable(p) == false and debug.getmetatable(p) == false)
+	assert(not pcall(setmetatable, newproxy(p), {}))
+	`)
+	errorIfScriptNotFail(t, L, `debug.setmetatable(p, nil)`, "cannot change a protected metatable")
+	errorIfScriptNotFail(t, L, `rawset(mt, "__index", nil)`, "readonly")
+	errorIfNotEqual(t, mt, ud.Metatable)
+
+	L.WithTableReadOnlyBypass(func() { mt.RawSetString("__metatable", LString("locked")) })
+	errorIfScriptFail(t, L, `assert(getmetatable(p) == "locked")`)
+	L.UnprotectMetatable(mt)
+	L.WithTableReadOnlyBypass(func() { mt.RawSetString("__metatable", LNil) })
+	errorIfScriptFail(t, L, `assert(getmetatable(p) == mt); debug.setmetatable(p, nil)`)
+}
+
+func TestDeterministic(t *testing.T) {
+	script := `
+	local t = {}
+	for i = 1, 20 do t["k" .. i] = i end
+	local keys = {}
+	for k in pairs(t) do keys[#keys + 1] = k end
+	print(table.concat(keys, ","))
+	print(math.random(), math.random(100), tostring({}), tostring(print), tostring(t))
+	print(os.time(), os.clock(), os.date("!%Y-%m-%d"))
+	`
+	run := func(opts Options) string {
+		var out bytes.Buffer
+		opts.Stdout = &out
+		L := NewState(opts)
+		defer L.Close()
+		errorIfNotNil(t, L.DoString(script))
+		return out.String()
+	}
+	first := run(Options{Deterministic: true, RandomSeed: 7})
+	errorIfNotEqual(t, first, run(Options{Deterministic: true, RandomSeed: 7}))
+	errorIfFalse(t, strings.Contains(first, "table: 0x00000001\tfunction: 0x00000002\ttable: 0x00000003"), "unexpected addresses: %s", first)
+	errorIfFalse(t, strings.Contains(first, "0\t0\t1970-01-01"), "unexpected time: %s", first)
+	errorIfFalse(t, first != run(Options{Deterministic: true, RandomSeed: 8}), "seed is ignored")
+
+	clock := &fixedClock{time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	L := NewState(Options{Clock: clock})
+	defer L.Close()
+	clock.t = clock.t.Add(2 * time.Second)
+	errorIfScriptFail(t, L, `assert(os.date("!%H:%M:%S") == "03:04:07" and os.clock() == 2)`)
+	errorIfScriptFail(t, L, `assert(tostring({}):find("0x") and not tostring({}):find("0x00000001"))`)
+}
+
+func TestAuditHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.PreloadModule("mod", func(L *LState) int {
+		L.Push(LTrue)
+		return 1
+	})
+	errDenied := errors.New("denied by policy")
+	var events []string
+	L.SetAuditHook(func(L *LState, event string, args []LValue) error {
+		events = append(events, fmt.Sprintf("%s(%s)", event, args[0]))
+		L.Audit("nested")
+		if event == "io.open" || event == "os.execute" {
+			return errDenied
+		}
+		return nil
+	})
+	errorIfScriptFail(t, L, `
+	assert(require("mod") == true)
+	assert(loadstring("return 1")() == 1)
+	assert(os.getenv("GOPHER_LUA_AUDIT") == nil)
+	`)
+	err := L.DoString(`io.open("/etc/passwd")`)
+	errorIfFalse(t, errors.Is(err, errDenied), "unexpected error: %v", err)
+	errorIfScriptNotFail(t, L, `os.execute("rm -rf /")`, "denied by policy")
+	errorIfNotEqual(t, "require(mod),loadstring(return 1),os.getenv(GOPHER_LUA_AUDIT),io.open(/etc/passwd),os.execute(rm -rf /)", strings.Join(events, ","))
+
+	events = nil
+	L.SetAuditHook(nil)
+	errorIfScriptFail(t, L, `loadstring("return 1")`)
+	errorIfNotEqual(t, 0, len(events))
+}
+
+func TestSafeLibs(t *testing.T) {
+	L := NewState(Options{SafeLibs: true})
+	defer L.Close()
+	fn, err := L.LoadString(`return 1`)
+	errorIfNotNil(t, err)
+	var buf bytes.Buffer
+	errorIfNotNil(t, DumpProto(&buf, fn.Proto))
+	L.SetGlobal("binary", LString(buf.String()))
+	errorIfScriptFail(t, L, `
+	assert(io == nil and debug == nil and package == nil and channel == nil)
+	assert(dofile == nil and loadfile == nil and require == nil)
+	assert(os.execute == nil and os.remove == nil and os.getenv == nil and os.exit == nil)
+	assert(type(os.time()) == "number")
+	assert(string.rep("a", 3) == "aaa" and table.concat({1, 2}) == "12" and math.max(1, 2) == 2)
+	assert(coroutine.wrap(function() return 1 end)() == 1)
+	assert(loadstring("return 1")() == 1)
+	local fn, err = loadstring(binary)
+	assert(fn == nil and err:find("binary chunk"))
+	`)
+
+	// the host can still load binary chunks
+	_, err = L.Load(&buf, "binary")
+	errorIfNotNil(t, err)
+}
+
+type fixedClock struct{ t time.Time }
+
+func (c *fixedClock) Now() time.Time { return c.t }
+
+func TestSandboxOs(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	clock := &fixedClock{time.Date(2020, 2, 29, 12, 30, 0, 0, time.UTC)}
+	env := map[string]string{"HOME": "/sandbox"}
+	L.Push(L.NewFunction(NewSandboxOs(SandboxOsOptions{Clock: clock, Env: env})))
+	L.Push(LString(OsLibName))
+	L.Call(1, 0)
+	clock.t = clock.t.Add(1500 * time.Millisecond)
+	errorIfScriptFail(t, L, `
+	assert(os.time() == 1582979401)
+	assert(os.date("%Y-%m-%d %H:%M:%S") == "2020-02-29 12:30:01")
+	assert(os.date("%H:%M", 0) == "00:00")
+	assert(os.time({year = 2020, month = 2, day = 29, hour = 12, min = 30}) == 1582979400)
+	assert(os.clock() == 1.5)
+	assert(os.getenv("HOME") == "/sandbox" and os.getenv("PATH") == nil)
+	assert(os.setenv("LANG", "C"))
+	for _, name in ipairs({"execute", "remove", "rename", "tmpname", "exit"}) do
+		local ok, err = pcall(os[name], "x", "y")
+		assert(not ok and err:find("not permitted"), name)
+	end
+	`)
+	errorIfNotEqual(t, "C", env["LANG"])
+
+	L.Push(L.NewFunction(NewSandboxOs(SandboxOsOptions{AllowTmpname: true})))
+	L.Push(LString(OsLibName))
+	L.Call(1, 0)
+	errorIfScriptFail(t, L, `
+	assert(type(os.tmpname()) == "string")
+	assert(os.getenv("HOME") == nil and os.setenv("HOME", "/") == nil)
+	`)
+}
+
+func TestFreezeTable(t *testing.T) {
+	owner := NewState(Options{DeterministicIteration: IterationSorted})
+	defer owner.Close()
+	errorIfScriptFail(t, owner, `config = {name = "app", limits = {cpu = 2, mem = 512}, list = {1, 2, 3}}`)
+	config := owner.GetGlobal("config").(*LTable)
+	owner.FreezeTable(config)
+
+	done := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			L := NewState(Options{FrozenTables: true})
+			defer L.Close()
+			L.SetGlobal("config", config)
+			done <- L.DoString(`
+			local n = 0
+			for k, v in pairs(config) do n = n + 1 end
+			assert(n == 3 and config.limits.mem == 512 and table.isfrozen(config.limits))
+			assert(not pcall(function() config.limits.cpu = 4 end))
+			assert(not pcall(function() config.list[4] = 4 end))
+			assert(not pcall(function() rawset(config, "name", "x") end))
+			assert(not pcall(function() table.insert(config.list, 4) end))
+			assert(not pcall(setmetatable, config, {}))
+			local t = table.freeze({1})
+			assert(table.isfrozen(t) and not pcall(function() t[2] = 2 end))
+			`)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		errorIfNotNil(t, <-done)
+	}
+	errorIfScriptFail(t, owner, `assert(table.freeze == nil)`)
+}
+
+func TestToBeClosed(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local log = {}
+	local function closer(name)
+	  return setmetatable({}, {__close = function(_, err) log[#log+1] = name .. ":" .. tostring(err) end})
+	end
+	do
+	  local a <close> = closer("a")
+	  local b <close> = closer("b")
+	  local c <close> = nil
+	end
+	assert(table.concat(log, " ") == "b:nil a:nil")
+	log = {}
+	for i = 1, 3 do
+	  local x <close> = closer("x" .. i)
+	  if i == 2 then break end
+	end
+	assert(table.concat(log, " ") == "x1:nil x2:nil")
+	log = {}
+	local function f()
+	  local y <close> = closer("y")
+	  return #log
+	end
+	assert(f() == 0 and table.concat(log, " ") == "y:nil")
+	log = {}
+	local ok, err = pcall(function()
+	  local z <close> = closer("z")
+	  error("boom", 0)
+	end)
+	assert(not ok and err == "boom" and table.concat(log, " ") == "z:boom")
+	`)
+	errorIfScriptNotFail(t, L, `local x <close> = {}`, "variable 'x' got a non-closable value")
+	errorIfScriptNotFail(t, L, `local x <close>, y <close> = nil, nil`, "multiple to-be-closed variables in local list")
+	errorIfScriptNotFail(t, L, `local x <static> = 1`, "unknown attribute 'static'")
+}
+
+func TestConstLocals(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local a <const>, b = 1, 2
+	b = 3
+	local f <const> = function() return a + b end
+	do local a = 10; a = 11 end
+	assert(f() == 4)
+	`)
+	for _, src := range []string{
+		`local x <const> = 1; x = 2`,
+		`local x <const> = 1; return function() x = 2 end`,
+		`local x <const> = 1; function x() end`,
+		`local x <close> = nil; x = 1`,
+	} {
+		errorIfScriptNotFail(t, L, src, "attempt to assign to const variable 'x'")
+	}
+}
@@ -0,0 +1,48 @@
+package lua
+
+/* step hook {{{ */
+
+// StepHook is called by the VM every few instructions, see SetStepHook.
+type StepHook func(L *LState) error
+
+type stepHook struct {
+	fn      StepHook
+	every   int
+	left    int
+	running bool
+}
+
+// SetStepHook calls fn every every instructions executed by this state and
+// the threads created from it from now on. fn runs on the goroutine of the
+// script, between two instructions, with the running thread as argument; it
+// can report progress, yield the goroutine with runtime.Gosched or decide to
+// stop the script. If fn returns an error, the script is aborted with it, so
+// that errors.Is and errors.As see it through the returned *ApiError. fn is
+// not called again while it runs, even if it calls into the state. A nil fn
+// or an every below 1 removes the hook.
+func (ls *LState) SetStepHook(every int, fn StepHook) {
+	if fn == nil || every < 1 {
+		ls.G.stepHook = nil
+	} else {
+		ls.G.stepHook = &stepHook{fn: fn, every: every, left: every}
+	}
+	ls.updateMainLoop()
+}
+
+// step counts an instruction and calls the hook when it is due.
+func (h *stepHook) step(L *LState) {
+	if h.left--; h.left > 0 || h.running {
+		return
+	}
+	h.left = h.every
+	h.running = true
+	defer func() { h.running = false }()
+	if clock := L.G.execClock; clock != nil && clock.pause() {
+		defer clock.resume()
+	}
+	if err := h.fn(L); err != nil {
+		L.raiseTypedError(err, "%s", err.Error())
+	}
+}
+
+/* }}} */
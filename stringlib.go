@@ -2,7 +2,11 @@ package lua
 
 import (
 	"fmt"
+	"io"
+	"math"
+	"strconv"
 	"strings"
+	"unsafe"
 
 	"github.com/yuin/gopher-lua/pm"
 )
@@ -25,19 +29,22 @@ func OpenString(L *LState) int {
 }
 
 var strFuncs = map[string]LGFunction{
-	"byte":    strByte,
-	"char":    strChar,
-	"dump":    strDump,
-	"find":    strFind,
-	"format":  strFormat,
-	"gsub":    strGsub,
-	"len":     strLen,
-	"lower":   strLower,
-	"match":   strMatch,
-	"rep":     strRep,
-	"reverse": strReverse,
-	"sub":     strSub,
-	"upper":   strUpper,
+	"byte":     strByte,
+	"char":     strChar,
+	"dump":     strDump,
+	"find":     strFind,
+	"format":   strFormat,
+	"gsub":     strGsub,
+	"len":      strLen,
+	"lower":    strLower,
+	"match":    strMatch,
+	"pack":     strPack,
+	"packsize": strPackSize,
+	"rep":      strRep,
+	"reverse":  strReverse,
+	"sub":      strSub,
+	"unpack":   strUnpack,
+	"upper":    strUpper,
 }
 
 func strByte(L *LState) int {
@@ -79,7 +86,7 @@ func strChar(L *LState) int {
 		bytes[i-1] = uint8(L.CheckInt(i))
 	}
 	result := string(bytes)
-	L.TrackAlloc(int64(len(result)))
+	L.trackString(len(result))
 	L.Push(LString(result))
 	return 1
 }
@@ -114,10 +121,7 @@ func strFind(L *LState) int {
 		return 2
 	}
 
-	mds, err := pm.Find(pattern, unsafeFastStringToReadOnlyBytes(str), init, 1)
-	if err != nil {
-		L.RaiseError(err.Error())
-	}
+	mds := patternFind(L, pattern, unsafeFastStringToReadOnlyBytes(str), init, 1)
 	if len(mds) == 0 {
 		L.Push(LNil)
 		return 1
@@ -130,7 +134,7 @@ func strFind(L *LState) int {
 			L.Push(LNumber(md.Capture(i)))
 		} else {
 			capture := str[md.Capture(i):md.Capture(i+1)]
-			L.TrackAlloc(int64(len(capture)))
+			L.trackString(len(capture))
 			L.Push(LString(capture))
 		}
 	}
@@ -144,13 +148,178 @@ func strFormat(L *LState) int {
 	for i := 2; i <= top; i++ {
 		args[i-2] = L.Get(i)
 	}
+	if L.Options.CompatFlags&CompatStrictIntegerFormat != 0 {
+		checkIntegerFormat(L, str)
+	}
+	bound := formatSizeBound(str, args) + L.sizing().StringHeader
+	if err := L.checkFits(bound); err != nil {
+		L.raiseNotFitting(err, bound)
+	}
+	formatConversions(str, func(verb byte, arg int) {
+		if verb == 'q' && arg-2 < len(args) {
+			args[arg-2] = quotedArg(quoteLiteral(L, arg))
+		}
+	})
 	npat := strings.Count(str, "%") - strings.Count(str, "%%")
 	result := fmt.Sprintf(str, args[:intMin(npat, len(args))]...)
-	L.TrackAlloc(int64(len(result)))
+	L.trackString(len(result))
+	if L.G.taint != nil {
+		tainted := false
+		for i := 1; i <= top; i++ {
+			tainted = tainted || L.IsTainted(L.Get(i))
+		}
+		L.propagateTaint(result, tainted)
+	}
 	L.Push(LString(result))
 	return 1
 }
 
+// formatConversions calls fn with the verb of every conversion of format
+// and the stack index of its argument.
+func formatConversions(format string, fn func(verb byte, arg int)) {
+	arg := 2
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) || format[i] == '%' {
+			continue
+		}
+		fn(format[i], arg)
+		arg++
+	}
+}
+
+// checkIntegerFormat raises an error if an integer conversion of format gets
+// a number that has no integer representation.
+func checkIntegerFormat(L *LState, format string) {
+	formatConversions(format, func(verb byte, arg int) {
+		if strings.IndexByte("dioxXc", verb) >= 0 {
+			if n, ok := L.Get(arg).(LNumber); ok && !isInteger(n) {
+				L.ArgError(arg, "number has no integer representation")
+			}
+		}
+	})
+}
+
+// quotedArg is an argument of string.format that %q writes as is.
+type quotedArg string
+
+func (q quotedArg) Format(f fmt.State, c rune) {
+	io.WriteString(f, string(q))
+}
+
+// quoteLiteral returns the argument n of string.format as a literal that
+// reads back as the same value, for %q: strings are quoted and escaped like
+// PUC Lua does, with decimal escapes for control characters.
+func quoteLiteral(L *LState, n int) string {
+	switch lv := L.Get(n).(type) {
+	case LString:
+		var buf strings.Builder
+		buf.WriteByte('"')
+		for i := 0; i < len(lv); i++ {
+			switch c := lv[i]; {
+			case c == '"' || c == '\\' || c == '\n':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case c < 0x20 || c == 0x7f:
+				if i+1 < len(lv) && '0' <= lv[i+1] && lv[i+1] <= '9' {
+					fmt.Fprintf(&buf, "\\%03d", c)
+				} else {
+					fmt.Fprintf(&buf, "\\%d", c)
+				}
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		buf.WriteByte('"')
+		return buf.String()
+	case LNumber:
+		switch v := float64(lv); {
+		case math.IsInf(v, 1):
+			return "1e9999"
+		case math.IsInf(v, -1):
+			return "-1e9999"
+		case math.IsNaN(v):
+			return "(0/0)"
+		case isInteger(lv):
+			return strconv.FormatInt(int64(lv), 10)
+		default:
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	case *LNilType, LBool:
+		return lv.String()
+	}
+	L.ArgError(n, "value has no literal form")
+	return ""
+}
+
+// formatSizeBound returns an upper bound of the length of the result of
+// formatting args with format, so that a huge width or precision fails
+// before the result is built.
+func formatSizeBound(format string, args []interface{}) int64 {
+	size, arg := int64(len(format)), 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		var num int64
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			if c := format[i]; c >= '0' && c <= '9' {
+				// fmt rejects widths and precisions above 1e6
+				num = min(num*10+int64(c-'0'), 1e6)
+			} else {
+				size += num
+				num = 0
+			}
+			i++
+		}
+		size += num
+		if i >= len(format) || format[i] == '%' {
+			continue
+		}
+		if arg < len(args) {
+			switch v := args[arg].(type) {
+			case LString:
+				size += int64(len(v))
+				if format[i] == 'q' {
+					// the quotes, and an escape of up to 4 bytes for
+					// every byte
+					size += int64(len(v))*3 + 2
+				}
+			case LNumber:
+				// the digits of the integer part, which %f prints in full
+				size += 24
+				if a := math.Abs(float64(v)); a >= 1 && !math.IsInf(a, 0) {
+					size += int64(math.Log10(a)) + 1
+				}
+			default:
+				size += 64
+			}
+		}
+		arg++
+	}
+	return size
+}
+
+// patternFind runs pm.FindWithStepLimit with the step limit of L and
+// raises its errors in L.
+func patternFind(L *LState, pattern string, src []byte, offset, limit int) []*pm.MatchData {
+	mds, err := pm.FindWithStepLimit(pattern, src, offset, limit, L.G.patternSteps)
+	if err == pm.ErrStepLimit {
+		L.raiseTypedError(&LimitError{Resource: "pattern steps", Limit: L.G.patternSteps, Value: L.G.patternSteps + 1},
+			"pattern step limit exceeded: matching %q took more than %d steps", pattern, L.G.patternSteps)
+	} else if err != nil {
+		L.RaiseError(err.Error())
+	}
+	return mds
+}
+
 func strGsub(L *LState) int {
 	str := L.CheckString(1)
 	pat := L.CheckString(2)
@@ -158,25 +327,43 @@ func strGsub(L *LState) int {
 	repl := L.CheckAny(3)
 	limit := L.OptInt(4, -1)
 
-	mds, err := pm.Find(pat, unsafeFastStringToReadOnlyBytes(str), 0, limit)
-	if err != nil {
-		L.RaiseError(err.Error())
-	}
+	mds := patternFind(L, pat, unsafeFastStringToReadOnlyBytes(str), 0, limit)
 	if len(mds) == 0 {
 		L.SetTop(1)
 		L.Push(LNumber(0))
 		return 2
 	}
-	var result string
+	// the matches and the replacements are held until the result is built
+	scratch := int64(len(mds)) * (int64(unsafe.Sizeof(pm.MatchData{})+unsafe.Sizeof(replaceInfo{})) + 8)
+	for _, md := range mds {
+		scratch += int64(md.CaptureLength()) * 4
+	}
+	L.trackAlloc(AllocString, scratch)
+	defer L.releaseAlloc(scratch)
+
+	var info []replaceInfo
+	tainted := L.IsTainted(LString(str)) || L.IsTainted(repl)
 	switch lv := repl.(type) {
 	case LString:
-		result = strGsubStr(L, str, string(lv), mds)
+		info = strGsubStr(L, str, string(lv), mds)
 	case *LTable:
-		result = strGsubTable(L, str, lv, mds)
+		info = strGsubTable(L, str, lv, mds, &tainted)
 	case *LFunction:
-		result = strGsubFunc(L, str, lv, mds)
+		info = strGsubFunc(L, str, lv, mds, &tainted)
+	}
+	size := len(str)
+	repls := 0
+	for _, replace := range info {
+		size += len(replace.String) - (replace.Indicies[1] - replace.Indicies[0])
+		repls += len(replace.String)
+	}
+	L.trackAlloc(AllocString, int64(repls)+L.sizing().StringHeader)
+	defer L.releaseAlloc(int64(repls) + L.sizing().StringHeader)
+	L.trackString(size)
+	result := strGsubDoReplace(str, info, size)
+	if L.G.taint != nil {
+		L.propagateTaint(result, tainted)
 	}
-	L.TrackAlloc(int64(len(result)))
 	L.Push(LString(result))
 	L.Push(LNumber(len(mds)))
 	return 2
@@ -209,25 +396,22 @@ func capturedString(L *LState, m *pm.MatchData, str string, idx int) string {
 
 }
 
-func strGsubDoReplace(str string, info []replaceInfo) string {
-	offset := 0
-	buf := []byte(str)
+// strGsubDoReplace replaces the matches of str listed by info, in order,
+// building a result of size bytes.
+func strGsubDoReplace(str string, info []replaceInfo, size int) string {
+	var buf strings.Builder
+	buf.Grow(size)
+	last := 0
 	for _, replace := range info {
-		oldlen := len(buf)
-		b1 := append([]byte(""), buf[0:offset+replace.Indicies[0]]...)
-		b2 := []byte("")
-		index2 := offset + replace.Indicies[1]
-		if index2 <= len(buf) {
-			b2 = append(b2, buf[index2:len(buf)]...)
-		}
-		buf = append(b1, replace.String...)
-		buf = append(buf, b2...)
-		offset += len(buf) - oldlen
+		buf.WriteString(str[last:replace.Indicies[0]])
+		buf.WriteString(replace.String)
+		last = replace.Indicies[1]
 	}
-	return string(buf)
+	buf.WriteString(str[last:])
+	return buf.String()
 }
 
-func strGsubStr(L *LState, str string, repl string, matches []*pm.MatchData) string {
+func strGsubStr(L *LState, str string, repl string, matches []*pm.MatchData) []replaceInfo {
 	infoList := make([]replaceInfo, 0, len(matches))
 	for _, match := range matches {
 		start, end := match.Capture(0), match.Capture(1)
@@ -250,10 +434,10 @@ func strGsubStr(L *LState, str string, repl string, matches []*pm.MatchData) str
 		infoList = append(infoList, replaceInfo{[]int{start, end}, sc.String()})
 	}
 
-	return strGsubDoReplace(str, infoList)
+	return infoList
 }
 
-func strGsubTable(L *LState, str string, repl *LTable, matches []*pm.MatchData) string {
+func strGsubTable(L *LState, str string, repl *LTable, matches []*pm.MatchData, tainted *bool) []replaceInfo {
 	infoList := make([]replaceInfo, 0, len(matches))
 	for _, match := range matches {
 		idx := 0
@@ -267,13 +451,14 @@ func strGsubTable(L *LState, str string, repl *LTable, matches []*pm.MatchData)
 			value = L.GetField(repl, str[match.Capture(idx):match.Capture(idx+1)])
 		}
 		if !LVIsFalse(value) {
+			*tainted = *tainted || L.IsTainted(value)
 			infoList = append(infoList, replaceInfo{[]int{match.Capture(0), match.Capture(1)}, LVAsString(value)})
 		}
 	}
-	return strGsubDoReplace(str, infoList)
+	return infoList
 }
 
-func strGsubFunc(L *LState, str string, repl *LFunction, matches []*pm.MatchData) string {
+func strGsubFunc(L *LState, str string, repl *LFunction, matches []*pm.MatchData, tainted *bool) []replaceInfo {
 	infoList := make([]replaceInfo, 0, len(matches))
 	for _, match := range matches {
 		start, end := match.Capture(0), match.Capture(1)
@@ -295,10 +480,11 @@ func strGsubFunc(L *LState, str string, repl *LFunction, matches []*pm.MatchData
 		L.Call(nargs, 1)
 		ret := L.reg.Pop()
 		if !LVIsFalse(ret) {
+			*tainted = *tainted || L.IsTainted(ret)
 			infoList = append(infoList, replaceInfo{[]int{start, end}, LVAsString(ret)})
 		}
 	}
-	return strGsubDoReplace(str, infoList)
+	return infoList
 }
 
 type strMatchData struct {
@@ -320,7 +506,7 @@ func strGmatchIter(L *LState) int {
 	match := matches[idx]
 	if match.CaptureLength() == 2 {
 		capture := str[match.Capture(0):match.Capture(1)]
-		L.TrackAlloc(int64(len(capture)))
+		L.trackString(len(capture))
 		L.Push(LString(capture))
 		return 1
 	}
@@ -330,19 +516,37 @@ func strGmatchIter(L *LState) int {
 			L.Push(LNumber(match.Capture(i)))
 		} else {
 			capture := str[match.Capture(i):match.Capture(i+1)]
-			L.TrackAlloc(int64(len(capture)))
+			L.trackString(len(capture))
 			L.Push(LString(capture))
 		}
 	}
 	return match.CaptureLength()/2 - 1
 }
 
+// strGmatch implements string.gmatch(s, pattern [, init]) of Lua 5.4: a '^'
+// at the start of pattern is not an anchor but matches itself, and an empty
+// match right after the previous match is skipped.
 func strGmatch(L *LState) int {
 	str := L.CheckString(1)
 	pattern := L.CheckString(2)
-	mds, err := pm.Find(pattern, []byte(str), 0, -1)
-	if err != nil {
-		L.RaiseError(err.Error())
+	pos := intMin(luaIndex2StringIndex(str, L.OptInt(3, 1), true), len(str))
+	if strings.HasPrefix(pattern, "^") {
+		pattern = "%" + pattern
+	}
+	src := []byte(str)
+	mds := []*pm.MatchData{}
+	for lastmatch := -1; pos <= len(str); {
+		found := patternFind(L, pattern, src, pos, 1)
+		if len(found) == 0 {
+			break
+		}
+		md := found[0]
+		if md.Capture(1) == lastmatch {
+			pos = md.Capture(0) + 1
+			continue
+		}
+		mds = append(mds, md)
+		pos, lastmatch = md.Capture(1), md.Capture(1)
 	}
 	L.Push(L.Get(UpvalueIndex(1)))
 	ud := L.NewUserData()
@@ -360,7 +564,10 @@ func strLen(L *LState) int {
 func strLower(L *LState) int {
 	str := L.CheckString(1)
 	result := strings.ToLower(str)
-	L.TrackAlloc(int64(len(result)))
+	L.trackString(len(result))
+	if L.G.taint != nil {
+		L.propagateTaint(result, L.IsTainted(LString(str)))
+	}
 	L.Push(LString(result))
 	return 1
 }
@@ -378,10 +585,7 @@ func strMatch(L *LState) int {
 		offset = 0
 	}
 
-	mds, err := pm.Find(pattern, unsafeFastStringToReadOnlyBytes(str), offset, 1)
-	if err != nil {
-		L.RaiseError(err.Error())
-	}
+	mds := patternFind(L, pattern, unsafeFastStringToReadOnlyBytes(str), offset, 1)
 	if len(mds) == 0 {
 		L.Push(LNil)
 		return 0
@@ -391,7 +595,7 @@ func strMatch(L *LState) int {
 	switch nsubs {
 	case 1:
 		capture := str[md.Capture(0):md.Capture(1)]
-		L.TrackAlloc(int64(len(capture)))
+		L.trackString(len(capture))
 		L.Push(LString(capture))
 		return 1
 	default:
@@ -400,7 +604,7 @@ func strMatch(L *LState) int {
 				L.Push(LNumber(md.Capture(i)))
 			} else {
 				capture := str[md.Capture(i):md.Capture(i+1)]
-				L.TrackAlloc(int64(len(capture)))
+				L.trackString(len(capture))
 				L.Push(LString(capture))
 			}
 		}
@@ -414,8 +618,14 @@ func strRep(L *LState) int {
 	if n < 0 {
 		L.Push(emptyLString)
 	} else {
-		L.TrackAlloc(int64(len(str) * n))
+		if len(str) > 0 && n > math.MaxInt/len(str) {
+			L.RaiseError("resulting string too large")
+		}
+		L.reserveString(len(str) * n)
 		result := strings.Repeat(str, n)
+		if L.G.taint != nil {
+			L.propagateTaint(result, L.IsTainted(LString(str)))
+		}
 		L.Push(LString(result))
 	}
 	return 1
@@ -429,7 +639,10 @@ func strReverse(L *LState) int {
 		out[i] = bts[j]
 	}
 	result := string(out)
-	L.TrackAlloc(int64(len(result)))
+	L.trackString(len(result))
+	if L.G.taint != nil {
+		L.propagateTaint(result, L.IsTainted(LString(str)))
+	}
 	L.Push(LString(result))
 	return 1
 }
@@ -443,7 +656,7 @@ func strSub(L *LState) int {
 		L.Push(emptyLString)
 	} else {
 		result := str[start:end]
-		L.TrackAlloc(int64(len(result)))
+		L.trackString(len(result))
 		L.Push(LString(result))
 	}
 	return 1
@@ -452,7 +665,10 @@ func strSub(L *LState) int {
 func strUpper(L *LState) int {
 	str := L.CheckString(1)
 	result := strings.ToUpper(str)
-	L.TrackAlloc(int64(len(result)))
+	L.trackString(len(result))
+	if L.G.taint != nil {
+		L.propagateTaint(result, L.IsTainted(LString(str)))
+	}
 	L.Push(LString(result))
 	return 1
 }
@@ -0,0 +1,372 @@
+package lua
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+/* string.pack {{{ */
+
+// packMaxIntSize is the largest size of an integer in a pack format.
+const packMaxIntSize = 16
+
+// packMaxAlign is the default maximum alignment of the '!' option.
+const packMaxAlign = 8
+
+var packNativeLittle = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+type packOptKind int
+
+const (
+	packInt       packOptKind = iota // signed integer
+	packUint                         // unsigned integer
+	packFloat                        // float
+	packDouble                       // double
+	packChar                         // fixed-length string
+	packString                       // string preceded by its length
+	packZstr                         // zero-terminated string
+	packPadding                      // padding byte
+	packPaddAlign                    // padding to an alignment
+	packNop                          // no-op, e.g. endianness
+)
+
+// packFormat reads the options of a format of string.pack, string.unpack
+// and string.packsize.
+type packFormat struct {
+	L        *LState
+	fmt      string
+	little   bool
+	maxAlign int
+}
+
+func newPackFormat(L *LState, fmt string) *packFormat {
+	return &packFormat{L: L, fmt: fmt, little: packNativeLittle, maxAlign: 1}
+}
+
+func (pf *packFormat) more() bool {
+	return len(pf.fmt) > 0
+}
+
+func (pf *packFormat) readNum(df int) int {
+	isDigit := func() bool { return len(pf.fmt) > 0 && '0' <= pf.fmt[0] && pf.fmt[0] <= '9' }
+	if !isDigit() {
+		return df
+	}
+	n := 0
+	for isDigit() && n <= (math.MaxInt32-9)/10 {
+		n = n*10 + int(pf.fmt[0]-'0')
+		pf.fmt = pf.fmt[1:]
+	}
+	return n
+}
+
+func (pf *packFormat) readNumLimit(df int) int {
+	n := pf.readNum(df)
+	if n > packMaxIntSize || n <= 0 {
+		pf.L.RaiseError("integral size (%d) out of limits [1,%d]", n, packMaxIntSize)
+	}
+	return n
+}
+
+// option reads the next option and returns its kind and size.
+func (pf *packFormat) option() (packOptKind, int) {
+	opt := pf.fmt[0]
+	pf.fmt = pf.fmt[1:]
+	switch opt {
+	case 'b':
+		return packInt, 1
+	case 'B':
+		return packUint, 1
+	case 'h':
+		return packInt, 2
+	case 'H':
+		return packUint, 2
+	case 'l', 'j':
+		return packInt, 8
+	case 'L', 'J', 'T':
+		return packUint, 8
+	case 'f':
+		return packFloat, 4
+	case 'd', 'n':
+		return packDouble, 8
+	case 'i':
+		return packInt, pf.readNumLimit(4)
+	case 'I':
+		return packUint, pf.readNumLimit(4)
+	case 's':
+		return packString, pf.readNumLimit(8)
+	case 'c':
+		size := pf.readNum(-1)
+		if size == -1 {
+			pf.L.RaiseError("missing size for format option 'c'")
+		}
+		return packChar, size
+	case 'z':
+		return packZstr, 0
+	case 'x':
+		return packPadding, 1
+	case 'X':
+		return packPaddAlign, 0
+	case ' ':
+	case '<':
+		pf.little = true
+	case '>':
+		pf.little = false
+	case '=':
+		pf.little = packNativeLittle
+	case '!':
+		pf.maxAlign = pf.readNumLimit(packMaxAlign)
+	default:
+		pf.L.RaiseError("invalid format option '%c'", opt)
+	}
+	return packNop, 0
+}
+
+// details reads the next option and returns its kind, its size and the
+// number of padding bytes that align it, given the size of the data so far.
+func (pf *packFormat) details(total int) (packOptKind, int, int) {
+	kind, size := pf.option()
+	align := size
+	if kind == packPaddAlign {
+		if len(pf.fmt) == 0 {
+			pf.L.ArgError(1, "invalid next option for option 'X'")
+		}
+		var k packOptKind
+		k, align = pf.option()
+		if k == packChar || align == 0 {
+			pf.L.ArgError(1, "invalid next option for option 'X'")
+		}
+	}
+	ntoalign := 0
+	if align > 1 && kind != packChar {
+		if align > pf.maxAlign {
+			align = pf.maxAlign
+		}
+		if align&(align-1) != 0 {
+			pf.L.ArgError(1, "format asks for alignment not power of 2")
+		}
+		ntoalign = (align - total&(align-1)) & (align - 1)
+	}
+	return kind, size, ntoalign
+}
+
+func packInteger(buf []byte, v uint64, little bool, size int, negative bool) []byte {
+	b := make([]byte, size)
+	for i := 0; i < size; i++ {
+		var c byte
+		if i < 8 {
+			c = byte(v >> (8 * uint(i)))
+		} else if negative {
+			c = 0xff
+		}
+		if little {
+			b[i] = c
+		} else {
+			b[size-1-i] = c
+		}
+	}
+	return append(buf, b...)
+}
+
+func unpackInteger(L *LState, data string, little bool, size int, signed bool) int64 {
+	var res uint64
+	limit := size
+	if limit > 8 {
+		limit = 8
+	}
+	for i := limit - 1; i >= 0; i-- {
+		res <<= 8
+		if little {
+			res |= uint64(data[i])
+		} else {
+			res |= uint64(data[size-1-i])
+		}
+	}
+	if size < 8 {
+		if signed {
+			mask := uint64(1) << (uint(size)*8 - 1)
+			res = (res ^ mask) - mask
+		}
+	} else if size > 8 {
+		var fill byte
+		if signed && int64(res) < 0 {
+			fill = 0xff
+		}
+		for i := limit; i < size; i++ {
+			c := data[i]
+			if !little {
+				c = data[size-1-i]
+			}
+			if c != fill {
+				L.RaiseError("%d-byte integer does not fit into Lua Integer", size)
+			}
+		}
+	}
+	return int64(res)
+}
+
+// packedSize returns the length of the string packed by string.pack, so that
+// it can be reserved before the string is built.
+func packedSize(L *LState) int {
+	pf := newPackFormat(L, L.CheckString(1))
+	total, arg := 0, 1
+	for pf.more() {
+		kind, size, ntoalign := pf.details(total)
+		total += ntoalign + size
+		switch kind {
+		case packInt, packUint, packFloat, packDouble, packChar:
+			arg++
+		case packString:
+			arg++
+			total += len(L.CheckString(arg))
+		case packZstr:
+			arg++
+			total += len(L.CheckString(arg)) + 1
+		}
+		if total > math.MaxInt32 {
+			L.RaiseError("format result too large")
+		}
+	}
+	return total
+}
+
+func strPack(L *LState) int {
+	total := packedSize(L)
+	L.reserveString(total)
+	pf := newPackFormat(L, L.CheckString(1))
+	buf := make([]byte, 0, total)
+	arg := 1
+	for pf.more() {
+		kind, size, ntoalign := pf.details(len(buf))
+		buf = append(buf, make([]byte, ntoalign)...)
+		switch kind {
+		case packInt, packUint:
+			arg++
+			n, ok := luaToInteger(L.CheckNumber(arg))
+			if !ok {
+				L.ArgError(arg, "number has no integer representation")
+			}
+			if size < 8 {
+				if kind == packInt {
+					lim := int64(1) << (uint(size)*8 - 1)
+					if n < -lim || n >= lim {
+						L.ArgError(arg, "integer overflow")
+					}
+				} else if uint64(n) >= uint64(1)<<(uint(size)*8) {
+					L.ArgError(arg, "unsigned overflow")
+				}
+			}
+			buf = packInteger(buf, uint64(n), pf.little, size, n < 0)
+		case packFloat:
+			arg++
+			bits := math.Float32bits(float32(L.CheckNumber(arg)))
+			buf = packInteger(buf, uint64(bits), pf.little, size, false)
+		case packDouble:
+			arg++
+			bits := math.Float64bits(float64(L.CheckNumber(arg)))
+			buf = packInteger(buf, bits, pf.little, size, false)
+		case packChar:
+			arg++
+			s := L.CheckString(arg)
+			if len(s) > size {
+				L.ArgError(arg, "string longer than given size")
+			}
+			buf = append(buf, s...)
+			buf = append(buf, make([]byte, size-len(s))...)
+		case packString:
+			arg++
+			s := L.CheckString(arg)
+			if size < 8 && uint64(len(s)) >= uint64(1)<<(uint(size)*8) {
+				L.ArgError(arg, "string length does not fit in given size")
+			}
+			buf = packInteger(buf, uint64(len(s)), pf.little, size, false)
+			buf = append(buf, s...)
+		case packZstr:
+			arg++
+			s := L.CheckString(arg)
+			if strings.IndexByte(s, 0) >= 0 {
+				L.ArgError(arg, "string contains zeros")
+			}
+			buf = append(buf, s...)
+			buf = append(buf, 0)
+		case packPadding:
+			buf = append(buf, 0)
+		}
+	}
+	L.Push(LString(buf))
+	return 1
+}
+
+func strPackSize(L *LState) int {
+	pf := newPackFormat(L, L.CheckString(1))
+	total := 0
+	for pf.more() {
+		kind, size, ntoalign := pf.details(total)
+		if kind == packString || kind == packZstr {
+			L.ArgError(1, "variable-length format")
+		}
+		total += ntoalign + size
+		if total > math.MaxInt32 {
+			L.ArgError(1, "format result too large")
+		}
+	}
+	L.Push(LNumber(total))
+	return 1
+}
+
+func strUnpack(L *LState) int {
+	pf := newPackFormat(L, L.CheckString(1))
+	data := L.CheckString(2)
+	pos := luaIndex2StringIndex(data, L.OptInt(3, 1), true)
+	if pos > len(data) {
+		L.ArgError(3, "initial position out of string")
+	}
+	n := 0
+	for pf.more() {
+		kind, size, ntoalign := pf.details(pos)
+		if ntoalign+size > len(data)-pos {
+			L.ArgError(2, "data string too short")
+		}
+		pos += ntoalign
+		n++
+		switch kind {
+		case packInt, packUint:
+			L.Push(LNumber(unpackInteger(L, data[pos:], pf.little, size, kind == packInt)))
+		case packFloat:
+			bits := unpackInteger(L, data[pos:], pf.little, size, false)
+			L.Push(LNumber(math.Float32frombits(uint32(bits))))
+		case packDouble:
+			bits := unpackInteger(L, data[pos:], pf.little, size, false)
+			L.Push(LNumber(math.Float64frombits(uint64(bits))))
+		case packChar:
+			L.trackString(size)
+			L.Push(LString(data[pos : pos+size]))
+		case packString:
+			l := uint64(unpackInteger(L, data[pos:], pf.little, size, false))
+			if l > uint64(len(data)-pos-size) {
+				L.ArgError(2, "data string too short")
+			}
+			s := data[pos+size : pos+size+int(l)]
+			L.trackString(len(s))
+			L.Push(LString(s))
+			pos += int(l)
+		case packZstr:
+			l := strings.IndexByte(data[pos:], 0)
+			if l < 0 {
+				L.ArgError(2, "unfinished string for format 'z'")
+			}
+			s := data[pos : pos+l]
+			L.trackString(len(s))
+			L.Push(LString(s))
+			pos += l + 1
+		default:
+			n--
+		}
+		pos += size
+	}
+	L.Push(LNumber(pos + 1))
+	return n + 1
+}
+
+/* }}} */
@@ -0,0 +1,77 @@
+package lua
+
+import (
+	"sync"
+	"unsafe"
+)
+
+/* shared strings {{{ */
+
+var sharedStrings = struct {
+	sync.RWMutex
+	pool   map[string]string
+	minLen int
+}{pool: map[string]string{}}
+
+// ShareString adds s to a process-wide pool of immutable strings and returns
+// the pooled copy. Hosts use it for large constants pushed into many states,
+// such as lookup blobs: every state then references the same bytes. String
+// constants equal to a pooled string in scripts compiled or loaded afterwards,
+// by any LState, reuse the pooled copy too, so preloaded module sources
+// holding large literals are stored once.
+//
+// EstimateSize charges a state only for the string header of a pooled
+// string, and reports its length in SizeEstimate.SharedStrings.
+func ShareString(s string) LString {
+	sharedStrings.Lock()
+	defer sharedStrings.Unlock()
+	if pooled, ok := sharedStrings.pool[s]; ok {
+		return LString(pooled)
+	}
+	sharedStrings.pool[s] = s
+	if sharedStrings.minLen == 0 || len(s) < sharedStrings.minLen {
+		sharedStrings.minLen = len(s)
+	}
+	return LString(s)
+}
+
+// UnshareString removes s from the pool of shared strings. States that
+// already reference the pooled copy keep it.
+func UnshareString(s string) {
+	sharedStrings.Lock()
+	defer sharedStrings.Unlock()
+	delete(sharedStrings.pool, s)
+	if len(sharedStrings.pool) == 0 {
+		sharedStrings.minLen = 0
+	}
+}
+
+// sharedString returns the pooled copy of s, or s if it is not pooled.
+func sharedString(s string) string {
+	sharedStrings.RLock()
+	defer sharedStrings.RUnlock()
+	if sharedStrings.minLen == 0 || len(s) < sharedStrings.minLen {
+		return s
+	}
+	if pooled, ok := sharedStrings.pool[s]; ok {
+		return pooled
+	}
+	return s
+}
+
+// isSharedString reports whether s is the pooled copy itself rather than an
+// equal string.
+func isSharedString(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	sharedStrings.RLock()
+	defer sharedStrings.RUnlock()
+	if len(s) < sharedStrings.minLen {
+		return false
+	}
+	pooled, ok := sharedStrings.pool[s]
+	return ok && unsafe.StringData(pooled) == unsafe.StringData(s)
+}
+
+/* }}} */
@@ -1,6 +1,8 @@
 package lua
 
-import "unsafe"
+import (
+	"sort"
+)
 
 const defaultArrayCap = 32
 const defaultHashCap = 32
@@ -43,23 +45,17 @@ func (ls *LState) newLTable(acap int, hcap int) *LTable {
 
 	// Calculate memory allocation size
 	// Base struct + array slice + hash map
-	size := int64(unsafe.Sizeof(LTable{}))
-	if acap != 0 {
-		// LValue is an interface: 16 bytes (2 pointers) on 64-bit
-		size += int64(acap) * 16
-	}
-	if hcap != 0 {
-		// Map overhead: approximately 48 bytes per entry for string -> LValue map
-		size += int64(hcap) * 48
-	}
+	m := ls.sizing()
+	size := m.Table + int64(acap)*m.ArraySlot + int64(hcap)*m.HashEntry
 
 	// Track allocation before creating the table
-	ls.TrackAlloc(size)
+	ls.trackAlloc(AllocTable, size)
 
 	tb := &LTable{}
 	tb.Metatable = LNil
 	tb.ls = ls
 	tb.allocBytes = size
+	tb.hashCap = hcap
 
 	if acap != 0 {
 		tb.array = make([]LValue, 0, acap)
@@ -96,10 +92,38 @@ func (tb *LTable) trackGrowth(additionalBytes int64) {
 	if tb.ls == nil {
 		return // No tracking if not associated with LState
 	}
-	tb.ls.TrackAlloc(additionalBytes)
+	tb.ls.trackAlloc(AllocTable, additionalBytes)
 	tb.allocBytes += additionalBytes
 }
 
+// trackArrayGrowth tracks the growth of the array part by slots.
+func (tb *LTable) trackArrayGrowth(slots int) {
+	if tb.ls != nil && slots > 0 {
+		tb.trackGrowth(int64(slots) * tb.ls.sizing().ArraySlot)
+	}
+}
+
+// trackHashGrowth tracks the growth of the hash part by entries.
+func (tb *LTable) trackHashGrowth(entries int) {
+	if tb.ls != nil && entries > 0 {
+		tb.trackGrowth(int64(entries) * tb.ls.sizing().HashEntry)
+	}
+}
+
+// growHash tracks memory allocation for a new key of the hash part. The
+// charged capacity doubles when it is exhausted, like the array part.
+func (tb *LTable) growHash() {
+	if tb.ls == nil || len(tb.keys) < tb.hashCap {
+		return
+	}
+	newCap := tb.hashCap * 2
+	if newCap < defaultHashCap {
+		newCap = defaultHashCap
+	}
+	tb.trackHashGrowth(newCap - tb.hashCap)
+	tb.hashCap = newCap
+}
+
 // checkWritable raises a Lua error if this table is marked readonly and the
 // table's owner LState is not inside a WithTableReadOnlyBypass scope. It is
 // used by the public LTable mutation methods (RawSet, RawSetString, Insert,
@@ -155,18 +179,18 @@ func (tb *LTable) append(value LValue) {
 		return
 	}
 	if tb.array == nil {
-		tb.trackGrowth(int64(defaultArrayCap) * 16)
+		tb.trackArrayGrowth(defaultArrayCap)
 		tb.array = make([]LValue, 0, defaultArrayCap)
 	}
 	if len(tb.array) == 0 || tb.array[len(tb.array)-1] != LNil {
+		tb.checkEntries(1)
 		// Track growth if append will exceed capacity
 		if len(tb.array) >= cap(tb.array) {
 			newCap := cap(tb.array) * 2
 			if newCap == 0 {
 				newCap = 1
 			}
-			additionalBytes := int64(newCap-cap(tb.array)) * 16
-			tb.trackGrowth(additionalBytes)
+			tb.trackArrayGrowth(newCap - cap(tb.array))
 		}
 		tb.array = append(tb.array, value)
 	} else {
@@ -190,7 +214,7 @@ func (tb *LTable) Insert(i int, value LValue) {
 // already gated on (*LState).checkTableWritable or (*LTable).checkWritable.
 func (tb *LTable) insert(i int, value LValue) {
 	if tb.array == nil {
-		tb.trackGrowth(int64(defaultArrayCap) * 16)
+		tb.trackArrayGrowth(defaultArrayCap)
 		tb.array = make([]LValue, 0, defaultArrayCap)
 	}
 	if i > len(tb.array) {
@@ -202,14 +226,14 @@ func (tb *LTable) insert(i int, value LValue) {
 		return
 	}
 	i -= 1
+	tb.checkEntries(1)
 	// Track growth if append will exceed capacity
 	if len(tb.array) >= cap(tb.array) {
 		newCap := cap(tb.array) * 2
 		if newCap == 0 {
 			newCap = 1
 		}
-		additionalBytes := int64(newCap-cap(tb.array)) * 16
-		tb.trackGrowth(additionalBytes)
+		tb.trackArrayGrowth(newCap - cap(tb.array))
 	}
 	tb.array = append(tb.array, LNil)
 	copy(tb.array[i+1:], tb.array[i:])
@@ -277,24 +301,25 @@ func (tb *LTable) rawSet(key LValue, value LValue) {
 	case LNumber:
 		if isArrayKey(v) {
 			if tb.array == nil {
-				tb.trackGrowth(int64(defaultArrayCap) * 16)
+				tb.trackArrayGrowth(defaultArrayCap)
 				tb.array = make([]LValue, 0, defaultArrayCap)
 			}
 			index := int(v) - 1
 			alen := len(tb.array)
 			switch {
 			case index == alen:
+				tb.checkEntries(1)
 				// Track growth if append will exceed capacity
 				if len(tb.array) >= cap(tb.array) {
 					newCap := cap(tb.array) * 2
 					if newCap == 0 {
 						newCap = 1
 					}
-					additionalBytes := int64(newCap-cap(tb.array)) * 16
-					tb.trackGrowth(additionalBytes)
+					tb.trackArrayGrowth(newCap - cap(tb.array))
 				}
 				tb.array = append(tb.array, value)
 			case index > alen:
+				tb.checkEntries(index + 1 - alen)
 				neededLen := index + 1
 				if neededLen > cap(tb.array) {
 					newCap := cap(tb.array)
@@ -304,8 +329,7 @@ func (tb *LTable) rawSet(key LValue, value LValue) {
 					for newCap < neededLen {
 						newCap *= 2
 					}
-					additionalBytes := int64(newCap-cap(tb.array)) * 16
-					tb.trackGrowth(additionalBytes)
+					tb.trackArrayGrowth(newCap - cap(tb.array))
 				}
 				for i := 0; i < (index - alen); i++ {
 					tb.array = append(tb.array, LNil)
@@ -339,24 +363,25 @@ func (tb *LTable) rawSetInt(key int, value LValue) {
 		return
 	}
 	if tb.array == nil {
-		tb.trackGrowth(int64(32) * 16)
+		tb.trackArrayGrowth(32)
 		tb.array = make([]LValue, 0, 32)
 	}
 	index := key - 1
 	alen := len(tb.array)
 	switch {
 	case index == alen:
+		tb.checkEntries(1)
 		// Track growth if append will exceed capacity
 		if len(tb.array) >= cap(tb.array) {
 			newCap := cap(tb.array) * 2
 			if newCap == 0 {
 				newCap = 1
 			}
-			additionalBytes := int64(newCap-cap(tb.array)) * 16
-			tb.trackGrowth(additionalBytes)
+			tb.trackArrayGrowth(newCap - cap(tb.array))
 		}
 		tb.array = append(tb.array, value)
 	case index > alen:
+		tb.checkEntries(index + 1 - alen)
 		neededLen := index + 1
 		if neededLen > cap(tb.array) {
 			newCap := cap(tb.array)
@@ -366,8 +391,7 @@ func (tb *LTable) rawSetInt(key int, value LValue) {
 			for newCap < neededLen {
 				newCap *= 2
 			}
-			additionalBytes := int64(newCap-cap(tb.array)) * 16
-			tb.trackGrowth(additionalBytes)
+			tb.trackArrayGrowth(newCap - cap(tb.array))
 		}
 		for i := 0; i < (index - alen); i++ {
 			tb.array = append(tb.array, LNil)
@@ -389,13 +413,15 @@ func (tb *LTable) RawSetString(key string, value LValue) {
 // (*LTable).checkWritable.
 func (tb *LTable) rawSetString(key string, value LValue) {
 	if tb.strdict == nil {
-		tb.trackGrowth(int64(defaultHashCap) * 48)
 		tb.strdict = make(map[string]LValue, defaultHashCap)
 	}
 	if tb.keys == nil {
-		tb.trackGrowth(int64(defaultHashCap) * 24) // keys array + k2i map overhead
 		tb.keys = []LValue{}
 		tb.k2i = map[LValue]int{}
+		if tb.hashCap == 0 {
+			tb.trackHashGrowth(defaultHashCap)
+			tb.hashCap = defaultHashCap
+		}
 	}
 
 	if value == LNil {
@@ -405,6 +431,8 @@ func (tb *LTable) rawSetString(key string, value LValue) {
 		tb.strdict[key] = value
 		lkey := LString(key)
 		if _, ok := tb.k2i[lkey]; !ok {
+			tb.checkEntries(1)
+			tb.growHash()
 			tb.k2i[lkey] = len(tb.keys)
 			tb.keys = append(tb.keys, lkey)
 		}
@@ -430,13 +458,15 @@ func (tb *LTable) rawSetH(key LValue, value LValue) {
 		if dictCap == 0 {
 			dictCap = defaultHashCap
 		}
-		tb.trackGrowth(int64(dictCap) * 48)
 		tb.dict = make(map[LValue]LValue, dictCap)
 	}
 	if tb.keys == nil {
-		tb.trackGrowth(int64(defaultHashCap) * 24) // keys array + k2i map overhead
 		tb.keys = []LValue{}
 		tb.k2i = map[LValue]int{}
+		if tb.hashCap == 0 {
+			tb.trackHashGrowth(defaultHashCap)
+			tb.hashCap = defaultHashCap
+		}
 	}
 
 	if value == LNil {
@@ -445,6 +475,8 @@ func (tb *LTable) rawSetH(key LValue, value LValue) {
 	} else {
 		tb.dict[key] = value
 		if _, ok := tb.k2i[key]; !ok {
+			tb.checkEntries(1)
+			tb.growHash()
 			tb.k2i[key] = len(tb.keys)
 			tb.keys = append(tb.keys, key)
 		}
@@ -535,6 +567,15 @@ func (tb *LTable) ForEach(cb func(LValue, LValue)) {
 			}
 		}
 	}
+	if order := tb.iterationOrder(); order != IterationUnordered {
+		keys, _ := tb.hashKeys(order)
+		for _, k := range keys {
+			if v := tb.RawGetH(k); v != LNil {
+				cb(k, v)
+			}
+		}
+		return
+	}
 	if tb.strdict != nil {
 		for k, v := range tb.strdict {
 			if v != LNil {
@@ -573,7 +614,8 @@ func (tb *LTable) Next(key LValue) (LValue, LValue) {
 				if (tb.dict == nil || len(tb.dict) == 0) && (tb.strdict == nil || len(tb.strdict) == 0) {
 					return LNil, LNil
 				}
-				key = tb.keys[0]
+				keys, _ := tb.hashKeys(tb.iterationOrder())
+				key = keys[0]
 				if v := tb.RawGetH(key); v != LNil {
 					return key, v
 				}
@@ -581,11 +623,74 @@ func (tb *LTable) Next(key LValue) (LValue, LValue) {
 		}
 	}
 
-	for i := tb.k2i[key] + 1; i < len(tb.keys); i++ {
-		key := tb.keys[i]
+	keys, k2i := tb.hashKeys(tb.iterationOrder())
+	for i := k2i[key] + 1; i < len(keys); i++ {
+		key := keys[i]
 		if v := tb.RawGetH(key); v != LNil {
 			return key, v
 		}
 	}
 	return LNil, LNil
 }
+
+func (tb *LTable) iterationOrder() IterationOrder {
+	if tb.ordered {
+		return IterationInsertion
+	}
+	if tb.ls == nil {
+		return IterationUnordered
+	}
+	return tb.ls.Options.DeterministicIteration
+}
+
+// hashKeys returns the keys of the hash part in iteration order, and a map
+// from each key to its position.
+func (tb *LTable) hashKeys(order IterationOrder) ([]LValue, map[LValue]int) {
+	if order != IterationSorted {
+		return tb.keys, tb.k2i
+	}
+	if len(tb.sorted) != len(tb.keys) {
+		if tb.sorted == nil {
+			tb.trackArrayGrowth(len(tb.keys))
+		}
+		tb.sorted = append(tb.sorted[:0], tb.keys...)
+		sort.SliceStable(tb.sorted, func(i, j int) bool {
+			return sortedKeyLess(tb.sorted[i], tb.sorted[j])
+		})
+		tb.s2i = make(map[LValue]int, len(tb.sorted))
+		for i, k := range tb.sorted {
+			tb.s2i[k] = i
+		}
+	}
+	return tb.sorted, tb.s2i
+}
+
+func sortedKeyRank(key LValue) int {
+	switch key.Type() {
+	case LTNumber:
+		return 0
+	case LTString:
+		return 1
+	case LTBool:
+		return 2
+	}
+	return 3
+}
+
+// sortedKeyLess orders keys for IterationSorted. Keys that can not be
+// compared keep their insertion order thanks to the stable sort.
+func sortedKeyLess(a, b LValue) bool {
+	ra, rb := sortedKeyRank(a), sortedKeyRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	switch ra {
+	case 0:
+		return a.(LNumber) < b.(LNumber)
+	case 1:
+		return a.(LString) < b.(LString)
+	case 2:
+		return a == LFalse && b == LTrue
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -231,3 +232,123 @@ func TestTableForEach(t *testing.T) {
 		}
 	})
 }
+
+func TestTableDeterministicIteration(t *testing.T) {
+	src := `
+	local t = {1, 2, zeta = 1, alpha = 2, [1.5] = 3, [-1] = 4, [true] = 5, mid = 6}
+	t.alpha = nil
+	t.beta = 7
+	local keys = {}
+	for k in pairs(t) do keys[#keys + 1] = tostring(k) end
+	return table.concat(keys, " ")
+	`
+	for _, order := range []IterationOrder{IterationInsertion, IterationSorted} {
+		L := NewState(Options{DeterministicIteration: order})
+		errorIfNotNil(t, L.DoString(src))
+		got := L.ToString(-1)
+		L.Pop(1)
+		if order == IterationSorted {
+			errorIfNotEqual(t, "1 2 -1 1.5 beta mid zeta true", got)
+		}
+		for i := 0; i < 10; i++ {
+			errorIfNotNil(t, L.DoString(src))
+			errorIfNotEqual(t, got, L.ToString(-1))
+			L.Pop(1)
+		}
+
+		tb := L.NewTable()
+		for _, k := range []string{"c", "a", "b", "e", "d"} {
+			tb.RawSetString(k, LTrue)
+		}
+		var keys []string
+		tb.ForEach(func(k, v LValue) { keys = append(keys, k.String()) })
+		if order == IterationSorted {
+			errorIfNotEqual(t, "a b c d e", strings.Join(keys, " "))
+		} else {
+			errorIfNotEqual(t, "c a b e d", strings.Join(keys, " "))
+		}
+		L.Close()
+	}
+}
+
+func TestOrderedTable(t *testing.T) {
+	L := NewState(Options{DeterministicIteration: IterationSorted, OrderedTables: true})
+	defer L.Close()
+	tb := L.NewOrderedTable()
+	errorIfFalse(t, L.IsTableOrdered(tb), "expected an ordered table")
+	errorIfFalse(t, !L.IsTableOrdered(L.NewTable()), "expected an unordered table")
+	for _, k := range []string{"c", "a", "b", "e", "d"} {
+		tb.RawSetString(k, LTrue)
+	}
+	tb.RawSetString("a", LNil)
+	tb.RawSetString("a", LTrue)
+	var keys []string
+	tb.ForEach(func(k, v LValue) { keys = append(keys, k.String()) })
+	errorIfNotEqual(t, "c a b e d", strings.Join(keys, " "))
+
+	errorIfScriptFail(t, L, `
+	local t = table.ordered({{"zeta", 1}, {"alpha", 2}, {"mid", 3}})
+	t.beta = 4
+	local keys = {}
+	for k in pairs(t) do keys[#keys + 1] = k end
+	assert(table.concat(keys, " ") == "zeta alpha mid beta")
+	`)
+	errorIfScriptNotFail(t, L, `table.ordered({1})`, "pair #1 is not a table")
+
+	L2 := NewState()
+	defer L2.Close()
+	errorIfScriptFail(t, L2, `assert(table.ordered == nil)`)
+}
+
+func TestWeakTable(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	cache := L.NewWeakTable("v")
+	L.SetGlobal("cache", cache)
+	errorIfScriptFail(t, L, `
+	keep = {}
+	cache.a = keep
+	cache.b = {}
+	cache[1] = {}
+	cache.c = "strings are never collected"
+	`)
+	before := L.GetAllocatedBytes()
+	errorIfNotEqual(t, 2, L.CollectWeakTables())
+	errorIfFalse(t, L.GetAllocatedBytes() < before, "expected collected tables to be credited back")
+	errorIfScriptFail(t, L, `
+	assert(cache.a == keep and cache.b == nil and cache[1] == nil and cache.c ~= nil)
+	local n = 0
+	for k in pairs(cache) do n = n + 1 end
+	assert(n == 2)
+	`)
+
+	// tables only reachable through a removed entry are credited with it
+	errorIfScriptFail(t, L, `
+	cache.d = {inner = {}, list = {}}
+	for i = 1, 1000 do cache.d.list[i] = {i} end
+	cache.d.list.parent = cache.d
+	`)
+	before = L.GetAllocatedBytes()
+	errorIfNotEqual(t, 1, L.CollectWeakTables())
+	errorIfFalse(t, before-L.GetAllocatedBytes() > 1000*L.sizing().Table, "expected nested tables to be credited back")
+
+	errorIfScriptFail(t, L, `
+	local ephemeron = setmetatable({}, {__mode = "k"})
+	local key = {}
+	ephemeron[key] = {}
+	ephemeron[{}] = 1
+	local k2 = {}
+	ephemeron[k2] = k2
+	k2 = nil
+	collectgarbage()
+	assert(ephemeron[key] ~= nil)
+	local n = 0
+	for k in pairs(ephemeron) do n = n + 1 end
+	assert(n == 1)
+	`)
+
+	errorIfGFuncNotFail(t, L, func(L *LState) int {
+		L.NewWeakTable("x")
+		return 0
+	}, "invalid weak table mode")
+}
@@ -1,11 +1,23 @@
 package lua
 
 import (
+	"fmt"
+	"math"
 	"sort"
 )
 
 func OpenTable(L *LState) int {
 	tabmod := L.RegisterModule(TabLibName, tableFuncs)
+	if L.Options.CompatFlags&CompatTableUnpack != 0 {
+		L.SetField(tabmod, "unpack", L.NewFunction(baseUnpack))
+	}
+	if L.Options.OrderedTables {
+		L.SetField(tabmod, "ordered", L.NewFunction(tableOrdered))
+	}
+	if L.Options.FrozenTables {
+		L.SetField(tabmod, "freeze", L.NewFunction(tableFreeze))
+		L.SetField(tabmod, "isfrozen", L.NewFunction(tableIsFrozen))
+	}
 	L.Push(tabmod)
 	return 1
 }
@@ -15,23 +27,113 @@ var tableFuncs = map[string]LGFunction{
 	"concat": tableConcat,
 	"insert": tableInsert,
 	"maxn":   tableMaxN,
+	"move":   tableMove,
+	"pack":   tablePack,
 	"remove": tableRemove,
 	"sort":   tableSort,
 }
 
+// tableSort sorts the array part in place, so the sort itself allocates
+// nothing; what the comparator allocates is charged by the VM as it runs.
 func tableSort(L *LState) int {
 	tbl := L.CheckTable(1)
 	L.checkTableWritable(tbl)
-	sorter := lValueArraySorter{L, nil, tbl.array}
+	var fn *LFunction
 	if L.GetTop() != 1 {
-		sorter.Fn = L.CheckFunction(2)
+		fn = L.CheckFunction(2)
+	}
+	n, meta := tableLen(L, tbl)
+	if !meta && L.metaOp1(tbl, "__index") == LNil && L.metaOp1(tbl, "__newindex") == LNil {
+		sort.Sort(lValueArraySorter{L, fn, tbl.array})
+		return 0
+	}
+	// sort a copy of the elements, read and written back through the
+	// metamethods, which is charged while it is held
+	if n >= math.MaxInt32 {
+		L.ArgError(1, "array too big")
+	}
+	scratch := int64(max(n, 0)) * L.sizing().ArraySlot
+	if err := L.checkFits(scratch); err != nil {
+		L.raiseNotFitting(err, scratch)
+	}
+	L.trackAlloc(AllocTable, scratch)
+	defer L.releaseAlloc(scratch)
+	values := make([]LValue, max(n, 0))
+	for i := range values {
+		values[i] = L.getField(tbl, LNumber(i+1))
+	}
+	sort.Sort(lValueArraySorter{L, fn, values})
+	for i, v := range values {
+		L.setField(tbl, LNumber(i+1), v)
 	}
-	sort.Sort(sorter)
 	return 0
 }
 
+// table.ordered([pairs]) returns a new ordered table, optionally filled from
+// a list of {key, value} pairs since table constructors do not keep key order.
+func tableOrdered(L *LState) int {
+	tb := L.NewOrderedTable()
+	if src := L.OptTable(1, nil); src != nil {
+		for i := 1; i <= src.Len(); i++ {
+			pair, ok := src.RawGetInt(i).(*LTable)
+			if !ok {
+				L.ArgError(1, fmt.Sprintf("pair #%d is not a table", i))
+			}
+			L.RawSet(tb, pair.RawGetInt(1), pair.RawGetInt(2))
+		}
+	}
+	L.Push(tb)
+	return 1
+}
+
+// tablePack returns its arguments in a new table, with their number in the
+// field n since the arguments may include nils.
+func tablePack(L *LState) int {
+	n := L.GetTop()
+	tb := L.CreateTable(n, 1)
+	for i := 1; i <= n; i++ {
+		tb.RawSetInt(i, L.Get(i))
+	}
+	tb.RawSetString("n", LNumber(n))
+	L.Push(tb)
+	return 1
+}
+
+// tableLen returns the length of tb as the # operator does: the result of
+// its __len metamethod if it has one, its border otherwise. meta reports
+// whether __len was called; the functions of the library then access the
+// elements with __index and __newindex, since they are those of a proxy.
+func tableLen(L *LState, tb *LTable) (n int, meta bool) {
+	op := L.metaOp1(tb, "__len")
+	if op == LNil {
+		return tb.Len(), false
+	}
+	L.Push(op)
+	L.Push(tb)
+	L.Call(1, 1)
+	ret, ok := L.reg.Pop().(LNumber)
+	if !ok {
+		L.RaiseError("object length is not a number")
+	}
+	n64, ok := luaToInteger(ret)
+	if !ok || int64(int(n64)) != n64 {
+		L.RaiseError("object length is not an integer")
+	}
+	return int(n64), true
+}
+
+// tableGetInt returns tb[i], raw unless meta.
+func tableGetInt(L *LState, tb *LTable, i int, meta bool) LValue {
+	if meta {
+		return L.getField(tb, LNumber(i))
+	}
+	return tb.RawGetInt(i)
+}
+
 func tableGetN(L *LState) int {
-	L.Push(LNumber(L.CheckTable(1).Len()))
+	L.warnDeprecated("table.getn", "the # operator")
+	n, _ := tableLen(L, L.CheckTable(1))
+	L.Push(LNumber(n))
 	return 1
 }
 
@@ -43,6 +145,18 @@ func tableMaxN(L *LState) int {
 func tableRemove(L *LState) int {
 	tbl := L.CheckTable(1)
 	L.checkTableWritable(tbl)
+	if size, meta := tableLen(L, tbl); meta {
+		pos := L.OptInt(2, size)
+		if pos != size && (pos < 1 || pos > size+1) {
+			L.ArgError(2, "position out of bounds")
+		}
+		L.Push(L.getField(tbl, LNumber(pos)))
+		for ; pos < size; pos++ {
+			L.setField(tbl, LNumber(pos), L.getField(tbl, LNumber(pos+1)))
+		}
+		L.setField(tbl, LNumber(pos), LNil)
+		return 1
+	}
 	if L.GetTop() == 1 {
 		L.Push(tbl.remove(-1))
 	} else {
@@ -51,19 +165,55 @@ func tableRemove(L *LState) int {
 	return 1
 }
 
+// tableMove copies a1[f..e] to a2[t..], a1 by default, going backwards when
+// the ranges overlap so that the elements are not overwritten before they
+// are copied. Like in Lua 5.3 it honours __index and __newindex; what the
+// destination grows by is charged as for any other assignment.
+func tableMove(L *LState) int {
+	a1 := L.CheckTable(1)
+	f := L.CheckInt(2)
+	e := L.CheckInt(3)
+	t := L.CheckInt(4)
+	a2 := a1
+	if L.GetTop() >= 5 && L.Get(5) != LNil {
+		a2 = L.CheckTable(5)
+	}
+	if e >= f {
+		if f <= 0 && e >= math.MaxInt+f {
+			L.ArgError(3, "too many elements to move")
+		}
+		if t > math.MaxInt-(e-f) {
+			L.ArgError(4, "destination wrap around")
+		}
+		L.checkTableWritable(a2)
+		if t > e || t <= f || a1 != a2 {
+			for i := 0; i <= e-f; i++ {
+				L.setField(a2, LNumber(t+i), L.getField(a1, LNumber(f+i)))
+			}
+		} else {
+			for i := e - f; i >= 0; i-- {
+				L.setField(a2, LNumber(t+i), L.getField(a1, LNumber(f+i)))
+			}
+		}
+	}
+	L.Push(a2)
+	return 1
+}
+
 func tableConcat(L *LState) int {
 	tbl := L.CheckTable(1)
 	sep := LString(L.OptString(2, ""))
+	n, meta := tableLen(L, tbl)
 	i := L.OptInt(3, 1)
-	j := L.OptInt(4, tbl.Len())
+	j := L.OptInt(4, n)
 	if L.GetTop() == 3 {
-		if i > tbl.Len() || i < 1 {
+		if i > n || i < 1 {
 			L.Push(emptyLString)
 			return 1
 		}
 	}
-	i = intMax(intMin(i, tbl.Len()), 1)
-	j = intMin(intMin(j, tbl.Len()), tbl.Len())
+	i = intMax(intMin(i, n), 1)
+	j = intMin(j, n)
 	if i > j {
 		L.Push(emptyLString)
 		return 1
@@ -71,7 +221,7 @@ func tableConcat(L *LState) int {
 	//TODO should flushing?
 	retbottom := L.GetTop()
 	for ; i <= j; i++ {
-		v := tbl.RawGetInt(i)
+		v := tableGetInt(L, tbl, i, meta)
 		if !LVCanConvToString(v) {
 			L.RaiseError("invalid value (%s) at index %d in table for concat", v.Type().String(), i)
 		}
@@ -92,6 +242,20 @@ func tableInsert(L *LState) int {
 	}
 	L.checkTableWritable(tbl)
 
+	if n, meta := tableLen(L, tbl); meta {
+		pos := n + 1
+		if nargs > 2 {
+			pos = L.CheckInt(2)
+			if pos < 1 || pos > n+1 {
+				L.ArgError(2, "position out of bounds")
+			}
+			for i := n + 1; i > pos; i-- {
+				L.setField(tbl, LNumber(i), L.getField(tbl, LNumber(i-1)))
+			}
+		}
+		L.setField(tbl, LNumber(pos), L.Get(nargs))
+		return 0
+	}
 	if L.GetTop() == 2 {
 		tbl.append(L.Get(2))
 		return 0
@@ -0,0 +1,176 @@
+package lua
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+/* taint tracking {{{ */
+
+// TaintError is raised when a tainted string is passed to a function wrapped
+// with TaintSink.
+type TaintError struct {
+	// Function is the name given to TaintSink.
+	Function string
+	// Arg is the 1-based position of the tainted argument.
+	Arg int
+	// Value is the tainted argument.
+	Value LString
+}
+
+func (e *TaintError) Error() string {
+	return fmt.Sprintf("tainted string passed as argument #%v to %v", e.Arg, e.Function)
+}
+
+// TaintHandler decides what a sink does with a tainted argument. It returns
+// true to let the call proceed, e.g. after reporting it, or false to raise
+// the error.
+type TaintHandler func(L *LState, err *TaintError) bool
+
+// taintSet holds the tainted strings of a state, sorted by address. A string
+// is tainted if its bytes lie within one of them, so substrings such as the
+// results of string.sub and pattern captures are tainted without copying.
+// The set keeps its strings alive, and EstimateSize counts them, until
+// CollectGarbage finds that the state no longer references them, see sweep.
+type taintSet struct {
+	strs []string
+}
+
+func (ts *taintSet) find(s string) int {
+	return ts.findAddr(uintptr(unsafe.Pointer(unsafe.StringData(s))))
+}
+
+// findAddr returns the index of the last string that starts at or before
+// p, or -1.
+func (ts *taintSet) findAddr(p uintptr) int {
+	return sort.Search(len(ts.strs), func(i int) bool {
+		return uintptr(unsafe.Pointer(unsafe.StringData(ts.strs[i]))) > p
+	}) - 1
+}
+
+func (ts *taintSet) contains(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	i := ts.find(s)
+	if i < 0 {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(unsafe.StringData(ts.strs[i])))
+	p := uintptr(unsafe.Pointer(unsafe.StringData(s)))
+	return p+uintptr(len(s)) <= start+uintptr(len(ts.strs[i]))
+}
+
+func (ts *taintSet) add(s string) {
+	if len(s) == 0 || ts.contains(s) {
+		return
+	}
+	i := ts.find(s) + 1
+	ts.strs = append(ts.strs, "")
+	copy(ts.strs[i+1:], ts.strs[i:])
+	ts.strs[i] = s
+}
+
+// sweep removes the strings that none of live, the bytes of the strings
+// reachable from the state, lie within, and returns how many it removed.
+// A tainted string that only the host still references is so forgotten,
+// like the userdata CollectGarbage finalizes.
+func (ts *taintSet) sweep(live map[*byte]struct{}) int {
+	keep := make([]bool, len(ts.strs))
+	for data := range live {
+		p := uintptr(unsafe.Pointer(data))
+		if i := ts.findAddr(p); i >= 0 {
+			start := uintptr(unsafe.Pointer(unsafe.StringData(ts.strs[i])))
+			keep[i] = keep[i] || p < start+uintptr(len(ts.strs[i]))
+		}
+	}
+	n := 0
+	for i, s := range ts.strs {
+		if keep[i] {
+			ts.strs[n] = s
+			n++
+		}
+	}
+	clear(ts.strs[n:])
+	removed := len(ts.strs) - n
+	ts.strs = ts.strs[:n]
+	return removed
+}
+
+// Taint returns a copy of s that is tainted. Strings built from it by
+// concatenation, table.concat, string.sub, string.gsub, string.format,
+// string.rep, string.reverse, string.upper and string.lower are tainted as
+// well, as are pattern captures, and functions wrapped with TaintSink refuse
+// them. Other functions, such as string.byte, string.pack and tostring,
+// return untainted values.
+//
+// The taint of a string is kept as long as the state references it:
+// CollectGarbage forgets the tainted strings it can not reach, even if the
+// host still holds them.
+func (ls *LState) Taint(s string) LString {
+	if len(s) == 0 {
+		return emptyLString
+	}
+	if ls.G.taint == nil {
+		ls.G.taint = &taintSet{}
+	}
+	s = strings.Clone(s)
+	ls.G.taint.add(s)
+	return LString(s)
+}
+
+// IsTainted reports whether lv is a tainted string.
+func (ls *LState) IsTainted(lv LValue) bool {
+	if ls.G.taint == nil {
+		return false
+	}
+	s, ok := lv.(LString)
+	return ok && ls.G.taint.contains(string(s))
+}
+
+// propagateTaint taints result if tainted is set. result must be a newly
+// allocated string.
+func (ls *LState) propagateTaint(result string, tainted bool) {
+	if tainted {
+		ls.G.taint.add(result)
+	}
+}
+
+// TaintSource wraps a host function that returns untrusted data, such as the
+// body of an HTTP request, so that the strings it returns are tainted.
+func TaintSource(fn LGFunction) LGFunction {
+	return func(L *LState) int {
+		n := fn(L)
+		top := L.GetTop()
+		for i := top - n + 1; i <= top; i++ {
+			if s, ok := L.Get(i).(LString); ok {
+				L.Replace(i, L.Taint(string(s)))
+			}
+		}
+		return n
+	}
+}
+
+// TaintSink wraps a host function that must not receive tainted strings,
+// such as a function running SQL or shell commands. If a string argument is
+// tainted, handler is called; the call fails with a *TaintError unless the
+// handler returns true. A nil handler rejects every tainted argument.
+func TaintSink(name string, handler TaintHandler, fn LGFunction) LGFunction {
+	return func(L *LState) int {
+		if L.G.taint != nil {
+			for i := 1; i <= L.GetTop(); i++ {
+				if s, ok := L.Get(i).(LString); ok && L.G.taint.contains(string(s)) {
+					err := &TaintError{Function: name, Arg: i, Value: s}
+					if handler == nil || !handler(L, err) {
+						L.raiseTypedError(err, "%s", err.Error())
+					}
+				}
+			}
+		}
+		return fn(L)
+	}
+}
+
+/* }}} */
@@ -0,0 +1,94 @@
+package lua
+
+/* to-be-closed variables {{{ */
+
+// toBeClosedVar is a variable declared with the <close> attribute whose
+// scope is still active.
+type toBeClosedVar struct {
+	// index is the register of the variable.
+	index int
+	name  string
+	value LValue
+}
+
+// markToBeClosed marks the variable name in the register index, set to
+// value, to be closed when it goes out of scope, see OP_TBC. nil and false
+// are not closed.
+func (ls *LState) markToBeClosed(index int, name string, value LValue) {
+	if value == LNil || value == LFalse {
+		return
+	}
+	if ls.metaOp1(value, "__close") == LNil {
+		ls.RaiseError("variable '%s' got a non-closable value", name)
+	}
+	ls.toBeClosed = append(ls.toBeClosed, toBeClosedVar{index, name, value})
+}
+
+// closeToBeClosed calls the __close metamethod of the variables in the
+// registers from idx up, most recent first, as their scope ends normally.
+// An error raised by a metamethod propagates as usual; the variables below
+// it are closed as the error unwinds the stack.
+func (ls *LState) closeToBeClosed(idx int) {
+	for n := len(ls.toBeClosed); n > 0 && ls.toBeClosed[n-1].index >= idx; n = len(ls.toBeClosed) {
+		tbc := ls.toBeClosed[n-1]
+		ls.toBeClosed = ls.toBeClosed[:n-1]
+		ls.pushCloseCall(tbc, LNil)
+		ls.Call(2, 0)
+	}
+}
+
+// closeToBeClosedOnError closes the variables in the registers from idx up
+// as err unwinds their scope, passing its object to their __close
+// metamethod. An error raised by a metamethod replaces err, and is passed
+// to the next ones.
+func (ls *LState) closeToBeClosedOnError(idx int, err *ApiError) *ApiError {
+	for n := len(ls.toBeClosed); n > 0 && ls.toBeClosed[n-1].index >= idx; n = len(ls.toBeClosed) {
+		tbc := ls.toBeClosed[n-1]
+		ls.toBeClosed = ls.toBeClosed[:n-1]
+		ls.pushCloseCall(tbc, err.Object)
+		if cerr := ls.PCall(2, 0, nil); cerr != nil {
+			err = cerr.(*ApiError)
+		}
+	}
+	return err
+}
+
+// closeThread kills the suspended or dead coroutine th, closes its pending
+// to-be-closed variables, most recent first, and gives back the memory of its
+// registry and call stack. It returns the error that killed th or the last
+// error raised by a __close metamethod, LNil if none.
+func (ls *LState) closeThread(th *LState) LValue {
+	errobj := th.deathErr
+	if errobj == nil {
+		errobj = LNil
+	}
+	th.deathErr = nil
+	th.kill()
+	for n := len(th.toBeClosed); n > 0; n = len(th.toBeClosed) {
+		tbc := th.toBeClosed[n-1]
+		th.toBeClosed = th.toBeClosed[:n-1]
+		ls.pushCloseCall(tbc, errobj)
+		if err := ls.PCall(2, 0, nil); err != nil {
+			errobj = err.(*ApiError).Object
+		}
+	}
+	size := th.stackSize()
+	th.stack.FreeAll()
+	th.stack = newFixedCallFrameStack(0)
+	th.currentFrame = nil
+	th.reg.array, th.reg.top = nil, 0
+	th.releaseAlloc(size - th.stackSize())
+	return errobj
+}
+
+func (ls *LState) pushCloseCall(tbc toBeClosedVar, errobj LValue) {
+	mm := ls.metaOp1(tbc.value, "__close")
+	if mm == LNil {
+		ls.RaiseError("metamethod 'close' of variable '%s' is nil", tbc.name)
+	}
+	ls.Push(mm)
+	ls.Push(tbc.value)
+	ls.Push(errobj)
+}
+
+/* }}} */
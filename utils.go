@@ -2,9 +2,10 @@ package lua
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"reflect"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -47,6 +48,94 @@ func defaultFormat(v interface{}, f fmt.State, c rune) {
 	fmt.Fprintf(f, format, v)
 }
 
+// floatFormat formats v like the C printf does: %g has a default precision
+// of 6, and infinities and NaN are written inf and nan.
+func floatFormat(v float64, f fmt.State, c rune) {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		s := "inf"
+		if math.IsNaN(v) {
+			s = "nan"
+		}
+		if c == 'E' || c == 'F' || c == 'G' {
+			s = strings.ToUpper(s)
+		}
+		padFormat(f, signFormat(f, s, math.Signbit(v) && !math.IsNaN(v)), false)
+		return
+	}
+	if _, ok := f.Precision(); !ok && (c == 'g' || c == 'G') {
+		format := "%"
+		for _, flag := range "-+# 0" {
+			if f.Flag(int(flag)) {
+				format += string(flag)
+			}
+		}
+		if w, ok := f.Width(); ok {
+			format += strconv.Itoa(w)
+		}
+		fmt.Fprintf(f, format+".6"+string(c), v)
+		return
+	}
+	defaultFormat(v, f, c)
+}
+
+// hexFloatFormat formats v like the %a and %A conversions of the C printf.
+func hexFloatFormat(v float64, f fmt.State, c rune) {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		floatFormat(v, f, c-'a'+'g')
+		return
+	}
+	prec := -1
+	if p, ok := f.Precision(); ok {
+		prec = p
+	}
+	s := strconv.FormatFloat(math.Abs(v), 'x', prec, 64)
+	// C writes the exponent without leading zeros
+	p := strings.IndexByte(s, 'p') + 2
+	exp := strings.TrimLeft(s[p:], "0")
+	if exp == "" {
+		exp = "0"
+	}
+	s = s[:p] + exp
+	if c == 'A' {
+		s = strings.ToUpper(s)
+	}
+	padFormat(f, signFormat(f, s, math.Signbit(v)), true)
+}
+
+// signFormat prefixes s with the sign of a number, as asked by the flags of f.
+func signFormat(f fmt.State, s string, negative bool) string {
+	switch {
+	case negative:
+		return "-" + s
+	case f.Flag('+'):
+		return "+" + s
+	case f.Flag(' '):
+		return " " + s
+	}
+	return s
+}
+
+// padFormat writes the number s padded to the width of f, with zeros after
+// its sign and 0x prefix if zero is set and f has the 0 flag.
+func padFormat(f fmt.State, s string, zero bool) {
+	w, _ := f.Width()
+	if pad := w - len(s); pad > 0 {
+		switch {
+		case f.Flag('-'):
+			s += strings.Repeat(" ", pad)
+		case zero && f.Flag('0'):
+			prefix := len(s) - len(strings.TrimLeft(s, "+- "))
+			if strings.HasPrefix(strings.ToLower(s[prefix:]), "0x") {
+				prefix += 2
+			}
+			s = s[:prefix] + strings.Repeat("0", pad) + s[prefix:]
+		default:
+			s = strings.Repeat(" ", pad) + s
+		}
+	}
+	io.WriteString(f, s)
+}
+
 type flagScanner struct {
 	flag       byte
 	start      string
@@ -140,19 +229,127 @@ func isArrayKey(v LNumber) bool {
 	return isInteger(v) && v < LNumber(int((^uint(0))>>1)) && v > LNumber(0) && v < LNumber(MaxArrayIndex)
 }
 
+// luaSpaces are the characters Lua skips around a number in a string.
+const luaSpaces = " \t\n\v\f\r"
+
+// parseNumber converts number with the grammar of Lua 5.3: spaces around
+// it are ignored, decimal numbers may have a fraction and an exponent, and
+// hexadecimal numbers a fraction and a binary exponent, as in 0xA.8p-1.
+// Hexadecimal integers wrap around on overflow; other numbers too large
+// give an infinity, like strtod does.
 func parseNumber(number string) (LNumber, error) {
-	var value LNumber
-	number = strings.Trim(number, " \t\n")
-	if v, err := strconv.ParseInt(number, 0, LNumberBit); err != nil {
-		if v2, err2 := strconv.ParseFloat(number, LNumberBit); err2 != nil {
-			return LNumber(0), err2
-		} else {
-			value = LNumber(v2)
+	errSyntax := &strconv.NumError{Func: "parseNumber", Num: number, Err: strconv.ErrSyntax}
+	str := strings.Trim(number, luaSpaces)
+	neg := false
+	if len(str) > 0 && (str[0] == '-' || str[0] == '+') {
+		neg = str[0] == '-'
+		str = str[1:]
+	}
+	hex := len(str) > 1 && str[0] == '0' && (str[1] == 'x' || str[1] == 'X')
+	if hex {
+		str = str[2:]
+	}
+	isDigit := func(c byte) bool {
+		return '0' <= c && c <= '9' || hex && ('a' <= c|0x20 && c|0x20 <= 'f')
+	}
+	i, ndigits := 0, 0
+	for ; i < len(str) && isDigit(str[i]); i++ {
+		ndigits++
+	}
+	intEnd := i
+	if i < len(str) && str[i] == '.' {
+		for i++; i < len(str) && isDigit(str[i]); i++ {
+			ndigits++
 		}
-	} else {
-		value = LNumber(v)
 	}
-	return value, nil
+	if ndigits == 0 {
+		return 0, errSyntax
+	}
+	mantEnd := i
+	if i < len(str) && (!hex && str[i]|0x20 == 'e' || hex && str[i]|0x20 == 'p') {
+		i++
+		if i < len(str) && (str[i] == '-' || str[i] == '+') {
+			i++
+		}
+		j := i
+		for ; i < len(str) && '0' <= str[i] && str[i] <= '9'; i++ {
+		}
+		if i == j {
+			return 0, errSyntax
+		}
+	}
+	if i != len(str) {
+		return 0, errSyntax
+	}
+
+	var value float64
+	switch {
+	case hex && intEnd == len(str):
+		var v uint64
+		for _, c := range []byte(str) {
+			d := c - '0'
+			if c > '9' {
+				d = (c | 0x20) - 'a' + 10
+			}
+			v = v<<4 | uint64(d)
+		}
+		iv := int64(v)
+		if neg {
+			iv = -iv
+		}
+		return LNumber(iv), nil
+	case hex:
+		if mantEnd == len(str) {
+			str += "p0"
+		}
+		str = "0x" + str
+		fallthrough
+	default:
+		v, err := strconv.ParseFloat(str, LNumberBit)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return 0, err
+		}
+		value = v
+	}
+	if neg {
+		value = -value
+	}
+	return LNumber(value), nil
+}
+
+// parseIntegerBase converts number, an integer written in base, as tonumber
+// does: spaces around it are ignored, it may have a minus sign, and it wraps
+// around on overflow.
+func parseIntegerBase(number string, base int) (LNumber, bool) {
+	str := strings.Trim(number, luaSpaces)
+	neg := false
+	if len(str) > 0 && str[0] == '-' {
+		neg = true
+		str = str[1:]
+	}
+	if len(str) == 0 {
+		return 0, false
+	}
+	var v int64
+	for _, c := range []byte(str) {
+		var d int
+		switch {
+		case '0' <= c && c <= '9':
+			d = int(c - '0')
+		case 'a' <= c|0x20 && c|0x20 <= 'z':
+			d = int((c|0x20)-'a') + 10
+		default:
+			return 0, false
+		}
+		if d >= base {
+			return 0, false
+		}
+		v = v*int64(base) + int64(d)
+	}
+	if neg {
+		v = -v
+	}
+	return LNumber(v), true
 }
 
 func popenArgs(arg string) (string, []string) {
@@ -177,17 +374,26 @@ func isGoroutineSafe(lv LValue) bool {
 	}
 }
 
-func readBufioSize(reader *bufio.Reader, size int64) ([]byte, error, bool) {
+// readChunkSize is the most readBufioSize and readBufioAll read at once,
+// so that a huge size does not allocate a huge buffer up front.
+const readChunkSize = 64 * 1024
+
+// readBufioSize reads up to size bytes. track, if not nil, is called with
+// the number of bytes appended to the result as they are read.
+func readBufioSize(reader *bufio.Reader, size int64, track func(int)) ([]byte, error, bool) {
 	result := []byte{}
 	read := int64(0)
 	var err error
 	var n int
+	buf := make([]byte, min(size, readChunkSize))
 	for read != size {
-		buf := make([]byte, size-read)
-		n, err = reader.Read(buf)
+		n, err = reader.Read(buf[:min(size-read, int64(len(buf)))])
 		if err != nil {
 			break
 		}
+		if track != nil {
+			track(n)
+		}
 		read += int64(n)
 		result = append(result, buf[:n]...)
 	}
@@ -199,7 +405,30 @@ func readBufioSize(reader *bufio.Reader, size int64) ([]byte, error, bool) {
 	return result, e, len(result) == 0 && err == io.EOF
 }
 
-func readBufioLine(reader *bufio.Reader) ([]byte, error, bool) {
+// readBufioAll reads until EOF, calling track like readBufioSize.
+func readBufioAll(reader *bufio.Reader, track func(int)) ([]byte, error) {
+	result := []byte{}
+	buf := make([]byte, readChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if track != nil {
+				track(n)
+			}
+			result = append(result, buf[:n]...)
+		}
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+// readBufioLine reads a line without its end, calling track like
+// readBufioSize.
+func readBufioLine(reader *bufio.Reader, track func(int)) ([]byte, error, bool) {
 	result := []byte{}
 	var buf []byte
 	var err error
@@ -209,6 +438,9 @@ func readBufioLine(reader *bufio.Reader) ([]byte, error, bool) {
 		if err != nil {
 			break
 		}
+		if track != nil {
+			track(len(buf))
+		}
 		result = append(result, buf...)
 	}
 	e := err
@@ -255,11 +487,6 @@ func strCmp(s1, s2 string) int {
 	}
 }
 
-func unsafeFastStringToReadOnlyBytes(s string) (bs []byte) {
-	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
-	bh.Data = sh.Data
-	bh.Cap = sh.Len
-	bh.Len = sh.Len
-	return
+func unsafeFastStringToReadOnlyBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
 }
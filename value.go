@@ -3,7 +3,11 @@ package lua
 import (
 	"context"
 	"fmt"
+	"io/fs"
+	"math/rand"
 	"os"
+	"reflect"
+	"time"
 )
 
 type LValueType int
@@ -128,7 +132,9 @@ func (nm LNumber) Format(f fmt.State, c rune) {
 	case 'b', 'c', 'd', 'o', 'x', 'X', 'U':
 		defaultFormat(int64(nm), f, c)
 	case 'e', 'E', 'f', 'F', 'g', 'G':
-		defaultFormat(float64(nm), f, c)
+		floatFormat(float64(nm), f, c)
+	case 'a', 'A':
+		hexFloatFormat(float64(nm), f, c)
 	case 'i':
 		defaultFormat(int64(nm), f, 'd')
 	default:
@@ -148,11 +154,21 @@ type LTable struct {
 	strdict map[string]LValue
 	keys    []LValue
 	k2i     map[LValue]int
+	// sorted hash keys, only used with IterationSorted
+	sorted []LValue
+	s2i    map[LValue]int
 
 	// Memory tracking
 	ls         *LState
 	allocBytes int64
+	hashCap    int // hash entries already charged to ls
 	readonly   bool
+	// metatable protected by ProtectMetatable
+	protected bool
+	// ordered tables always iterate the hash part in insertion order
+	ordered bool
+	// weak mode set by NewWeakTable
+	weak weakMode
 }
 
 func (tb *LTable) String() string   { return fmt.Sprintf("table: %p", tb) }
@@ -176,9 +192,40 @@ type Global struct {
 	Registry      *LTable
 	Global        *LTable
 
-	builtinMts map[int]LValue
-	tempFiles  []*os.File
-	gccount    int32
+	builtinMts             map[int]LValue
+	tempFiles              []*os.File
+	gccount                int32
+	warningHandler         WarningHandler
+	warnFunc               WarnFunc
+	warnOff                bool
+	scriptFS               fs.FS
+	ioFS                   fs.FS
+	finalizers             *finalizerSet
+	hostRegistry           *LTable
+	undefinedGlobalHandler UndefinedGlobalHandler
+	types                  map[reflect.Type]*typeInfo
+	recordReplay           *recordReplay
+	taint                  *taintSet
+	instLimit              int64
+	execClock              *execClock
+	stepHook               *stepHook
+	patternSteps           int64
+	coroutines             int
+	maxCoroutines          int
+	maxStringLength        int
+	maxTableEntries        int
+	callInterceptor        *callInterceptor
+	pause                  *pauseGate
+	textChunksOnly         bool
+	moduleSearchers        []ModuleSearcher
+	requireWhitelist       map[string]bool
+	isolatedEnvMt          *LTable
+	clock                  Clock
+	clockStart             time.Time
+	rand                   *rand.Rand
+	objectIDs              map[LValue]uint64
+	auditHook              *auditHook
+	chunkVerifier          ChunkVerifier
 }
 
 type LState struct {
@@ -201,10 +248,44 @@ type LState struct {
 	ctx            context.Context
 	ctxCancelFn    context.CancelFunc
 	readonlyBypass int
+	errorCause     error
+	instCount      *int64
+	// variables to close as their scope ends, innermost last
+	toBeClosed []toBeClosedVar
+	// the error that killed this coroutine, see coroutine.close
+	deathErr LValue
 
 	// Memory tracking
-	allocatedBytes int64
-	maxBytes       int64
+	allocatedBytes  int64
+	maxBytes        int64
+	peakBytes       int64
+	warnedNearLimit bool
+	// the state that created this coroutine, charged for its allocations
+	memParent  *LState
+	coMaxBytes int64
+	// memory limit shared with other states, see JoinQuotaGroup
+	quota *QuotaGroup
+	// budgets of the running CallWithBudget calls, innermost first
+	budget *memBudget
+	// shared with other goroutines, see MemoryCounters
+	counters *MemoryCounters
+	// values buffered in channels, charged until received
+	chanItems map[LChannel][]channelItem
+	// called on every tracked allocation, see SetAllocHook
+	allocHook AllocHook
+	// what to do when the limit is exceeded, see SetMemoryPolicy
+	memPolicy  MemoryPolicy
+	collecting bool
+	// pacing of the collections, see collectgarbage
+	gcStopped    bool
+	gcPause      int
+	gcStepMul    int
+	gcEstimate   int64
+	gcStepCredit int64
+	// soft watermark set by SetMemoryThreshold
+	memThreshold      int64
+	memThresholdFn    func(used, limit uint64)
+	memThresholdFired bool
 }
 
 func (ls *LState) String() string   { return fmt.Sprintf("thread: %p", ls) }
@@ -214,6 +295,11 @@ type LUserData struct {
 	Value     interface{}
 	Env       *LTable
 	Metatable LValue
+
+	g   *Global
+	fin *userDataFinalizer
+	// bytes charged for Value by NewUserDataWithSize
+	size int64
 }
 
 func (ud *LUserData) String() string   { return fmt.Sprintf("userdata: %p", ud) }
@@ -0,0 +1,227 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/* bytecode verification {{{ */
+
+// ErrInvalidBytecode matches, with errors.Is, the errors of VerifyProto.
+var ErrInvalidBytecode = errors.New("invalid bytecode")
+
+// ChunkVerifier checks a binary chunk before it is loaded, see
+// SetChunkVerifier.
+type ChunkVerifier func(chunkName string, data []byte) error
+
+// SetChunkVerifier makes Load, and so load, loadstring, dofile and require,
+// pass every binary chunk to fn before it is undumped, e.g. to check a
+// signature: data holds the whole chunk as read, including any bytes the
+// host appended after the dump, which UndumpProto ignores. If fn returns an
+// error, the chunk is not loaded and the load fails with it. Source chunks
+// are not affected. A nil fn removes the verifier.
+func (ls *LState) SetChunkVerifier(fn ChunkVerifier) {
+	ls.G.chunkVerifier = fn
+}
+
+// undumpChunk undumps the binary chunk in br, after it passed the chunk
+// verifier and before it is checked by VerifyProto.
+func (ls *LState) undumpChunk(br *bufio.Reader, name string) (*FunctionProto, error) {
+	if verify := ls.G.chunkVerifier; verify != nil {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, newApiErrorE(ApiErrorFile, err)
+		}
+		if err := verify(name, data); err != nil {
+			return nil, newApiErrorE(ApiErrorSyntax, fmt.Errorf("%s: %w", name, err))
+		}
+		br = bufio.NewReader(bytes.NewReader(data))
+	}
+	proto, err := UndumpProto(br)
+	if err == nil {
+		err = VerifyProto(proto)
+	}
+	if err != nil {
+		return nil, newApiErrorE(ApiErrorSyntax, fmt.Errorf("%s: %w", name, err))
+	}
+	return proto, nil
+}
+
+// VerifyProto checks that the bytecode of proto and of its nested functions
+// is well formed, as the compiler would have produced it: every instruction
+// is known, the constants, upvalues and nested functions it refers to exist,
+// its jumps stay in the function, the registers it uses are below
+// NumUsedRegisters and every function ends with a return.
+// Load calls it on the binary chunks it loads, since the VM trusts the
+// bytecode it runs. A well formed chunk can still misbehave, so chunks from
+// untrusted sources should also be authenticated, see SetChunkVerifier.
+func VerifyProto(proto *FunctionProto) error {
+	v := protoVerifier{proto: proto}
+	return v.verify()
+}
+
+type protoVerifier struct {
+	proto *FunctionProto
+	pc    int
+}
+
+func (v *protoVerifier) fail(format string, args ...interface{}) error {
+	p := v.proto
+	return fmt.Errorf("%w: %s in function at %s:%d, pc %d", ErrInvalidBytecode,
+		fmt.Sprintf(format, args...), p.SourceName, p.LineDefined, v.pc)
+}
+
+func (v *protoVerifier) verify() error {
+	p := v.proto
+	if len(p.Code) == 0 || opGetOpCode(p.Code[len(p.Code)-1]) != OP_RETURN {
+		return v.fail("missing final return")
+	}
+	if len(p.stringConstants) != len(p.Constants) {
+		return v.fail("constant table mismatch")
+	}
+	constant := func(k int, str bool) error {
+		if k >= len(p.Constants) {
+			return v.fail("constant %d out of range", k)
+		}
+		if _, ok := p.Constants[k].(LString); str && !ok {
+			return v.fail("constant %d is not a string", k)
+		}
+		return nil
+	}
+	register := func(inst uint32) error {
+		if r := opMaxRegister(inst); r >= int(p.NumUsedRegisters) {
+			return v.fail("register %d out of range", r)
+		}
+		return nil
+	}
+	rk := func(arg int, mode opArgMode, str bool) error {
+		if mode == opArgModeK && opIsK(arg) {
+			return constant(opIndexK(arg), str)
+		}
+		return nil
+	}
+	next := func(n int) error {
+		if v.pc+n >= len(p.Code) {
+			return v.fail("truncated instruction")
+		}
+		return nil
+	}
+
+	for v.pc = 0; v.pc < len(p.Code); v.pc++ {
+		inst := p.Code[v.pc]
+		op := opGetOpCode(inst)
+		if op > opCodeMax {
+			return v.fail("unknown opcode %d", op)
+		}
+		prop := &opProps[op]
+		a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+		if err := register(inst); err != nil {
+			return err
+		}
+		switch prop.Type {
+		case opTypeABC:
+			if err := rk(b, prop.ModeArgB, op == OP_SETTABLEKS); err != nil {
+				return err
+			}
+			if err := rk(c, prop.ModeArgC, op == OP_GETTABLEKS); err != nil {
+				return err
+			}
+		case opTypeABx:
+			var err error
+			switch bx := opGetArgBx(inst); op {
+			case OP_LOADK:
+				err = constant(bx, false)
+			case OP_GETGLOBAL, OP_SETGLOBAL, OP_TBC:
+				err = constant(bx, true)
+			case OP_CLOSURE:
+				err = v.closure(bx)
+			}
+			if err != nil {
+				return err
+			}
+		case opTypeASbx:
+			if op != OP_NOP {
+				if target := v.pc + 1 + opGetArgSbx(inst); target < 0 || target >= len(p.Code) {
+					return v.fail("jump to %d out of range", target)
+				}
+			}
+		}
+		switch {
+		case op == OP_LOADNIL && b < a, op == OP_CONCAT && c < b:
+			return v.fail("invalid register range")
+		case op == OP_GETUPVAL || op == OP_SETUPVAL:
+			if b >= int(p.NumUpvalues) {
+				return v.fail("upvalue %d out of range", b)
+			}
+		case op == OP_MOVEN:
+			if err := next(c); err != nil {
+				return err
+			}
+			for i := 1; i <= c; i++ {
+				move := p.Code[v.pc+i]
+				if opGetOpCode(move) != OP_MOVE {
+					return v.fail("invalid MOVEN sequence")
+				}
+				if err := register(move); err != nil {
+					return err
+				}
+			}
+			v.pc += c
+		case op == OP_SETLIST && c == 0:
+			if err := next(1); err != nil {
+				return err
+			}
+			v.pc++
+		case prop.IsTest || op == OP_LOADBOOL && c != 0:
+			if err := next(1); err != nil {
+				return err
+			}
+		}
+		if op == OP_CLOSURE {
+			v.pc += int(p.FunctionPrototypes[opGetArgBx(inst)].NumUpvalues)
+		}
+	}
+	for _, child := range p.FunctionPrototypes {
+		if child == nil {
+			return v.fail("missing nested function")
+		}
+		if err := VerifyProto(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closure checks a CLOSURE instruction and the pseudo instructions that
+// bind the upvalues of the new function.
+func (v *protoVerifier) closure(bx int) error {
+	p := v.proto
+	if bx >= len(p.FunctionPrototypes) || p.FunctionPrototypes[bx] == nil {
+		return v.fail("function %d out of range", bx)
+	}
+	n := int(p.FunctionPrototypes[bx].NumUpvalues)
+	if n > 0 && v.pc+n >= len(p.Code) {
+		return v.fail("truncated instruction")
+	}
+	for i := 1; i <= n; i++ {
+		inst := p.Code[v.pc+i]
+		switch opGetOpCode(inst) {
+		case OP_MOVE:
+			if b := opGetArgB(inst); b >= int(p.NumUsedRegisters) {
+				return v.fail("register %d out of range", b)
+			}
+		case OP_GETUPVAL:
+			if b := opGetArgB(inst); b >= int(p.NumUpvalues) {
+				return v.fail("upvalue %d out of range", b)
+			}
+		default:
+			return v.fail("invalid upvalue binding")
+		}
+	}
+	return nil
+}
+
+/* }}} */
@@ -54,7 +54,7 @@ func mainLoopWithContext(L *LState, baseframe *callFrame) {
 		cf.Pc++
 		select {
 		case <-L.ctx.Done():
-			L.RaiseError(L.ctx.Err().Error())
+			L.raiseContextError()
 			return
 		default:
 			if jumpTable[int(inst>>26)](L, inst, baseframe) == 1 {
@@ -64,6 +64,64 @@ func mainLoopWithContext(L *LState, baseframe *callFrame) {
 	}
 }
 
+// mainLoopWithCount counts executed instructions in L.instCount, enforces
+// the instruction and execution time limits, calls the step hook, stops
+// while the state is paused and honours the context, for those that are set.
+func mainLoopWithCount(L *LState, baseframe *callFrame) {
+	var inst uint32
+	var cf *callFrame
+	var n int
+
+	if L.stack.IsEmpty() {
+		return
+	}
+
+	clock := L.G.execClock
+	if clock != nil && clock.resume() {
+		defer clock.pause()
+	}
+
+	L.currentFrame = L.stack.Last()
+	if L.currentFrame.Fn.IsG {
+		callGFunction(L, false)
+		return
+	}
+
+	for {
+		cf = L.currentFrame
+		inst = cf.Fn.Proto.Code[cf.Pc]
+		cf.Pc++
+		if L.instCount != nil {
+			*L.instCount++
+			if L.G.instLimit > 0 && *L.instCount > L.G.instLimit {
+				L.raiseTypedError(&LimitError{Resource: "instructions", Limit: L.G.instLimit, Value: *L.instCount},
+					"instruction limit exceeded: %d instructions executed, limit is %d", *L.instCount, L.G.instLimit)
+				return
+			}
+		}
+		if n++; clock != nil && n%execClockInterval == 0 {
+			clock.check(L)
+		}
+		if hook := L.G.stepHook; hook != nil {
+			hook.step(L)
+		}
+		if gate := L.G.pause; gate != nil && gate.paused.Load() {
+			gate.wait(L)
+		}
+		if L.ctx != nil {
+			select {
+			case <-L.ctx.Done():
+				L.raiseContextError()
+				return
+			default:
+			}
+		}
+		if jumpTable[int(inst>>26)](L, inst, baseframe) == 1 {
+			return
+		}
+	}
+}
+
 // regv is the first target register to copy the return values to.
 // It can be reg.top, indicating that the copied values are going into new registers, or it can be below reg.top
 // Indicating that the values should be within the existing registers.
@@ -198,6 +256,9 @@ func switchToParentThread(L *LState, nargs int, haserror bool, kill bool) {
 }
 
 func callGFunction(L *LState, tailcall bool) bool {
+	if clock := L.G.execClock; clock != nil && clock.pause() {
+		defer clock.resume()
+	}
 	frame := L.currentFrame
 	gfnret := frame.Fn.GFunction(L)
 	if tailcall {
@@ -278,8 +339,10 @@ func threadRun(L *LState) {
 				lv = LString(fmt.Sprint(rcv))
 			}
 			if parent := L.Parent; parent != nil {
+				L.deathErr = lv
 				if L.wrapped {
 					L.Push(lv)
+					L.kill()
 					parent.Panic(L)
 				} else {
 					L.SetTop(0)
@@ -546,6 +609,9 @@ func init() {
 			Bx := int(inst & 0x3ffff) // GETBX
 			// reg.Set(RA, L.getField(cf.Fn.Env, cf.Fn.Proto.Constants[Bx]))
 			v := L.getFieldString(cf.Fn.Env, cf.Fn.Proto.stringConstants[Bx])
+			if v == LNil && L.G.undefinedGlobalHandler != nil {
+				v = L.undefinedGlobal(cf.Fn.Proto.stringConstants[Bx])
+			}
 			// this section is inlined by go-inline
 			// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
 			{
@@ -819,6 +885,9 @@ func init() {
 					}
 				} else if str, ok1 := unaryv.(LString); ok1 {
 					if num, err := parseNumber(string(str)); err == nil {
+						if L.warnEnabled() {
+							L.warn(WarningCoercion, "string '%v' converted to a number in unm operation", string(str))
+						}
 						// this section is inlined by go-inline
 						// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
 						{
@@ -840,10 +909,10 @@ func init() {
 							}
 						}
 					} else {
-						L.RaiseError("__unm undefined")
+						L.raiseTypedError(&ArithmeticError{Op: "unm", Lhs: unaryv}, "__unm undefined")
 					}
 				} else {
-					L.RaiseError("__unm undefined")
+					L.raiseTypedError(&ArithmeticError{Op: "unm", Lhs: unaryv}, "__unm undefined")
 				}
 			}
 			return 0
@@ -1178,6 +1247,9 @@ func init() {
 				nargs = reg.Top() - (RA + 1)
 			}
 			lv := reg.Get(RA)
+			if ci := L.G.callInterceptor; ci != nil {
+				ci.intercept(L, lv, RA+1, nargs)
+			}
 			nret := C - 1
 			var callable *LFunction
 			var meta bool
@@ -1198,10 +1270,10 @@ func init() {
 					ls.reg.Insert(fn, cf.LocalBase)
 				}
 				if cf.Fn == nil {
-					ls.RaiseError("attempt to call a non-function object")
+					ls.raiseTypedError(&CallError{Name: ls.currentCallName(), Value: fn}, "attempt to call a non-function object")
 				}
 				if ls.stack.IsFull() {
-					ls.RaiseError("stack overflow")
+					ls.raiseTypedError(&StackOverflowError{Stack: "call stack", Size: ls.stack.Sp()}, "stack overflow")
 				}
 				ls.stack.Push(cf)
 				newcf := ls.stack.Last()
@@ -1322,6 +1394,9 @@ func init() {
 				nargs = reg.Top() - (RA + 1)
 			}
 			lv := reg.Get(RA)
+			if ci := L.G.callInterceptor; ci != nil {
+				ci.intercept(L, lv, RA+1, nargs)
+			}
 			var callable *LFunction
 			var meta bool
 			if fn, ok := lv.(*LFunction); ok {
@@ -1331,7 +1406,7 @@ func init() {
 				callable, meta = L.metaCall(lv)
 			}
 			if callable == nil {
-				L.RaiseError("attempt to call a non-function object")
+				L.raiseTypedError(&CallError{Name: L.currentCallName(), Value: lv}, "attempt to call a non-function object")
 			}
 			// this section is inlined by go-inline
 			// source function is 'func (ls *LState) closeUpvalues(idx int) ' in '_state.go'
@@ -2099,6 +2174,9 @@ func init() {
 					}
 				}
 			}
+			if len(L.toBeClosed) > 0 {
+				L.closeToBeClosed(RA)
+			}
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { // OP_CLOSURE
@@ -2204,10 +2282,117 @@ func init() {
 		func(L *LState, inst uint32, baseframe *callFrame) int { // OP_NOP
 			return 0
 		},
+		opArith, // OP_IDIV
+		opArith, // OP_BAND
+		opArith, // OP_BOR
+		opArith, // OP_BXOR
+		opArith, // OP_SHL
+		opArith, // OP_SHR
+		func(L *LState, inst uint32, baseframe *callFrame) int { // OP_BNOT
+			reg := L.reg
+			cf := L.currentFrame
+			lbase := cf.LocalBase
+			A := int(inst>>18) & 0xff // GETA
+			RA := lbase + A
+			B := int(inst & 0x1ff) // GETB
+			unaryv := L.rkValue(B)
+			if nm, ok := unaryv.(LNumber); ok {
+				v := luaBitwiseNot(L, nm)
+				// this section is inlined by go-inline
+				// source function is 'func (rg *registry) SetNumber(regi int, vali LNumber) ' in '_state.go'
+				{
+					rg := reg
+					regi := RA
+					vali := v
+					newSize := regi + 1
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+					{
+						requiredSize := newSize
+						if requiredSize > cap(rg.array) {
+							rg.resize(requiredSize)
+						}
+					}
+					rg.array[regi] = rg.alloc.LNumber2I(vali)
+					if regi >= rg.top {
+						rg.top = regi + 1
+					}
+				}
+			} else {
+				op := L.metaOp1(unaryv, "__bnot")
+				if op.Type() == LTFunction {
+					reg.Push(op)
+					reg.Push(unaryv)
+					L.Call(1, 1)
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+					{
+						rg := reg
+						regi := RA
+						vali := reg.Pop()
+						newSize := regi + 1
+						// this section is inlined by go-inline
+						// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+						{
+							requiredSize := newSize
+							if requiredSize > cap(rg.array) {
+								rg.resize(requiredSize)
+							}
+						}
+						rg.array[regi] = vali
+						if regi >= rg.top {
+							rg.top = regi + 1
+						}
+					}
+				} else if str, ok1 := unaryv.(LString); ok1 {
+					if num, err := parseNumber(string(str)); err == nil {
+						if L.warnEnabled() {
+							L.warn(WarningCoercion, "string '%v' converted to a number in bnot operation", string(str))
+						}
+						v := luaBitwiseNot(L, num)
+						// this section is inlined by go-inline
+						// source function is 'func (rg *registry) SetNumber(regi int, vali LNumber) ' in '_state.go'
+						{
+							rg := reg
+							regi := RA
+							vali := v
+							newSize := regi + 1
+							// this section is inlined by go-inline
+							// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+							{
+								requiredSize := newSize
+								if requiredSize > cap(rg.array) {
+									rg.resize(requiredSize)
+								}
+							}
+							rg.array[regi] = rg.alloc.LNumber2I(vali)
+							if regi >= rg.top {
+								rg.top = regi + 1
+							}
+						}
+					} else {
+						L.raiseTypedError(&ArithmeticError{Op: "bnot", Lhs: unaryv}, "__bnot undefined")
+					}
+				} else {
+					L.raiseTypedError(&ArithmeticError{Op: "bnot", Lhs: unaryv}, "__bnot undefined")
+				}
+			}
+			return 0
+		},
+		func(L *LState, inst uint32, baseframe *callFrame) int { // OP_TBC
+			reg := L.reg
+			cf := L.currentFrame
+			lbase := cf.LocalBase
+			A := int(inst>>18) & 0xff // GETA
+			RA := lbase + A
+			Bx := int(inst & 0x3ffff) // GETBX
+			L.markToBeClosed(RA, cf.Fn.Proto.stringConstants[Bx], reg.Get(RA))
+			return 0
+		},
 	}
 }
 
-func opArith(L *LState, inst uint32, baseframe *callFrame) int { // OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW
+func opArith(L *LState, inst uint32, baseframe *callFrame) int { // OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR
 	reg := L.reg
 	cf := L.currentFrame
 	lbase := cf.LocalBase
@@ -2294,10 +2479,75 @@ func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
 		flhs := float64(lhs)
 		frhs := float64(rhs)
 		return LNumber(math.Pow(flhs, frhs))
+	case OP_IDIV:
+		return LNumber(math.Floor(float64(lhs / rhs)))
+	case OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		return luaBitwise(L, opcode, lhs, rhs)
+	}
+	panic("should not reach here")
+}
+
+var bitwiseOpNames = map[int]string{
+	OP_BAND: "band",
+	OP_BOR:  "bor",
+	OP_BXOR: "bxor",
+	OP_SHL:  "shl",
+	OP_SHR:  "shr",
+}
+
+func luaBitwise(L *LState, opcode int, lhs, rhs LNumber) LNumber {
+	x, ok1 := luaToInteger(lhs)
+	y, ok2 := luaToInteger(rhs)
+	if !ok1 || !ok2 {
+		L.raiseTypedError(&ArithmeticError{Op: bitwiseOpNames[opcode], Lhs: lhs, Rhs: rhs},
+			"number has no integer representation")
+	}
+	switch opcode {
+	case OP_BAND:
+		return LNumber(x & y)
+	case OP_BOR:
+		return LNumber(x | y)
+	case OP_BXOR:
+		return LNumber(x ^ y)
+	case OP_SHL:
+		return LNumber(luaShiftLeft(x, y))
+	case OP_SHR:
+		return LNumber(luaShiftLeft(x, -y))
 	}
 	panic("should not reach here")
 }
 
+// luaShiftLeft shifts x by n bits to the left, or to the right if n is
+// negative. Shifts are logical: vacated bits are filled with zeros.
+func luaShiftLeft(x, n int64) int64 {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n < 0:
+		return int64(uint64(x) >> uint(-n))
+	default:
+		return int64(uint64(x) << uint(n))
+	}
+}
+
+func luaBitwiseNot(L *LState, v LNumber) LNumber {
+	x, ok := luaToInteger(v)
+	if !ok {
+		L.raiseTypedError(&ArithmeticError{Op: "bnot", Lhs: v}, "number has no integer representation")
+	}
+	return LNumber(^x)
+}
+
+// luaToInteger converts the operand v of a bitwise operation to an integer.
+// It fails if v has a fractional part or is out of the range of int64.
+func luaToInteger(v LNumber) (int64, bool) {
+	f := float64(v)
+	if f != math.Floor(f) || f < -(1<<63) || f >= 1<<63 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
 func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 	event := ""
 	switch opcode {
@@ -2313,6 +2563,18 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		event = "__mod"
 	case OP_POW:
 		event = "__pow"
+	case OP_IDIV:
+		event = "__idiv"
+	case OP_BAND:
+		event = "__band"
+	case OP_BOR:
+		event = "__bor"
+	case OP_BXOR:
+		event = "__bxor"
+	case OP_SHL:
+		event = "__shl"
+	case OP_SHR:
+		event = "__shr"
 	}
 	op := L.metaOp2(lhs, rhs, event)
 	if _, ok := op.(*LFunction); ok {
@@ -2324,11 +2586,17 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 	}
 	if str, ok := lhs.(LString); ok {
 		if lnum, err := parseNumber(string(str)); err == nil {
+			if L.warnEnabled() {
+				L.warn(WarningCoercion, "string '%v' converted to a number in %v operation", string(str), strings.TrimLeft(event, "_"))
+			}
 			lhs = lnum
 		}
 	}
 	if str, ok := rhs.(LString); ok {
 		if rnum, err := parseNumber(string(str)); err == nil {
+			if L.warnEnabled() {
+				L.warn(WarningCoercion, "string '%v' converted to a number in %v operation", string(str), strings.TrimLeft(event, "_"))
+			}
 			rhs = rnum
 		}
 	}
@@ -2337,8 +2605,9 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 			return numberArith(L, opcode, LNumber(v1), LNumber(v2))
 		}
 	}
-	L.RaiseError(fmt.Sprintf("cannot perform %v operation between %v and %v",
-		strings.TrimLeft(event, "_"), lhs.Type().String(), rhs.Type().String()))
+	L.raiseTypedError(&ArithmeticError{Op: strings.TrimLeft(event, "_"), Lhs: lhs, Rhs: rhs},
+		fmt.Sprintf("cannot perform %v operation between %v and %v",
+			strings.TrimLeft(event, "_"), lhs.Type().String(), rhs.Type().String()))
 
 	return LNil
 }
@@ -2359,7 +2628,8 @@ func stringConcat(L *LState, total, last int) LValue {
 				total--
 				i--
 			} else {
-				L.RaiseError("cannot perform concat operation between %v and %v", lhs.Type().String(), rhs.Type().String())
+				L.raiseTypedError(&ArithmeticError{Op: "concat", Lhs: lhs, Rhs: rhs},
+					"cannot perform concat operation between %v and %v", lhs.Type().String(), rhs.Type().String())
 				return LNil
 			}
 		} else {
@@ -2374,14 +2644,30 @@ func stringConcat(L *LState, total, last int) LValue {
 				i--
 				total--
 			}
+			size := 0
+			for _, str := range buf {
+				size += len(str)
+			}
+			L.reserveString(size)
 			result := strings.Join(buf, "")
-			L.TrackAlloc(int64(len(result)))
+			if L.G.taint != nil {
+				L.propagateTaint(result, concatTainted(L, buf))
+			}
 			rhs = LString(result)
 		}
 	}
 	return rhs
 }
 
+func concatTainted(L *LState, parts []string) bool {
+	for _, part := range parts {
+		if L.G.taint.contains(part) {
+			return true
+		}
+	}
+	return false
+}
+
 func lessThan(L *LState, lhs, rhs LValue) bool {
 	// optimization for numbers
 	if v1, ok1 := lhs.(LNumber); ok1 {
@@ -0,0 +1,133 @@
+package lua
+
+import (
+	"fmt"
+)
+
+/* warnings {{{ */
+
+// WarningCategory classifies a non-fatal diagnostic reported to the host.
+type WarningCategory int
+
+const (
+	// WarningUser is a warning emitted by a script via the warn() function.
+	WarningUser WarningCategory = iota
+	// WarningDeprecated is emitted when a script uses a deprecated function.
+	WarningDeprecated
+	// WarningCoercion is emitted when a value is implicitly converted in a surprising way
+	// (e.g. arithmetic on strings).
+	WarningCoercion
+	// WarningSandbox is emitted when a script comes close to a sandbox limit.
+	WarningSandbox
+)
+
+var warningCategoryNames = [...]string{"user", "deprecated", "coercion", "sandbox"}
+
+func (wc WarningCategory) String() string {
+	if int(wc) < len(warningCategoryNames) {
+		return warningCategoryNames[wc]
+	}
+	return fmt.Sprintf("WarningCategory(%d)", int(wc))
+}
+
+// Warning is a non-fatal diagnostic. Source and Line point to the innermost
+// Lua function that was running when the warning was emitted; Line is -1 if
+// no Lua function was running.
+type Warning struct {
+	Category WarningCategory
+	Message  string
+	Source   string
+	Line     int
+}
+
+func (w *Warning) String() string {
+	if w.Line < 0 {
+		return fmt.Sprintf("%v: %v warning: %v", w.Source, w.Category, w.Message)
+	}
+	return fmt.Sprintf("%v:%v: %v warning: %v", w.Source, w.Line, w.Category, w.Message)
+}
+
+// WarningHandler receives every warning emitted by an LState and its threads.
+type WarningHandler func(L *LState, w *Warning)
+
+// SetWarningHandler sets the handler that receives warnings. The handler is
+// shared by all threads created from this state. Warnings are discarded if no
+// handler is set.
+func (ls *LState) SetWarningHandler(handler WarningHandler) {
+	ls.G.warningHandler = handler
+}
+
+// GetWarningHandler returns the current warning handler, or nil.
+func (ls *LState) GetWarningHandler() WarningHandler {
+	return ls.G.warningHandler
+}
+
+// WarnFunc receives the text of every warning emitted by an LState and its
+// threads, like the warning function of lua_setwarnf. A message is given in
+// pieces when tocont is true, and ends with the piece given with tocont
+// false.
+type WarnFunc func(msg string, tocont bool)
+
+// SetWarnFunc sets the function that receives the text of warnings, e.g. to
+// route them to a logger, alongside the warning handler. warn(msg1, ...)
+// gives it one piece per argument; other warnings are given whole. The
+// function is shared by all threads created from this state. A nil fn
+// removes it.
+func (ls *LState) SetWarnFunc(fn WarnFunc) {
+	ls.G.warnFunc = fn
+}
+
+// Warn reports a warning to the host warning handler.
+func (ls *LState) Warn(category WarningCategory, format string, args ...interface{}) {
+	ls.warn(category, format, args...)
+}
+
+// warnEnabled reports whether warnings reach the host. Hot paths check it
+// before building the arguments of warn.
+func (ls *LState) warnEnabled() bool {
+	return ls.G.warningHandler != nil || ls.G.warnFunc != nil
+}
+
+func (ls *LState) warn(category WarningCategory, format string, args ...interface{}) {
+	if !ls.warnEnabled() {
+		return
+	}
+	message := format
+	if len(args) > 0 {
+		message = fmt.Sprintf(format, args...)
+	}
+	if fn := ls.G.warnFunc; fn != nil {
+		fn(message, false)
+	}
+	ls.handleWarning(category, message)
+}
+
+// handleWarning passes a warning to the warning handler, if any.
+func (ls *LState) handleWarning(category WarningCategory, message string) {
+	handler := ls.G.warningHandler
+	if handler == nil {
+		return
+	}
+	source, line := ls.sourcePosition()
+	handler(ls, &Warning{Category: category, Message: message, Source: source, Line: line})
+}
+
+func (ls *LState) warnDeprecated(name, replacement string) {
+	if !ls.warnEnabled() {
+		return
+	}
+	ls.warn(WarningDeprecated, "%v is deprecated, use %v instead", name, replacement)
+}
+
+// sourcePosition returns the source name and the current line of the
+// innermost running Lua function.
+func (ls *LState) sourcePosition() (string, int) {
+	for cf := ls.currentFrame; cf != nil; cf = cf.Parent {
+		if !cf.Fn.IsG && cf.Pc > 0 {
+			return cf.Fn.Proto.SourceName, cf.Fn.Proto.DbgSourcePositions[cf.Pc-1]
+		}
+	}
+	return "[G]", -1
+}
+
+/* }}} */
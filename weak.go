@@ -0,0 +1,292 @@
+package lua
+
+import (
+	"strings"
+)
+
+/* weak tables {{{ */
+
+type weakMode uint8
+
+const (
+	weakKeys weakMode = 1 << iota
+	weakValues
+)
+
+func parseWeakMode(mode string) weakMode {
+	var wm weakMode
+	if strings.ContainsRune(mode, 'k') {
+		wm |= weakKeys
+	}
+	if strings.ContainsRune(mode, 'v') {
+		wm |= weakValues
+	}
+	return wm
+}
+
+// NewWeakTable returns a new table whose keys ("k"), values ("v") or both
+// ("kv") are weak references. Entries whose weak key or value is a table,
+// function, userdata, thread or channel that can no longer be reached from
+// the state are removed by CollectWeakTables. Strings, numbers and booleans
+// are never removed.
+//
+// Setting a metatable with a __mode field on a regular table has the same
+// effect.
+func (ls *LState) NewWeakTable(mode string) *LTable {
+	wm := parseWeakMode(mode)
+	if wm == 0 {
+		ls.RaiseError("invalid weak table mode %q", mode)
+	}
+	tb := ls.newLTable(0, defaultHashCap)
+	tb.weak = wm
+	return tb
+}
+
+// CollectWeakTables removes the dead entries of every weak table reachable
+// from the globals, the registry and the stack of this state, and returns the
+// number of entries removed. The memory charged for tables that were only
+// referenced by removed entries is credited back to the state that created
+// them, and Go's garbage collector is free to reclaim them afterwards.
+// CollectGarbage, and so collectgarbage(), does this as well.
+//
+// Values that are only referenced from Go, for instance from the variables
+// of a Go function or the Value of a userdata, can not be seen and are
+// treated as unreachable. Weak tables that are only referenced from Go are
+// not collected.
+func (ls *LState) CollectWeakTables() int {
+	c := ls.markReachable()
+	cleared := 0
+	for _, tb := range c.weak {
+		cleared += c.sweep(tb)
+	}
+	return cleared
+}
+
+// markReachable marks everything reachable from the roots of this state.
+func (ls *LState) markReachable() *weakCollector {
+	c := &weakCollector{marked: map[interface{}]struct{}{}}
+	c.mark(ls.G.Registry)
+	if ls.G.hostRegistry != nil {
+		c.mark(ls.G.hostRegistry)
+	}
+	c.mark(ls.G.Global)
+	c.mark(ls.Env)
+	for _, mt := range ls.G.builtinMts {
+		c.mark(mt)
+	}
+	c.mark(ls)
+	if ls.G.MainThread != nil {
+		c.mark(ls.G.MainThread)
+	}
+	if ls.G.CurrentThread != nil {
+		c.mark(ls.G.CurrentThread)
+	}
+	c.propagate()
+	return c
+}
+
+type weakCollector struct {
+	marked     map[interface{}]struct{}
+	pending    []LValue
+	weak       []*LTable
+	ephemerons []*LTable
+}
+
+func isCollectable(lv LValue) bool {
+	switch lv.(type) {
+	case *LTable, *LFunction, *LUserData, *LState, LChannel:
+		return true
+	}
+	return false
+}
+
+func (c *weakCollector) mark(lv LValue) {
+	if lv == nil || !isCollectable(lv) || c.isMarked(lv) {
+		return
+	}
+	c.marked[lv] = struct{}{}
+	c.pending = append(c.pending, lv)
+}
+
+func (c *weakCollector) isMarked(lv LValue) bool {
+	if !isCollectable(lv) {
+		return true
+	}
+	_, ok := c.marked[lv]
+	return ok
+}
+
+// propagate marks everything reachable from the pending values. Values of
+// weak-keyed tables are only marked once their key is, so a value that
+// refers to its own key does not keep the entry alive.
+func (c *weakCollector) propagate() {
+	for {
+		for len(c.pending) > 0 {
+			lv := c.pending[len(c.pending)-1]
+			c.pending = c.pending[:len(c.pending)-1]
+			c.traverse(lv)
+		}
+		for _, tb := range c.ephemerons {
+			for key, value := range tb.dict {
+				if c.isMarked(key) {
+					c.mark(value)
+				}
+			}
+		}
+		if len(c.pending) == 0 {
+			return
+		}
+	}
+}
+
+func (c *weakCollector) traverse(lv LValue) {
+	switch v := lv.(type) {
+	case *LTable:
+		c.mark(v.Metatable)
+		wm := v.weakMode()
+		if wm != 0 {
+			c.weak = append(c.weak, v)
+		}
+		if wm&weakValues != 0 {
+			if wm&weakKeys == 0 {
+				for key := range v.dict {
+					c.mark(key)
+				}
+			}
+			return
+		}
+		for _, value := range v.array {
+			c.mark(value)
+		}
+		for _, value := range v.strdict {
+			c.mark(value)
+		}
+		if wm&weakKeys != 0 {
+			c.ephemerons = append(c.ephemerons, v)
+			return
+		}
+		for key, value := range v.dict {
+			c.mark(key)
+			c.mark(value)
+		}
+	case *LFunction:
+		if v.Env != nil {
+			c.mark(v.Env)
+		}
+		for _, uv := range v.Upvalues {
+			if uv != nil {
+				c.mark(uv.Value())
+			}
+		}
+	case *LUserData:
+		if v.Env != nil {
+			c.mark(v.Env)
+		}
+		c.mark(v.Metatable)
+	case *LState:
+		if v.reg != nil {
+			for i := 0; i < v.reg.top && i < len(v.reg.array); i++ {
+				c.mark(v.reg.array[i])
+			}
+		}
+		if v.Env != nil {
+			c.mark(v.Env)
+		}
+		for cf := v.currentFrame; cf != nil; cf = cf.Parent {
+			if cf.Fn != nil {
+				c.mark(cf.Fn)
+			}
+		}
+	}
+}
+
+func (c *weakCollector) sweep(tb *LTable) int {
+	wm := tb.weakMode()
+	cleared := 0
+	if wm&weakValues != 0 {
+		for i, value := range tb.array {
+			if !c.isMarked(value) {
+				tb.array[i] = LNil
+				c.release(value)
+				cleared++
+			}
+		}
+		for key, value := range tb.strdict {
+			if !c.isMarked(value) {
+				delete(tb.strdict, key)
+				c.release(value)
+				cleared++
+			}
+		}
+	}
+	for key, value := range tb.dict {
+		if (wm&weakKeys != 0 && !c.isMarked(key)) || (wm&weakValues != 0 && !c.isMarked(value)) {
+			delete(tb.dict, key)
+			c.release(key)
+			c.release(value)
+			cleared++
+		}
+	}
+	if cleared > 0 {
+		// drop removed keys so that the iteration order does not retain them
+		keys := tb.keys[:0]
+		for _, key := range tb.keys {
+			if tb.RawGetH(key) != LNil {
+				keys = append(keys, key)
+			}
+		}
+		for i := len(keys); i < len(tb.keys); i++ {
+			tb.keys[i] = nil
+		}
+		tb.keys = keys
+		tb.k2i = make(map[LValue]int, len(keys))
+		for i, key := range keys {
+			tb.k2i[key] = i
+		}
+		tb.sorted, tb.s2i = nil, nil
+	}
+	return cleared
+}
+
+// release credits the memory charged for a table that has become
+// unreachable, and for the tables only reachable through it, so that a
+// cache entry holding nested tables is credited as a whole.
+func (c *weakCollector) release(lv LValue) {
+	pending := []LValue{lv}
+	for len(pending) > 0 {
+		tb, ok := pending[len(pending)-1].(*LTable)
+		pending = pending[:len(pending)-1]
+		if !ok || c.isMarked(tb) || tb.allocBytes == 0 {
+			continue
+		}
+		if tb.ls != nil {
+			tb.ls.releaseAlloc(tb.allocBytes)
+		}
+		// also marks tb as released, which ends cycles
+		tb.allocBytes = 0
+		pending = append(pending, tb.Metatable)
+		pending = append(pending, tb.array...)
+		for _, value := range tb.strdict {
+			pending = append(pending, value)
+		}
+		for key, value := range tb.dict {
+			pending = append(pending, key, value)
+		}
+	}
+}
+
+// weakMode returns the weak mode set by NewWeakTable, or the one given by
+// the __mode field of the metatable.
+func (tb *LTable) weakMode() weakMode {
+	if tb.weak != 0 {
+		return tb.weak
+	}
+	if mt, ok := tb.Metatable.(*LTable); ok {
+		if mode, ok := mt.RawGetString("__mode").(LString); ok {
+			return parseWeakMode(string(mode))
+		}
+	}
+	return 0
+}
+
+/* }}} */